@@ -6,6 +6,7 @@ import (
 	"github.com/majestrate/XD/lib/config"
 	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/rpc"
+	"github.com/majestrate/XD/lib/storage"
 	t "github.com/majestrate/XD/lib/translate"
 	"github.com/majestrate/XD/lib/util"
 	"github.com/majestrate/XD/lib/version"
@@ -14,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func formatRate(r float64) string {
@@ -90,12 +92,100 @@ func Run() {
 			deleteTorrents(c, args...)
 			count++
 		}
+	case "verify":
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			verifyTorrents(c, args...)
+			count++
+		}
 	case "set-piece-window":
 		for count < swarms {
 			c := rpc.NewClient(rpcURL, count)
 			setPieceWindow(c, args[0])
 			count++
 		}
+	case "set-file-priority":
+		if len(args) < 3 {
+			printHelp(os.Args[0])
+			return
+		}
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			setFilePriority(c, args[0], args[1], args[2])
+			count++
+		}
+	case "sequential":
+		if len(args) < 2 {
+			printHelp(os.Args[0])
+			return
+		}
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			setSequential(c, args[0], args[1])
+			count++
+		}
+	case "super-seed":
+		if len(args) < 2 {
+			printHelp(os.Args[0])
+			return
+		}
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			setSuperSeeding(c, args[0], args[1])
+			count++
+		}
+	case "seed-limit":
+		if len(args) < 4 {
+			printHelp(os.Args[0])
+			return
+		}
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			setSeedLimits(c, args[0], args[1], args[2], args[3])
+			count++
+		}
+	case "queue-move":
+		if len(args) < 2 {
+			printHelp(os.Args[0])
+			return
+		}
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			moveInQueue(c, args[0], args[1])
+			count++
+		}
+	case "set-rate-limit":
+		if len(args) < 2 {
+			printHelp(os.Args[0])
+			return
+		}
+		var ih string
+		if len(args) > 2 {
+			ih = args[2]
+		}
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			setRateLimit(c, args[0], args[1], ih)
+			count++
+		}
+	case "blocklist", "blocklist-update":
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			showBlocklist(c, cmd == "blocklist-update")
+			count++
+		}
+	case "connections":
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			showConnStats(c)
+			count++
+		}
+	case "cache":
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			showCacheStats(c)
+			count++
+		}
 	case "version":
 		fmt.Println(version.Version())
 	case "help":
@@ -104,7 +194,7 @@ func Run() {
 }
 
 func printHelp(cmd string) {
-	fmt.Println(t.T("usage: %s [help|version|list|add http://somesite.i2p/some.torrent|set-piece-window n|remove infohash|delete infohash|stop infohash|start infohash]", cmd))
+	fmt.Println(t.T("usage: %s [help|version|list|add http://somesite.i2p/some.torrent|set-piece-window n|set-file-priority infohash file skip|low|normal|high|sequential infohash on|off|super-seed infohash on|off|seed-limit infohash ratio minutes idle-minutes|queue-move infohash top|up|down|bottom|set-rate-limit upload-KiB/s download-KiB/s [infohash]|blocklist|blocklist-update|connections|cache|remove infohash|delete infohash|verify infohash|stop infohash|start infohash]", cmd))
 }
 
 func setPieceWindow(c *rpc.Client, str string) {
@@ -115,6 +205,114 @@ func setPieceWindow(c *rpc.Client, str string) {
 	c.SetPieceWindow(n)
 }
 
+func setFilePriority(c *rpc.Client, ih, file, prio string) {
+	idx, err := strconv.Atoi(file)
+	if err != nil {
+		log.Fatalf("error: %s", err.Error())
+	}
+	err = c.SetFilePriority(ih, idx, prio)
+	if err == nil {
+		fmt.Println(t.T("OK"))
+	} else {
+		fmt.Println(t.E(err))
+	}
+}
+
+// parse an on|off command line argument
+func parseOnOff(mode string) (on bool) {
+	switch strings.ToLower(mode) {
+	case "on", "yes", "true", "1":
+		on = true
+	case "off", "no", "false", "0":
+		on = false
+	default:
+		log.Fatalf("error: invalid mode %s", mode)
+	}
+	return
+}
+
+func setSequential(c *rpc.Client, ih, mode string) {
+	err := c.SetSequential(ih, parseOnOff(mode))
+	if err == nil {
+		fmt.Println(t.T("OK"))
+	} else {
+		fmt.Println(t.E(err))
+	}
+}
+
+func setSuperSeeding(c *rpc.Client, ih, mode string) {
+	err := c.SetSuperSeeding(ih, parseOnOff(mode))
+	if err == nil {
+		fmt.Println(t.T("OK"))
+	} else {
+		fmt.Println(t.E(err))
+	}
+}
+
+func setSeedLimits(c *rpc.Client, ih, ratio, minutes, idleMinutes string) {
+	r, err := strconv.ParseFloat(ratio, 64)
+	if err != nil {
+		log.Fatalf("error: %s", err.Error())
+	}
+	seed, err := strconv.ParseInt(minutes, 10, 64)
+	if err != nil {
+		log.Fatalf("error: %s", err.Error())
+	}
+	idle, err := strconv.ParseInt(idleMinutes, 10, 64)
+	if err != nil {
+		log.Fatalf("error: %s", err.Error())
+	}
+	err = c.SetSeedLimits(ih, r, time.Duration(seed)*time.Minute, time.Duration(idle)*time.Minute)
+	if err == nil {
+		fmt.Println(t.T("OK"))
+	} else {
+		fmt.Println(t.E(err))
+	}
+}
+
+func moveInQueue(c *rpc.Client, ih, move string) {
+	err := c.MoveInQueue(ih, move)
+	if err == nil {
+		fmt.Println(t.T("OK"))
+	} else {
+		fmt.Println(t.E(err))
+	}
+}
+
+func setRateLimit(c *rpc.Client, upload, download, ih string) {
+	up, err := strconv.ParseUint(upload, 10, 64)
+	if err != nil {
+		log.Fatalf("error: %s", err.Error())
+	}
+	down, err := strconv.ParseUint(download, 10, 64)
+	if err != nil {
+		log.Fatalf("error: %s", err.Error())
+	}
+	err = c.SetRateLimit(ih, up*1024, down*1024)
+	if err == nil {
+		fmt.Println(t.T("OK"))
+	} else {
+		fmt.Println(t.E(err))
+	}
+}
+
+func showBlocklist(c *rpc.Client, update bool) {
+	st, err := c.GetBlocklist(update)
+	if err != nil {
+		fmt.Println(t.E(err))
+		return
+	}
+	var sources []string
+	for source := range st.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	fmt.Printf("%s: %d %s: %d\n", t.T("blocklist entries"), st.Entries, t.T("hits"), st.Hits)
+	for _, source := range sources {
+		fmt.Printf("\t%s %s: %d %s: %d\n", source, t.T("entries"), st.Sources[source].Entries, t.T("hits"), st.Sources[source].Hits)
+	}
+}
+
 func addTorrents(c *rpc.Client, urls ...string) {
 	for idx := range urls {
 		fmt.Println(t.T("fetch %s ... ", urls[idx]))
@@ -175,6 +373,18 @@ func deleteTorrents(c *rpc.Client, ih ...string) {
 	}
 }
 
+func verifyTorrents(c *rpc.Client, ih ...string) {
+	for idx := range ih {
+		fmt.Println(t.T("verify %s ... ", ih[idx]))
+		err := c.VerifyTorrent(ih[idx])
+		if err == nil {
+			fmt.Println(t.T("OK"))
+		} else {
+			fmt.Println(t.E(err))
+		}
+	}
+}
+
 func listTorrents(c *rpc.Client) {
 	var err error
 	var st swarm.SwarmStatus
@@ -201,10 +411,23 @@ func listTorrents(c *rpc.Client) {
 			}
 			fmt.Printf("\t%stx=%s rx=%s\n", pad, formatRate(peer.TX), formatRate(peer.RX))
 		}
+		if status.Sequential {
+			fmt.Println(t.T("sequential download"))
+		}
+		if status.SuperSeeding {
+			fmt.Println(t.T("super seeding"))
+		}
+		if status.Error != "" {
+			fmt.Printf("%s: %s\n", t.T("error"), status.Error)
+		}
 		fmt.Printf("%s tx=%s rx=%s (%s: %.2f)\n", status.State, formatRate(status.Peers.TX()), formatRate(status.Peers.RX()), t.T("ratio"), status.Ratio())
 		fmt.Println(t.T("files:"))
 		for idx, f := range status.Files {
-			fmt.Printf("\t[%d] %s (%s: %.2f)\n", idx, f.FileInfo.Path.FilePath(""), t.T("progress:"), f.Progress)
+			prio := f.Priority
+			if !f.Wanted {
+				prio = storage.PrioritySkip
+			}
+			fmt.Printf("\t[%d] %s (%s: %.2f, %s)\n", idx, f.FileInfo.Path.FilePath(""), t.T("progress:"), f.Progress, prio)
 		}
 		fmt.Println()
 	}
@@ -214,3 +437,23 @@ func listTorrents(c *rpc.Client) {
 	fmt.Println()
 	fmt.Println()
 }
+
+func showConnStats(c *rpc.Client) {
+	st, err := c.GetConnStats()
+	if err != nil {
+		fmt.Println(t.E(err))
+		return
+	}
+	fmt.Printf("%s: %d/%d %s: %d/%d\n", t.T("connections"), st.Connections, st.MaxConnections, t.T("half open"), st.HalfOpen, st.MaxHalfOpen)
+	fmt.Printf("%s: %d %s: %d %s: %d\n", t.T("torrents"), st.Torrents, t.T("fair share"), st.FairShare, t.T("evicted"), st.Evicted)
+}
+
+func showCacheStats(c *rpc.Client) {
+	st, err := c.GetCacheStats()
+	if err != nil {
+		fmt.Println(t.E(err))
+		return
+	}
+	fmt.Printf("%s: %s/%s %s: %d %s: %s\n", t.T("cache"), util.FormatBytes(st.Size), util.FormatBytes(st.MaxSize), t.T("pieces"), st.Pieces, t.T("pending"), util.FormatBytes(st.Pending))
+	fmt.Printf("%s: %.1f%% %s: %d %s: %d %s: %d\n", t.T("hit rate"), st.HitRate()*100, t.T("hits"), st.Hits, t.T("misses"), st.Misses, t.T("piece writes"), st.Writes)
+}
@@ -2,10 +2,14 @@ package xd
 
 import (
 	"bufio"
+	"fmt"
 	"github.com/majestrate/XD/lib/bittorrent/swarm"
 	"github.com/majestrate/XD/lib/config"
+	"github.com/majestrate/XD/lib/dht"
+	"github.com/majestrate/XD/lib/fs"
 	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/rpc"
+	"github.com/majestrate/XD/lib/storage"
 	"github.com/majestrate/XD/lib/sync"
 	t "github.com/majestrate/XD/lib/translate"
 	"github.com/majestrate/XD/lib/util"
@@ -185,6 +189,11 @@ func Run() {
 		}()
 	}
 
+	if conf.Bittorrent.DHT && !conf.I2P.Disabled {
+		// i2p dht needs datagrams
+		conf.I2P.DatagramPort = dht.I2PDHTPort
+	}
+
 	st := conf.Storage.CreateStorage()
 	err = st.Init()
 	if err != nil {
@@ -193,10 +202,21 @@ func Run() {
 	}
 	// start io thread
 	go st.Run()
+	// dht nodes are saved next to the torrent metadata which is not always on the local filesystem
+	var metaFS fs.Driver = fs.STD
+	if fst, ok := st.(*storage.FsStorage); ok {
+		metaFS = fst.FS
+	}
 	count := 0
 	for count < conf.Bittorrent.Swarms {
 		gnutella := conf.Gnutella.CreateSwarm()
 		sw := conf.Bittorrent.CreateSwarm(st, gnutella)
+		if conf.Bittorrent.DHT {
+			sw.EnableDHT(metaFS, metaFS.Join(conf.Storage.Meta, fmt.Sprintf("dht-%d.dat", count)))
+			if !conf.I2P.Disabled {
+				sw.EnableI2PDHT(metaFS, metaFS.Join(conf.Storage.Meta, fmt.Sprintf("dht-i2p-%d.dat", count)))
+			}
+		}
 		if gnutella != nil {
 			ctx.AddCloser(gnutella)
 		}
@@ -223,7 +243,7 @@ func Run() {
 		for ctx.Running() {
 			nt := st.PollNewTorrents()
 			for _, t := range nt {
-				e := t.VerifyAll()
+				e := t.VerifyChanged()
 				if e != nil {
 					log.Errorf("failed to add %s: %s", t.Name(), e.Error())
 					continue
@@ -81,6 +81,15 @@ func (bf *Bitfield) Zero() {
 	bf.Data = make([]byte, (bf.Length/8)+1)
 }
 
+// Fill sets all bits to one
+func (bf *Bitfield) Fill() {
+	idx := bf.Length
+	for idx > 0 {
+		idx--
+		bf.Set(idx)
+	}
+}
+
 // Inverted gets copy of current Bitfield with all bits inverted
 func (bf *Bitfield) Inverted() *Bitfield {
 	b := NewBitfield(bf.Length, bf.Data)
@@ -5,3 +5,14 @@ const I2PDHT = Extension("i2p_dht")
 
 // bittorrent extension for XD's dht variant over wire protocol
 const XDHT = Extension("xdht")
+
+// NewI2PDHT creates a message telling a peer the i2cp ports our i2p dht takes queries and replies on
+func NewI2PDHT(id uint8, port, rport int) Message {
+	msg := New()
+	msg.ID = id
+	msg.Payload = map[string]interface{}{
+		"port":  port,
+		"rport": rport,
+	}
+	return msg
+}
@@ -24,8 +24,12 @@ type Message struct {
 	Payload      interface{}       `bencode:"-"`
 	PayloadRaw   []byte            `bencode:"-"`
 	MetainfoSize *uint32           `bencode:"metadata_size,omitempty"`
+	RequestQueue *uint32           `bencode:"reqq,omitempty"` // handshake data
 }
 
+// OurRequestQueue is how many outstanding block requests we let a peer have
+const OurRequestQueue = 250
+
 // I2PPEX returns true if i2p PEX is supported
 func (opts Message) I2PPEX() bool {
 	return opts.IsSupported(I2PPeerExchange.String())
@@ -36,11 +40,29 @@ func (opts Message) LNPEX() bool {
 	return opts.IsSupported(LokinetPeerExchange.String())
 }
 
+// UTPEX returns true if BEP 11 PEX is supported
+func (opts Message) UTPEX() bool {
+	return opts.IsSupported(UTPeerExchange.String())
+}
+
 // XDHT returns true if XHDT is supported
 func (opts Message) XDHT() bool {
 	return opts.IsSupported(XDHT.String())
 }
 
+// I2PDHT returns true if the i2p dht is supported
+func (opts Message) I2PDHT() bool {
+	return opts.IsSupported(I2PDHT.String())
+}
+
+// MaxRequests returns how many outstanding block requests the sender accepts or 0 if it did not say
+func (opts Message) MaxRequests() uint32 {
+	if opts.RequestQueue == nil {
+		return 0
+	}
+	return *opts.RequestQueue
+}
+
 // MetaData returns true if ut_metadata is supported
 func (opts Message) MetaData() bool {
 	return opts.IsSupported(UTMetaData.String())
@@ -93,6 +115,7 @@ func (opts Message) Copy() Message {
 		Extensions:   ext,
 		Payload:      opts.Payload,
 		MetainfoSize: opts.MetainfoSize,
+		RequestQueue: opts.RequestQueue,
 	}
 	if opts.PayloadRaw != nil {
 		m.PayloadRaw = make([]byte, len(opts.PayloadRaw))
@@ -129,11 +152,13 @@ func New() Message {
 	}
 }
 
-// NewOur creates a new Message instance with metadata size set
+// NewOur creates a new Message instance with metadata size and our request queue size set
 func NewOur(sz uint32) Message {
+	reqq := uint32(OurRequestQueue)
 	m := Message{
-		Version:    version.Version(),
-		Extensions: make(map[string]uint32),
+		Version:      version.Version(),
+		Extensions:   make(map[string]uint32),
+		RequestQueue: &reqq,
 	}
 	if sz > 0 {
 		m.MetainfoSize = &sz
@@ -5,3 +5,33 @@ const I2PPeerExchange = Extension("i2p_pex")
 
 // LokinetPeerExchange is a Bittorrent Extension indication we support Lokinet PEX
 const LokinetPeerExchange = Extension("ln_pex")
+
+// UTPeerExchange is the BEP 11 PEX extension, used with compact .loki addresses on lokinet
+const UTPeerExchange = Extension("ut_pex")
+
+// flags for peers in added.f of a PEX message
+const (
+	// peer prefers encryption
+	PEXEncryption = 0x01
+	// peer is a seed
+	PEXSeed = 0x02
+	// peer supports uTP
+	PEXUTP = 0x04
+	// peer supports ut_holepunch
+	PEXHolepunch = 0x08
+	// peer takes inbound connections
+	PEXReachable = 0x10
+)
+
+// NewUTPEX creates a new BEP 11 PEX message with compact added and dropped peers and a flag byte for each added peer
+func NewUTPEX(id uint8, added, addedf, dropped []byte) Message {
+	payload := map[string]interface{}{
+		"added":   added,
+		"added.f": addedf,
+		"dropped": dropped,
+	}
+	msg := New()
+	msg.ID = id
+	msg.Payload = payload
+	return msg
+}
@@ -0,0 +1,49 @@
+package bittorrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+
+	"github.com/majestrate/XD/lib/common"
+)
+
+// AllowedFastSetSize is how many pieces we put in an allowed fast set
+const AllowedFastSetSize = 10
+
+// AllowedFastSet computes the canonical allowed fast set of k pieces for a peer address (BEP 6)
+// ipv4 addresses are masked to their /24, other addresses (i2p, lokinet) are hashed as is
+func AllowedFastSet(addr net.Addr, ih common.Infohash, numPieces uint32, k int) (set []uint32) {
+	if numPieces == 0 {
+		return
+	}
+	if uint32(k) > numPieces {
+		k = int(numPieces)
+	}
+	host := addr.String()
+	h, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+	}
+	var x []byte
+	ip := net.ParseIP(host).To4()
+	if ip != nil {
+		x = append(x, ip[0], ip[1], ip[2], 0)
+	} else {
+		x = append(x, []byte(host)...)
+	}
+	x = append(x, ih[:]...)
+	has := make(map[uint32]bool)
+	for len(set) < k {
+		d := sha1.Sum(x)
+		x = d[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			idx := binary.BigEndian.Uint32(x[i*4:]) % numPieces
+			if !has[idx] {
+				has[idx] = true
+				set = append(set, idx)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,27 @@
+package bittorrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/majestrate/XD/lib/common"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var ih common.Infohash
+	for idx := range ih {
+		ih[idx] = 0xaa
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("80.4.4.200"), Port: 6881}
+	// test vectors from BEP 6
+	expected := []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	set := AllowedFastSet(addr, ih, 1313, len(expected))
+	if len(set) != len(expected) {
+		t.Fatalf("got %d pieces, expected %d", len(set), len(expected))
+	}
+	for idx := range expected {
+		if set[idx] != expected[idx] {
+			t.Errorf("piece %d is %d, expected %d", idx, set[idx], expected[idx])
+		}
+	}
+}
@@ -46,6 +46,12 @@ func (r *Reserved) Intersect(other Reserved) {
 // Extension is ReservedBit for bittorrent extensions
 const Extension = ReservedBit(44)
 
+// V2 is ReservedBit for BitTorrent v2 upgrades (BEP 52)
+const V2 = ReservedBit(60)
+
+// Fast is ReservedBit for the Fast Extension (BEP 6)
+const Fast = ReservedBit(62)
+
 // DHT is ReservedBit for BT DHT
 const DHT = ReservedBit(64)
 
@@ -0,0 +1,124 @@
+package swarm
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// how many strikes for sending data that fails hash checks a peer gets before we ban it
+const BanStrikes = 3
+
+// how long a peer stays banned
+const BanDuration = time.Hour * 2
+
+var ErrPeerBanned = errors.New("peer is banned")
+var ErrPeerBlocked = errors.New("peer is in blocklist")
+
+// strike counters and timed bans for peers that send us bad data
+// peers are tracked by both destination and peer id
+type peerBans struct {
+	access  sync.Mutex
+	strikes map[string]int
+	banned  map[string]time.Time
+}
+
+func newPeerBans() *peerBans {
+	return &peerBans{
+		strikes: make(map[string]int),
+		banned:  make(map[string]time.Time),
+	}
+}
+
+// key for a peer's destination, ports are ignored
+func addrBanKey(a net.Addr) string {
+	str := a.String()
+	host, _, err := net.SplitHostPort(str)
+	if err == nil {
+		return host
+	}
+	return str
+}
+
+// key for a peer id
+func idBanKey(id common.PeerID) string {
+	return "id:" + id.String()
+}
+
+// ban a set of keys until now + BanDuration
+func (b *peerBans) ban(keys ...string) {
+	if b == nil {
+		return
+	}
+	until := time.Now().Add(BanDuration)
+	b.access.Lock()
+	for _, k := range keys {
+		b.banned[k] = until
+		delete(b.strikes, k)
+	}
+	b.access.Unlock()
+}
+
+// give a strike to a key, returns true if it is now banned
+func (b *peerBans) strike(key string, n int) (banned bool) {
+	if b == nil {
+		return
+	}
+	b.access.Lock()
+	b.strikes[key] += n
+	banned = b.strikes[key] >= BanStrikes
+	b.access.Unlock()
+	return
+}
+
+// check if any of the keys are banned, forgets expired bans
+func (b *peerBans) isBanned(keys ...string) (banned bool) {
+	if b == nil {
+		return
+	}
+	now := time.Now()
+	b.access.Lock()
+	for _, k := range keys {
+		until, ok := b.banned[k]
+		if !ok {
+			continue
+		}
+		if now.After(until) {
+			delete(b.banned, k)
+		} else {
+			banned = true
+		}
+	}
+	b.access.Unlock()
+	return
+}
+
+// IsBanned returns true if a peer with this address or peer id is banned
+func (h *Holder) IsBanned(a net.Addr, id common.PeerID) bool {
+	return h.bans.isBanned(addrBanKey(a), idBanKey(id))
+}
+
+// called when a piece failed its hash check with the peers that sent blocks of it
+// a peer that sent the whole piece is banned right away, otherwise every contributor gets a strike
+func (t *Torrent) onHashFailed(idx uint32, peers []*PeerConn) {
+	for _, c := range peers {
+		addr := addrBanKey(c.c.RemoteAddr())
+		strikes := 1
+		if len(peers) == 1 {
+			strikes = BanStrikes
+		}
+		log.Warnf("%s (%s) sent bad data for piece %d", c.id.String(), addr, idx)
+		if t.bans.strike(addr, strikes) {
+			log.Warnf("banning %s (%s) for %s", c.id.String(), addr, BanDuration)
+			t.bans.ban(addr)
+			if c.id != (common.PeerID{}) {
+				t.bans.ban(idBanKey(c.id))
+			}
+			c.Close()
+		}
+	}
+}
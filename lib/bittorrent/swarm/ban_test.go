@@ -0,0 +1,61 @@
+package swarm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+)
+
+func TestHashFailContributors(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize*2, 1)
+	st.corrupt = true
+	pt := createPieceTracker(st, testPicker(st))
+	var failed []*PeerConn
+	pt.hashFailed = func(idx uint32, peers []*PeerConn) {
+		failed = peers
+	}
+	a, b := new(PeerConn), new(PeerConn)
+	remote := fullBitfield(1)
+	for _, from := range []*PeerConn{a, b} {
+		r := pt.NextRequest(remote, nil)
+		if r == nil {
+			t.Fatal("no request")
+		}
+		pt.handlePieceData(&common.PieceData{
+			Index: r.Index,
+			Begin: r.Begin,
+			Data:  make([]byte, r.Length),
+		}, from)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("expected 2 peers blamed for bad piece, got %d", len(failed))
+	}
+	if st.bf.Has(0) {
+		t.Fatal("bad piece was marked as obtained")
+	}
+}
+
+func TestPeerBans(t *testing.T) {
+	b := newPeerBans()
+	for i := 1; i < BanStrikes; i++ {
+		if b.strike("peer", 1) {
+			t.Fatalf("banned after %d strikes", i)
+		}
+	}
+	if !b.strike("peer", 1) {
+		t.Fatal("not banned after enough strikes")
+	}
+	b.ban("peer")
+	if !b.isBanned("other", "peer") {
+		t.Fatal("banned peer is not banned")
+	}
+	b.banned["peer"] = time.Now().Add(-time.Second)
+	if b.isBanned("peer") {
+		t.Fatal("ban did not expire")
+	}
+	var nobans *peerBans
+	if nobans.isBanned("peer") {
+		t.Fatal("nil ban list banned a peer")
+	}
+}
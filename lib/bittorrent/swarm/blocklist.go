@@ -0,0 +1,84 @@
+package swarm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/majestrate/XD/lib/blocklist"
+	"github.com/majestrate/XD/lib/log"
+)
+
+// how long fetching a blocklist url may take including reading it, slow eepsites must not hang updates
+const blocklistFetchTimeout = time.Minute * 5
+
+// Blocklist gets the blocklist enforced by this swarm
+func (sw *Swarm) Blocklist() *blocklist.Blocklist {
+	return sw.Torrents.blocklist
+}
+
+// SetBlocklistSources sets the files and urls the blocklist is loaded from
+func (sw *Swarm) SetBlocklistSources(sources []string) {
+	sw.blocklistMtx.Lock()
+	sw.blocklistSources = append([]string{}, sources...)
+	sw.blocklistMtx.Unlock()
+}
+
+// BlocklistSources gets the files and urls the blocklist is loaded from
+func (sw *Swarm) BlocklistSources() (sources []string) {
+	sw.blocklistMtx.Lock()
+	sources = append(sources, sw.blocklistSources...)
+	sw.blocklistMtx.Unlock()
+	return
+}
+
+// open a blocklist source, urls are fetched over our network
+func (sw *Swarm) openBlocklistSource(source string) (r io.ReadCloser, err error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+	n := sw.Network()
+	cl := &http.Client{
+		Transport: &http.Transport{
+			Dial: n.Dial,
+		},
+		Timeout: blocklistFetchTimeout,
+	}
+	var resp *http.Response
+	resp, err = cl.Get(source)
+	if err == nil {
+		if resp.StatusCode == http.StatusOK {
+			r = resp.Body
+		} else {
+			resp.Body.Close()
+			err = fmt.Errorf("failed to fetch blocklist from %s: %s", source, resp.Status)
+		}
+	}
+	return
+}
+
+// UpdateBlocklist reloads the blocklist from all of its sources
+// the current blocklist is kept if any source fails to load
+func (sw *Swarm) UpdateBlocklist() (err error) {
+	fresh := blocklist.New()
+	for _, source := range sw.BlocklistSources() {
+		log.Infof("loading blocklist from %s", source)
+		var r io.ReadCloser
+		r, err = sw.openBlocklistSource(source)
+		if err == nil {
+			var n int
+			n, err = fresh.Load(source, r)
+			r.Close()
+			log.Infof("loaded %d blocklist entries from %s", n, source)
+		}
+		if err != nil {
+			log.Errorf("failed to load blocklist: %s", err.Error())
+			return
+		}
+	}
+	sw.Torrents.blocklist.Replace(fresh)
+	return
+}
@@ -0,0 +1,120 @@
+package swarm
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/majestrate/XD/lib/log"
+)
+
+// default number of regular upload slots per torrent
+const DefaultUploadSlots = 4
+
+// default number of optimistic unchoke slots per torrent
+const DefaultOptimisticSlots = 1
+
+// how often we recalculate which peers get regular upload slots
+const chokeInterval = time.Second * 10
+
+// how often we rotate the optimistic unchoke slots
+const optimisticInterval = time.Second * 30
+
+// rate used to rank a peer for a regular upload slot
+// while leeching we reward peers that give us data, while seeding peers that take it fastest
+func (c *PeerConn) chokeRate(seeding bool) float64 {
+	if seeding {
+		return c.tx.Mean()
+	}
+	return c.rx.Mean()
+}
+
+// called on the peer's goroutine when a peer tells us it is interested
+// all choke decisions are made in tickChoke, so only ask it to recalculate on the next tick
+// which gives the peer a free regular slot if there is one
+func (t *Torrent) onPeerInterested(c *PeerConn) {
+	if c.Chocking() {
+		atomic.StoreInt32(&t.rechoke, 1)
+	}
+}
+
+// recalculate upload slots, regular slots go to the best ranked interested peers
+// and optimistic slots rotate between the rest
+// only called from the torrent's tick goroutine
+func (t *Torrent) tickChoke(now time.Time) {
+	rechoke := atomic.SwapInt32(&t.rechoke, 0) == 1
+	if !rechoke && now.Sub(t.lastChoke) < chokeInterval {
+		return
+	}
+	t.lastChoke = now
+	rotate := now.Sub(t.lastOptimistic) >= optimisticInterval
+	if rotate {
+		t.lastOptimistic = now
+	}
+	seeding := t.Done()
+
+	var candidates []*PeerConn
+	t.VisitPeers(func(c *PeerConn) {
+		if c.RemoteInterested() && !c.isClosing() {
+			candidates = append(candidates, c)
+		}
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].chokeRate(seeding) > candidates[j].chokeRate(seeding)
+	})
+
+	unchoke := make(map[*PeerConn]bool)
+	var rest []*PeerConn
+	for _, c := range candidates {
+		if len(unchoke) < t.UploadSlots {
+			unchoke[c] = true
+		} else {
+			rest = append(rest, c)
+		}
+	}
+
+	// keep the current optimistic peers until it is time to rotate
+	var optimistic []*PeerConn
+	if !rotate {
+		for _, c := range t.optimistic {
+			for _, r := range rest {
+				if c == r {
+					optimistic = append(optimistic, c)
+					break
+				}
+			}
+		}
+	}
+	rand.Shuffle(len(rest), func(i, j int) {
+		rest[i], rest[j] = rest[j], rest[i]
+	})
+	for _, c := range rest {
+		if len(optimistic) >= t.OptimisticSlots {
+			break
+		}
+		found := false
+		for _, o := range optimistic {
+			if o == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Debugf("%s optimistically unchoked", c.id.String())
+			optimistic = append(optimistic, c)
+		}
+	}
+	t.optimistic = optimistic
+	for _, c := range optimistic {
+		unchoke[c] = true
+	}
+
+	t.VisitPeers(func(c *PeerConn) {
+		if unchoke[c] {
+			c.Unchoke()
+		} else if !c.Chocking() {
+			c.Choke()
+		}
+	})
+}
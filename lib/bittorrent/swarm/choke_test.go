@@ -0,0 +1,152 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/sync"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChoker(t *testing.T) {
+	tr := newTorrent(newTestTorrentStorage(BlockSize, 4), nil)
+	tr.UploadSlots = 2
+	tr.OptimisticSlots = 1
+	newPeer := func(name string, id byte, rate uint64) *PeerConn {
+		c, _ := net.Pipe()
+		p := makePeerConn(c, tr, common.PeerID{id}, extensions.Message{}, bittorrent.Reserved{})
+		p.rx.AddSample(rate)
+		tr.obconns[name] = p
+		return p
+	}
+	interested := func(p *PeerConn) {
+		atomic.StoreInt32(&p.peerInterested, 1)
+		tr.onPeerInterested(p)
+	}
+	unchoked := func() (n int) {
+		tr.VisitPeers(func(c *PeerConn) {
+			if !c.Chocking() {
+				n++
+			}
+		})
+		return
+	}
+	now := time.Now()
+	tr.lastChoke = now
+	tr.lastOptimistic = now
+
+	// a free slot is handed out on the next tick
+	a := newPeer("a", 1, 600)
+	interested(a)
+	if !a.Chocking() {
+		t.Fatal("peer unchoked outside of tickChoke")
+	}
+	tr.tickChoke(now)
+	if a.Chocking() {
+		t.Fatal("interested peer did not get a free slot")
+	}
+
+	b := newPeer("b", 2, 500)
+	peers := []*PeerConn{a, b}
+	for id, rate := range []uint64{100, 200, 300, 400} {
+		peers = append(peers, newPeer(string(rune('c'+id)), byte(id+3), rate))
+	}
+	for _, p := range peers[1:] {
+		interested(p)
+	}
+	tr.tickChoke(now.Add(time.Second))
+	if n := unchoked(); n != tr.UploadSlots+tr.OptimisticSlots {
+		t.Fatalf("%d peers unchoked", n)
+	}
+	if a.Chocking() || b.Chocking() {
+		t.Fatal("fastest peers did not get regular slots")
+	}
+	if len(tr.optimistic) != 1 {
+		t.Fatalf("%d optimistic peers", len(tr.optimistic))
+	}
+
+	// more interested peers never exceed the slots
+	g := newPeer("g", 7, 0)
+	interested(g)
+	tr.tickChoke(now.Add(time.Second * 2))
+	if n := unchoked(); n != tr.UploadSlots+tr.OptimisticSlots {
+		t.Fatalf("%d peers unchoked after new interested peer", n)
+	}
+
+	// the optimistic peer is kept until it is time to rotate
+	optimistic := tr.optimistic[0]
+	tr.tickChoke(now.Add(chokeInterval * 2))
+	if tr.optimistic[0] != optimistic || optimistic.Chocking() {
+		t.Fatal("optimistic peer rotated early")
+	}
+
+	// rotation gives other peers a turn
+	seen := map[*PeerConn]bool{optimistic: true}
+	at := now
+	for i := 0; i < 32; i++ {
+		at = at.Add(optimisticInterval)
+		tr.tickChoke(at)
+		if n := unchoked(); n != tr.UploadSlots+tr.OptimisticSlots {
+			t.Fatalf("%d peers unchoked after rotation", n)
+		}
+		seen[tr.optimistic[0]] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("optimistic slot never rotated")
+	}
+	if seen[a] || seen[b] {
+		t.Fatal("peer with a regular slot got an optimistic slot")
+	}
+}
+
+func TestChokerConcurrent(t *testing.T) {
+	tr := newTorrent(newTestTorrentStorage(BlockSize, 4), nil)
+	tr.UploadSlots = 2
+	tr.OptimisticSlots = 1
+	var peers []*PeerConn
+	for id := byte(1); id <= 6; id++ {
+		c, _ := net.Pipe()
+		p := makePeerConn(c, tr, common.PeerID{id}, extensions.Message{}, bittorrent.Reserved{})
+		tr.obconns[string(rune('a'+id))] = p
+		p.markInterested()
+		peers = append(peers, p)
+	}
+	start := make(chan struct{})
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for idx, p := range peers {
+		wg.Add(1)
+		go func(p *PeerConn, closes bool) {
+			defer wg.Done()
+			<-start
+			// what a peer's goroutine does while the tick goroutine rechokes
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				switch i % 100 {
+				case 50:
+					p.markNotInterested()
+				case 99:
+					p.markInterested()
+				}
+				p.Chocking()
+				if closes && i == 100 {
+					p.Close()
+				}
+			}
+		}(p, idx == 0)
+	}
+	close(start)
+	now := time.Now()
+	for i := 0; i < 2000; i++ {
+		tr.tickChoke(now.Add(chokeInterval * time.Duration(i)))
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,251 @@
+package swarm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// DefaultMaxConnections is the default swarm wide limit on peer connections, 0 means unlimited
+const DefaultMaxConnections = 200
+
+// DefaultMaxHalfOpen is the default limit on outbound connections still being set up, 0 means unlimited
+const DefaultMaxHalfOpen = 8
+
+// peers connected for less than this are never evicted
+const connEvictGrace = time.Minute
+
+// how long connection counts are reused before counting again
+const connCountInterval = time.Second
+
+// how long to wait before retrying to get a half open slot
+const connDialWait = time.Millisecond * 100
+
+// ErrConnLimit is returned when the swarm wide connection limit is reached
+var ErrConnLimit = errors.New("connection limit reached")
+
+// ConnStats is the state of the swarm wide connection limits
+type ConnStats struct {
+	// limit on peer connections, 0 means unlimited
+	MaxConnections int
+	// limit on outbound connections still being set up, 0 means unlimited
+	MaxHalfOpen int
+	// open peer connections
+	Connections int
+	// outbound connections still being set up
+	HalfOpen int
+	// running torrents
+	Torrents int
+	// connections each running torrent is guaranteed
+	FairShare int
+	// how many peers were dropped to make room for other torrents
+	Evicted uint64
+}
+
+// connManager enforces the connection limits shared by all torrents in a swarm
+type connManager struct {
+	h           *Holder
+	mtx         sync.Mutex
+	maxConns    int
+	maxHalfOpen int
+	halfOpen    int
+	evicted     uint64
+	conns       int
+	torrents    int
+	lastCount   time.Time
+}
+
+func newConnManager(h *Holder) *connManager {
+	return &connManager{
+		h:           h,
+		maxConns:    DefaultMaxConnections,
+		maxHalfOpen: DefaultMaxHalfOpen,
+	}
+}
+
+// connections per torrent when max connections are split among torrents
+func fairShare(max, torrents int) int {
+	if torrents < 1 {
+		torrents = 1
+	}
+	share := max / torrents
+	if share < 1 {
+		share = 1
+	}
+	return share
+}
+
+// count open connections and running torrents, reusing recent counts unless forced
+func (m *connManager) count(force bool) (conns, torrents int) {
+	m.mtx.Lock()
+	if !force && time.Since(m.lastCount) < connCountInterval {
+		conns, torrents = m.conns, m.torrents
+		m.mtx.Unlock()
+		return
+	}
+	m.mtx.Unlock()
+	m.h.ForEachTorrent(func(t *Torrent) {
+		if t.closing || t.Queued() {
+			return
+		}
+		torrents++
+		conns += t.numOpenPeers()
+	})
+	m.mtx.Lock()
+	m.conns, m.torrents = conns, torrents
+	m.lastCount = time.Now()
+	m.mtx.Unlock()
+	return
+}
+
+// get the limits and how many connections are being set up
+func (m *connManager) limits() (maxConns, maxHalfOpen, halfOpen int) {
+	m.mtx.Lock()
+	maxConns, maxHalfOpen, halfOpen = m.maxConns, m.maxHalfOpen, m.halfOpen
+	m.mtx.Unlock()
+	return
+}
+
+// hasRoom returns true if t can get another connection, possibly by evicting a peer of another torrent
+func (m *connManager) hasRoom(t *Torrent) bool {
+	if m == nil {
+		return true
+	}
+	maxConns, _, halfOpen := m.limits()
+	if maxConns <= 0 {
+		return true
+	}
+	conns, torrents := m.count(false)
+	if conns+halfOpen < maxConns {
+		return true
+	}
+	return !t.Done() && t.numOpenPeers() < fairShare(maxConns, torrents)
+}
+
+// makeRoom frees a connection slot for t if the swarm is full and t is below its fair share
+// returns false if t cannot get another connection
+func (m *connManager) makeRoom(t *Torrent) bool {
+	if m == nil {
+		return true
+	}
+	maxConns, _, halfOpen := m.limits()
+	if maxConns <= 0 {
+		return true
+	}
+	conns, torrents := m.count(true)
+	if conns+halfOpen < maxConns {
+		return true
+	}
+	share := fairShare(maxConns, torrents)
+	if t.Done() || t.numOpenPeers() >= share {
+		return false
+	}
+	victim := m.leastUseful(t, share)
+	if victim == nil {
+		return false
+	}
+	log.Debugf("evicting %s from %s to make room for %s", victim.id.String(), victim.t.Name(), t.Name())
+	victim.Close()
+	m.mtx.Lock()
+	m.evicted++
+	m.mtx.Unlock()
+	return true
+}
+
+// find the least useful peer of the torrents other than t that are above their fair share
+func (m *connManager) leastUseful(t *Torrent, share int) (victim *PeerConn) {
+	now := time.Now()
+	best := -1
+	m.h.ForEachTorrent(func(other *Torrent) {
+		if other == t || other.numOpenPeers() <= share {
+			return
+		}
+		other.VisitPeers(func(c *PeerConn) {
+			score := peerUsefulness(c, now)
+			if score < 0 {
+				return
+			}
+			if victim == nil || score < best || (score == best && c.connected.Before(victim.connected)) {
+				victim = c
+				best = score
+			}
+		})
+	})
+	return
+}
+
+// how useful a peer is to keep connected, lower is less useful
+// peers that have pieces we want or just connected are never evicted and get -1
+func peerUsefulness(c *PeerConn, now time.Time) (score int) {
+	if c.isClosing() || c.usInterested || now.Sub(c.connected) < connEvictGrace {
+		return -1
+	}
+	if c.RemoteInterested() {
+		score += 2
+	}
+	if c.uploading || c.tx.Mean() > 0 || c.rx.Mean() > 0 {
+		score++
+	}
+	return
+}
+
+// acquireDial takes a half open connection slot, returns false if none are free
+func (m *connManager) acquireDial() bool {
+	if m == nil {
+		return true
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.maxHalfOpen > 0 && m.halfOpen >= m.maxHalfOpen {
+		return false
+	}
+	m.halfOpen++
+	return true
+}
+
+// releaseDial gives back a half open connection slot
+func (m *connManager) releaseDial() {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	m.halfOpen--
+	m.mtx.Unlock()
+}
+
+// count open connections that are not closing
+func (t *Torrent) numOpenPeers() (count int) {
+	t.VisitPeers(func(c *PeerConn) {
+		if !c.isClosing() {
+			count++
+		}
+	})
+	return
+}
+
+// SetConnLimits sets the swarm wide connection limit and half open connection limit, 0 means unlimited
+func (h *Holder) SetConnLimits(maxConns, maxHalfOpen int) {
+	h.connMgr.mtx.Lock()
+	h.connMgr.maxConns = maxConns
+	h.connMgr.maxHalfOpen = maxHalfOpen
+	h.connMgr.mtx.Unlock()
+}
+
+// ConnStats gets the state of the swarm wide connection limits
+func (h *Holder) ConnStats() (st ConnStats) {
+	conns, torrents := h.connMgr.count(true)
+	h.connMgr.mtx.Lock()
+	st.MaxConnections = h.connMgr.maxConns
+	st.MaxHalfOpen = h.connMgr.maxHalfOpen
+	st.HalfOpen = h.connMgr.halfOpen
+	st.Evicted = h.connMgr.evicted
+	h.connMgr.mtx.Unlock()
+	st.Connections = conns
+	st.Torrents = torrents
+	if st.MaxConnections > 0 {
+		st.FairShare = fairShare(st.MaxConnections, torrents)
+	}
+	return
+}
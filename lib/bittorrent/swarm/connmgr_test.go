@@ -0,0 +1,67 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnManager(t *testing.T) {
+	h := &Holder{}
+	h.connMgr = newConnManager(h)
+	h.SetConnLimits(2, 1)
+
+	seeding := newTestTorrentStorage(BlockSize, 4)
+	seeding.bf.Fill()
+	seeder := newTorrent(seeding, nil)
+	seeder.connMgr = h.connMgr
+	leecher := newTorrent(newTestTorrentStorage(BlockSize, 4), nil)
+	leecher.connMgr = h.connMgr
+	h.torrents.Store("seeder", seeder)
+	h.torrents.Store("leecher", leecher)
+
+	newPeer := func(tr *Torrent, name string, id byte) *PeerConn {
+		c, _ := net.Pipe()
+		p := makePeerConn(c, tr, common.PeerID{id}, extensions.Message{}, bittorrent.Reserved{})
+		p.bf = bittorrent.NewBitfield(4, nil)
+		p.connected = time.Now().Add(-connEvictGrace * 2)
+		tr.obconns[name] = p
+		return p
+	}
+	idle := newPeer(seeder, "idle", 1)
+	wants := newPeer(seeder, "wants", 2)
+	atomic.StoreInt32(&wants.peerInterested, 1)
+
+	if seeder.connMgr.hasRoom(seeder) {
+		t.Fatal("seeding torrent got room in a full swarm")
+	}
+	if !leecher.NeedsPeers() {
+		t.Fatal("torrent below its fair share does not need peers")
+	}
+	if !leecher.connMgr.makeRoom(leecher) {
+		t.Fatal("no room made for torrent below its fair share")
+	}
+	if !idle.isClosing() || wants.isClosing() {
+		t.Fatal("did not evict the least useful peer")
+	}
+	st := h.ConnStats()
+	if st.Connections != 1 || st.Torrents != 2 || st.FairShare != 1 || st.Evicted != 1 {
+		t.Fatalf("bad conn stats %+v", st)
+	}
+	newPeer(leecher, "new", 3)
+	if leecher.connMgr.makeRoom(leecher) {
+		t.Fatal("evicted a peer of a torrent at its fair share")
+	}
+
+	if !h.connMgr.acquireDial() || h.connMgr.acquireDial() {
+		t.Fatal("half open limit not enforced")
+	}
+	h.connMgr.releaseDial()
+	if !h.connMgr.acquireDial() {
+		t.Fatal("half open slot not released")
+	}
+}
@@ -5,5 +5,7 @@ package swarm
 
 import "github.com/majestrate/XD/lib/bittorrent/extensions"
 
-const DefaultMaxParallelRequests = 4
-const DefaultPEXDialect = extensions.I2PPeerExchange
+const DefaultMaxParallelRequests = 32
+
+// pex dialects we support
+var DefaultPEXDialects = []extensions.Extension{extensions.I2PPeerExchange}
@@ -6,4 +6,6 @@ package swarm
 import "github.com/majestrate/XD/lib/bittorrent/extensions"
 
 const DefaultMaxParallelRequests = 48
-const DefaultPEXDialect = extensions.LokinetPeerExchange
+
+// pex dialects we support, ln_pex is kept for older XD
+var DefaultPEXDialects = []extensions.Extension{extensions.UTPeerExchange, extensions.LokinetPeerExchange}
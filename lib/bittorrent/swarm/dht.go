@@ -0,0 +1,166 @@
+package swarm
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/dht"
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/network"
+	"github.com/majestrate/XD/lib/network/i2p"
+)
+
+// how often a torrent with no peers looks for some in the dht
+const dhtLookupInterval = time.Minute
+
+// how often a torrent announces itself in the dht
+const dhtAnnounceInterval = time.Minute * 15
+
+// a peer connection we speak xdht with
+type dhtNode struct {
+	c *PeerConn
+}
+
+func (n dhtNode) SendLowLevel(data []byte) error {
+	id := n.c.theirOpts.Extensions[extensions.XDHT.String()]
+	msg := extensions.Message{
+		ID:         uint8(id),
+		PayloadRaw: data,
+	}
+	n.c.Send(msg.ToWireMessage())
+	return nil
+}
+
+func (n dhtNode) ID() string {
+	return string(n.c.id[:])
+}
+
+func (n dhtNode) Addr() string {
+	return n.c.c.RemoteAddr().String()
+}
+
+// EnableDHT turns on xdht, persisting known nodes to a file on driver
+func (sw *Swarm) EnableDHT(driver fs.Driver, path string) {
+	sw.xdht.Enable(sw.id, driver, path)
+}
+
+// EnableI2PDHT turns on the i2p dht, persisting known nodes to a file on driver
+// the i2p session needs datagrams enabled on dht.I2PDHTPort
+func (sw *Swarm) EnableI2PDHT(driver fs.Driver, path string) {
+	sw.i2pdht.Enable(driver, path)
+}
+
+// start the i2p dht if we got an i2p network
+func (sw *Swarm) startI2PDHT(n network.Network) {
+	if sw.i2pdht.Enabled() && n.Addr().Network() == "i2p" {
+		sw.i2pdht.Start(n, n.Addr())
+	}
+}
+
+// return true if this torrent may use the dht
+func (t *Torrent) dhtEnabled() bool {
+	return t.xdht != nil && t.xdht.Enabled() && !t.Private()
+}
+
+// return true if this torrent may use the i2p dht
+func (t *Torrent) i2pDHTEnabled() bool {
+	return t.i2pdht != nil && t.i2pdht.Running() && !t.Private()
+}
+
+// add a peer that supports xdht as a dht node and tell i2p dht peers where our dht is
+func (c *PeerConn) addDHTNode() {
+	if c.theirOpts.XDHT() && c.ourOpts.XDHT() && c.t.dhtEnabled() {
+		c.t.xdht.AddNode(dhtNode{c})
+	}
+	if c.theirOpts.I2PDHT() && c.ourOpts.I2PDHT() && c.t.i2pDHTEnabled() {
+		id := c.theirOpts.Extensions[extensions.I2PDHT.String()]
+		msg := extensions.NewI2PDHT(uint8(id), dht.I2PDHTPort, dht.I2PDHTPort+1)
+		c.Send(msg.ToWireMessage())
+	}
+}
+
+// a peer told us the port their i2p dht takes queries on
+func (c *PeerConn) handleI2PDHT(m interface{}) {
+	if !c.t.i2pDHTEnabled() {
+		return
+	}
+	msg, _ := m.(map[string]interface{})
+	port, ok := msg["port"].(int64)
+	if !ok || port <= 0 || port >= 65536 {
+		log.Warnf("%s sent invalid i2p_dht message: %q", c.id.String(), m)
+		return
+	}
+	host, _, err := net.SplitHostPort(c.c.RemoteAddr().String())
+	if err != nil {
+		host = c.c.RemoteAddr().String()
+	}
+	c.t.i2pdht.Ping(net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+// look for peers in the dht if we have none and announce ourselves now and then
+func (t *Torrent) tickDHT() {
+	xdht := t.dhtEnabled()
+	i2pdht := t.i2pDHTEnabled()
+	if !xdht && !i2pdht {
+		return
+	}
+	now := time.Now()
+	if t.Ready() && now.Sub(t.lastDHTAnnounce) > dhtAnnounceInterval {
+		t.lastDHTAnnounce = now
+		t.lastDHTLookup = now
+		if xdht {
+			port := 0
+			_, p, err := net.SplitHostPort(t.Network().Addr().String())
+			if err == nil {
+				port, _ = strconv.Atoi(p)
+			}
+			t.xdht.Announce(t.Infohash(), port, t.addDHTPeers)
+		}
+		if i2pdht {
+			t.i2pdht.Announce(t.Infohash(), t.addI2PDHTPeers)
+		}
+	} else if t.NumPeers() == 0 && now.Sub(t.lastDHTLookup) > dhtLookupInterval {
+		t.lastDHTLookup = now
+		log.Debugf("looking up peers for %s in dht", t.Infohash().Hex())
+		if xdht {
+			t.xdht.GetPeers(t.Infohash(), t.addDHTPeers)
+		}
+		if i2pdht {
+			t.i2pdht.GetPeers(t.Infohash(), t.addI2PDHTPeers)
+		}
+	}
+}
+
+// add peers found in the dht
+func (t *Torrent) addDHTPeers(addrs []string) {
+	var peers []common.Peer
+	for _, addr := range addrs {
+		var p common.Peer
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			p.IP = host
+			p.Port, _ = strconv.Atoi(port)
+		} else {
+			p.IP = addr
+		}
+		peers = append(peers, p)
+	}
+	log.Debugf("dht gave %d peers for %s", len(peers), t.Infohash().Hex())
+	t.addPeers(peers)
+}
+
+// add peers found in the i2p dht
+func (t *Torrent) addI2PDHTPeers(hashes []i2p.Base32Addr) {
+	var peers []common.Peer
+	for _, h := range hashes {
+		peers = append(peers, common.Peer{
+			Compact: h,
+		})
+	}
+	log.Debugf("i2p dht gave %d peers for %s", len(peers), t.Infohash().Hex())
+	t.addPeers(peers)
+}
@@ -0,0 +1,56 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/log"
+)
+
+// LocalError gets the storage error that stopped this torrent, nil if there is none
+func (t *Torrent) LocalError() (err error) {
+	t.errMtx.Lock()
+	err = t.localErr
+	t.errMtx.Unlock()
+	return
+}
+
+func (t *Torrent) setLocalError(err error) {
+	t.errMtx.Lock()
+	t.localErr = err
+	t.errMtx.Unlock()
+}
+
+// check that the data we still need fits on disk before we start downloading
+func (t *Torrent) checkFreeSpace() (err error) {
+	t.setLocalError(nil)
+	if !t.Ready() || t.Done() {
+		return
+	}
+	err = t.st.CheckFreeSpace()
+	if err != nil {
+		t.setLocalError(err)
+	}
+	return
+}
+
+// pause a torrent when its disk is full instead of failing every write
+func (t *Torrent) onDiskFull(err error) {
+	t.errMtx.Lock()
+	paused := t.localErr != nil
+	if !paused {
+		t.localErr = err
+	}
+	t.errMtx.Unlock()
+	if paused || t.closing {
+		return
+	}
+	log.Errorf("disk is full, pausing %s: %s", t.Name(), err.Error())
+	go t.pause()
+}
+
+// stop a torrent but keep it in the swarm
+func (t *Torrent) pause() {
+	err := t.Close()
+	if err != nil {
+		log.Warnf("failed to close %s: %s", t.Name(), err.Error())
+	}
+	t.StopAnnouncing(true)
+}
@@ -1,20 +1,52 @@
 package swarm
 
 import (
+	"github.com/majestrate/XD/lib/blocklist"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/network"
 	"github.com/majestrate/XD/lib/storage"
 	"github.com/majestrate/XD/lib/sync"
+	"github.com/majestrate/XD/lib/util"
+	"time"
 )
 
 // torrent swarm container
 type Holder struct {
-	closing      bool
-	st           storage.Storage
-	torrents     sync.Map
-	torrentsByID sync.Map
-	MaxReq       int
-	QueueSize    int
+	closing         bool
+	st              storage.Storage
+	torrents        sync.Map
+	torrentsByID    sync.Map
+	torrentsByV2    sync.Map
+	MaxReq          int
+	QueueSize       int
+	UploadSlots     int
+	OptimisticSlots int
+	limitMtx        sync.Mutex
+	uploadSpeed     SpeedLimit
+	downloadSpeed   SpeedLimit
+	altSpeed        AltSpeed
+	uploadLimit     *util.RateLimiter
+	downloadLimit   *util.RateLimiter
+	bans            *peerBans
+	blocklist       *blocklist.Blocklist
+	connMgr         *connManager
+	// limits on active downloads and seeds, 0 means unlimited
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// downloads that got no data for this long do not count as active
+	StalledTime time.Duration
+	queue       *torrentQueue
+	seedLimits  SeedLimits
+}
+
+// FreeSpace gets how many bytes are free on the filesystem of path, empty path means the download directory
+func (h *Holder) FreeSpace(path string) (int64, error) {
+	return h.st.FreeSpace(path)
+}
+
+// CacheStats gets statistics of the piece cache of our storage
+func (h *Holder) CacheStats() storage.CacheStats {
+	return h.st.CacheStats()
 }
 
 func (h *Holder) TorrentIDs() (ids map[int64]string) {
@@ -39,8 +71,41 @@ func (h *Holder) addTorrent(t storage.Torrent, getNet func() network.Network) {
 	}
 	tr := newTorrent(t, getNet)
 	tr.MaxRequests = h.MaxReq
-	h.torrents.Store(t.Infohash().Hex(), tr)
+	tr.UploadSlots = h.UploadSlots
+	tr.OptimisticSlots = h.OptimisticSlots
+	tr.globalUpload = h.uploadLimit
+	tr.globalDownload = h.downloadLimit
+	tr.bans = h.bans
+	tr.blocklist = h.blocklist
+	tr.connMgr = h.connMgr
+	tr.setQueued(true)
+	tr.queue = h.queue
+	tr.globalSeedLimits = h.SeedLimits
+	tr.InfohashChanged = func(old common.Infohash) {
+		h.rekeyTorrent(old, tr)
+	}
 	h.torrentsByID.Store(tr.TID, tr)
+	h.storeTorrent(tr)
+}
+
+// index a torrent by its infohash
+func (h *Holder) storeTorrent(tr *Torrent) {
+	h.torrents.Store(tr.Infohash().Hex(), tr)
+	if meta := tr.MetaInfo(); meta != nil && meta.IsHybrid() {
+		// hybrid torrents can be found by their truncated v2 infohash too
+		h.torrentsByV2.Store(meta.InfohashV2().Truncated().Hex(), tr)
+	}
+}
+
+// index a torrent that was added by truncated v2 infohash by its v1 infohash once we have its metainfo
+func (h *Holder) rekeyTorrent(old common.Infohash, tr *Torrent) {
+	if h.closing {
+		return
+	}
+	if v, ok := h.torrents.Load(old.Hex()); ok && v == tr {
+		h.torrents.Delete(old.Hex())
+	}
+	h.storeTorrent(tr)
 }
 
 func (h *Holder) addMagnet(ih common.Infohash, getNet func() network.Network) {
@@ -49,6 +114,19 @@ func (h *Holder) addMagnet(ih common.Infohash, getNet func() network.Network) {
 	}
 	tr := newTorrent(h.st.EmptyTorrent(ih), getNet)
 	tr.MaxRequests = h.MaxReq
+	tr.UploadSlots = h.UploadSlots
+	tr.OptimisticSlots = h.OptimisticSlots
+	tr.globalUpload = h.uploadLimit
+	tr.globalDownload = h.downloadLimit
+	tr.bans = h.bans
+	tr.blocklist = h.blocklist
+	tr.connMgr = h.connMgr
+	tr.setQueued(true)
+	tr.queue = h.queue
+	tr.globalSeedLimits = h.SeedLimits
+	tr.InfohashChanged = func(old common.Infohash) {
+		h.rekeyTorrent(old, tr)
+	}
 	h.torrents.Store(ih.Hex(), tr)
 	h.torrentsByID.Store(tr.TID, tr)
 }
@@ -61,6 +139,13 @@ func (h *Holder) removeTorrent(ih common.Infohash) {
 	if ok {
 		h.torrents.Delete(ih.Hex())
 		h.torrentsByID.Delete(tr.(*Torrent).TID)
+		h.torrentsByV2.Range(func(k, v interface{}) bool {
+			if v == tr {
+				h.torrentsByV2.Delete(k)
+			}
+			return true
+		})
+		h.dequeue(tr.(*Torrent))
 	}
 }
 
@@ -91,6 +176,9 @@ func (h *Holder) ForEachTorrentParallel(visit func(*Torrent)) {
 // returns nil if we don't have a torrent with this infohash
 func (h *Holder) GetTorrent(ih common.Infohash) (t *Torrent) {
 	v, ok := h.torrents.Load(ih.Hex())
+	if !ok {
+		v, ok = h.torrentsByV2.Load(ih.Hex())
+	}
 	if ok {
 		t = v.(*Torrent)
 	}
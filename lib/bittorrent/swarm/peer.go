@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/majestrate/XD/lib/bittorrent"
@@ -16,6 +17,9 @@ import (
 
 const sendChanLen = 512
 
+// how many flushed write buffers may wait for the writer goroutine, which sleeps in the upload rate limiters
+const writeQueueLen = 8
+
 // a peer connection
 type PeerConn struct {
 	writeBuff           util.Buffer
@@ -23,20 +27,25 @@ type PeerConn struct {
 	sendPieceBuff       [BlockSize]byte
 	inbound             bool
 	c                   net.Conn
+	r                   io.Reader
+	w                   io.Writer
+	writeQueue          chan []byte
+	writeErr            chan error
 	id                  common.PeerID
 	t                   *Torrent
 	send                chan common.WireMessage
 	recv                chan common.WireMessage
 	bf                  *bittorrent.Bitfield
 	peerChoke           bool
-	peerInterested      bool
-	usChoke             bool
+	peerInterested      int32
+	usChoke             int32
 	usInterested        bool
 	peerUsInterested    bool
 	Done                func()
 	lastSend            time.Time
 	tx                  *util.Rate
 	lastRecv            time.Time
+	connected           time.Time
 	rx                  *util.Rate
 	downloading         []*common.PieceRequest
 	lastRequest         *common.PieceRequest
@@ -47,14 +56,23 @@ type PeerConn struct {
 	close               chan bool
 	ticker              *time.Ticker
 	tickstats           bool
-	closing             bool
+	closing             int32
 	uploading           bool
 	runDownload         bool
 	nextPieceRequest    time.Time
 	reserved            bittorrent.Reserved
 	sendPending         int
+	ourAllowedFast      map[uint32]bool
+	theirAllowedFast    map[uint32]bool
+	suggested           []uint32
+	superSeed           superSeedState
+	pipeline            requestPipeline
+	lastPEX             time.Time
 }
 
+// max number of suggested pieces we remember per peer
+const maxSuggestedPieces = 16
+
 func (c *PeerConn) Bitfield() *bittorrent.Bitfield {
 	if c.bf != nil {
 		return c.bf.Copy()
@@ -70,13 +88,15 @@ func (c *PeerConn) Stats() (st *PeerConnStats) {
 	st.Addr = c.c.RemoteAddr().String()
 	st.ID = c.id.String()
 	st.UsInterested = c.usInterested
-	st.ThemInterested = c.peerInterested
-	st.UsChoking = c.usChoke
+	st.ThemInterested = c.RemoteInterested()
+	st.UsChoking = c.Chocking()
 	st.ThemChoking = c.peerChoke
 	st.Client = util.ClientNameFromID(c.id[:])
 	st.Downloading = c.numDownloading() > 0
 	st.Inbound = c.inbound
 	st.Uploading = c.uploading
+	st.RequestWindow = c.RequestWindow()
+	st.RTT = int64(c.pipeline.rtt() / time.Millisecond)
 	if c.bf != nil {
 		st.Bitfield.CopyFrom(c.bf)
 	}
@@ -87,36 +107,44 @@ func makePeerConn(c net.Conn, t *Torrent, id common.PeerID, ourOpts extensions.M
 	p := t.getNextPeer()
 	p.c = c
 	p.t = t
+	p.r = util.NewRateLimitedReader(c, t.downloadLimiters()...)
+	p.w = util.NewRateLimitedWriter(c, t.uploadLimiters()...)
 	p.tx = util.NewRate(10)
 	p.rx = util.NewRate(10)
 	p.ticker = time.NewTicker(time.Millisecond * 500)
 	p.ourOpts = ourOpts
 	p.peerChoke = true
-	p.usChoke = true
+	p.usChoke = 1
 	copy(p.id[:], id[:])
 	p.MaxParalellRequests = t.MaxRequests
 	p.downloading = []*common.PieceRequest{}
 	p.send = make(chan common.WireMessage, sendChanLen)
+	p.writeQueue = make(chan []byte, writeQueueLen)
+	p.writeErr = make(chan error, 1)
 	p.recv = make(chan common.WireMessage)
 	p.reserved = reserved
+	p.ourAllowedFast = make(map[uint32]bool)
+	p.theirAllowedFast = make(map[uint32]bool)
+	p.suggested = nil
+	p.superSeed = superSeedState{}
+	p.pipeline = requestPipeline{}
+	p.lastPEX = time.Time{}
 	p.close = make(chan bool, 1)
 	p.lastSend = time.Now()
 	p.lastRecv = time.Now()
+	p.connected = time.Now()
 	return p
 }
 
 func (c *PeerConn) appendSend(msg common.WireMessage) {
 	if c.writeBuff.Len() > 1000 {
-		if c.flushSend() != nil {
-			c.closing = true
-			return
-		}
+		c.flushSend()
 	}
 	c.processWrite(&c.writeBuff, msg)
 }
 
 func (c *PeerConn) run() {
-	for !c.closing {
+	for !c.isClosing() {
 		got := c.tickOne()
 		if !got {
 			time.Sleep(time.Millisecond * 50)
@@ -126,12 +154,20 @@ func (c *PeerConn) run() {
 	c.doClose()
 }
 func (c *PeerConn) tickOne() bool {
+	send := c.send
+	if cap(c.writeQueue)-len(c.writeQueue) < 2 {
+		// the writer is behind, do not take more messages until it catches up
+		// sending one message flushes at most twice
+		send = nil
+	}
 	select {
+	case err := <-c.writeErr:
+		log.Debugf("%s starting close due to send error: %s", c.id.String(), err.Error())
+		c.setClosing()
+		return true
 	case <-c.ticker.C:
-		if c.flushSend() != nil {
-			log.Debugf("%s starting close due to send error", c.id.String())
-			c.closing = true
-			return true
+		if len(c.writeQueue) < cap(c.writeQueue) {
+			c.flushSend()
 		}
 		if c.tickstats {
 			c.tx.Tick()
@@ -141,7 +177,7 @@ func (c *PeerConn) tickOne() bool {
 		return true
 	case <-c.close:
 		log.Debugf("%s received close message", c.id.String())
-		c.closing = true
+		c.setClosing()
 		return true
 	case msg := <-c.recv:
 		err := c.inboundMessage(msg)
@@ -149,28 +185,17 @@ func (c *PeerConn) tickOne() bool {
 			log.Errorf("%s failed to read message: %s", c.id.String(), err.Error())
 		}
 		return true
-	case msg := <-c.send:
+	case msg := <-send:
 		if msg == nil {
 			return true
 		}
 		c.sendPending--
 		c.lastSend = time.Now()
 		log.Debugf("%s sending message type %s", c.id.String(), msg.MessageID().String())
+		c.appendSend(msg)
 		if msg.Len() > 1000 {
-			if c.flushSend() == nil {
-				// write big messages right away
-				if c.processWrite(c.c, msg) != nil {
-					log.Debugf("%s starting close due to send error", c.id.String())
-					c.closing = true
-					return true
-				}
-			} else {
-				log.Debugf("%s starting close due to send error", c.id.String())
-				c.closing = true
-				return true
-			}
-		} else {
-			c.appendSend(msg)
+			// write big messages right away
+			c.flushSend()
 		}
 		return true
 	default:
@@ -182,12 +207,32 @@ func (c *PeerConn) tickOne() bool {
 func (c *PeerConn) start() {
 	go c.run()
 	go c.runReader()
+	go c.runWriter()
 }
 
-func (c *PeerConn) flushSend() error {
-	_, err := io.Copy(c.c, &c.writeBuff)
-	c.writeBuff.Reset()
-	return err
+// hand buffered messages to the writer goroutine, write errors come back on writeErr
+func (c *PeerConn) flushSend() {
+	if c.writeBuff.Len() > 0 {
+		data := make([]byte, c.writeBuff.Len())
+		copy(data, c.writeBuff.Bytes())
+		c.writeBuff.Reset()
+		c.writeQueue <- data
+	}
+}
+
+// run write loop, rate limiting happens here so it does not hold up handling messages from the peer
+func (c *PeerConn) runWriter() {
+	var err error
+	for data := range c.writeQueue {
+		if err != nil {
+			// drain so the run loop never blocks
+			continue
+		}
+		err = util.WriteFull(c.w, data)
+		if err != nil {
+			c.writeErr <- err
+		}
+	}
 }
 
 func (c *PeerConn) btPeer() (p common.Peer) {
@@ -200,7 +245,7 @@ func (c *PeerConn) btPeer() (p common.Peer) {
 
 func (c *PeerConn) processWrite(w io.Writer, msg common.WireMessage) (err error) {
 	if msg != nil {
-		if c.RemoteChoking() && msg.MessageID() == common.Request {
+		if c.RemoteChoking() && msg.MessageID() == common.Request && !c.theyAllowFast(msg.GetPieceRequest().Index) {
 			// drop
 			log.Debugf("%s cancel request because choke", c.id.String())
 			c.cancelDownload(msg.GetPieceRequest())
@@ -213,6 +258,7 @@ func (c *PeerConn) processWrite(w io.Writer, msg common.WireMessage) (err error)
 				n := uint64(msg.Len())
 				c.tx.AddSample(n)
 				c.t.statsTracker.AddSample(RateUpload, n)
+				c.t.gotUpload(time.Now())
 			}
 		}
 	}
@@ -242,7 +288,7 @@ func (c *PeerConn) queueRecv(msg common.WireMessage) (err error) {
 	}
 	log.Debugf("got %d bytes from %s", msg.Len(), c.id)
 
-	if !c.closing && c.recv != nil {
+	if !c.isClosing() && c.recv != nil {
 		msgCopy := make(common.WireMessage, len(msg))
 		copy(msgCopy[:], msg[:])
 		c.recv <- msgCopy
@@ -252,36 +298,71 @@ func (c *PeerConn) queueRecv(msg common.WireMessage) (err error) {
 
 // send choke
 func (c *PeerConn) Choke() {
-	if c.usChoke {
-		log.Warnf("multiple chokes sent to %s", c.id.String())
-	} else {
+	if atomic.CompareAndSwapInt32(&c.usChoke, 0, 1) {
 		log.Debugf("choke peer %s", c.id.String())
 		c.Send(common.NewWireMessage(common.Choke, nil))
-		c.usChoke = true
+	} else {
+		log.Warnf("multiple chokes sent to %s", c.id.String())
 	}
 }
 
 // send unchoke
 func (c *PeerConn) Unchoke() {
-	if c.usChoke {
+	if atomic.CompareAndSwapInt32(&c.usChoke, 1, 0) {
 		log.Debugf("unchoke peer %s", c.id.String())
 		c.Send(common.NewWireMessage(common.UnChoke, nil))
-		c.usChoke = false
 	}
 }
 
 func (c *PeerConn) gotDownload(p *common.PieceData) {
 	c.access.Lock()
 	var downloading []*common.PieceRequest
+	got := false
 	for idx := range c.downloading {
 		if c.downloading[idx].Matches(p) {
-			c.t.pt.handlePieceData(p)
+			c.pipeline.blockReceived(c.downloading[idx], c.rx.Mean(), time.Now())
+			c.t.gotData(time.Now())
+			c.t.pt.handlePieceData(p, c)
+			got = true
 		} else {
 			downloading = append(downloading, c.downloading[idx])
 		}
 	}
 	c.downloading = downloading
 	c.access.Unlock()
+	if got && c.t.pt.InEndgame() {
+		c.t.cancelDuplicates(c, p)
+	}
+}
+
+// cancel our request for a block we already got from another peer
+func (c *PeerConn) cancelObtained(p *common.PieceData) {
+	c.access.Lock()
+	var downloading []*common.PieceRequest
+	for _, r := range c.downloading {
+		if r.Matches(p) {
+			log.Debugf("cancel duplicate request to %s for %d %d %d", c.id.String(), r.Index, r.Begin, r.Length)
+			c.pipeline.requestCanceled(r)
+			c.Send(r.Cancel())
+		} else {
+			downloading = append(downloading, r)
+		}
+	}
+	c.downloading = downloading
+	c.access.Unlock()
+}
+
+// return true if we have a pending request to this peer equal to r
+func (c *PeerConn) isDownloading(r *common.PieceRequest) (has bool) {
+	c.access.Lock()
+	for _, req := range c.downloading {
+		if req.Equals(r) {
+			has = true
+			break
+		}
+	}
+	c.access.Unlock()
+	return
 }
 
 func (c *PeerConn) cancelDownload(req *common.PieceRequest) {
@@ -289,6 +370,7 @@ func (c *PeerConn) cancelDownload(req *common.PieceRequest) {
 	var downloading []*common.PieceRequest
 	for _, r := range c.downloading {
 		if r.Equals(req) {
+			c.pipeline.requestCanceled(r)
 			c.t.pt.canceledRequest(r)
 		} else {
 			downloading = append(downloading, r)
@@ -307,6 +389,7 @@ func (c *PeerConn) numDownloading() int {
 
 func (c *PeerConn) queueDownload(req *common.PieceRequest) {
 	c.lastRequest = req
+	c.pipeline.requestSent(req, time.Now())
 	c.access.Lock()
 	c.downloading = append(c.downloading, req)
 	c.access.Unlock()
@@ -317,6 +400,7 @@ func (c *PeerConn) queueDownload(req *common.PieceRequest) {
 func (c *PeerConn) clearDownloading() {
 	c.access.Lock()
 	for _, r := range c.downloading {
+		c.pipeline.requestCanceled(r)
 		c.Send(r.Cancel())
 		c.t.pt.canceledRequest(r)
 	}
@@ -340,7 +424,22 @@ func (c *PeerConn) RemoteChoking() bool {
 
 // return true if we are choking the remote peer otherwise return false
 func (c *PeerConn) Chocking() bool {
-	return c.usChoke
+	return atomic.LoadInt32(&c.usChoke) == 1
+}
+
+// RemoteInterested returns true if the remote peer wants data from us
+func (c *PeerConn) RemoteInterested() bool {
+	return atomic.LoadInt32(&c.peerInterested) == 1
+}
+
+// returns true if this connection is closing or closed
+func (c *PeerConn) isClosing() bool {
+	return atomic.LoadInt32(&c.closing) == 1
+}
+
+// mark this connection as closing, returns false if it already was
+func (c *PeerConn) setClosing() bool {
+	return atomic.SwapInt32(&c.closing, 1) == 0
 }
 
 func (c *PeerConn) remoteUnchoke() {
@@ -360,31 +459,38 @@ func (c *PeerConn) remoteChoke() {
 	log.Debugf("%s choked us", c.id.String())
 }
 
+// cancel all pending downloads except for pieces the remote peer allows us to fetch while choked
 func (c *PeerConn) cancelPendingDownloads() {
 	c.access.Lock()
+	var downloading []*common.PieceRequest
 	for _, r := range c.downloading {
-		c.t.pt.canceledRequest(r)
-		c.Send(r.Cancel())
+		if c.theirAllowedFast[r.Index] {
+			downloading = append(downloading, r)
+		} else {
+			c.pipeline.requestCanceled(r)
+			c.t.pt.canceledRequest(r)
+			c.Send(r.Cancel())
+		}
 	}
-	c.downloading = []*common.PieceRequest{}
+	c.downloading = downloading
 	c.access.Unlock()
 }
 
 func (c *PeerConn) markInterested() {
-	c.peerInterested = true
+	atomic.StoreInt32(&c.peerInterested, 1)
 	log.Debugf("%s is interested", c.id.String())
+	c.t.onPeerInterested(c)
 }
 
 func (c *PeerConn) markNotInterested() {
-	c.peerInterested = false
+	atomic.StoreInt32(&c.peerInterested, 0)
 	log.Debugf("%s is not interested", c.id.String())
 }
 
 func (c *PeerConn) Close() {
-	if c.closing {
+	if !c.setClosing() {
 		return
 	}
-	c.closing = true
 
 	if c.close != nil {
 		c.close <- true
@@ -392,7 +498,7 @@ func (c *PeerConn) Close() {
 }
 
 func (c *PeerConn) doClose() {
-	c.closing = true
+	c.setClosing()
 	c.send = nil
 	c.recv = nil
 	c.close = nil
@@ -403,6 +509,9 @@ func (c *PeerConn) doClose() {
 	c.downloading = nil
 	c.access.Unlock()
 	log.Debugf("%s closing connection", c.id.String())
+	if c.t.xdht != nil {
+		c.t.xdht.RemoveNode(dhtNode{c})
+	}
 	if c.inbound {
 		c.t.removeIBConn(c)
 	} else {
@@ -410,11 +519,12 @@ func (c *PeerConn) doClose() {
 	}
 	c.ticker.Stop()
 	c.c.Close()
+	close(c.writeQueue)
 }
 
 // run read loop
 func (c *PeerConn) runReader() {
-	err := common.ReadWireMessages(c.c, c.queueRecv, c.readBuff[:])
+	err := common.ReadWireMessages(c.r, c.queueRecv, c.readBuff[:])
 	if err != nil {
 		log.Debugf("%s PeerConn() reader failed: %s", c.id.String(), err.Error())
 	}
@@ -437,10 +547,14 @@ func (c *PeerConn) cancelPiece(idx uint32) {
 
 func (c *PeerConn) checkInterested() {
 	bf := c.t.Bitfield()
-	if bf != nil && c.bf != nil && bf.Inverted().AND(c.bf).AnySet() {
-		c.usInterested = true
-	} else {
-		c.usInterested = false
+	c.usInterested = false
+	if bf != nil && c.bf != nil {
+		missing := bf.Inverted().AND(c.bf)
+		wanted := c.t.wantedBitfield()
+		if missing != nil && wanted != nil {
+			missing = missing.AND(wanted)
+		}
+		c.usInterested = missing != nil && missing.AnySet()
 	}
 
 	if c.usInterested != c.peerUsInterested {
@@ -497,26 +611,37 @@ func (c *PeerConn) inboundMessage(msg common.WireMessage) (err error) {
 	}
 	msgid := msg.MessageID()
 	log.Debugf("%s from %s", msgid.String(), c.id.String())
-	if msgid == common.BitField {
+	if msgid == common.BitField || msgid == common.HaveAll || msgid == common.HaveNone {
+		if msgid != common.BitField && !c.SupportsFast() {
+			log.Warnf("%s sent %s without fast extension, closing", c.id.String(), msgid.String())
+			c.Close()
+			return
+		}
 		isnew := false
 		if c.bf == nil {
 			isnew = true
 		}
 		if c.t.Ready() {
-			c.bf = bittorrent.NewBitfield(c.t.MetaInfo().Info.NumPieces(), msg.Payload())
+			c.bf = bittorrent.NewBitfield(c.t.MetaInfo().Info.NumPieces(), nil)
+			if msgid == common.BitField {
+				c.bf = bittorrent.NewBitfield(c.bf.Length, msg.Payload())
+			} else if msgid == common.HaveAll {
+				c.bf.Fill()
+			}
 			log.Debugf("got bitfield from %s", c.id.String())
 			c.checkInterested()
 			if isnew {
-				c.Unchoke()
 				if c.reserved.Has(bittorrent.Extension) {
 					c.Send(c.ourOpts.ToWireMessage())
 				}
 			}
 		} else {
 			log.Debugf("%s requested bitfield before we were ready", c.id.String())
-			// empty bitfield
-			bits := make([]byte, len(msg.Payload()))
-			c.Send(common.NewWireMessage(common.BitField, bits))
+			if !c.SupportsFast() {
+				// empty bitfield, fast peers got a HaveNone already
+				bits := make([]byte, len(msg.Payload()))
+				c.Send(common.NewWireMessage(common.BitField, bits))
+			}
 			c.Send(c.ourOpts.ToWireMessage())
 			c.metaInfoDownload()
 		}
@@ -559,6 +684,7 @@ func (c *PeerConn) inboundMessage(msg common.WireMessage) (err error) {
 		if c.bf != nil {
 			c.bf.Set(idx)
 			c.checkInterested()
+			c.t.superSeedSawHave(c, idx)
 		} else {
 			if c.t.Ready() {
 				// The initial bitfield message is optional. However, we currently require it.
@@ -575,6 +701,12 @@ func (c *PeerConn) inboundMessage(msg common.WireMessage) (err error) {
 		// TODO: check validity
 		//c.t.pt.canceledRequest(msg.GetPieceRequest())
 	}
+	if c.SupportsFast() {
+		c.handleFastMessage(msgid, msg)
+	}
+	if c.SupportsV2() {
+		c.handleV2Message(msgid, msg)
+	}
 	if msgid == common.Extended && c.reserved.Has(bittorrent.Extension) {
 		// handle extended options
 		opts, err := extensions.FromWireMessage(msg)
@@ -591,6 +723,9 @@ func (c *PeerConn) handleLNPEX(m interface{}) {
 	var peers []common.Peer
 	pex, ok := m.(map[string]interface{})
 	if ok {
+		if !c.acceptPEX() {
+			return
+		}
 		added, ok := pex["addedln"]
 		if ok {
 			l, ok := added.([]interface{})
@@ -631,7 +766,7 @@ func (c *PeerConn) handleLNPEX(m interface{}) {
 				}
 			}
 		}
-		c.t.addPeers(peers)
+		c.t.addPeers(c.t.filterPEXPeers(peers))
 	} else {
 		log.Errorf("%s invalid pex message: %q", c.id.String(), m)
 	}
@@ -642,38 +777,222 @@ func (c *PeerConn) handleI2PPEX(m interface{}) {
 
 	pex, ok := m.(map[string]interface{})
 	if ok {
-		var added interface{}
-		added, ok = pex["added"]
+		if !c.acceptPEX() {
+			return
+		}
+		added, _ := pex["added"].(string)
+		addedf, _ := pex["added.f"].(string)
+		c.handlePEXAdded(added, addedf, i2pPEXPeerLen, decodeI2PPEXPeer)
+	} else {
+		log.Errorf("%s invalid pex message: %q", c.id.String(), m)
+	}
+}
+
+// handles an inbound BEP 11 pex message with compact lokinet peers
+func (c *PeerConn) handleUTPEX(m interface{}) {
+	pex, ok := m.(map[string]interface{})
+	if ok {
+		if !c.acceptPEX() {
+			return
+		}
+		added, _ := pex["added"].(string)
+		addedf, _ := pex["added.f"].(string)
+		c.handlePEXAdded(added, addedf, lokiPEXPeerLen, decodeLokiPEXPeer)
+	} else {
+		log.Errorf("%s invalid pex message: %q", c.id.String(), m)
+	}
+}
+
+// handle the compact added peers and their flags of an inbound PEX message payload
+func (c *PeerConn) handlePEXAdded(added, addedf string, size int, decode func(string) (common.Peer, bool)) {
+	peers := decodePEXPeers(added, addedf, size, c.t.Done(), decode)
+	peers = c.t.filterPEXPeers(peers)
+	log.Infof("%s got %d peers for %s", c.id.String(), len(peers), c.t.st.Infohash().Hex())
+	c.t.addPeers(peers)
+}
+
+// SupportsFast returns true if we negotiated the fast extension with this peer
+func (c *PeerConn) SupportsFast() bool {
+	return c.reserved.Has(bittorrent.Fast)
+}
+
+// handle wire messages from the fast extension
+func (c *PeerConn) handleFastMessage(msgid common.WireMessageType, msg common.WireMessage) {
+	switch msgid {
+	case common.Reject:
+		r := msg.GetPieceRequest()
+		if r != nil {
+			log.Debugf("%s rejected request for %d %d %d", c.id.String(), r.Index, r.Begin, r.Length)
+			c.cancelDownload(r)
+			// don't ask them again right away
+			c.nextPieceRequest = time.Now().Add(time.Second)
+		}
+	case common.AllowedFast:
+		idx, ok := msg.GetPieceIndex()
 		if ok {
-			c.handlePEXAdded(added)
+			c.access.Lock()
+			c.theirAllowedFast[idx] = true
+			c.access.Unlock()
 		}
-		added, ok = pex["added.f"]
+	case common.Suggest:
+		idx, ok := msg.GetPieceIndex()
 		if ok {
-			c.handlePEXAddedf(added)
+			c.addSuggested(idx)
 		}
+	}
+}
+
+// remember a piece the peer suggested we download
+func (c *PeerConn) addSuggested(idx uint32) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if len(c.suggested) >= maxSuggestedPieces {
+		return
+	}
+	for _, s := range c.suggested {
+		if s == idx {
+			return
+		}
+	}
+	c.suggested = append(c.suggested, idx)
+}
+
+// get the first suggested piece we did not try yet
+func (c *PeerConn) firstSuggested() (idx uint32, ok bool) {
+	c.access.Lock()
+	if len(c.suggested) > 0 {
+		idx = c.suggested[0]
+		ok = true
+	}
+	c.access.Unlock()
+	return
+}
+
+// forget a suggested piece that is done or not available
+func (c *PeerConn) dropSuggested(idx uint32) {
+	c.access.Lock()
+	if len(c.suggested) > 0 && c.suggested[0] == idx {
+		c.suggested = c.suggested[1:]
+	}
+	c.access.Unlock()
+}
+
+// return true if the peer lets us request this piece while it chokes us
+func (c *PeerConn) theyAllowFast(idx uint32) (allowed bool) {
+	c.access.Lock()
+	allowed = c.theirAllowedFast[idx]
+	c.access.Unlock()
+	return
+}
+
+// return true if we let the peer request this piece while we choke it
+func (c *PeerConn) weAllowFast(idx uint32) (allowed bool) {
+	c.access.Lock()
+	allowed = c.ourAllowedFast[idx]
+	c.access.Unlock()
+	return
+}
+
+// send our bitfield, as HaveAll or HaveNone if the peer supports the fast extension
+func (c *PeerConn) sendBitfield() {
+	if !c.t.Ready() {
+		if c.SupportsFast() {
+			c.Send(common.NewHaveNone())
+		}
+		return
+	}
+	if c.t.superSeedHide(c) {
+		// pretend to be a leecher and hand out pieces one at a time
+		if c.SupportsFast() {
+			c.Send(common.NewHaveNone())
+		} else {
+			c.Send(bittorrent.NewBitfield(c.t.Bitfield().Length, nil).ToWireMessage())
+		}
+		c.t.superSeedOffer(c)
+		return
+	}
+	bf := c.t.Bitfield()
+	if !c.SupportsFast() {
+		c.Send(bf.ToWireMessage())
+		return
+	}
+	if bf.Completed() {
+		c.Send(common.NewHaveAll())
+	} else if !bf.AnySet() {
+		c.Send(common.NewHaveNone())
 	} else {
-		log.Errorf("%s invalid pex message: %q", c.id.String(), m)
+		c.Send(bf.ToWireMessage())
+	}
+	for _, idx := range bittorrent.AllowedFastSet(c.c.RemoteAddr(), c.t.Infohash(), bf.Length, bittorrent.AllowedFastSetSize) {
+		c.access.Lock()
+		c.ourAllowedFast[idx] = true
+		c.access.Unlock()
+		if bf.Has(idx) {
+			c.Send(common.NewAllowedFast(idx))
+		}
 	}
 }
 
-// handle inbound PEX message payload
-func (c *PeerConn) handlePEXAdded(m interface{}) {
-	var peers []common.Peer
-	msg := m.(string)
-	l := len(msg) / 32
-	log.Infof("%s got %d peers for %s", c.id.String(), l, c.t.st.Infohash().Hex())
-	for l > 0 {
-		var p common.Peer
-		// TODO: bounds check
-		copy(p.Compact[:], msg[(l-1)*32:l*32])
-		l--
-		peers = append(peers, p)
+// reject a piece request, dropped silently if the peer does not support the fast extension
+func (c *PeerConn) rejectRequest(r *common.PieceRequest) {
+	if c.SupportsFast() {
+		c.Send(r.Reject())
 	}
-	c.t.addPeers(peers)
 }
 
-func (c *PeerConn) handlePEXAddedf(m interface{}) {
-	// TODO: implement this
+// bitfield of pieces we can request while this peer is choking us
+func (c *PeerConn) allowedFastBitfield() *bittorrent.Bitfield {
+	bf := bittorrent.NewBitfield(c.bf.Length, nil)
+	c.access.Lock()
+	for idx := range c.theirAllowedFast {
+		if c.bf.Has(idx) {
+			bf.Set(idx)
+		}
+	}
+	c.access.Unlock()
+	return bf
+}
+
+// return true if the peer lets us request any piece while it chokes us
+func (c *PeerConn) anyAllowedFast() (has bool) {
+	c.access.Lock()
+	has = len(c.theirAllowedFast) > 0
+	c.access.Unlock()
+	return
+}
+
+// get the next piece request for this peer, suggested pieces go first
+// while we are choked only allowed fast pieces are considered
+func (c *PeerConn) nextRequest() *common.PieceRequest {
+	remote := c.bf
+	last := c.lastRequest
+	if c.RemoteChoking() {
+		remote = c.allowedFastBitfield()
+		if last != nil && !remote.Has(last.Index) {
+			last = nil
+		}
+	}
+	for {
+		idx, ok := c.firstSuggested()
+		if !ok {
+			break
+		}
+		hint := &common.PieceRequest{Index: idx}
+		r := c.t.pt.NextRequest(remote, hint)
+		if r != nil && r.Index == hint.Index {
+			return r
+		}
+		// suggested piece is done or not available
+		c.dropSuggested(idx)
+		if r != nil {
+			return r
+		}
+	}
+	r := c.t.pt.NextRequest(remote, last)
+	if r == nil {
+		r = c.t.pt.EndgameRequest(remote, c.isDownloading)
+	}
+	return r
 }
 
 func (c *PeerConn) SupportsI2PPEX() bool {
@@ -684,6 +1003,10 @@ func (c *PeerConn) SupportsLNPEX() bool {
 	return c.theirOpts.LNPEX()
 }
 
+func (c *PeerConn) SupportsUTPEX() bool {
+	return c.theirOpts.UTPEX()
+}
+
 func (c *PeerConn) sendI2PPEX(connected, disconnected []byte) {
 	if len(connected) > 0 || len(disconnected) > 0 {
 		log.Debugf("sending i2p pex message to %s", c.id.String())
@@ -693,6 +1016,15 @@ func (c *PeerConn) sendI2PPEX(connected, disconnected []byte) {
 	}
 }
 
+func (c *PeerConn) sendUTPEX(added, addedf, dropped []byte) {
+	if len(added) > 0 || len(dropped) > 0 {
+		log.Debugf("sending ut_pex message to %s", c.id.String())
+		id := c.theirOpts.Extensions[extensions.UTPeerExchange.String()]
+		msg := extensions.NewUTPEX(uint8(id), added, addedf, dropped)
+		c.Send(msg.ToWireMessage())
+	}
+}
+
 func (c *PeerConn) sendLNPEX(connected, disconnected []common.Peer) {
 	log.Debugf("sending lokinet pex message to %s", c.id.String())
 	id := c.theirOpts.Extensions[extensions.LokinetPeerExchange.String()]
@@ -707,6 +1039,7 @@ func (c *PeerConn) handleExtendedOpts(opts extensions.Message) {
 		for k, v := range opts.Extensions {
 			log.Debugf("%s has extension %s %d", c.id.String(), k, v)
 		}
+		c.addDHTNode()
 	} else {
 		// lookup the extension number
 		ext, ok := c.ourOpts.Lookup(opts.ID)
@@ -714,13 +1047,19 @@ func (c *PeerConn) handleExtendedOpts(opts extensions.Message) {
 			if ext == extensions.I2PPeerExchange.String() {
 				log.Debugf("received I2P pex message from %s", c.id.String())
 				c.handleI2PPEX(opts.Payload)
+			} else if ext == extensions.UTPeerExchange.String() {
+				log.Debugf("received ut_pex message from %s", c.id.String())
+				c.handleUTPEX(opts.Payload)
 			} else if ext == extensions.LokinetPeerExchange.String() {
 				log.Debugf("received lokinet pex message from %s", c.id.String())
 				c.handleLNPEX(opts.Payload)
+			} else if ext == extensions.I2PDHT.String() {
+				log.Debugf("received i2p dht port from %s", c.id.String())
+				c.handleI2PDHT(opts.Payload)
 			} else if ext == extensions.XDHT.String() {
 				// xdht message
 				log.Debugf("received xdht message from %s", c.id.String())
-				err := c.t.xdht.HandleMessage(opts, c.id)
+				err := c.t.xdht.HandleMessage(opts.PayloadRaw, dhtNode{c})
 				if err != nil {
 					log.Warnf("error handling xdht message from %s: %s", c.id.String(), err.Error())
 				}
@@ -816,26 +1155,27 @@ func (c *PeerConn) tickDownload() {
 	if !c.runDownload {
 		return
 	}
+	c.t.requestPieceLayers(c)
 	if c.t.Done() {
 		// done downloading
 		if c.Done != nil {
 			c.Done()
 			c.Done = nil
 		}
-	} else if c.usInterested && !c.closing {
-		if c.RemoteChoking() {
+	} else if c.usInterested && !c.isClosing() {
+		if c.RemoteChoking() && !c.anyAllowedFast() {
 			//log.Debugf("will not download this tick, %s is choking", c.id.String())
 			return
 		}
 		// pending request
 		p := c.numDownloading()
-		if p >= c.MaxParalellRequests {
+		if p >= c.RequestWindow() {
 			//log.Debugf("max parallel reached for %s", c.id.String())
 			return
 		}
 		now := time.Now()
 		if now.After(c.nextPieceRequest) {
-			r := c.t.pt.NextRequest(c.bf, c.lastRequest)
+			r := c.nextRequest()
 			if r != nil {
 				c.queueDownload(r)
 			} else {
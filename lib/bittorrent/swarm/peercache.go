@@ -0,0 +1,261 @@
+package swarm
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/storage"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// how long we keep a peer we have not connected to
+const peerCacheMaxAge = time.Hour * 24 * 7
+
+// peers we never connected to are dropped after this many failures in a row
+const peerCacheMaxFailures = 10
+
+// most peers we keep per torrent
+const peerCacheSize = 200
+
+// how long we wait before redialing a peer after it failed or went away
+const peerCacheRetryInterval = time.Minute
+
+// longest we wait before redialing a peer that keeps failing
+const peerCacheMaxRetryInterval = time.Hour
+
+// how many cached peers we dial at once
+const peerCacheDialers = 4
+
+// how often we save known peers
+const peerCacheSaveInterval = time.Minute * 5
+
+// a peer we know from before with its redial state
+type cachedPeer struct {
+	storage.KnownPeer
+	// failures since we last connected
+	failStreak int64
+	nextDial   time.Time
+	dialing    bool
+}
+
+// peers of a torrent we connected to before, saved in the metadata dir
+type peerCache struct {
+	mtx      sync.Mutex
+	peers    map[string]*cachedPeer
+	dirty    bool
+	lastSave time.Time
+}
+
+// backoff before dialing a peer again after it failed n times in a row
+func peerCacheBackoff(n int64) time.Duration {
+	backoff := peerCacheRetryInterval
+	for n > 1 && backoff < peerCacheMaxRetryInterval {
+		backoff *= 2
+		n--
+	}
+	if backoff > peerCacheMaxRetryInterval {
+		backoff = peerCacheMaxRetryInterval
+	}
+	return backoff
+}
+
+// return true if a known peer is not worth keeping
+func (cp *cachedPeer) stale(now time.Time) bool {
+	if cp.Successes == 0 {
+		return cp.failStreak >= peerCacheMaxFailures
+	}
+	return now.Sub(time.Unix(cp.LastSeen, 0)) > peerCacheMaxAge
+}
+
+// drop stale peers and the least recently seen ones over the size limit
+func (pc *peerCache) prune(now time.Time) {
+	var keep []*cachedPeer
+	for addr, cp := range pc.peers {
+		if cp.stale(now) {
+			delete(pc.peers, addr)
+			pc.dirty = true
+		} else {
+			keep = append(keep, cp)
+		}
+	}
+	if len(keep) <= peerCacheSize {
+		return
+	}
+	sort.Slice(keep, func(i, j int) bool {
+		return keep[i].LastSeen > keep[j].LastSeen
+	})
+	for _, cp := range keep[peerCacheSize:] {
+		delete(pc.peers, cp.Addr)
+	}
+	pc.dirty = true
+}
+
+// load known peers from storage and schedule them for dialing
+func (t *Torrent) loadPeerCache() {
+	peers, err := t.st.LoadPeers()
+	if err != nil {
+		log.Warnf("failed to load known peers for %s: %s", t.Name(), err.Error())
+	}
+	now := time.Now()
+	t.peerCache.mtx.Lock()
+	t.peerCache.peers = make(map[string]*cachedPeer)
+	for _, p := range peers {
+		if p.Addr == "" {
+			continue
+		}
+		t.peerCache.peers[p.Addr] = &cachedPeer{
+			KnownPeer: p,
+			nextDial:  now,
+		}
+	}
+	t.peerCache.prune(now)
+	t.peerCache.lastSave = now
+	n := len(t.peerCache.peers)
+	t.peerCache.mtx.Unlock()
+	if n > 0 {
+		log.Infof("loaded %d known peers for %s", n, t.Name())
+	}
+}
+
+// save known peers to storage if they changed
+func (t *Torrent) savePeerCache() (err error) {
+	var peers []storage.KnownPeer
+	t.peerCache.mtx.Lock()
+	if !t.peerCache.dirty || t.peerCache.peers == nil {
+		t.peerCache.mtx.Unlock()
+		return
+	}
+	t.peerCache.prune(time.Now())
+	for _, cp := range t.peerCache.peers {
+		peers = append(peers, cp.KnownPeer)
+	}
+	t.peerCache.dirty = false
+	t.peerCache.lastSave = time.Now()
+	t.peerCache.mtx.Unlock()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LastSeen > peers[j].LastSeen
+	})
+	err = t.st.SavePeers(peers)
+	if err != nil {
+		log.Warnf("failed to save known peers for %s: %s", t.Name(), err.Error())
+	}
+	return
+}
+
+// record the outcome of connecting to a peer
+// peers we never connected to are only remembered once a connection works
+func (t *Torrent) recordPeer(a net.Addr, id common.PeerID, connected bool) {
+	now := time.Now()
+	addr := a.String()
+	t.peerCache.mtx.Lock()
+	defer t.peerCache.mtx.Unlock()
+	if t.peerCache.peers == nil {
+		return
+	}
+	cp := t.peerCache.peers[addr]
+	if cp == nil {
+		if !connected {
+			return
+		}
+		cp = &cachedPeer{
+			KnownPeer: storage.KnownPeer{
+				Addr: addr,
+			},
+		}
+		t.peerCache.peers[addr] = cp
+	}
+	if connected {
+		cp.Successes++
+		cp.LastSeen = now.Unix()
+		cp.ID = string(id[:])
+		cp.failStreak = 0
+		cp.nextDial = now.Add(peerCacheRetryInterval)
+	} else {
+		cp.Failures++
+		cp.failStreak++
+		cp.nextDial = now.Add(peerCacheBackoff(cp.failStreak))
+	}
+	t.peerCache.dirty = true
+}
+
+// return true if we have a connection to a peer by address
+func (t *Torrent) hasConnTo(addr string) (has bool) {
+	t.connMtx.Lock()
+	_, has = t.obconns[addr]
+	if !has {
+		_, has = t.ibconns[addr]
+	}
+	t.connMtx.Unlock()
+	return
+}
+
+// redial known peers that are due and save them now and then
+func (t *Torrent) tickPeerCache() {
+	now := time.Now()
+	var dial []storage.KnownPeer
+	wantPeers := !t.closing && t.NeedsPeers() && !t.Done()
+	t.peerCache.mtx.Lock()
+	if t.peerCache.peers == nil {
+		t.peerCache.mtx.Unlock()
+		return
+	}
+	save := t.peerCache.dirty && now.Sub(t.peerCache.lastSave) > peerCacheSaveInterval
+	if wantPeers {
+		dialing := 0
+		for _, cp := range t.peerCache.peers {
+			if cp.dialing {
+				dialing++
+			}
+		}
+		for _, cp := range t.peerCache.peers {
+			if dialing >= peerCacheDialers {
+				break
+			}
+			if cp.dialing || now.Before(cp.nextDial) || t.hasConnTo(cp.Addr) {
+				continue
+			}
+			cp.dialing = true
+			dialing++
+			dial = append(dial, cp.KnownPeer)
+		}
+	}
+	t.peerCache.mtx.Unlock()
+	for _, p := range dial {
+		go t.dialKnownPeer(p)
+	}
+	if save {
+		t.savePeerCache()
+	}
+}
+
+// dial a known peer once, DialPeer records how it went
+func (t *Torrent) dialKnownPeer(p storage.KnownPeer) {
+	var peer common.Peer
+	host, port, err := net.SplitHostPort(p.Addr)
+	if err == nil {
+		peer.IP = host
+		peer.Port, _ = strconv.Atoi(port)
+	} else {
+		peer.IP = p.Addr
+	}
+	copy(peer.ID[:], p.ID)
+	a, err := peer.Resolve(t.Network())
+	if err == nil {
+		log.Debugf("dialing known peer %s for %s", p.Addr, t.Name())
+		err = t.DialPeer(a, peer.ID)
+	}
+	t.peerCache.mtx.Lock()
+	if cp := t.peerCache.peers[p.Addr]; cp != nil {
+		cp.dialing = false
+		if err != nil && !cp.nextDial.After(time.Now()) {
+			// could not resolve or not recorded, back off anyways
+			cp.failStreak++
+			cp.nextDial = time.Now().Add(peerCacheBackoff(cp.failStreak))
+		}
+	}
+	t.peerCache.mtx.Unlock()
+}
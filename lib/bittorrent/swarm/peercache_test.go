@@ -0,0 +1,63 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/network/inet"
+	"github.com/majestrate/XD/lib/storage"
+	"testing"
+	"time"
+)
+
+func TestPeerCacheBackoff(t *testing.T) {
+	if peerCacheBackoff(1) != peerCacheRetryInterval {
+		t.Fatalf("first backoff is %s", peerCacheBackoff(1))
+	}
+	if peerCacheBackoff(3) != peerCacheRetryInterval*4 {
+		t.Fatalf("third backoff is %s", peerCacheBackoff(3))
+	}
+	if peerCacheBackoff(100) != peerCacheMaxRetryInterval {
+		t.Fatalf("backoff is not capped: %s", peerCacheBackoff(100))
+	}
+}
+
+func TestPeerCache(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize, 4)
+	now := time.Now()
+	st.peers = []storage.KnownPeer{
+		{Addr: "10.0.0.1:6881", LastSeen: now.Unix(), Successes: 3},
+		{Addr: "10.0.0.2:6881", LastSeen: now.Add(-peerCacheMaxAge * 2).Unix(), Successes: 1},
+		{Addr: "10.0.0.3:6881", LastSeen: now.Unix(), Successes: 1, Failures: 40},
+	}
+	tr := newTorrent(st, nil)
+	tr.loadPeerCache()
+	if len(tr.peerCache.peers) != 2 || tr.peerCache.peers["10.0.0.2:6881"] != nil {
+		t.Fatal("stale peer was not pruned")
+	}
+
+	var id common.PeerID
+	id[0] = 1
+	tr.recordPeer(inet.NewAddr("10.0.0.4", "6881"), id, false)
+	if tr.peerCache.peers["10.0.0.4:6881"] != nil {
+		t.Fatal("remembered peer we never connected to")
+	}
+	tr.recordPeer(inet.NewAddr("10.0.0.4", "6881"), id, true)
+	tr.recordPeer(inet.NewAddr("10.0.0.1", "6881"), id, false)
+	tr.recordPeer(inet.NewAddr("10.0.0.1", "6881"), id, false)
+	cp := tr.peerCache.peers["10.0.0.1:6881"]
+	if cp.Failures != 2 || cp.failStreak != 2 || cp.nextDial.Before(now.Add(peerCacheBackoff(2))) {
+		t.Fatalf("bad failed peer state %+v", cp)
+	}
+
+	err := tr.savePeerCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.peers) != 3 {
+		t.Fatalf("saved %d peers", len(st.peers))
+	}
+	for _, p := range st.peers {
+		if p.Addr == "10.0.0.4:6881" && (p.Successes != 1 || p.ID != string(id[:])) {
+			t.Fatalf("bad saved peer %+v", p)
+		}
+	}
+}
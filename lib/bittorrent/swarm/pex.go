@@ -1,37 +1,229 @@
 package swarm
 
 import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/network/i2p"
+	"github.com/majestrate/XD/lib/network/inet"
 	"github.com/majestrate/XD/lib/sync"
-	"net"
 )
 
+// most peers we put in or take from one pex message
+const pexMaxPeers = 50
+
+// least time between pex messages we take from one peer, a little under the minute BEP 11 asks for
+const pexMinInterval = time.Second * 50
+
+// size of a compact i2p peer in pex, a destination hash
+const i2pPEXPeerLen = 32
+
+// size of a compact lokinet peer in pex, a .loki key and a port
+const lokiPEXPeerLen = inet.LokiKeyLen + 2
+
 // PEXSwarmState manages PeerExchange state on a bittorrent swarm
 type PEXSwarmState struct {
 	m sync.Map
 }
 
-func (p *PEXSwarmState) onNewPeer(addr net.Addr) {
-	p.m.Store(addr.String(), true)
+// what we know about a peer for pex
+type pexPeer struct {
+	connected bool
+	// we dialed them so they take inbound connections
+	reachable bool
+}
+
+func (p *PEXSwarmState) onNewPeer(addr net.Addr, reachable bool) {
+	p.m.Store(addr.String(), pexPeer{connected: true, reachable: reachable})
 }
 
 func (p *PEXSwarmState) onPeerDisconnected(addr net.Addr) {
-	p.m.Store(addr.String(), false)
+	var peer pexPeer
+	if v, ok := p.m.Load(addr.String()); ok {
+		peer = v.(pexPeer)
+	}
+	peer.connected = false
+	p.m.Store(addr.String(), peer)
 }
 
 // PopDestHashList gets list of i2p destination hashes of currently active and disconnected peers
 func (p *PEXSwarmState) PopDestHashLists() (connected, disconnected []byte) {
 	p.m.Range(func(k, v interface{}) bool {
 		addr := k.(string)
-		active := v.(bool)
+		peer := v.(pexPeer)
 		h := i2p.I2PAddr(addr).Base32Addr()
-		if active {
-			connected = append(connected, h[:]...)
+		if peer.connected {
+			if len(connected) < pexMaxPeers*i2pPEXPeerLen {
+				connected = append(connected, h[:]...)
+			}
 		} else {
-			disconnected = append(disconnected, h[:]...)
+			if len(disconnected) < pexMaxPeers*i2pPEXPeerLen {
+				disconnected = append(disconnected, h[:]...)
+			}
 			p.m.Delete(k)
 		}
-		return false
+		return true
 	})
 	return
 }
+
+// PopLokiPeerLists gets compact lokinet peers we can tell others to connect to with their flags and peers that disconnected
+// only peers we dialed are added because the port of inbound peers is not one they listen on
+func (p *PEXSwarmState) PopLokiPeerLists(flags func(addr string) byte) (added, addedf, dropped []byte) {
+	p.m.Range(func(k, v interface{}) bool {
+		addr := k.(string)
+		peer := v.(pexPeer)
+		compact, ok := encodeLokiPEXPeer(addr)
+		if peer.connected {
+			if ok && peer.reachable && len(addedf) < pexMaxPeers {
+				added = append(added, compact...)
+				addedf = append(addedf, flags(addr)|extensions.PEXReachable)
+			}
+		} else {
+			if ok && len(dropped) < pexMaxPeers*lokiPEXPeerLen {
+				dropped = append(dropped, compact...)
+			}
+			p.m.Delete(k)
+		}
+		return true
+	})
+	return
+}
+
+// encode a name.loki:port address as a compact lokinet peer
+func encodeLokiPEXPeer(addr string) (compact []byte, ok bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	key, err := inet.DecodeLokiAddr(host)
+	if err != nil {
+		return
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return
+	}
+	compact = make([]byte, lokiPEXPeerLen)
+	copy(compact, key[:])
+	binary.BigEndian.PutUint16(compact[inet.LokiKeyLen:], uint16(n))
+	ok = true
+	return
+}
+
+// decode a compact lokinet peer
+func decodeLokiPEXPeer(compact string) (p common.Peer, ok bool) {
+	var key inet.LokiKey
+	copy(key[:], compact[:inet.LokiKeyLen])
+	p.IP = key.String()
+	p.Port = int(binary.BigEndian.Uint16([]byte(compact[inet.LokiKeyLen:])))
+	ok = p.Port > 0
+	return
+}
+
+// decode a compact i2p peer
+func decodeI2PPEXPeer(compact string) (p common.Peer, ok bool) {
+	copy(p.Compact[:], compact)
+	var zero i2p.Base32Addr
+	ok = p.Compact != zero
+	return
+}
+
+// decode the added peers of a pex message made of fixed size compact entries with optional flags for each peer
+// peers that take inbound connections come first, seeds are skipped if skipSeeds is set
+// the whole list is rejected if it is malformed
+func decodePEXPeers(added, addedf string, size int, skipSeeds bool, decode func(string) (common.Peer, bool)) (peers []common.Peer) {
+	if len(added)%size != 0 {
+		log.Warnf("pex peer list has bad length %d", len(added))
+		return
+	}
+	count := len(added) / size
+	if len(addedf) != count {
+		// flags are optional
+		addedf = ""
+	}
+	var unreachable []common.Peer
+	for idx := 0; idx < count; idx++ {
+		p, ok := decode(added[idx*size : (idx+1)*size])
+		if !ok {
+			continue
+		}
+		if addedf == "" {
+			peers = append(peers, p)
+			continue
+		}
+		flags := addedf[idx]
+		if skipSeeds && flags&extensions.PEXSeed != 0 {
+			continue
+		}
+		if flags&extensions.PEXReachable != 0 {
+			peers = append(peers, p)
+		} else {
+			unreachable = append(unreachable, p)
+		}
+	}
+	peers = append(peers, unreachable...)
+	return
+}
+
+// returns true if we take a pex message from this peer now, peers may send one about every minute
+func (c *PeerConn) acceptPEX() bool {
+	now := time.Now()
+	if !c.lastPEX.IsZero() && now.Sub(c.lastPEX) < pexMinInterval {
+		log.Debugf("%s sent pex too often, ignoring", c.id.String())
+		return false
+	}
+	c.lastPEX = now
+	return true
+}
+
+// drop malformed peers, duplicates and peers we are connected to from peers we got over pex
+func (t *Torrent) filterPEXPeers(peers []common.Peer) (valid []common.Peer) {
+	seen := make(map[string]bool)
+	for _, p := range peers {
+		var key string
+		if p.IP == "" {
+			var zero i2p.Base32Addr
+			if p.Compact == zero {
+				continue
+			}
+			key = p.Compact.String()
+		} else {
+			if p.Port <= 0 || p.Port > 65535 {
+				continue
+			}
+			key = net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+			if t.hasConnTo(key) {
+				continue
+			}
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		valid = append(valid, p)
+		if len(valid) >= pexMaxPeers {
+			break
+		}
+	}
+	return
+}
+
+// get the pex flags for a peer we are connected to by address
+func (t *Torrent) pexFlags(addr string) (flags byte) {
+	t.connMtx.Lock()
+	c := t.obconns[addr]
+	if c == nil {
+		c = t.ibconns[addr]
+	}
+	t.connMtx.Unlock()
+	if c != nil && c.bf != nil && c.bf.Completed() {
+		flags |= extensions.PEXSeed
+	}
+	return
+}
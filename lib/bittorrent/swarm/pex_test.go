@@ -0,0 +1,99 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/network/inet"
+	"testing"
+	"time"
+)
+
+func TestPEXPopDestHashLists(t *testing.T) {
+	var st PEXSwarmState
+	st.onNewPeer(inet.NewAddr("a", "1"), true)
+	st.onNewPeer(inet.NewAddr("b", "1"), false)
+	st.onNewPeer(inet.NewAddr("c", "1"), true)
+	st.onPeerDisconnected(inet.NewAddr("c", "1"))
+	connected, disconnected := st.PopDestHashLists()
+	if len(connected) != 2*i2pPEXPeerLen || len(disconnected) != i2pPEXPeerLen {
+		t.Fatalf("got %d connected and %d disconnected bytes", len(connected), len(disconnected))
+	}
+	_, disconnected = st.PopDestHashLists()
+	if len(disconnected) != 0 {
+		t.Fatal("disconnected peer was not forgotten")
+	}
+}
+
+func TestPEXLokiPeers(t *testing.T) {
+	var key inet.LokiKey
+	for idx := range key {
+		key[idx] = byte(idx)
+	}
+	name := key.String()
+	decoded, err := inet.DecodeLokiAddr(name)
+	if err != nil || decoded != key {
+		t.Fatalf("%s did not decode: %v", name, err)
+	}
+
+	var st PEXSwarmState
+	st.onNewPeer(inet.NewAddr(name, "6881"), true)
+	st.onNewPeer(inet.NewAddr(name, "40000"), false)
+	st.onNewPeer(inet.NewAddr("notakey.loki", "6881"), true)
+	added, addedf, dropped := st.PopLokiPeerLists(func(string) byte { return extensions.PEXSeed })
+	if len(added) != lokiPEXPeerLen || len(addedf) != 1 || len(dropped) != 0 {
+		t.Fatalf("added %d bytes with %d flags", len(added), len(addedf))
+	}
+	if addedf[0] != extensions.PEXSeed|extensions.PEXReachable {
+		t.Fatalf("bad flags %x", addedf[0])
+	}
+	peers := decodePEXPeers(string(added), string(addedf), lokiPEXPeerLen, false, decodeLokiPEXPeer)
+	if len(peers) != 1 || peers[0].IP != name || peers[0].Port != 6881 {
+		t.Fatalf("bad decoded peers %v", peers)
+	}
+	if len(decodePEXPeers(string(added), string(addedf), lokiPEXPeerLen, true, decodeLokiPEXPeer)) != 0 {
+		t.Fatal("seed was not skipped while seeding")
+	}
+	if len(decodePEXPeers(string(added[1:]), "", lokiPEXPeerLen, false, decodeLokiPEXPeer)) != 0 {
+		t.Fatal("malformed peer list was accepted")
+	}
+}
+
+func TestPEXReachableFirst(t *testing.T) {
+	added := make([]byte, 2*i2pPEXPeerLen)
+	added[0] = 1
+	added[i2pPEXPeerLen] = 2
+	flags := []byte{0, extensions.PEXReachable}
+	peers := decodePEXPeers(string(added), string(flags), i2pPEXPeerLen, false, decodeI2PPEXPeer)
+	if len(peers) != 2 || peers[0].Compact[0] != 2 {
+		t.Fatalf("reachable peer not first: %v", peers)
+	}
+}
+
+func TestPEXFilterAndRateLimit(t *testing.T) {
+	tr := newTorrent(newTestTorrentStorage(BlockSize, 4), nil)
+	peers := []common.Peer{
+		{IP: "a.loki", Port: 1},
+		{IP: "a.loki", Port: 1},
+		{IP: "b.loki", Port: 0},
+		{IP: "c.loki", Port: 70000},
+		{},
+	}
+	for idx := 0; idx < pexMaxPeers*2; idx++ {
+		var p common.Peer
+		p.Compact[0] = byte(idx + 1)
+		peers = append(peers, p)
+	}
+	valid := tr.filterPEXPeers(peers)
+	if len(valid) != pexMaxPeers || valid[0].IP != "a.loki" || valid[1].IP != "" {
+		t.Fatalf("bad filtered peers %d %v", len(valid), valid[:2])
+	}
+
+	var c PeerConn
+	if !c.acceptPEX() || c.acceptPEX() {
+		t.Fatal("pex not rate limited")
+	}
+	c.lastPEX = time.Now().Add(-pexMinInterval)
+	if !c.acceptPEX() {
+		t.Fatal("pex not accepted after interval")
+	}
+}
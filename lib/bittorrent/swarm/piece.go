@@ -6,6 +6,7 @@ import (
 	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/storage"
 	"github.com/majestrate/XD/lib/sync"
+	"github.com/majestrate/XD/lib/util"
 	"time"
 )
 
@@ -20,6 +21,8 @@ type cachedPiece struct {
 	index      uint32
 	length     uint32
 	mtx        sync.Mutex
+	// which peer sent each block
+	senders map[uint32]*PeerConn
 }
 
 // should we accept a piece data with offset and length ?
@@ -64,7 +67,7 @@ func (p *cachedPiece) finalChunkLen() uint32 {
 	}
 }
 
-// is this piece done downloading ?
+// is this piece done downloading ? call with mtx held
 func (p *cachedPiece) done() bool {
 	return p.obtained.Completed()
 }
@@ -74,10 +77,16 @@ func (p *cachedPiece) bitfieldIndex(offset uint32) uint32 {
 	return offset / BlockSize
 }
 
-// mark slice of data at offset as obtained
-func (p *cachedPiece) put(offset uint32) {
+// mark slice of data at offset as obtained from a peer, call with mtx held
+func (p *cachedPiece) put(offset uint32, from *PeerConn) {
 	// set obtained
 	idx := p.bitfieldIndex(offset)
+	if from != nil {
+		if p.senders == nil {
+			p.senders = make(map[uint32]*PeerConn)
+		}
+		p.senders[idx] = from
+	}
 	p.obtained.Set(idx)
 	p.pending.Unset(idx)
 	p.lastActive = time.Now()
@@ -86,6 +95,13 @@ func (p *cachedPiece) put(offset uint32) {
 
 // cancel a slice
 func (p *cachedPiece) cancel(offset uint32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.cancelLocked(offset)
+}
+
+// cancel a slice, call with mtx held
+func (p *cachedPiece) cancelLocked(offset uint32) {
 	idx := p.bitfieldIndex(offset)
 	p.pending.Unset(idx)
 	p.lastActive = time.Now()
@@ -117,6 +133,54 @@ func (p *cachedPiece) nextRequest() (r *common.PieceRequest) {
 	return
 }
 
+// get a request for a block we do not have yet even if it is already pending from another peer
+// requested returns true if the peer we are asking for already has this block requested
+func (p *cachedPiece) endgameRequest(requested func(*common.PieceRequest) bool) (r *common.PieceRequest) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for begin := uint32(0); begin < p.length; begin += BlockSize {
+		idx := p.bitfieldIndex(begin)
+		if p.obtained.Has(idx) {
+			continue
+		}
+		r = &common.PieceRequest{
+			Index:  p.index,
+			Begin:  begin,
+			Length: BlockSize,
+		}
+		if idx == p.finalChunkBitfieldIndex() {
+			r.Length = p.finalChunkLen()
+		}
+		if requested(r) {
+			continue
+		}
+		log.Debugf("endgame piece request made: idx=%d offset=%d len=%d", r.Index, r.Begin, r.Length)
+		p.pending.Set(idx)
+		return
+	}
+	r = nil
+	return
+}
+
+// get the distinct peers that sent blocks of this piece, call with mtx held
+func (p *cachedPiece) contributors() (peers []*PeerConn) {
+	seen := make(map[*PeerConn]bool)
+	for _, c := range p.senders {
+		if !seen[c] {
+			seen[c] = true
+			peers = append(peers, c)
+		}
+	}
+	return
+}
+
+// number of blocks in this piece we have not obtained yet
+func (p *cachedPiece) missingBlocks() uint32 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.obtained.Length - uint32(p.obtained.CountSet())
+}
+
 // picks the next good piece to download
 type PiecePicker func(*bittorrent.Bitfield, []uint32) (uint32, bool)
 
@@ -127,6 +191,13 @@ type pieceTracker struct {
 	st        storage.Torrent
 	have      func(uint32)
 	nextPiece PiecePicker
+	// returns how many block requests we can have outstanding across all peers
+	budget  func() int
+	endgame bool
+	// called with the peers that sent a piece that failed its hash check
+	hashFailed func(uint32, []*PeerConn)
+	// called when a write failed because the disk is full
+	diskFull func(error)
 }
 
 func (pt *pieceTracker) visitCached(idx uint32, v func(*cachedPiece)) {
@@ -149,11 +220,40 @@ func createPieceTracker(st storage.Torrent, picker PiecePicker) (pt *pieceTracke
 		st:        st,
 		nextPiece: picker,
 	}
+	pt.resumePartial()
 	return
 }
 
+// track the pieces we have some blocks of from a previous session so we only request the missing blocks
+func (pt *pieceTracker) resumePartial() {
+	if pt.st.MetaInfo() == nil {
+		return
+	}
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+	for idx, blocks := range pt.st.PartialPieces() {
+		if _, has := pt.requests[idx]; has || !pt.newPiece(idx) {
+			continue
+		}
+		pc := pt.requests[idx]
+		if blocks.Length != pc.obtained.Length || blocks.Completed() {
+			// the block size does not match or the piece still needs a check, get it again
+			delete(pt.requests, idx)
+			continue
+		}
+		pc.obtained.CopyFrom(blocks)
+		log.Debugf("resuming piece %d with %d of %d blocks", idx, blocks.CountSet(), blocks.Length)
+	}
+}
+
 func (pt *pieceTracker) newPiece(piece uint32) bool {
 
+	bf := pt.st.Bitfield()
+	if bf != nil && bf.Has(piece) {
+		// we already have this piece
+		return false
+	}
+
 	info := pt.st.MetaInfo()
 
 	sz := info.LengthOfPiece(piece)
@@ -172,9 +272,12 @@ func (pt *pieceTracker) newPiece(piece uint32) bool {
 	return true
 }
 
-func (pt *pieceTracker) removePiece(piece uint32) {
+// stop tracking a piece we are done with, a newer download of the same piece stays
+func (pt *pieceTracker) removePiece(pc *cachedPiece) {
 	pt.mtx.Lock()
-	delete(pt.requests, piece)
+	if pt.requests[pc.index] == pc {
+		delete(pt.requests, pc.index)
+	}
 	pt.mtx.Unlock()
 }
 
@@ -208,7 +311,7 @@ func (pt *pieceTracker) PendingPieces() (exclude []uint32) {
 }
 
 func (pt *pieceTracker) NextRequest(remote *bittorrent.Bitfield, lastReq *common.PieceRequest) (r *common.PieceRequest) {
-	if lastReq != nil {
+	if lastReq != nil && remote.Has(lastReq.Index) && !pt.st.Bitfield().Has(lastReq.Index) {
 		pt.visitCached(lastReq.Index, func(cp *cachedPiece) {
 			r = cp.nextRequest()
 		})
@@ -231,6 +334,72 @@ func (pt *pieceTracker) NextRequest(remote *bittorrent.Bitfield, lastReq *common
 	return
 }
 
+// InEndgame returns true if we are in endgame mode and hand out blocks to more than one peer
+func (pt *pieceTracker) InEndgame() bool {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+	return pt.endgame
+}
+
+// check if the blocks we are missing fit in the outstanding request budget and update endgame mode
+func (pt *pieceTracker) checkEndgame() bool {
+	budget := DefaultMaxParallelRequests
+	if pt.budget != nil {
+		budget = pt.budget()
+	}
+	bf := pt.st.Bitfield()
+	if bf == nil {
+		return false
+	}
+	blocksPerPiece := pt.st.MetaInfo().Info.PieceLength / BlockSize
+	if pt.st.MetaInfo().Info.PieceLength%BlockSize != 0 {
+		blocksPerPiece++
+	}
+	pt.mtx.Lock()
+	missing := 0
+	for idx := uint32(0); idx < bf.Length && missing <= budget; idx++ {
+		if bf.Has(idx) {
+			continue
+		}
+		cp, ok := pt.requests[idx]
+		if ok {
+			missing += int(cp.missingBlocks())
+		} else {
+			missing += int(blocksPerPiece)
+		}
+	}
+	endgame := missing > 0 && missing <= budget
+	if endgame != pt.endgame {
+		log.Debugf("endgame mode %t with %d blocks left", endgame, missing)
+	}
+	pt.endgame = endgame
+	pt.mtx.Unlock()
+	return endgame
+}
+
+// EndgameRequest gets a duplicate request for a block already pending from another peer
+// returns nil if we are not in endgame mode
+func (pt *pieceTracker) EndgameRequest(remote *bittorrent.Bitfield, requested func(*common.PieceRequest) bool) (r *common.PieceRequest) {
+	if !pt.checkEndgame() {
+		return
+	}
+	var pieces []*cachedPiece
+	pt.mtx.Lock()
+	for _, cp := range pt.requests {
+		if remote.Has(cp.index) {
+			pieces = append(pieces, cp)
+		}
+	}
+	pt.mtx.Unlock()
+	for _, cp := range pieces {
+		r = cp.endgameRequest(requested)
+		if r != nil {
+			return
+		}
+	}
+	return
+}
+
 // cancel previously requested piece request
 func (pt *pieceTracker) canceledRequest(r *common.PieceRequest) {
 	if r.Length == 0 {
@@ -241,31 +410,71 @@ func (pt *pieceTracker) canceledRequest(r *common.PieceRequest) {
 	})
 }
 
-func (pt *pieceTracker) handlePieceData(d *common.PieceData) {
+// returns true and reports it if err is from a write to a full disk
+func (pt *pieceTracker) checkDiskFull(err error) bool {
+	if err != storage.ErrNoSpace && !util.IsDiskFull(err) {
+		return false
+	}
+	if pt.diskFull != nil {
+		pt.diskFull(err)
+	}
+	return true
+}
+
+// put piece data we got, returns common.ErrInvalidPiece if it completed a piece that failed its hash check
+func (pt *pieceTracker) handlePieceData(d *common.PieceData, from *PeerConn) (bad error) {
 	idx := d.Index
 	pt.visitCached(idx, func(pc *cachedPiece) {
 		if !pc.accept(d.Begin, uint32(len(d.Data))) {
 			log.Errorf("invalid piece data: index=%d offset=%d length=%d", d.Index, d.Begin, len(d.Data))
 			return
 		}
+		// endgame copies and web seeds can hand us the same block at once
+		// only the goroutine that puts the last block verifies the piece
+		pc.mtx.Lock()
+		if pc.obtained.Has(pc.bitfieldIndex(d.Begin)) {
+			pc.mtx.Unlock()
+			// duplicate from endgame
+			log.Debugf("already have chunk idx=%d offset=%d", d.Index, d.Begin)
+			return
+		}
 		err := pt.st.PutChunk(d)
 		if err == nil {
-			pc.put(d.Begin)
+			pc.put(d.Begin, from)
 		} else {
-			pc.cancel(d.Begin)
+			pc.cancelLocked(d.Begin)
 			log.Errorf("failed to put chunk %d: %s", idx, err.Error())
+			pt.checkDiskFull(err)
+		}
+		completed := err == nil && pc.done()
+		var contributors []*PeerConn
+		if completed {
+			contributors = pc.contributors()
+		}
+		pc.mtx.Unlock()
+		if !completed {
+			return
 		}
-		if pc.done() {
-			err = pt.st.VerifyPiece(idx)
-			if err == nil {
-				pt.st.Flush()
-				if pt.have != nil {
-					pt.have(idx)
-				}
-			} else {
-				log.Warnf("put piece %d failed: %s", idx, err.Error())
+		err = pt.st.VerifyPiece(idx)
+		if err == nil {
+			pt.st.Flush()
+			if pt.have != nil {
+				pt.have(idx)
+			}
+		} else if pt.checkDiskFull(err) {
+			// the piece is fine but we could not write it, we get it again later
+			log.Warnf("failed to write piece %d: %s", idx, err.Error())
+		} else if err != common.ErrInvalidPiece {
+			// we lost the data, not the peers' fault
+			log.Errorf("failed to store piece %d: %s", idx, err.Error())
+		} else {
+			log.Warnf("put piece %d failed: %s", idx, err.Error())
+			bad = err
+			if pt.hashFailed != nil {
+				pt.hashFailed(idx, contributors)
 			}
-			pt.removePiece(idx)
 		}
+		pt.removePiece(pc)
 	})
+	return
 }
@@ -1,11 +1,377 @@
 package swarm
 
 import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/metainfo"
+	"github.com/majestrate/XD/lib/stats"
+	"github.com/majestrate/XD/lib/storage"
+	"github.com/majestrate/XD/lib/sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
+// in memory storage.Torrent for piece tracker tests
+type testTorrentStorage struct {
+	meta *metainfo.TorrentFile
+	bf   *bittorrent.Bitfield
+	puts int
+	// fail hash checks of all pieces
+	corrupt bool
+	// saved known peers
+	peers []storage.KnownPeer
+	// saved queue position plus one
+	queuePos int
+	// saved seeding goals
+	seedLimits storage.SeedLimits
+	// blocks of incomplete pieces
+	partial map[uint32]*bittorrent.Bitfield
+	// returned by CheckFreeSpace
+	space error
+	// returned by PutChunk
+	full error
+	// how long PutChunk takes
+	putDelay time.Duration
+	// which files are wanted, all of them if nil
+	wanted []bool
+	// how often Seed was called
+	seeds int
+	// how often VerifyPiece was called
+	verifies int
+}
+
+func newTestTorrentStorage(pieceLen uint32, numPieces uint32) *testTorrentStorage {
+	meta, _ := metainfo.TorrentFileFromInfo(metainfo.Info{
+		PieceLength: pieceLen,
+		Pieces:      make([]byte, 20*numPieces),
+		Path:        "test",
+		Length:      uint64(pieceLen) * uint64(numPieces),
+	})
+	return &testTorrentStorage{
+		meta: meta,
+		bf:   bittorrent.NewBitfield(numPieces, nil),
+	}
+}
+
+func (st *testTorrentStorage) Allocate() error       { return nil }
+func (st *testTorrentStorage) CheckFreeSpace() error { return st.space }
+func (st *testTorrentStorage) VerifyAll() error      { return nil }
+func (st *testTorrentStorage) VerifyChanged() error  { return nil }
+func (st *testTorrentStorage) Checking() bool        { return false }
+func (st *testTorrentStorage) PutChunk(pc *common.PieceData) error {
+	time.Sleep(st.putDelay)
+	st.puts++
+	return st.full
+}
+func (st *testTorrentStorage) GetPiece(r common.PieceRequest, pc *common.PieceData) error {
+	return nil
+}
+func (st *testTorrentStorage) VerifyPiece(idx uint32) error {
+	st.verifies++
+	if st.corrupt {
+		return common.ErrInvalidPiece
+	}
+	st.bf.Set(idx)
+	return nil
+}
+func (st *testTorrentStorage) MetaInfo() *metainfo.TorrentFile { return st.meta }
+func (st *testTorrentStorage) Infohash() common.Infohash       { return st.meta.Infohash() }
+func (st *testTorrentStorage) Bitfield() *bittorrent.Bitfield  { return st.bf }
+func (st *testTorrentStorage) DownloadedSize() uint64          { return 0 }
+func (st *testTorrentStorage) DownloadRemaining() uint64       { return 0 }
+func (st *testTorrentStorage) Flush() error                    { return nil }
+func (st *testTorrentStorage) Name() string                    { return st.meta.TorrentName() }
+func (st *testTorrentStorage) Delete() error                   { return nil }
+func (st *testTorrentStorage) SaveStats(s *stats.Tracker) error {
+	return nil
+}
+func (st *testTorrentStorage) FileList() []string        { return nil }
+func (st *testTorrentStorage) MoveTo(other string) error { return nil }
+func (st *testTorrentStorage) Seed() (bool, error) {
+	st.seeds++
+	return st.bf.Completed(), nil
+}
+func (st *testTorrentStorage) PutInfoBytes(info []byte) error { return nil }
+func (st *testTorrentStorage) DownloadDir() string            { return "" }
+func (st *testTorrentStorage) FilePriorities() []storage.FilePriority {
+	prios := make([]storage.FilePriority, len(st.meta.Info.GetFiles()))
+	for idx := range prios {
+		prios[idx] = storage.PriorityNormal
+	}
+	return prios
+}
+func (st *testTorrentStorage) SetFilePriority(idx int, p storage.FilePriority) error {
+	return nil
+}
+func (st *testTorrentStorage) FilesWanted() []bool {
+	if st.wanted != nil {
+		return append([]bool{}, st.wanted...)
+	}
+	wanted := make([]bool, len(st.meta.Info.GetFiles()))
+	for idx := range wanted {
+		wanted[idx] = true
+	}
+	return wanted
+}
+func (st *testTorrentStorage) SetFileWanted(idx int, wanted bool) error {
+	st.wanted = st.FilesWanted()
+	st.wanted[idx] = wanted
+	return nil
+}
+func (st *testTorrentStorage) QueuePosition() int { return st.queuePos - 1 }
+func (st *testTorrentStorage) SetQueuePosition(pos int) error {
+	st.queuePos = pos + 1
+	return nil
+}
+func (st *testTorrentStorage) SeedLimits() storage.SeedLimits { return st.seedLimits }
+func (st *testTorrentStorage) SetSeedLimits(l storage.SeedLimits) error {
+	st.seedLimits = l
+	return nil
+}
+func (st *testTorrentStorage) SavePeers(peers []storage.KnownPeer) error {
+	st.peers = peers
+	return nil
+}
+
+func (st *testTorrentStorage) LoadPeers() ([]storage.KnownPeer, error) {
+	return st.peers, nil
+}
+
+func (st *testTorrentStorage) PartialPieces() map[uint32]*bittorrent.Bitfield {
+	return st.partial
+}
+
+func (st *testTorrentStorage) PutPieceLayer(root, layer []byte) error {
+	return st.meta.SetPieceLayer(root, layer)
+}
+
+// picks the first piece the remote has that we don't and is not excluded
+func testPicker(st *testTorrentStorage) PiecePicker {
+	return func(remote *bittorrent.Bitfield, exclude []uint32) (uint32, bool) {
+		ex := make(map[uint32]bool)
+		for _, idx := range exclude {
+			ex[idx] = true
+		}
+		for idx := uint32(0); idx < remote.Length; idx++ {
+			if remote.Has(idx) && !st.bf.Has(idx) && !ex[idx] {
+				return idx, true
+			}
+		}
+		return 0, false
+	}
+}
+
+func fullBitfield(n uint32) *bittorrent.Bitfield {
+	bf := bittorrent.NewBitfield(n, nil)
+	bf.Fill()
+	return bf
+}
+
 func TestPieceRequester(t *testing.T) {
 	log.SetLevel("debug")
+	st := newTestTorrentStorage(BlockSize*4, 2)
+	pt := createPieceTracker(st, testPicker(st))
+	remote := fullBitfield(2)
+
+	seen := make(map[common.PieceRequest]bool)
+	var last *common.PieceRequest
+	for i := 0; i < 8; i++ {
+		r := pt.NextRequest(remote, last)
+		if r == nil {
+			t.Fatalf("no request after %d requests", i)
+		}
+		if seen[*r] {
+			t.Fatalf("duplicate request for %d %d", r.Index, r.Begin)
+		}
+		seen[*r] = true
+		last = r
+	}
+	if r := pt.NextRequest(remote, last); r != nil {
+		t.Fatalf("got request for %d %d after all blocks were requested", r.Index, r.Begin)
+	}
+}
+
+func TestPieceTrackerEndgame(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize*2, 1)
+	pt := createPieceTracker(st, testPicker(st))
+	budget := 0
+	pt.budget = func() int { return budget }
+	remote := fullBitfield(1)
+
+	// peer a gets both blocks
+	var a []*common.PieceRequest
+	for r := pt.NextRequest(remote, nil); r != nil; r = pt.NextRequest(remote, r) {
+		a = append(a, r)
+	}
+	if len(a) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(a))
+	}
+	requested := func(r *common.PieceRequest) bool {
+		for _, req := range a {
+			if req.Equals(r) {
+				return true
+			}
+		}
+		return false
+	}
+	// not enough budget for endgame yet
+	if r := pt.EndgameRequest(remote, func(*common.PieceRequest) bool { return false }); r != nil {
+		t.Fatal("got endgame request outside of endgame")
+	}
+	budget = 4
+	// peer a already asked for everything
+	if r := pt.EndgameRequest(remote, requested); r != nil {
+		t.Fatalf("peer got duplicate request for %d %d", r.Index, r.Begin)
+	}
+	// peer b gets the same blocks
+	var b []*common.PieceRequest
+	for {
+		r := pt.EndgameRequest(remote, func(r *common.PieceRequest) bool {
+			for _, req := range b {
+				if req.Equals(r) {
+					return true
+				}
+			}
+			return false
+		})
+		if r == nil {
+			break
+		}
+		b = append(b, r)
+	}
+	if len(b) != 2 {
+		t.Fatalf("expected 2 endgame requests, got %d", len(b))
+	}
+	if !pt.InEndgame() {
+		t.Fatal("not in endgame")
+	}
+	// first copy of each block is stored, duplicates are dropped
+	for _, r := range append(a, b...) {
+		pt.handlePieceData(&common.PieceData{
+			Index: r.Index,
+			Begin: r.Begin,
+			Data:  make([]byte, r.Length),
+		}, nil)
+	}
+	if st.puts != 2 {
+		t.Fatalf("expected 2 chunks stored, got %d", st.puts)
+	}
+	if !st.bf.Has(0) {
+		t.Fatal("piece was not completed")
+	}
+	if r := pt.EndgameRequest(remote, func(*common.PieceRequest) bool { return false }); r != nil {
+		t.Fatal("got endgame request after torrent was completed")
+	}
+}
+
+func TestPieceTrackerResume(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize*4, 2)
+	blocks := bittorrent.NewBitfield(4, nil)
+	blocks.Set(0)
+	blocks.Set(2)
+	st.partial = map[uint32]*bittorrent.Bitfield{1: blocks}
+	pt := createPieceTracker(st, testPicker(st))
+	remote := bittorrent.NewBitfield(2, nil)
+	remote.Set(1)
+
+	var begins []uint32
+	for r := pt.NextRequest(remote, nil); r != nil; r = pt.NextRequest(remote, r) {
+		begins = append(begins, r.Begin)
+	}
+	if len(begins) != 2 || begins[0] != BlockSize || begins[1] != BlockSize*3 {
+		t.Fatalf("expected requests for the missing blocks only, got %v", begins)
+	}
+}
+
+func TestPieceTrackerDiskFull(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize*2, 1)
+	st.full = syscall.ENOSPC
+	pt := createPieceTracker(st, testPicker(st))
+	var full error
+	pt.diskFull = func(err error) { full = err }
+	pt.hashFailed = func(uint32, []*PeerConn) { t.Fatal("write error taken for bad data") }
+
+	r := pt.NextRequest(fullBitfield(1), nil)
+	pt.handlePieceData(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)}, nil)
+	if full != syscall.ENOSPC {
+		t.Fatalf("disk full not reported: %v", full)
+	}
+	// the block is requested again
+	if again := pt.NextRequest(fullBitfield(1), nil); again == nil || again.Begin != r.Begin {
+		t.Fatal("failed block not requested again")
+	}
+}
+
+func TestPieceTrackerConcurrentPut(t *testing.T) {
+	const blocks = 16
+	for round := 0; round < 10; round++ {
+		st := newTestTorrentStorage(BlockSize*blocks, 1)
+		st.putDelay = time.Millisecond
+		pt := createPieceTracker(st, testPicker(st))
+		var haves int32
+		pt.have = func(uint32) { atomic.AddInt32(&haves, 1) }
+		// every peer sends every block like endgame copies do
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for n := 0; n < 8; n++ {
+			wg.Add(1)
+			go func(from *PeerConn) {
+				defer wg.Done()
+				<-start
+				for begin := uint32(0); begin < BlockSize*blocks; begin += BlockSize {
+					pt.handlePieceData(&common.PieceData{Index: 0, Begin: begin, Data: make([]byte, BlockSize)}, from)
+				}
+			}(new(PeerConn))
+		}
+		close(start)
+		wg.Wait()
+		if st.puts != blocks || st.verifies != 1 || haves != 1 {
+			t.Fatalf("%d blocks written, %d checks, %d haves", st.puts, st.verifies, haves)
+		}
+	}
+}
 
+func TestSkippedFileDone(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize, 4)
+	st.meta, _ = metainfo.TorrentFileFromInfo(metainfo.Info{
+		PieceLength: BlockSize,
+		Pieces:      make([]byte, 20*4),
+		Path:        "test",
+		Files: []metainfo.FileInfo{
+			{Length: BlockSize * 2, Path: metainfo.FilePath{"wanted"}},
+			{Length: BlockSize * 2, Path: metainfo.FilePath{"skipped"}},
+		},
+	})
+	tr := newTorrent(st, nil)
+	if err := tr.SetFileWanted(1, false); err != nil {
+		t.Fatal(err)
+	}
+	for idx := uint32(0); idx < 2; idx++ {
+		st.VerifyPiece(idx)
+	}
+	// all wanted pieces are done but we do not have every piece to seed
+	for i := 0; i < 3; i++ {
+		if tr.checkSeeding() {
+			t.Fatal("seeding without skipped file")
+		}
+	}
+	if !tr.Done() || !tr.wantedDone || st.seeds != 0 {
+		t.Fatalf("wanted pieces not done or checked for seeding %d times", st.seeds)
+	}
+	// wanting the skipped file again needs its pieces
+	if err := tr.SetFileWanted(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if tr.checkSeeding() || tr.Done() || tr.wantedDone {
+		t.Fatal("done with missing pieces of wanted file")
+	}
+	for idx := uint32(2); idx < 4; idx++ {
+		st.VerifyPiece(idx)
+	}
+	if !tr.checkSeeding() || st.seeds != 1 {
+		t.Fatalf("not seeding with every piece after %d checks", st.seeds)
+	}
 }
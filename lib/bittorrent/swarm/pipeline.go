@@ -0,0 +1,113 @@
+package swarm
+
+import (
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// smallest request window we use for a peer
+const minRequestWindow = 2
+
+// request window we start with before we measured anything
+const startRequestWindow = 4
+
+// extra requests on top of the measured bandwidth delay product so the window can grow
+const requestWindowHeadroom = 2
+
+// how long a minimum round trip sample is trusted before we take a fresh one
+const minRTTLifetime = time.Minute
+
+// requests older than this are forgotten when measuring round trips
+const requestSampleTimeout = 2 * time.Minute
+
+// requestPipeline sizes how many block requests we keep outstanding to one peer
+// using the measured block round trip time and throughput of the peer
+type requestPipeline struct {
+	mtx     sync.Mutex
+	sent    map[common.PieceRequest]time.Time
+	srtt    time.Duration
+	minRTT  time.Duration
+	minTime time.Time
+	window  int
+}
+
+// remember when we sent a request
+func (p *requestPipeline) requestSent(r *common.PieceRequest, now time.Time) {
+	p.mtx.Lock()
+	if p.sent == nil {
+		p.sent = make(map[common.PieceRequest]time.Time)
+	}
+	p.sent[*r] = now
+	for req, tm := range p.sent {
+		if now.Sub(tm) > requestSampleTimeout {
+			delete(p.sent, req)
+		}
+	}
+	p.mtx.Unlock()
+}
+
+// forget a request we canceled
+func (p *requestPipeline) requestCanceled(r *common.PieceRequest) {
+	p.mtx.Lock()
+	delete(p.sent, *r)
+	p.mtx.Unlock()
+}
+
+// take a round trip sample for a block we got and resize the window given the peer's throughput in bytes per second
+func (p *requestPipeline) blockReceived(r *common.PieceRequest, rate float64, now time.Time) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	tm, ok := p.sent[*r]
+	if !ok {
+		return
+	}
+	delete(p.sent, *r)
+	rtt := now.Sub(tm)
+	if p.srtt == 0 {
+		p.srtt = rtt
+	} else {
+		p.srtt = (p.srtt*7 + rtt) / 8
+	}
+	if p.minRTT == 0 || rtt < p.minRTT || now.Sub(p.minTime) > minRTTLifetime {
+		p.minRTT = rtt
+		p.minTime = now
+	}
+	// keep enough blocks in flight to cover the unloaded round trip at the current throughput
+	// queueing at the peer adds to the round trip but not the throughput so this settles once the peer is saturated
+	p.window = int(rate*p.minRTT.Seconds()/float64(BlockSize)) + requestWindowHeadroom
+}
+
+// get the request window capped by our upper bound and the peer's request queue size
+func (p *requestPipeline) size(max int, reqq uint32) (n int) {
+	p.mtx.Lock()
+	n = p.window
+	p.mtx.Unlock()
+	if n == 0 {
+		n = startRequestWindow
+	}
+	if n < minRequestWindow {
+		n = minRequestWindow
+	}
+	if reqq > 0 && int(reqq) < max {
+		max = int(reqq)
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	return
+}
+
+// get the smoothed block round trip time
+func (p *requestPipeline) rtt() (rtt time.Duration) {
+	p.mtx.Lock()
+	rtt = p.srtt
+	p.mtx.Unlock()
+	return
+}
+
+// RequestWindow gets how many block requests we keep outstanding to this peer
+func (c *PeerConn) RequestWindow() int {
+	return c.pipeline.size(c.MaxParalellRequests, c.theirOpts.MaxRequests())
+}
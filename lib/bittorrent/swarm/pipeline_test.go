@@ -0,0 +1,44 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/common"
+	"testing"
+	"time"
+)
+
+func TestRequestPipeline(t *testing.T) {
+	var p requestPipeline
+	if p.size(32, 0) != startRequestWindow {
+		t.Fatalf("start window is %d", p.size(32, 0))
+	}
+	now := time.Now()
+	r := &common.PieceRequest{Index: 1, Begin: 0, Length: BlockSize}
+	p.requestSent(r, now)
+	// 1 second round trip at 10 blocks per second
+	p.blockReceived(r, float64(BlockSize*10), now.Add(time.Second))
+	if n := p.size(32, 0); n != 10+requestWindowHeadroom {
+		t.Fatalf("window is %d", n)
+	}
+	if p.rtt() != time.Second {
+		t.Fatalf("rtt is %s", p.rtt())
+	}
+	if n := p.size(8, 0); n != 8 {
+		t.Fatalf("window not capped by upper bound: %d", n)
+	}
+	if n := p.size(32, 5); n != 5 {
+		t.Fatalf("window not capped by reqq: %d", n)
+	}
+	// canceled requests give no samples
+	p.requestSent(r, now)
+	p.requestCanceled(r)
+	p.blockReceived(r, 0, now.Add(time.Second))
+	if n := p.size(32, 0); n != 10+requestWindowHeadroom {
+		t.Fatalf("window changed by canceled request: %d", n)
+	}
+	// a slow peer gets a small window
+	p.requestSent(r, now)
+	p.blockReceived(r, float64(BlockSize), now.Add(time.Millisecond*100))
+	if n := p.size(32, 0); n != minRequestWindow {
+		t.Fatalf("slow peer window is %d", n)
+	}
+}
@@ -0,0 +1,104 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/storage"
+)
+
+// FilePriorities gets the download priority of each file in this torrent, PrioritySkip for files we do not download
+func (t *Torrent) FilePriorities() (prios []storage.FilePriority) {
+	prios = t.st.FilePriorities()
+	wanted := t.st.FilesWanted()
+	for idx := range prios {
+		if idx < len(wanted) && !wanted[idx] {
+			prios[idx] = storage.PrioritySkip
+		}
+	}
+	return
+}
+
+// SetFilePriority sets the download priority of a file in this torrent by index, does not change if the file is wanted
+func (t *Torrent) SetFilePriority(idx int, p storage.FilePriority) (err error) {
+	err = t.st.SetFilePriority(idx, p)
+	if err == nil {
+		t.filesChanged()
+	}
+	return
+}
+
+// FilesWanted gets which files of this torrent we download
+func (t *Torrent) FilesWanted() []bool {
+	return t.st.FilesWanted()
+}
+
+// SetFileWanted sets if we download a file in this torrent by index, the file keeps its priority
+func (t *Torrent) SetFileWanted(idx int, wanted bool) (err error) {
+	err = t.st.SetFileWanted(idx, wanted)
+	if err == nil {
+		t.filesChanged()
+	}
+	return
+}
+
+// called when file priorities or wanted files changed
+func (t *Torrent) filesChanged() {
+	t.updatePiecePriorities()
+	t.VisitPeers(func(c *PeerConn) {
+		c.checkInterested()
+	})
+}
+
+// recompute the priority of each piece as the highest priority of the files it holds data for
+func (t *Torrent) updatePiecePriorities() {
+	if !t.Ready() {
+		return
+	}
+	info := t.MetaInfo().Info
+	np := info.NumPieces()
+	prios := make([]storage.FilePriority, np)
+	var wanted *bittorrent.Bitfield
+	for idx, p := range t.FilePriorities() {
+		begin, end := info.FilePieces(idx)
+		for i := begin; i < end && i < np; i++ {
+			if p > prios[i] {
+				prios[i] = p
+			}
+		}
+	}
+	for idx := range prios {
+		if !prios[idx].Wanted() {
+			if wanted == nil {
+				wanted = bittorrent.NewBitfield(np, nil)
+				wanted.Fill()
+			}
+			wanted.Unset(uint32(idx))
+		}
+	}
+	t.prioMtx.Lock()
+	t.piecePrios = prios
+	t.wantedPieces = wanted
+	t.prioMtx.Unlock()
+}
+
+// get priority of each piece
+func (t *Torrent) piecePriorities() (prios []storage.FilePriority) {
+	t.prioMtx.Lock()
+	prios = t.piecePrios
+	t.prioMtx.Unlock()
+	if prios == nil && t.Ready() {
+		t.updatePiecePriorities()
+		t.prioMtx.Lock()
+		prios = t.piecePrios
+		t.prioMtx.Unlock()
+	}
+	return
+}
+
+// get bitfield of pieces we want to download, nil if we want all of them
+func (t *Torrent) wantedBitfield() (bf *bittorrent.Bitfield) {
+	t.piecePriorities()
+	t.prioMtx.Lock()
+	bf = t.wantedPieces
+	t.prioMtx.Unlock()
+	return
+}
@@ -0,0 +1,247 @@
+package swarm
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// DefaultStalledTime is how long a download gets no data before it stops counting against the queue limits
+const DefaultStalledTime = time.Minute * 30
+
+// how often we look for queued torrents to start
+const queueTickInterval = time.Second
+
+// QueueMove is a direction to move a torrent in the queue
+type QueueMove int
+
+const (
+	// QueueTop moves a torrent to the front of the queue
+	QueueTop = QueueMove(iota)
+	// QueueUp moves a torrent one place towards the front of the queue
+	QueueUp
+	// QueueDown moves a torrent one place towards the back of the queue
+	QueueDown
+	// QueueBottom moves a torrent to the back of the queue
+	QueueBottom
+)
+
+// ErrNotInQueue is returned when moving a torrent that is not in the queue
+var ErrNotInQueue = errors.New("torrent not in queue")
+
+// torrentQueue is the order torrents in a swarm are started in
+type torrentQueue struct {
+	mtx      sync.Mutex
+	torrents []*Torrent
+	lastTick time.Time
+}
+
+// get the index of a torrent in the queue, call with mtx held
+func (q *torrentQueue) index(t *Torrent) int {
+	for idx, other := range q.torrents {
+		if other == t {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Queued returns true if this torrent waits in the queue to be started
+func (t *Torrent) Queued() bool {
+	return atomic.LoadInt32(&t.queued) == 1
+}
+
+// set if this torrent waits in the queue to be started
+func (t *Torrent) setQueued(queued bool) {
+	var v int32
+	if queued {
+		v = 1
+	}
+	atomic.StoreInt32(&t.queued, v)
+}
+
+// StartQueued puts a stopped torrent back in the queue so it starts once there is a free slot
+// use Start to start it right away
+func (t *Torrent) StartQueued() error {
+	if t.Queued() {
+		return nil
+	}
+	if !t.closing {
+		return ErrAlreadyStarted
+	}
+	if t.queue == nil {
+		return t.Start()
+	}
+	t.setQueued(true)
+	return nil
+}
+
+// QueuePosition gets the place of this torrent in the queue, -1 if it is not in the queue
+func (t *Torrent) QueuePosition() int {
+	if t.queue == nil {
+		return -1
+	}
+	t.queue.mtx.Lock()
+	defer t.queue.mtx.Unlock()
+	return t.queue.index(t)
+}
+
+// remember that we got piece data now
+func (t *Torrent) gotData(now time.Time) {
+	atomic.StoreInt64(&t.lastData, now.UnixNano())
+}
+
+// returns true if this torrent downloads but got no piece data for a while
+func (t *Torrent) stalled(now time.Time, stalledTime time.Duration) bool {
+	if stalledTime <= 0 || t.Done() {
+		return false
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&t.lastData))) > stalledTime
+}
+
+// put a torrent in the queue, torrents keep the order of their saved queue positions
+// torrents without a saved position go to the back
+func (h *Holder) enqueue(t *Torrent) {
+	h.queue.mtx.Lock()
+	pos := t.st.QueuePosition()
+	if pos < 0 {
+		pos = 0
+		if n := len(h.queue.torrents); n > 0 {
+			pos = h.queue.torrents[n-1].st.QueuePosition() + 1
+		}
+		h.saveQueuePosition(t, pos)
+	}
+	idx := len(h.queue.torrents)
+	for i, other := range h.queue.torrents {
+		if other.st.QueuePosition() > pos {
+			idx = i
+			break
+		}
+	}
+	h.queue.torrents = append(h.queue.torrents, nil)
+	copy(h.queue.torrents[idx+1:], h.queue.torrents[idx:])
+	h.queue.torrents[idx] = t
+	h.queue.mtx.Unlock()
+}
+
+// take a torrent out of the queue
+func (h *Holder) dequeue(t *Torrent) {
+	h.queue.mtx.Lock()
+	if idx := h.queue.index(t); idx >= 0 {
+		h.queue.torrents = append(h.queue.torrents[:idx], h.queue.torrents[idx+1:]...)
+	}
+	h.queue.mtx.Unlock()
+}
+
+func (h *Holder) saveQueuePosition(t *Torrent, pos int) {
+	err := t.st.SetQueuePosition(pos)
+	if err != nil {
+		log.Warnf("failed to save queue position of %s: %s", t.Name(), err.Error())
+	}
+}
+
+// persist queue positions that changed, call with queue mtx held
+func (h *Holder) saveQueue() {
+	for idx, t := range h.queue.torrents {
+		if t.st.QueuePosition() != idx {
+			h.saveQueuePosition(t, idx)
+		}
+	}
+}
+
+// MoveInQueue moves a torrent in the queue
+func (h *Holder) MoveInQueue(t *Torrent, move QueueMove) error {
+	h.queue.mtx.Lock()
+	defer h.queue.mtx.Unlock()
+	from := h.queue.index(t)
+	if from < 0 {
+		return ErrNotInQueue
+	}
+	to := from
+	switch move {
+	case QueueTop:
+		to = 0
+	case QueueUp:
+		to--
+	case QueueDown:
+		to++
+	case QueueBottom:
+		to = len(h.queue.torrents) - 1
+	}
+	if to < 0 || to >= len(h.queue.torrents) || to == from {
+		return nil
+	}
+	torrents := append(h.queue.torrents[:from], h.queue.torrents[from+1:]...)
+	torrents = append(torrents, nil)
+	copy(torrents[to+1:], torrents[to:])
+	torrents[to] = t
+	h.queue.torrents = torrents
+	h.saveQueue()
+	return nil
+}
+
+// start queued torrents in queue order while there are free download and seed slots
+// downloads that stalled do not take a slot
+func (h *Holder) tickQueue(now time.Time) {
+	start := h.nextInQueue(now)
+	for _, t := range start {
+		log.Infof("starting queued torrent %s", t.Name())
+		t.gotData(now)
+		err := t.Start()
+		if err != nil && err != ErrAlreadyStarted {
+			log.Warnf("failed to start %s: %s", t.Name(), err.Error())
+			// stop it so it does not hold a slot, starting it again puts it back in the queue
+			t.closing = true
+		}
+	}
+}
+
+// pick the queued torrents that fit in the free slots and take them out of the queued state
+func (h *Holder) nextInQueue(now time.Time) (start []*Torrent) {
+	h.queue.mtx.Lock()
+	defer h.queue.mtx.Unlock()
+	if now.Sub(h.queue.lastTick) < queueTickInterval {
+		return
+	}
+	h.queue.lastTick = now
+	downloads, seeds := 0, 0
+	for _, t := range h.queue.torrents {
+		if t.Queued() || t.closing || t.stalled(now, h.StalledTime) {
+			continue
+		}
+		if t.Done() {
+			seeds++
+		} else {
+			downloads++
+		}
+	}
+	for _, t := range h.queue.torrents {
+		if !t.Queued() {
+			continue
+		}
+		if h.QueueSize > 0 && downloads+seeds >= h.QueueSize {
+			break
+		}
+		done := t.Done()
+		if done && h.MaxActiveSeeds > 0 && seeds >= h.MaxActiveSeeds {
+			continue
+		}
+		if !done && h.MaxActiveDownloads > 0 && downloads >= h.MaxActiveDownloads {
+			continue
+		}
+		if !atomic.CompareAndSwapInt32(&t.queued, 1, 0) {
+			// started by hand in the meantime
+			continue
+		}
+		if done {
+			seeds++
+		} else {
+			downloads++
+		}
+		start = append(start, t)
+	}
+	return
+}
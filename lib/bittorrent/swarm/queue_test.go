@@ -0,0 +1,120 @@
+package swarm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/majestrate/XD/lib/storage"
+)
+
+func TestTorrentQueue(t *testing.T) {
+	h := &Holder{queue: new(torrentQueue), StalledTime: DefaultStalledTime}
+	newQueued := func(pos int, done bool) *Torrent {
+		st := newTestTorrentStorage(BlockSize, 4)
+		st.SetQueuePosition(pos)
+		if done {
+			st.bf.Fill()
+		}
+		tr := newTorrent(st, nil)
+		tr.setQueued(true)
+		tr.queue = h.queue
+		h.enqueue(tr)
+		return tr
+	}
+	// saved positions are kept, new torrents go to the back
+	b := newQueued(5, false)
+	a := newQueued(2, false)
+	c := newQueued(-1, false)
+	seed := newQueued(-1, true)
+	if a.QueuePosition() != 0 || b.QueuePosition() != 1 || c.QueuePosition() != 2 || seed.QueuePosition() != 3 {
+		t.Fatal("queue not in saved order")
+	}
+	if c.st.QueuePosition() != 6 || seed.st.QueuePosition() != 7 {
+		t.Fatal("new torrents did not get a position after the last one")
+	}
+
+	if err := h.MoveInQueue(c, QueueTop); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.MoveInQueue(a, QueueDown); err != nil {
+		t.Fatal(err)
+	}
+	if c.QueuePosition() != 0 || b.QueuePosition() != 1 || a.QueuePosition() != 2 {
+		t.Fatal("torrents not moved in queue")
+	}
+	if c.st.QueuePosition() != 0 || a.st.QueuePosition() != 2 {
+		t.Fatal("moved queue positions not saved")
+	}
+
+	h.MaxActiveDownloads = 1
+	h.MaxActiveSeeds = 1
+	now := time.Now()
+	start := h.nextInQueue(now)
+	if len(start) != 2 || start[0] != c || start[1] != seed {
+		t.Fatalf("bad torrents started from queue: %v", start)
+	}
+	if !b.Queued() || c.Queued() {
+		t.Fatal("queued state not updated")
+	}
+	// a stalled download frees its slot
+	c.gotData(now)
+	if len(h.nextInQueue(now.Add(time.Minute))) != 0 {
+		t.Fatal("started download over the limit")
+	}
+	start = h.nextInQueue(now.Add(DefaultStalledTime + time.Minute))
+	if len(start) != 1 || start[0] != b {
+		t.Fatal("stalled download still takes a slot")
+	}
+
+	h.dequeue(b)
+	if b.QueuePosition() != -1 || h.MoveInQueue(b, QueueUp) != ErrNotInQueue {
+		t.Fatal("torrent not taken out of queue")
+	}
+}
+
+func TestStartQueued(t *testing.T) {
+	h := &Holder{queue: new(torrentQueue), StalledTime: DefaultStalledTime}
+	tr := newTorrent(newTestTorrentStorage(BlockSize, 4), nil)
+	tr.queue = h.queue
+	h.enqueue(tr)
+	if tr.StartQueued() != ErrAlreadyStarted {
+		t.Fatal("running torrent put in the queue")
+	}
+	// stopped torrents wait for a free slot
+	tr.closing = true
+	if err := tr.StartQueued(); err != nil {
+		t.Fatal(err)
+	}
+	if !tr.Queued() {
+		t.Fatal("torrent not queued")
+	}
+	start := h.nextInQueue(time.Now())
+	if len(start) != 1 || start[0] != tr || tr.Queued() {
+		t.Fatal("queued torrent not started")
+	}
+}
+
+func TestQueueStartFails(t *testing.T) {
+	h := &Holder{queue: new(torrentQueue), StalledTime: DefaultStalledTime, MaxActiveDownloads: 1}
+	newQueued := func(space error) *Torrent {
+		st := newTestTorrentStorage(BlockSize, 4)
+		st.space = space
+		tr := newTorrent(st, nil)
+		tr.setQueued(true)
+		tr.queue = h.queue
+		h.enqueue(tr)
+		return tr
+	}
+	full := newQueued(storage.ErrNoSpace)
+	next := newQueued(nil)
+	now := time.Now()
+	h.tickQueue(now)
+	if full.Queued() || !full.closing {
+		t.Fatal("torrent that failed to start not stopped")
+	}
+	// the failed torrent does not hold the only download slot
+	start := h.nextInQueue(now.Add(queueTickInterval))
+	if len(start) != 1 || start[0] != next {
+		t.Fatal("failed torrent holds a download slot")
+	}
+}
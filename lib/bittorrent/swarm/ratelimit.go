@@ -0,0 +1,137 @@
+package swarm
+
+import (
+	"time"
+
+	"github.com/majestrate/XD/lib/util"
+)
+
+// AltSpeed is an alternate set of global rate limits
+// it can be turned on by hand or by a time of day schedule
+type AltSpeed struct {
+	// upload limit in bytes per second, 0 means unlimited
+	Upload uint64
+	// download limit in bytes per second, 0 means unlimited
+	Download uint64
+	// turned on by hand
+	Enabled bool
+	// turned on by schedule
+	Scheduled bool
+	// schedule start in minutes after midnight
+	Begin int
+	// schedule end in minutes after midnight
+	End int
+	// days the schedule applies to, sunday is 1, monday 2, ... saturday 64
+	Days int
+}
+
+// AltSpeedEveryDay is the day mask for all days of the week
+const AltSpeedEveryDay = 127
+
+// Active returns true if the alternate limits apply at a time
+func (a AltSpeed) Active(now time.Time) bool {
+	if a.Enabled {
+		return true
+	}
+	if !a.Scheduled || a.Days&(1<<uint(now.Weekday())) == 0 {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if a.Begin <= a.End {
+		return minute >= a.Begin && minute < a.End
+	}
+	// schedule wraps around midnight
+	return minute >= a.Begin || minute < a.End
+}
+
+// SpeedLimit is a rate limit that keeps its rate while it is turned off
+type SpeedLimit struct {
+	// limit in bytes per second
+	Rate uint64
+	// the limit only applies when enabled
+	Enabled bool
+}
+
+// get the limit in bytes per second, 0 means unlimited
+func (l SpeedLimit) limit() uint64 {
+	if l.Enabled {
+		return l.Rate
+	}
+	return 0
+}
+
+// SetRateLimits sets the global upload and download limits in bytes per second, 0 means unlimited
+func (h *Holder) SetRateLimits(up, down uint64) {
+	h.SetSpeedLimits(SpeedLimit{up, up > 0}, SpeedLimit{down, down > 0})
+}
+
+// RateLimits gets the global upload and download limits in bytes per second, 0 means unlimited
+func (h *Holder) RateLimits() (up, down uint64) {
+	upLimit, downLimit := h.SpeedLimits()
+	return upLimit.limit(), downLimit.limit()
+}
+
+// SetSpeedLimits sets the global upload and download limits
+func (h *Holder) SetSpeedLimits(up, down SpeedLimit) {
+	h.limitMtx.Lock()
+	h.uploadSpeed = up
+	h.downloadSpeed = down
+	h.limitMtx.Unlock()
+	h.updateRateLimits()
+}
+
+// SpeedLimits gets the global upload and download limits including the rates of limits that are turned off
+func (h *Holder) SpeedLimits() (up, down SpeedLimit) {
+	h.limitMtx.Lock()
+	up, down = h.uploadSpeed, h.downloadSpeed
+	h.limitMtx.Unlock()
+	return
+}
+
+// SetAltSpeed sets the alternate speed profile
+func (h *Holder) SetAltSpeed(a AltSpeed) {
+	h.limitMtx.Lock()
+	h.altSpeed = a
+	h.limitMtx.Unlock()
+	h.updateRateLimits()
+}
+
+// GetAltSpeed gets the alternate speed profile
+func (h *Holder) GetAltSpeed() (a AltSpeed) {
+	h.limitMtx.Lock()
+	a = h.altSpeed
+	h.limitMtx.Unlock()
+	return
+}
+
+// apply either the normal or alternate limits to the global limiters
+func (h *Holder) updateRateLimits() {
+	up, down := h.RateLimits()
+	alt := h.GetAltSpeed()
+	if alt.Active(time.Now()) {
+		up, down = alt.Upload, alt.Download
+	}
+	h.uploadLimit.SetRate(up)
+	h.downloadLimit.SetRate(down)
+}
+
+// SetRateLimits sets the upload and download limits of this torrent in bytes per second, 0 means unlimited
+func (t *Torrent) SetRateLimits(up, down uint64) {
+	t.uploadLimit.SetRate(up)
+	t.downloadLimit.SetRate(down)
+}
+
+// RateLimits gets the upload and download limits of this torrent in bytes per second
+func (t *Torrent) RateLimits() (up, down uint64) {
+	return t.uploadLimit.Rate(), t.downloadLimit.Rate()
+}
+
+// limiters that apply to data we send on this torrent
+func (t *Torrent) uploadLimiters() []*util.RateLimiter {
+	return []*util.RateLimiter{t.uploadLimit, t.globalUpload}
+}
+
+// limiters that apply to data we receive on this torrent
+func (t *Torrent) downloadLimiters() []*util.RateLimiter {
+	return []*util.RateLimiter{t.downloadLimit, t.globalDownload}
+}
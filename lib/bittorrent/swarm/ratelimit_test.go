@@ -0,0 +1,83 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/util"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAltSpeedSchedule(t *testing.T) {
+	// 22:00 to 06:00 on weekdays
+	alt := AltSpeed{
+		Scheduled: true,
+		Begin:     22 * 60,
+		End:       6 * 60,
+		Days:      AltSpeedEveryDay &^ 1 &^ 64,
+	}
+	// 2020-01-06 is a monday
+	monday := time.Date(2020, 1, 6, 0, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		at     time.Time
+		active bool
+	}{
+		{monday.Add(23 * time.Hour), true},
+		{monday.Add(5 * time.Hour), true},
+		{monday.Add(12 * time.Hour), false},
+		{monday.Add(-time.Hour), false},
+	} {
+		if alt.Active(tc.at) != tc.active {
+			t.Fatalf("alt speed active at %s should be %v", tc.at, tc.active)
+		}
+	}
+	alt.Scheduled = false
+	if alt.Active(monday.Add(23 * time.Hour)) {
+		t.Fatal("alt speed active without schedule")
+	}
+	alt.Enabled = true
+	if !alt.Active(monday.Add(12 * time.Hour)) {
+		t.Fatal("alt speed not active when turned on by hand")
+	}
+}
+
+func TestThrottledPeerStillReads(t *testing.T) {
+	tr := newTorrent(newTestTorrentStorage(BlockSize, 4), nil)
+	// one byte per second, the writer goroutine sleeps for the rest of the test
+	tr.uploadLimit.SetRate(1)
+	c, _ := net.Pipe()
+	p := makePeerConn(c, tr, common.PeerID{1}, extensions.Message{}, bittorrent.Reserved{})
+	p.Send(common.NewHave(0))
+	p.Send(common.NewWireMessage(common.Piece, make([]byte, 2000)))
+	p.start()
+	done := make(chan struct{})
+	go func() {
+		p.queueRecv(common.NewWireMessage(common.Choke, nil))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("peer stopped handling messages while throttled")
+	}
+}
+
+func TestSpeedLimitDisabled(t *testing.T) {
+	h := &Holder{uploadLimit: util.NewRateLimiter(0), downloadLimit: util.NewRateLimiter(0)}
+	h.SetSpeedLimits(SpeedLimit{Rate: 1000, Enabled: true}, SpeedLimit{Rate: 2000, Enabled: false})
+	if up, down := h.RateLimits(); up != 1000 || down != 0 {
+		t.Fatalf("limits are %d/%d", up, down)
+	}
+	if h.downloadLimit.Rate() != 0 {
+		t.Fatal("disabled download limit was applied")
+	}
+	// turning it back on restores the rate we set before
+	up, down := h.SpeedLimits()
+	down.Enabled = true
+	h.SetSpeedLimits(up, down)
+	if h.downloadLimit.Rate() != 2000 {
+		t.Fatalf("download limit is %d", h.downloadLimit.Rate())
+	}
+}
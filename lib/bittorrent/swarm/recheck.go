@@ -0,0 +1,39 @@
+package swarm
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/storage"
+)
+
+// ErrChecking is returned when rechecking a torrent that is being checked
+var ErrChecking = errors.New("torrent is already being checked")
+
+// Recheck checks all local data of this torrent in the background
+func (t *Torrent) Recheck() error {
+	if !t.Ready() {
+		return storage.ErrNoMetaInfo
+	}
+	if t.st.Checking() || !atomic.CompareAndSwapInt32(&t.rechecking, 0, 1) {
+		return ErrChecking
+	}
+	go func() {
+		defer atomic.StoreInt32(&t.rechecking, 0)
+		log.Infof("rechecking %s", t.Name())
+		err := t.st.VerifyAll()
+		if err != nil {
+			log.Errorf("failed to recheck %s: %s", t.Name(), err.Error())
+			return
+		}
+		if t.seeding && !t.Done() {
+			log.Infof("%s is missing pieces and will download them again", t.Name())
+			t.seeding = false
+			if t.started {
+				go t.runUntilSeeding()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,142 @@
+package swarm
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/storage"
+)
+
+// SeedLimits are goals after which we stop seeding a torrent, 0 or a negative value means no limit
+type SeedLimits struct {
+	// stop once we uploaded this many times what we downloaded
+	Ratio float64
+	// stop after seeding this long
+	Time time.Duration
+	// stop after this long with nothing uploaded
+	Idle time.Duration
+	// remove the torrent instead of stopping it, only used in the global limits
+	Remove bool
+}
+
+// merge the goals of a torrent with the global limits
+func mergeSeedLimits(l storage.SeedLimits, global SeedLimits) SeedLimits {
+	merged := global
+	switch l.RatioMode {
+	case storage.SeedLimitSingle:
+		merged.Ratio = l.Ratio
+	case storage.SeedLimitUnlimited:
+		merged.Ratio = 0
+	}
+	switch l.TimeMode {
+	case storage.SeedLimitSingle:
+		merged.Time = l.Time
+	case storage.SeedLimitUnlimited:
+		merged.Time = 0
+	}
+	switch l.IdleMode {
+	case storage.SeedLimitSingle:
+		merged.Idle = l.Idle
+	case storage.SeedLimitUnlimited:
+		merged.Idle = 0
+	}
+	return merged
+}
+
+// returns true if any goal was reached
+func (l SeedLimits) reached(ratio float64, seeding, idle time.Duration) bool {
+	return (l.Ratio > 0 && ratio >= l.Ratio) || (l.Time > 0 && seeding >= l.Time) || (l.Idle > 0 && idle >= l.Idle)
+}
+
+// SetSeedLimits sets the global seeding goals
+func (h *Holder) SetSeedLimits(l SeedLimits) {
+	h.limitMtx.Lock()
+	h.seedLimits = l
+	h.limitMtx.Unlock()
+}
+
+// SeedLimits gets the global seeding goals
+func (h *Holder) SeedLimits() (l SeedLimits) {
+	h.limitMtx.Lock()
+	l = h.seedLimits
+	h.limitMtx.Unlock()
+	return
+}
+
+// SetSeedLimits sets and saves the seeding goals of this torrent
+func (t *Torrent) SetSeedLimits(l storage.SeedLimits) error {
+	return t.st.SetSeedLimits(l)
+}
+
+// SeedLimits gets the seeding goals of this torrent
+func (t *Torrent) SeedLimits() storage.SeedLimits {
+	return t.st.SeedLimits()
+}
+
+// ActiveSeedLimits gets the seeding goals that apply to this torrent
+func (t *Torrent) ActiveSeedLimits() SeedLimits {
+	var global SeedLimits
+	if t.globalSeedLimits != nil {
+		global = t.globalSeedLimits()
+	}
+	return mergeSeedLimits(t.SeedLimits(), global)
+}
+
+// Finished returns true if this torrent reached a seeding goal and stopped
+func (t *Torrent) Finished() bool {
+	return t.finished
+}
+
+// remember that we uploaded piece data now
+func (t *Torrent) gotUpload(now time.Time) {
+	atomic.StoreInt64(&t.lastUpload, now.UnixNano())
+}
+
+// remember that we began seeding now
+func (t *Torrent) beganSeeding(now time.Time) {
+	t.seedMtx.Lock()
+	t.seedingSince = now
+	t.seedMtx.Unlock()
+	t.gotUpload(now)
+}
+
+// get our upload ratio, when we downloaded nothing this session it is taken against the size of the torrent
+func (t *Torrent) seedRatio() float64 {
+	rx := float64(t.rx)
+	if rx == 0 {
+		if info := t.MetaInfo(); info != nil {
+			rx = float64(info.TotalSize())
+		}
+	}
+	if rx == 0 {
+		return 0
+	}
+	return float64(t.tx) / rx
+}
+
+// stop seeding if we reached a seeding goal
+func (t *Torrent) tickSeedLimits(now time.Time) {
+	if t.finished || !t.seeding || t.globalSeedLimits == nil {
+		return
+	}
+	l := t.ActiveSeedLimits()
+	t.seedMtx.Lock()
+	seeding := now.Sub(t.seedingSince)
+	t.seedMtx.Unlock()
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&t.lastUpload)))
+	if !l.reached(t.seedRatio(), seeding, idle) {
+		return
+	}
+	t.finished = true
+	log.Infof("%s reached its seeding goal", t.Name())
+	go t.finish(l.Remove)
+}
+
+// stop a torrent that reached its seeding goal, it stays in the swarm as finished unless remove is set
+func (t *Torrent) finish(remove bool) {
+	t.pause()
+	if remove {
+		t.RemoveSelf()
+	}
+}
@@ -0,0 +1,56 @@
+package swarm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/majestrate/XD/lib/storage"
+)
+
+func TestSeedLimits(t *testing.T) {
+	global := SeedLimits{Ratio: 2, Idle: time.Hour, Remove: true}
+	l := mergeSeedLimits(storage.SeedLimits{
+		Ratio:     3,
+		RatioMode: storage.SeedLimitUnlimited,
+		Time:      time.Minute,
+		TimeMode:  storage.SeedLimitSingle,
+		Idle:      time.Minute,
+	}, global)
+	if l.Ratio != 0 || l.Time != time.Minute || l.Idle != time.Hour || !l.Remove {
+		t.Fatalf("bad merged limits %+v", l)
+	}
+	if l.reached(10, 0, 0) {
+		t.Fatal("unlimited ratio reached")
+	}
+	if !l.reached(0, time.Minute, 0) || !l.reached(0, 0, time.Hour) {
+		t.Fatal("seeding goal not reached")
+	}
+	if (SeedLimits{}).reached(10, time.Hour, time.Hour) {
+		t.Fatal("no goal reached")
+	}
+
+	st := newTestTorrentStorage(BlockSize, 4)
+	st.bf.Fill()
+	tr := newTorrent(st, nil)
+	tr.globalSeedLimits = func() SeedLimits { return SeedLimits{Idle: time.Minute} }
+	tr.seeding = true
+	now := time.Now()
+	tr.beganSeeding(now)
+	tr.tx = uint64(BlockSize) * 8
+	if tr.seedRatio() != 2 {
+		t.Fatalf("bad seed ratio %f", tr.seedRatio())
+	}
+	tr.tickSeedLimits(now.Add(time.Second * 30))
+	if tr.Finished() {
+		t.Fatal("finished before idle goal")
+	}
+	tr.gotUpload(now.Add(time.Second * 50))
+	tr.tickSeedLimits(now.Add(time.Second * 100))
+	if tr.Finished() {
+		t.Fatal("upload did not reset idle time")
+	}
+	tr.tickSeedLimits(now.Add(time.Second * 120))
+	if !tr.Finished() {
+		t.Fatal("not finished after idle goal")
+	}
+}
@@ -0,0 +1,100 @@
+package swarm
+
+import (
+	"time"
+
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/storage"
+)
+
+// Sequential returns true if we download pieces in order instead of rarest first
+func (t *Torrent) Sequential() (seq bool) {
+	t.prioMtx.Lock()
+	seq = t.sequential
+	t.prioMtx.Unlock()
+	return
+}
+
+// SetSequential turns sequential download mode on or off
+func (t *Torrent) SetSequential(seq bool) {
+	t.prioMtx.Lock()
+	t.sequential = seq
+	t.prioMtx.Unlock()
+}
+
+// SetPieceDeadline asks for a piece to be downloaded before a deadline, pieces with the earliest deadline are fetched first
+// a zero deadline clears it
+func (t *Torrent) SetPieceDeadline(idx uint32, deadline time.Time) (err error) {
+	if t.Ready() && idx >= t.MetaInfo().Info.NumPieces() {
+		err = ErrBadPieceIndex
+		return
+	}
+	t.prioMtx.Lock()
+	if deadline.IsZero() {
+		delete(t.deadlines, idx)
+	} else {
+		if t.deadlines == nil {
+			t.deadlines = make(map[uint32]time.Time)
+		}
+		t.deadlines[idx] = deadline
+	}
+	t.prioMtx.Unlock()
+	return
+}
+
+// ClearPieceDeadlines removes all piece deadlines
+func (t *Torrent) ClearPieceDeadlines() {
+	t.prioMtx.Lock()
+	t.deadlines = nil
+	t.prioMtx.Unlock()
+}
+
+// pick the piece with the earliest deadline, forgets deadlines of pieces we have
+func (t *Torrent) pickDeadlinePiece(bf *bittorrent.Bitfield, skip func(uint32) bool) (idx uint32, has bool) {
+	var earliest time.Time
+	t.prioMtx.Lock()
+	for i, deadline := range t.deadlines {
+		if bf.Has(i) {
+			delete(t.deadlines, i)
+			continue
+		}
+		if skip(i) {
+			continue
+		}
+		if !has || deadline.Before(earliest) {
+			idx, earliest, has = i, deadline, true
+		}
+	}
+	t.prioMtx.Unlock()
+	return
+}
+
+// pick the next piece in playback order, the first and last pieces of each file go first as players need them for container headers
+func (t *Torrent) pickSequentialPiece(prios []storage.FilePriority, skip func(uint32) bool) (idx uint32, has bool) {
+	info := t.MetaInfo().Info
+	fileprios := t.FilePriorities()
+	for p := storage.PriorityHigh; p > storage.PrioritySkip; p-- {
+		for f, fp := range fileprios {
+			if fp != p {
+				continue
+			}
+			begin, end := info.FilePieces(f)
+			if end == begin {
+				continue
+			}
+			if !skip(begin) {
+				return begin, true
+			}
+			if !skip(end - 1) {
+				return end - 1, true
+			}
+		}
+		for i := range prios {
+			idx = uint32(i)
+			if prios[i] == p && !skip(idx) {
+				return idx, true
+			}
+		}
+	}
+	return 0, false
+}
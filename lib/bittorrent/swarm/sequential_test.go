@@ -0,0 +1,31 @@
+package swarm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSequentialPicker(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize, 4)
+	tr := newTorrent(st, nil)
+	tr.SetSequential(true)
+	remote := fullBitfield(4)
+	// first and last piece of the file go first, then the rest in order
+	var exclude []uint32
+	for _, expect := range []uint32{0, 3, 1, 2} {
+		idx, has := tr.getRarestPiece(remote, exclude)
+		if !has || idx != expect {
+			t.Fatalf("picked piece %d (%v), expected %d", idx, has, expect)
+		}
+		exclude = append(exclude, idx)
+	}
+	if err := tr.SetPieceDeadline(2, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if idx, _ := tr.getRarestPiece(remote, nil); idx != 2 {
+		t.Fatalf("picked piece %d instead of piece with deadline", idx)
+	}
+	if tr.SetPieceDeadline(4, time.Now()) != ErrBadPieceIndex {
+		t.Fatal("set deadline on piece out of range")
+	}
+}
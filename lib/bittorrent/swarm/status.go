@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"github.com/majestrate/XD/lib/bittorrent"
 	"github.com/majestrate/XD/lib/metainfo"
+	"github.com/majestrate/XD/lib/storage"
 	"github.com/majestrate/XD/lib/util"
 )
 
 type TorrentFileInfo struct {
 	FileInfo metainfo.FileInfo
 	Progress float64
+	Priority storage.FilePriority
+	Wanted   bool
 }
 
 func (i TorrentFileInfo) Length() int64 {
@@ -71,6 +74,12 @@ type PeerConnStats struct {
 	Inbound        bool
 	Uploading      bool
 	Bitfield       bittorrent.Bitfield
+	// how many block requests we keep outstanding to this peer
+	RequestWindow int
+	// smoothed block round trip time in milliseconds
+	RTT int64
+	// true if this is a web seed and not a bittorrent peer
+	WebSeed bool
 }
 
 func (p *PeerConnStats) Less(o *PeerConnStats) bool {
@@ -83,6 +92,8 @@ const Seeding = TorrentState("seeding")
 const Checking = TorrentState("checking")
 const Stopped = TorrentState("stopped")
 const Downloading = TorrentState("downloading")
+const Queued = TorrentState("queued")
+const Finished = TorrentState("finished")
 
 func (t TorrentState) String() string {
 	return string(t)
@@ -99,6 +110,12 @@ type TorrentStatus struct {
 	Progress float64
 	TX       uint64
 	RX       uint64
+	// true if pieces are downloaded in order
+	Sequential bool
+	// true if we hand out pieces one peer at a time
+	SuperSeeding bool
+	// why the torrent was stopped by a storage problem, empty if it was not
+	Error string
 }
 
 func (t TorrentStatus) Ratio() (r float64) {
@@ -0,0 +1,197 @@
+package swarm
+
+import (
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+)
+
+// how long we wait for a piece we offered to show up at another peer before offering the peer something else
+const superSeedOfferTimeout = time.Minute * 2
+
+// per peer super seeding state (BEP 16)
+type superSeedState struct {
+	// true if we hid our pieces from this peer when they connected
+	hidden bool
+	// every piece we offered this peer, they may request these
+	offered map[uint32]bool
+	// piece we are waiting for them to pass on
+	current uint32
+	// true if current is set
+	waiting bool
+	// when current was offered
+	offeredAt time.Time
+}
+
+// SuperSeeding returns true if we hide our pieces and hand them out one peer at a time
+func (t *Torrent) SuperSeeding() (on bool) {
+	t.superMtx.Lock()
+	on = t.superSeed
+	t.superMtx.Unlock()
+	return
+}
+
+// SetSuperSeeding turns super seeding on or off
+// peers connected before super seeding is turned on already know we have every piece
+func (t *Torrent) SetSuperSeeding(on bool) {
+	t.superMtx.Lock()
+	was := t.superSeed
+	t.superSeed = on
+	t.superMtx.Unlock()
+	if was && !on {
+		t.revealPieces()
+	}
+}
+
+// return true if we are seeding with super seeding on
+func (t *Torrent) superSeeding() bool {
+	if !t.SuperSeeding() || !t.Ready() {
+		return false
+	}
+	bf := t.Bitfield()
+	return bf != nil && bf.Completed()
+}
+
+// tell super seeded peers about all the pieces we did not offer them
+func (t *Torrent) revealPieces() {
+	bf := t.Bitfield()
+	if bf == nil {
+		return
+	}
+	t.VisitPeers(func(c *PeerConn) {
+		t.superMtx.Lock()
+		hidden := c.superSeed.hidden
+		offered := c.superSeed.offered
+		c.superSeed = superSeedState{}
+		t.superMtx.Unlock()
+		if !hidden {
+			return
+		}
+		for idx := uint32(0); idx < bf.Length; idx++ {
+			if bf.Has(idx) && !offered[idx] {
+				c.Send(common.NewHave(idx))
+			}
+		}
+	})
+}
+
+// hide our pieces from a new peer if we are super seeding
+// returns true if the pieces were hidden
+func (t *Torrent) superSeedHide(c *PeerConn) bool {
+	if !t.superSeeding() {
+		return false
+	}
+	t.superMtx.Lock()
+	c.superSeed = superSeedState{hidden: true}
+	t.superMtx.Unlock()
+	return true
+}
+
+// return true if a peer may request a piece, peers we hide pieces from may only get what we offered them
+func (t *Torrent) superSeedAllowed(c *PeerConn, idx uint32) (allowed bool) {
+	t.superMtx.Lock()
+	allowed = !c.superSeed.hidden || c.superSeed.offered[idx]
+	t.superMtx.Unlock()
+	return
+}
+
+// a peer told us they have a piece, peers that were waiting to pass it on get a new piece
+func (t *Torrent) superSeedSawHave(from *PeerConn, idx uint32) {
+	if !t.superSeeding() {
+		return
+	}
+	var passedOn []*PeerConn
+	t.superMtx.Lock()
+	t.VisitPeers(func(c *PeerConn) {
+		if c != from && c.superSeed.waiting && c.superSeed.current == idx {
+			c.superSeed.waiting = false
+			passedOn = append(passedOn, c)
+		}
+	})
+	t.superMtx.Unlock()
+	for _, c := range passedOn {
+		log.Debugf("%s passed on piece %d", c.id.String(), idx)
+		t.superSeedOffer(c)
+	}
+}
+
+// offer a peer the rarest piece nobody is waiting on yet
+func (t *Torrent) superSeedOffer(c *PeerConn) {
+	bf := t.Bitfield()
+	if bf == nil {
+		return
+	}
+	t.superMtx.Lock()
+	if !c.superSeed.hidden || c.superSeed.waiting || (c.bf != nil && c.bf.Completed()) {
+		t.superMtx.Unlock()
+		return
+	}
+	counts := make([]int, bf.Length)
+	pending := make(map[uint32]bool)
+	t.VisitPeers(func(other *PeerConn) {
+		if other.bf != nil {
+			for idx := uint32(0); idx < bf.Length && idx < other.bf.Length; idx++ {
+				if other.bf.Has(idx) {
+					counts[idx]++
+				}
+			}
+		}
+		if other != c && other.superSeed.waiting {
+			pending[other.superSeed.current] = true
+		}
+	})
+	idx, has := pickSuperSeedPiece(counts, func(idx uint32) bool {
+		return (c.bf != nil && c.bf.Has(idx)) || c.superSeed.offered[idx] || pending[idx]
+	})
+	if !has {
+		// every piece is being passed on already, hand out a duplicate
+		idx, has = pickSuperSeedPiece(counts, func(idx uint32) bool {
+			return (c.bf != nil && c.bf.Has(idx)) || c.superSeed.offered[idx]
+		})
+	}
+	if has {
+		if c.superSeed.offered == nil {
+			c.superSeed.offered = make(map[uint32]bool)
+		}
+		c.superSeed.offered[idx] = true
+		c.superSeed.current = idx
+		c.superSeed.waiting = true
+		c.superSeed.offeredAt = time.Now()
+	}
+	t.superMtx.Unlock()
+	if has {
+		log.Debugf("super seeding piece %d to %s", idx, c.id.String())
+		c.Send(common.NewHave(idx))
+	}
+}
+
+// pick the piece with the fewest copies in the swarm that is not skipped
+func pickSuperSeedPiece(counts []int, skip func(uint32) bool) (piece uint32, has bool) {
+	for idx := range counts {
+		if skip(uint32(idx)) {
+			continue
+		}
+		if !has || counts[idx] < counts[piece] {
+			piece = uint32(idx)
+			has = true
+		}
+	}
+	return
+}
+
+// offer pieces to peers that have nothing to pass on or held on to their piece for too long
+func (t *Torrent) tickSuperSeed() {
+	if !t.superSeeding() {
+		return
+	}
+	now := time.Now()
+	t.VisitPeers(func(c *PeerConn) {
+		t.superMtx.Lock()
+		if c.superSeed.waiting && now.Sub(c.superSeed.offeredAt) > superSeedOfferTimeout {
+			c.superSeed.waiting = false
+		}
+		t.superMtx.Unlock()
+		t.superSeedOffer(c)
+	})
+}
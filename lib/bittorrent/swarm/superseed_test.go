@@ -0,0 +1,51 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"net"
+	"testing"
+)
+
+func TestSuperSeedOffers(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize, 4)
+	st.bf.Fill()
+	tr := newTorrent(st, nil)
+	tr.SetSuperSeeding(true)
+	newPeer := func(name string, id byte) *PeerConn {
+		c, _ := net.Pipe()
+		p := makePeerConn(c, tr, common.PeerID{id}, extensions.Message{}, bittorrent.Reserved{})
+		p.bf = bittorrent.NewBitfield(4, nil)
+		tr.obconns[name] = p
+		return p
+	}
+	a := newPeer("a", 1)
+	b := newPeer("b", 2)
+	if !tr.superSeedHide(a) || !tr.superSeedHide(b) {
+		t.Fatal("pieces not hidden while super seeding")
+	}
+	tr.superSeedOffer(a)
+	tr.superSeedOffer(b)
+	if a.superSeed.current != 0 || b.superSeed.current != 1 {
+		t.Fatalf("offered pieces %d and %d", a.superSeed.current, b.superSeed.current)
+	}
+	if !tr.superSeedAllowed(a, 0) || tr.superSeedAllowed(a, 1) {
+		t.Fatal("wrong pieces allowed")
+	}
+	// a does not get another piece until someone else has its piece
+	a.bf.Set(0)
+	tr.superSeedSawHave(a, 0)
+	if a.superSeed.current != 0 {
+		t.Fatal("peer got new piece before passing on its piece")
+	}
+	b.bf.Set(0)
+	tr.superSeedSawHave(b, 0)
+	if !a.superSeed.waiting || a.superSeed.current != 2 {
+		t.Fatalf("peer got piece %d after passing on its piece", a.superSeed.current)
+	}
+	tr.SetSuperSeeding(false)
+	if !tr.superSeedAllowed(b, 3) {
+		t.Fatal("piece not allowed after super seeding was turned off")
+	}
+}
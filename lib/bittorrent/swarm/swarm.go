@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/majestrate/XD/lib/bittorrent"
 	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/blocklist"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/dht"
 	"github.com/majestrate/XD/lib/gnutella"
@@ -11,6 +12,7 @@ import (
 	"github.com/majestrate/XD/lib/metainfo"
 	"github.com/majestrate/XD/lib/network"
 	"github.com/majestrate/XD/lib/storage"
+	"github.com/majestrate/XD/lib/sync"
 	"github.com/majestrate/XD/lib/tracker"
 	"github.com/majestrate/XD/lib/util"
 	"net"
@@ -28,13 +30,16 @@ type Swarm struct {
 	id       common.PeerID
 	trackers map[string]tracker.Announcer
 	xdht     dht.XDHT
+	i2pdht   dht.I2PDHT
 	gnutella *gnutella.Swarm
-	active   int
 	getNet   chan network.Network
 	netDied  chan bool
 	newNet   chan network.Network
 	netError chan error
 	netDead  bool
+
+	blocklistMtx     sync.Mutex
+	blocklistSources []string
 }
 
 func (sw *Swarm) IsOnline() bool {
@@ -45,32 +50,24 @@ func (sw *Swarm) Running() bool {
 	return !sw.closing
 }
 
-func (sw *Swarm) onStopped(t *Torrent) {
-	sw.active--
-}
-
 func (sw *Swarm) Network() network.Network {
 	return <-sw.getNet
 }
 
-func (sw *Swarm) waitForQueue() {
-	if sw.Torrents.QueueSize > 0 {
-		for sw.active >= sw.Torrents.QueueSize {
-			time.Sleep(time.Second)
-		}
-	}
-}
-
 func (sw *Swarm) startTorrent(t *Torrent) {
 	t.RemoveSelf = func() {
 		sw.Torrents.removeTorrent(t.st.Infohash())
 	}
-	t.Stopped = func() {
-		sw.onStopped(t)
-	}
 	// wait for network
 	sw.Network()
 	t.xdht = &sw.xdht
+	t.i2pdht = &sw.i2pdht
+	if sw.xdht.Enabled() && !t.Private() {
+		t.defaultOpts.SetSupported(extensions.XDHT)
+	}
+	if sw.i2pdht.Enabled() && !t.Private() {
+		t.defaultOpts.SetSupported(extensions.I2PDHT)
+	}
 	// give peerid
 	t.id = sw.id
 	// add open trackers
@@ -91,14 +88,22 @@ func (sw *Swarm) startTorrent(t *Torrent) {
 			}
 		}
 	}
-	// handle messages
-	sw.waitForQueue()
-	sw.active++
-	t.Start()
+	// wait for our turn to start
+	sw.Torrents.enqueue(t)
 }
 
 // got inbound connection
 func (sw *Swarm) inboundConn(c net.Conn) {
+	if sw.Torrents.bans.isBanned(addrBanKey(c.RemoteAddr())) {
+		log.Debugf("refusing connection from banned peer %s", c.RemoteAddr())
+		c.Close()
+		return
+	}
+	if sw.Torrents.blocklist.BlockedAddr(c.RemoteAddr()) {
+		log.Debugf("refusing connection from blocked peer %s", c.RemoteAddr())
+		c.Close()
+		return
+	}
 	var firstBytes [20]byte
 	n, err := c.Read(firstBytes[:])
 	if err != nil || n != 20 {
@@ -125,6 +130,11 @@ func (sw *Swarm) inboundConn(c net.Conn) {
 		}
 		var id common.PeerID
 		copy(id[:], h.PeerID[:])
+		if sw.Torrents.IsBanned(c.RemoteAddr(), id) {
+			log.Debugf("%s is banned, closing connection", id.String())
+			c.Close()
+			return
+		}
 		t := sw.Torrents.GetTorrent(h.Infohash)
 		if t == nil {
 			log.Warnf("%s we don't have torrent with infohash %s, closing connection", id.String(), h.Infohash.Hex())
@@ -148,12 +158,15 @@ func (sw *Swarm) inboundConn(c net.Conn) {
 		} else {
 			log.Debugf("%s does not support extensions", id.String())
 		}
-		// reply to handshake
-		ih := t.st.Infohash()
+		// reply to handshake with the infohash they asked for, hybrid torrents have 2
 		var replyh bittorrent.Handshake
 		replyh.Reserved.Set(bittorrent.Extension)
+		replyh.Reserved.Set(bittorrent.Fast)
+		if t.isV2() {
+			replyh.Reserved.Set(bittorrent.V2)
+		}
 		replyh.Reserved.Intersect(h.Reserved)
-		copy(replyh.Infohash[:], ih[:])
+		copy(replyh.Infohash[:], h.Infohash[:])
 		copy(replyh.PeerID[:], t.id[:])
 		err = replyh.Send(c)
 		if err != nil {
@@ -249,12 +262,17 @@ func (sw *Swarm) Run() error {
 			return err
 		}
 	}
-	return nil
 }
 
 func (sw *Swarm) tick() {
+	sw.Torrents.updateRateLimits()
+	sw.xdht.Tick()
+	sw.i2pdht.Tick()
+	sw.Torrents.tickQueue(time.Now())
 	sw.Torrents.ForEachTorrent(func(t *Torrent) {
-		t.tick()
+		if !t.Queued() && !t.Finished() {
+			t.tick()
+		}
 	})
 }
 
@@ -282,6 +300,8 @@ func (sw *Swarm) LostNetwork() {
 func (sw *Swarm) ObtainedNetwork(n network.Network) {
 	sw.id = common.GeneratePeerID()
 	log.Infof("Generated new peer id: %s", sw.id.String())
+	sw.xdht.SetID(sw.id)
+	sw.startI2PDHT(n)
 	// give network to netLoop
 	sw.newNet <- n
 	log.Info("Swarm got network context")
@@ -292,7 +312,13 @@ func (sw *Swarm) ObtainedNetwork(n network.Network) {
 func NewSwarm(storage storage.Storage, gnutella *gnutella.Swarm) *Swarm {
 	sw := &Swarm{
 		Torrents: Holder{
-			st: storage,
+			st:            storage,
+			uploadLimit:   util.NewRateLimiter(0),
+			downloadLimit: util.NewRateLimiter(0),
+			bans:          newPeerBans(),
+			blocklist:     blocklist.New(),
+			StalledTime:   DefaultStalledTime,
+			queue:         new(torrentQueue),
 		},
 		trackers: map[string]tracker.Announcer{},
 		gnutella: gnutella,
@@ -301,6 +327,7 @@ func NewSwarm(storage storage.Storage, gnutella *gnutella.Swarm) *Swarm {
 		netDied:  make(chan bool),
 		netError: make(chan error),
 	}
+	sw.Torrents.connMgr = newConnManager(&sw.Torrents)
 	go sw.acceptLoop()
 	go sw.netLoop()
 	return sw
@@ -325,6 +352,10 @@ func (sw *Swarm) Close() (err error) {
 		sw.closing = true
 		log.Info("Swarm closing")
 		sw.Torrents.Close(!sw.netDead)
+		err = sw.xdht.Close()
+		if e := sw.i2pdht.Close(); err == nil {
+			err = e
+		}
 	}
 	return
 }
@@ -350,20 +381,38 @@ func (sw *Swarm) AddMagnet(uri string) (err error) {
 	u, err = url.Parse(uri)
 	if err == nil {
 		q := u.Query()
-		xt := q.Get("xt")
-		if len(xt) > 0 {
-			xt = strings.ToLower(xt)
-			if strings.HasPrefix(xt, "urn:btih:") && len(xt) == 49 {
-				var ih common.Infohash
-				ih, err = common.DecodeInfohash(xt[9:])
-				if err == nil {
-					err = sw.addMagnet(ih)
+		var ih common.Infohash
+		ih, err = parseMagnetInfohash(q["xt"])
+		if err == nil {
+			err = sw.addMagnet(ih)
+		}
+		if err == nil {
+			if t := sw.Torrents.GetTorrent(ih); t != nil {
+				for _, ws := range q["ws"] {
+					t.AddWebSeed(ws)
 				}
-			} else {
-				err = common.ErrBadMagnetURI
 			}
-		} else {
-			err = common.ErrBadMagnetURI
+		}
+	}
+	return
+}
+
+// get the infohash from the xt parameters of a magnet
+// v1 infohashes are preferred over v2 ones for hybrid torrents
+func parseMagnetInfohash(xts []string) (ih common.Infohash, err error) {
+	err = common.ErrBadMagnetURI
+	for _, xt := range xts {
+		xt = strings.ToLower(xt)
+		if strings.HasPrefix(xt, "urn:btih:") && len(xt) == 49 {
+			return common.DecodeInfohash(xt[9:])
+		}
+		// multihash with sha256 code 0x12 and length 0x20
+		if strings.HasPrefix(xt, "urn:btmh:1220") && len(xt) == 77 && err != nil {
+			var ih2 common.InfohashV2
+			ih2, err = common.DecodeInfohashV2(xt[13:])
+			if err == nil {
+				ih = ih2.Truncated()
+			}
 		}
 	}
 	return
@@ -386,7 +435,7 @@ func (sw *Swarm) addFileTorrent(path string) (err error) {
 			var t storage.Torrent
 			t, err = sw.Torrents.st.OpenTorrent(&info)
 			if err == nil {
-				err = t.VerifyAll()
+				err = t.VerifyChanged()
 				if err == nil {
 					sw.AddTorrent(t)
 				}
@@ -418,7 +467,7 @@ func (sw *Swarm) addHTTPTorrent(remote string) (err error) {
 				var t storage.Torrent
 				t, err = sw.Torrents.st.OpenTorrent(&info)
 				if err == nil {
-					err = t.VerifyAll()
+					err = t.VerifyChanged()
 					if err == nil {
 						sw.AddTorrent(t)
 					}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/majestrate/XD/lib/bittorrent"
 	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/blocklist"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/dht"
 	"github.com/majestrate/XD/lib/log"
@@ -38,6 +39,7 @@ type Torrent struct {
 	Started          func()
 	Stopped          func()
 	RemoveSelf       func()
+	InfohashChanged  func(old common.Infohash)
 	netacces         sync.Mutex
 	suspended        bool
 	Network          func() network.Network
@@ -58,10 +60,12 @@ type Torrent struct {
 	MaxPeers         uint
 	pexState         PEXSwarmState
 	xdht             *dht.XDHT
+	i2pdht           *dht.I2PDHT
 	statsTracker     *stats.Tracker
 	tx               uint64
 	rx               uint64
 	seeding          bool
+	wantedDone       bool
 	metaInfo         []byte
 	pendingInfoBF    *bittorrent.Bitfield
 	requestingInfoBF *bittorrent.Bitfield
@@ -69,7 +73,45 @@ type Torrent struct {
 	addedAt          time.Time
 	peersPool        sync.Pool
 	lastPEX          time.Time
+	lastDHTLookup    time.Time
+	lastDHTAnnounce  time.Time
+	peerCache        peerCache
 	pexInterval      time.Duration
+	UploadSlots      int
+	OptimisticSlots  int
+	optimistic       []*PeerConn
+	lastChoke        time.Time
+	lastOptimistic   time.Time
+	rechoke          int32
+	prioMtx          sync.Mutex
+	piecePrios       []storage.FilePriority
+	wantedPieces     *bittorrent.Bitfield
+	sequential       bool
+	deadlines        map[uint32]time.Time
+	uploadLimit      *util.RateLimiter
+	downloadLimit    *util.RateLimiter
+	globalUpload     *util.RateLimiter
+	globalDownload   *util.RateLimiter
+	bans             *peerBans
+	blocklist        *blocklist.Blocklist
+	connMgr          *connManager
+	queued           int32
+	queue            *torrentQueue
+	lastData         int64
+	seedMtx          sync.Mutex
+	globalSeedLimits func() SeedLimits
+	seedingSince     time.Time
+	lastUpload       int64
+	finished         bool
+	rechecking       int32
+	errMtx           sync.Mutex
+	localErr         error
+	hashMtx          sync.Mutex
+	layers           pieceLayerFetch
+	webSeedMtx       sync.Mutex
+	webSeeds         []*webSeed
+	superMtx         sync.Mutex
+	superSeed        bool
 }
 
 func (t *Torrent) ShouldAcceptNewPeer() bool {
@@ -105,6 +147,7 @@ func (t *Torrent) Close() error {
 		c.Close()
 	})
 	t.saveStats()
+	t.savePeerCache()
 	return t.st.Flush()
 }
 
@@ -141,19 +184,23 @@ var tIDCounter = int64(0)
 
 func newTorrent(st storage.Torrent, getNet func() network.Network) *Torrent {
 	t := &Torrent{
-		TID:          tIDCounter,
-		Trackers:     make(map[string]tracker.Announcer),
-		announcers:   make(map[string]*torrentAnnounce),
-		st:           st,
-		Network:      getNet,
-		ibconns:      make(map[string]*PeerConn),
-		obconns:      make(map[string]*PeerConn),
-		MaxRequests:  DefaultMaxParallelRequests,
-		MaxPeers:     DefaultMaxSwarmPeers,
-		statsTracker: stats.NewTracker(),
-		addedAt:      time.Now(),
-		lastPEX:      time.Now(),
-		pexInterval:  time.Minute * 2,
+		TID:             tIDCounter,
+		Trackers:        make(map[string]tracker.Announcer),
+		announcers:      make(map[string]*torrentAnnounce),
+		st:              st,
+		Network:         getNet,
+		ibconns:         make(map[string]*PeerConn),
+		obconns:         make(map[string]*PeerConn),
+		MaxRequests:     DefaultMaxParallelRequests,
+		MaxPeers:        DefaultMaxSwarmPeers,
+		UploadSlots:     DefaultUploadSlots,
+		OptimisticSlots: DefaultOptimisticSlots,
+		statsTracker:    stats.NewTracker(),
+		addedAt:         time.Now(),
+		lastPEX:         time.Now(),
+		pexInterval:     time.Minute * 2,
+		uploadLimit:     util.NewRateLimiter(0),
+		downloadLimit:   util.NewRateLimiter(0),
 	}
 	t.peersPool.New = func() interface{} { return &PeerConn{} }
 	tIDCounter++
@@ -167,12 +214,22 @@ func newTorrent(st storage.Torrent, getNet func() network.Network) *Torrent {
 	} else {
 		t.defaultOpts = extensions.NewOur(0)
 	}
-	// set default pex dialect supported
-	t.defaultOpts.SetSupported(DefaultPEXDialect)
+	// set default pex dialects supported
+	for _, ext := range DefaultPEXDialects {
+		t.defaultOpts.SetSupported(ext)
+	}
 	// set ut_metadata supported
 	t.defaultOpts.SetSupported(extensions.UTMetaData)
 	t.pt = createPieceTracker(st, t.getRarestPiece)
 	t.pt.have = t.broadcastHave
+	t.pt.budget = t.requestBudget
+	t.pt.hashFailed = t.onHashFailed
+	t.pt.diskFull = t.onDiskFull
+	if t.Ready() {
+		for _, u := range t.st.MetaInfo().URLList {
+			t.AddWebSeed(u)
+		}
+	}
 	return t
 }
 
@@ -188,9 +245,27 @@ func (t *Torrent) getRarestPiece(remote *bittorrent.Bitfield, exclude []uint32)
 		m[exclude[idx]] = true
 	}
 	bt := t.st.Bitfield()
-	idx, has = remote.FindRarest(swarm, func(idx uint32) bool {
-		return bt.Has(idx) || m[idx]
-	})
+	prios := t.piecePriorities()
+	meta := t.MetaInfo()
+	skip := func(idx uint32) bool {
+		return !remote.Has(idx) || bt.Has(idx) || m[idx] || (idx < uint32(len(prios)) && !prios[idx].Wanted()) || !meta.PieceVerifiable(idx)
+	}
+	idx, has = t.pickDeadlinePiece(bt, skip)
+	if has {
+		return
+	}
+	if t.Sequential() {
+		return t.pickSequentialPiece(prios, skip)
+	}
+	// pick rarest piece from the highest priority files first
+	for p := storage.PriorityHigh; p > storage.PrioritySkip; p-- {
+		idx, has = remote.FindRarest(swarm, func(idx uint32) bool {
+			return bt.Has(idx) || m[idx] || (idx < uint32(len(prios)) && prios[idx] != p) || !meta.PieceVerifiable(idx)
+		})
+		if has {
+			return
+		}
+	}
 	return
 }
 
@@ -247,10 +322,20 @@ func (t *Torrent) GetStatus() TorrentStatus {
 	t.VisitPeers(func(c *PeerConn) {
 		peers = append(peers, c.Stats())
 	})
+	t.visitWebSeeds(func(ws *webSeed) {
+		peers = append(peers, ws.Stats())
+	})
+	var localErr string
+	if err := t.LocalError(); err != nil {
+		localErr = err.Error()
+	}
 	state := Downloading
 	if t.st.Checking() {
 		state = Checking
 	}
+	if t.Queued() {
+		state = Queued
+	}
 	if !t.Ready() {
 		return TorrentStatus{
 			Peers:    peers,
@@ -259,6 +344,7 @@ func (t *Torrent) GetStatus() TorrentStatus {
 			Infohash: t.st.Infohash().Hex(),
 			TX:       t.tx,
 			RX:       t.rx,
+			Error:    localErr,
 			Us: PeerConnStats{
 				TX:     float64(t.TX()),
 				RX:     float64(t.RX()),
@@ -273,6 +359,12 @@ func (t *Torrent) GetStatus() TorrentStatus {
 	} else if t.closing || !t.started {
 		state = Stopped
 	}
+	if t.finished {
+		state = Finished
+	}
+	if t.Queued() {
+		state = Queued
+	}
 	if t.st.Checking() {
 		state = Checking
 	}
@@ -280,56 +372,53 @@ func (t *Torrent) GetStatus() TorrentStatus {
 	bf := t.Bitfield()
 	var files []TorrentFileInfo
 	nfo := t.st.MetaInfo().Info
-	var idx uint64
-	f := nfo.GetFiles()
-	if len(f) == 1 {
-		b := bittorrent.Bitfield{
-			Data:   bf.Data,
-			Length: bf.Length,
+	prios := t.st.FilePriorities()
+	filesWanted := t.st.FilesWanted()
+	for idx, file := range nfo.GetFiles() {
+		begin, end := nfo.FilePieces(idx)
+		progress := 1.0
+		if end > begin {
+			var have uint32
+			for i := begin; i < end; i++ {
+				if bf.Has(i) {
+					have++
+				}
+			}
+			progress = float64(have) / float64(end-begin)
+		}
+		prio := storage.PriorityNormal
+		if idx < len(prios) {
+			prio = prios[idx]
 		}
 		files = append(files, TorrentFileInfo{
-			FileInfo: f[0],
-			Progress: b.Progress(),
+			FileInfo: file,
+			Progress: progress,
+			Priority: prio,
+			Wanted:   idx >= len(filesWanted) || filesWanted[idx],
 		})
-	} else {
-		for _, file := range f {
-			l := file.Length / uint64(nfo.PieceLength)
-			// XXX: this below here is wrong because how the bits are packed in the bitfield
-			l /= 8
-			plen := l
-			var data []byte
-			if l == 0 {
-				data = []byte{bf.Data[idx]}
-				plen = 1
-			} else if idx+l < uint64(len(bf.Data)) {
-				data = bf.Data[idx : idx+l]
-			} else {
-				data = bf.Data[idx:]
-			}
-			b := bittorrent.Bitfield{
-				Data:   data,
-				Length: uint32(plen),
-			}
-			files = append(files, TorrentFileInfo{
-				FileInfo: file,
-				Progress: b.Progress(),
-			})
-			idx += l
-		}
 	}
-	b := bittorrent.Bitfield{
-		Data:   bf.Data,
-		Length: bf.Length,
+	// only count pieces from wanted files
+	progress := bf.Progress()
+	wanted := t.wantedBitfield()
+	if wanted != nil {
+		progress = 1.0
+		n := wanted.CountSet()
+		if n > 0 {
+			progress = float64(bf.AND(wanted).CountSet()) / float64(n)
+		}
 	}
 	return TorrentStatus{
-		Peers:    peers,
-		Name:     name,
-		State:    state,
-		Infohash: t.MetaInfo().Infohash().Hex(),
-		Progress: b.Progress(),
-		Files:    files,
-		TX:       t.tx,
-		RX:       t.rx,
+		Peers:        peers,
+		Name:         name,
+		State:        state,
+		Infohash:     t.MetaInfo().Infohash().Hex(),
+		Progress:     progress,
+		Files:        files,
+		Sequential:   t.Sequential(),
+		SuperSeeding: t.SuperSeeding(),
+		TX:           t.tx,
+		RX:           t.rx,
+		Error:        localErr,
 		Us: PeerConnStats{
 			TX:     float64(t.TX()),
 			RX:     float64(t.RX()),
@@ -451,6 +540,10 @@ func (t *Torrent) addPeers(peers []common.Peer) {
 			if t.HasOBConn(a) {
 				continue
 			}
+			if t.blocklist.BlockedAddr(a) {
+				log.Debugf("not adding blocked peer %s", a)
+				continue
+			}
 			// no error resolving
 			go t.PersistPeer(a, p.ID)
 		} else {
@@ -502,7 +595,7 @@ func (t *Torrent) addOBPeer(c *PeerConn) {
 	t.connMtx.Lock()
 	t.obconns[addr.String()] = c
 	t.connMtx.Unlock()
-	t.pexState.onNewPeer(addr)
+	t.pexState.onNewPeer(addr, true)
 }
 
 func (t *Torrent) removeOBConn(c *PeerConn) {
@@ -519,7 +612,7 @@ func (t *Torrent) addIBPeer(c *PeerConn) {
 	t.ibconns[addr.String()] = c
 	t.connMtx.Unlock()
 	c.inbound = true
-	t.pexState.onNewPeer(addr)
+	t.pexState.onNewPeer(addr, false)
 }
 
 func (t *Torrent) removeIBConn(c *PeerConn) {
@@ -574,7 +667,12 @@ func (t *Torrent) putInfoSlice(idx uint32, data []byte) {
 			t.puttingMetaInfo = true
 			log.Debugf("got all info slices: %q", t.metaInfo)
 			log.Info("putting metainfo")
+			old := t.Infohash()
 			err := t.st.PutInfoBytes(t.metaInfo)
+			if err == nil && !old.Equal(t.Infohash()) && t.InfohashChanged != nil {
+				// hybrid torrent added by v2 magnet is known by its v1 infohash now
+				t.InfohashChanged(old)
+			}
 			if err == nil {
 				// reset
 				sz := uint32(len(t.metaInfo))
@@ -619,6 +717,24 @@ func (t *Torrent) DialPeer(a net.Addr, id common.PeerID) error {
 	if t.HasOBConn(a) {
 		return nil
 	}
+	if t.bans.isBanned(addrBanKey(a), idBanKey(id)) {
+		log.Debugf("not dialing banned peer %s", a)
+		return ErrPeerBanned
+	}
+	if t.blocklist.BlockedAddr(a) {
+		log.Debugf("not dialing blocked peer %s", a)
+		return ErrPeerBlocked
+	}
+	if !t.connMgr.makeRoom(t) {
+		return ErrConnLimit
+	}
+	for !t.connMgr.acquireDial() {
+		if t.closing {
+			return ErrConnLimit
+		}
+		time.Sleep(connDialWait)
+	}
+	defer t.connMgr.releaseDial()
 	ih := t.st.Infohash()
 	log.Debugf("%s %s ", a.String(), a.Network())
 	c, err := t.Network().Dial(a.Network(), a.String())
@@ -628,6 +744,10 @@ func (t *Torrent) DialPeer(a net.Addr, id common.PeerID) error {
 		var ourh, h bittorrent.Handshake
 		// enable bittorrent extensions
 		ourh.Reserved.Set(bittorrent.Extension)
+		ourh.Reserved.Set(bittorrent.Fast)
+		if t.isV2() {
+			ourh.Reserved.Set(bittorrent.V2)
+		}
 		copy(ourh.Infohash[:], ih[:])
 		copy(ourh.PeerID[:], t.id[:])
 		// send handshake
@@ -636,7 +756,9 @@ func (t *Torrent) DialPeer(a net.Addr, id common.PeerID) error {
 			// get response to handshake
 			err = h.Recv(c)
 			if err == nil {
-				if bytes.Equal(ih[:], h.Infohash[:]) {
+				if t.bans.isBanned(idBanKey(h.PeerID)) {
+					err = ErrPeerBanned
+				} else if bytes.Equal(ih[:], h.Infohash[:]) {
 					// infohashes match
 					var opts extensions.Message
 					h.Reserved.Intersect(ourh.Reserved)
@@ -650,11 +772,10 @@ func (t *Torrent) DialPeer(a net.Addr, id common.PeerID) error {
 						log.Debugf("%s does not support extensions", h.PeerID.String())
 					}
 					pc := makePeerConn(c, t, h.PeerID, opts, h.Reserved)
+					t.recordPeer(a, h.PeerID, true)
 					t.addOBPeer(pc)
 					pc.start()
-					if t.Ready() {
-						pc.Send(t.Bitfield().ToWireMessage())
-					}
+					pc.sendBitfield()
 					return nil
 				} else {
 					log.Warnf("%s Infohash missmatch", h.PeerID.String())
@@ -666,9 +787,29 @@ func (t *Torrent) DialPeer(a net.Addr, id common.PeerID) error {
 		c.Close()
 	}
 	log.Debugf("didn't connect to %s: %s", a, err)
+	t.recordPeer(a, id, false)
 	return err
 }
 
+// how many block requests we can have outstanding to peers that are not choking us
+func (t *Torrent) requestBudget() (n int) {
+	t.VisitPeers(func(c *PeerConn) {
+		if !c.RemoteChoking() {
+			n += c.RequestWindow()
+		}
+	})
+	return
+}
+
+// cancel requests to other peers for a block we got during endgame
+func (t *Torrent) cancelDuplicates(from *PeerConn, d *common.PieceData) {
+	t.VisitPeers(func(c *PeerConn) {
+		if c != from {
+			c.cancelObtained(d)
+		}
+	})
+}
+
 func (t *Torrent) broadcastHave(idx uint32) {
 	msg := common.NewHave(idx)
 	log.Debugf("%s got piece %d", t.Name(), idx)
@@ -694,9 +835,9 @@ func (t *Torrent) Name() string {
 	return t.Infohash().Hex()
 }
 
-// return false if we reached max peers for this torrent
+// return false if we reached max peers for this torrent or the swarm has no room for more
 func (t *Torrent) NeedsPeers() bool {
-	return t.NumPeers() <= t.MaxPeers
+	return t.NumPeers() <= t.MaxPeers && t.connMgr.hasRoom(t)
 }
 
 // callback called when we get a new inbound peer
@@ -707,11 +848,15 @@ func (t *Torrent) onNewPeer(c *PeerConn) {
 		c.Close()
 		return
 	}
-	if t.NeedsPeers() && t.Ready() {
+	if t.NeedsPeers() && t.Ready() && t.connMgr.makeRoom(t) {
 		log.Debugf("New inbound peer (%s) for %s", c.id.String(), t.st.Infohash().Hex())
+		if a.Network() == "i2p" {
+			// i2p peers can be dialed back at the address they came from
+			t.recordPeer(a, c.id, true)
+		}
 		t.addIBPeer(c)
 		c.start()
-		c.Send(t.Bitfield().ToWireMessage())
+		c.sendBitfield()
 	} else {
 		log.Debugf("New inbound peer (%s) for %s rejected due to limit or torrent not ready", c.id.String(), t.st.Infohash().Hex())
 		c.Close()
@@ -728,6 +873,11 @@ func (t *Torrent) run() {
 	}
 	t.started = true
 	go t.runRateTicker()
+	t.runUntilSeeding()
+}
+
+// fetch metadata if we need it and begin seeding once we have every piece
+func (t *Torrent) runUntilSeeding() {
 	counter := 0
 	for !t.closing {
 		if !t.Ready() {
@@ -743,26 +893,45 @@ func (t *Torrent) run() {
 			}
 			continue
 		}
-		if t.Done() {
-			if t.seeding {
-				break
-			} else {
-				var err error
-				t.seeding, err = t.st.Seed()
-				if t.seeding {
-					log.Infof("%s is seeding", t.Name())
-					t.AnnounceSeed()
-				} else if err != nil {
-					log.Errorf("failed to begin seeding: %s", err.Error())
-				} else {
-					log.Infof("will need to redownload pieces for %s", t.Name())
-				}
-			}
+		if t.checkSeeding() {
+			break
 		}
 		time.Sleep(time.Second)
 	}
 }
 
+// begin seeding once we have every piece, returns true if we are seeding
+func (t *Torrent) checkSeeding() bool {
+	if !t.Done() {
+		t.wantedDone = false
+		return false
+	}
+	if t.seeding {
+		return true
+	}
+	if !t.Bitfield().Completed() {
+		// we have all pieces of wanted files, seeding would check every piece again and find the skipped ones missing
+		// keep waiting in case a skipped file is wanted again
+		if !t.wantedDone {
+			log.Infof("%s finished downloading wanted files", t.Name())
+			t.wantedDone = true
+		}
+		return false
+	}
+	var err error
+	t.seeding, err = t.st.Seed()
+	if t.seeding {
+		log.Infof("%s is seeding", t.Name())
+		t.beganSeeding(time.Now())
+		t.AnnounceSeed()
+	} else if err != nil {
+		log.Errorf("failed to begin seeding: %s", err.Error())
+	} else {
+		log.Infof("will need to redownload pieces for %s", t.Name())
+	}
+	return t.seeding
+}
+
 func (t *Torrent) Private() bool {
 	info := t.MetaInfo()
 	if info == nil {
@@ -773,6 +942,9 @@ func (t *Torrent) Private() bool {
 
 func (t *Torrent) tick() {
 
+	t.tickDHT()
+	t.tickPeerCache()
+
 	if !t.Ready() {
 		return
 	}
@@ -795,8 +967,11 @@ func (t *Torrent) tick() {
 						connected = append(connected, p.btPeer())
 					}
 				})
+				added, addedf, dropped := t.pexState.PopLokiPeerLists(t.pexFlags)
 				t.VisitPeers(func(p *PeerConn) {
-					if p.SupportsLNPEX() {
+					if p.SupportsUTPEX() {
+						p.sendUTPEX(added, addedf, dropped)
+					} else if p.SupportsLNPEX() {
 						p.sendLNPEX(connected, []common.Peer{})
 					}
 				})
@@ -813,6 +988,10 @@ func (t *Torrent) tick() {
 		conn.sendKeepAlive()
 	})
 
+	t.tickChoke(time.Now())
+	t.tickSuperSeed()
+	t.tickSeedLimits(time.Now())
+
 	if t.Done() {
 		return
 	}
@@ -832,10 +1011,30 @@ func (t *Torrent) tick() {
 	t.VisitPeers(func(conn *PeerConn) {
 		conn.tickDownload()
 	})
+	t.tickWebSeeds()
 }
 
 func (t *Torrent) handlePieceRequest(c *PeerConn, r *common.PieceRequest) {
 
+	if c.Chocking() && !c.weAllowFast(r.Index) {
+		log.Debugf("%s asked for piece %d while choked, rejecting request", c.id.String(), r.Index)
+		c.rejectRequest(r)
+		return
+	}
+
+	bf := t.Bitfield()
+	if bf == nil || !bf.Has(r.Index) {
+		log.Debugf("%s asked for piece %d we do not have, rejecting request", c.id.String(), r.Index)
+		c.rejectRequest(r)
+		return
+	}
+
+	if !t.superSeedAllowed(c, r.Index) {
+		log.Debugf("%s asked for piece %d we did not offer while super seeding, rejecting request", c.id.String(), r.Index)
+		c.rejectRequest(r)
+		return
+	}
+
 	if r.Length > 0 {
 		var pc common.PieceData
 		log.Debugf("%s asked for piece %d %d-%d", c.id.String(), r.Index, r.Begin, r.Begin+r.Length)
@@ -861,16 +1060,22 @@ func (t *Torrent) handlePieceRequest(c *PeerConn, r *common.PieceRequest) {
 
 }
 
+// Done returns true if we have all pieces of all wanted files
 func (t *Torrent) Done() bool {
 	bf := t.Bitfield()
 	if bf == nil {
 		return false
 	}
-	return bf.Completed()
+	wanted := t.wantedBitfield()
+	if wanted == nil {
+		return bf.Completed()
+	}
+	return !bf.Inverted().AND(wanted).AnySet()
 }
 
 var ErrAlreadyStopped = errors.New("torrent already stopped")
 var ErrAlreadyStarted = errors.New("torrent already started")
+var ErrBadPieceIndex = errors.New("no such piece")
 
 func (t *Torrent) runRateTicker() {
 	for t.started {
@@ -921,7 +1126,18 @@ func (t *Torrent) Start() error {
 	if t.started {
 		return ErrAlreadyStarted
 	}
+	err := t.checkFreeSpace()
+	if err != nil {
+		return err
+	}
 	t.closing = false
+	t.setQueued(false)
+	if t.finished {
+		// seeding goals count again from now
+		t.finished = false
+		t.beganSeeding(time.Now())
+	}
+	t.loadPeerCache()
 	t.StartAnnouncing()
 	go t.run()
 	return nil
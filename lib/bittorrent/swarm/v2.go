@@ -0,0 +1,148 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/metainfo"
+	"time"
+)
+
+// how long we wait for an answer to a hash request before asking again
+const hashRequestTimeout = time.Minute
+
+// v2 piece layers we are fetching from peers
+type pieceLayerFetch struct {
+	// when each hash request was sent by pieces root and index
+	requested map[common.HashesRequest]time.Time
+	// verified hashes by pieces root and index
+	got map[[32]byte]map[uint32][][32]byte
+}
+
+// return true if this torrent has v2 metadata
+func (t *Torrent) isV2() bool {
+	meta := t.MetaInfo()
+	return meta != nil && meta.IsV2()
+}
+
+// SupportsV2 returns true if this peer does BitTorrent v2
+func (c *PeerConn) SupportsV2() bool {
+	return c.reserved.Has(bittorrent.V2)
+}
+
+// ask a peer for the piece layers we don't have yet
+func (t *Torrent) requestPieceLayers(c *PeerConn) {
+	if !c.SupportsV2() || !t.isV2() {
+		return
+	}
+	meta := t.MetaInfo()
+	missing := meta.MissingPieceLayers()
+	if len(missing) == 0 {
+		return
+	}
+	now := time.Now()
+	t.hashMtx.Lock()
+	defer t.hashMtx.Unlock()
+	if t.layers.requested == nil {
+		t.layers.requested = make(map[common.HashesRequest]time.Time)
+		t.layers.got = make(map[[32]byte]map[uint32][][32]byte)
+	}
+	for _, f := range missing {
+		var root [32]byte
+		copy(root[:], f.PiecesRoot)
+		for _, req := range meta.PieceLayerRequests(f) {
+			if _, got := t.layers.got[root][req.Index]; got {
+				continue
+			}
+			if now.Sub(t.layers.requested[req]) < hashRequestTimeout {
+				continue
+			}
+			t.layers.requested[req] = now
+			log.Debugf("asking %s for %d hashes of %x at %d", c.id.String(), req.Length, req.PiecesRoot, req.Index)
+			c.Send(req.ToWireMessage())
+		}
+	}
+}
+
+// got hashes for one of our hash requests
+func (t *Torrent) gotHashes(c *PeerConn, req common.HashesRequest, hashes [][32]byte) {
+	meta := t.MetaInfo()
+	layer, err := meta.VerifyHashes(req, hashes)
+	if err != nil {
+		log.Warnf("%s sent bad hashes: %s", c.id.String(), err.Error())
+		return
+	}
+	var f metainfo.FileInfo
+	found := false
+	for _, fi := range meta.MissingPieceLayers() {
+		if string(fi.PiecesRoot) == string(req.PiecesRoot[:]) {
+			f = fi
+			found = true
+		}
+	}
+	if !found {
+		// already have it
+		return
+	}
+	t.hashMtx.Lock()
+	if t.layers.got == nil {
+		t.hashMtx.Unlock()
+		return
+	}
+	chunks := t.layers.got[req.PiecesRoot]
+	if chunks == nil {
+		chunks = make(map[uint32][][32]byte)
+		t.layers.got[req.PiecesRoot] = chunks
+	}
+	chunks[req.Index] = layer
+	reqs := meta.PieceLayerRequests(f)
+	var full []byte
+	for _, r := range reqs {
+		chunk, ok := chunks[r.Index]
+		if !ok {
+			t.hashMtx.Unlock()
+			return
+		}
+		for _, h := range chunk {
+			full = append(full, h[:]...)
+		}
+	}
+	delete(t.layers.got, req.PiecesRoot)
+	for _, r := range reqs {
+		delete(t.layers.requested, r)
+	}
+	t.hashMtx.Unlock()
+	// drop hashes of padding past the end of the file
+	n := int((f.Length + uint64(meta.Info.PieceLength) - 1) / uint64(meta.Info.PieceLength))
+	err = t.st.PutPieceLayer(f.PiecesRoot, full[:n*32])
+	if err == nil {
+		log.Infof("got piece layer for %s in %s", f.Path.FilePath(""), t.Name())
+	} else {
+		log.Errorf("failed to put piece layer for %s: %s", f.Path.FilePath(""), err.Error())
+	}
+}
+
+// handle wire messages from BitTorrent v2
+func (c *PeerConn) handleV2Message(msgid common.WireMessageType, msg common.WireMessage) {
+	if !c.t.isV2() {
+		return
+	}
+	req := msg.GetHashesRequest()
+	if req == nil {
+		return
+	}
+	switch msgid {
+	case common.HashRequest:
+		hashes, err := c.t.MetaInfo().Hashes(*req)
+		if err == nil {
+			c.Send(common.NewHashes(*req, hashes))
+		} else {
+			log.Debugf("rejecting hash request from %s: %s", c.id.String(), err.Error())
+			c.Send(common.NewHashReject(*req))
+		}
+	case common.Hashes:
+		c.t.gotHashes(c, *req, msg.GetHashes())
+	case common.HashReject:
+		log.Debugf("%s rejected hash request for %x at %d", c.id.String(), req.PiecesRoot, req.Index)
+	}
+}
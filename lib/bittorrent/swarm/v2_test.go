@@ -0,0 +1,97 @@
+package swarm
+
+import (
+	"encoding/hex"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/majestrate/XD/lib/metainfo"
+	"github.com/majestrate/XD/lib/storage"
+	"github.com/zeebo/bencode"
+	"testing"
+)
+
+func TestParseMagnetInfohash(t *testing.T) {
+	v1 := "urn:btih:6bcdc07177ec43658c1b4d5450640059663a5214"
+	v2 := "urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	ih2, _ := common.DecodeInfohashV2("caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e")
+	ih, err := parseMagnetInfohash([]string{v2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ih != ih2.Truncated() {
+		t.Fatalf("v2 magnet gave infohash %s", ih.Hex())
+	}
+	ih, err = parseMagnetInfohash([]string{v2, v1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ih.Hex() != "6bcdc07177ec43658c1b4d5450640059663a5214" {
+		t.Fatalf("hybrid magnet gave infohash %s", ih.Hex())
+	}
+	if _, err = parseMagnetInfohash([]string{"urn:btmh:1114abcd"}); err == nil {
+		t.Fatal("parsed magnet with unsupported multihash")
+	}
+}
+
+func TestResolveV2Magnet(t *testing.T) {
+	dir := t.TempDir()
+	testResolveV2Magnet(t, &storage.FsStorage{
+		MetaDir:    fs.STD.Join(dir, "meta"),
+		DataDir:    fs.STD.Join(dir, "data"),
+		SeedingDir: fs.STD.Join(dir, "seeding"),
+		FS:         fs.STD,
+	})
+	testResolveV2Magnet(t, &storage.MemStorage{})
+}
+
+func testResolveV2Magnet(t *testing.T, st storage.Storage) {
+	if err := st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	// hybrid torrent with one piece
+	raw, err := bencode.EncodeBytes(map[string]interface{}{
+		"name":         "test",
+		"piece length": BlockSize,
+		"pieces":       string(make([]byte, 20)),
+		"length":       BlockSize,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"test": map[string]interface{}{"": map[string]interface{}{"length": BlockSize, "pieces root": string(make([]byte, 32))}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := metainfo.TorrentFileFromInfoBytes(raw)
+	if err != nil || !meta.IsHybrid() {
+		t.Fatalf("bad hybrid torrent: %v", err)
+	}
+	ih2 := meta.InfohashV2()
+	ih, err := parseMagnetInfohash([]string{"urn:btmh:1220" + hex.EncodeToString(ih2[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Holder{st: st, queue: new(torrentQueue), StalledTime: DefaultStalledTime}
+	h.addTorrent(st.EmptyTorrent(ih), nil)
+	tr := h.GetTorrent(ih)
+	if tr == nil {
+		t.Fatal("magnet not added")
+	}
+	// metadata from a peer
+	tr.metaInfo = make([]byte, len(raw))
+	tr.pendingInfoBF = bittorrent.NewBitfield(1, nil)
+	tr.requestingInfoBF = bittorrent.NewBitfield(1, nil)
+	tr.putInfoSlice(0, raw)
+	if !tr.Ready() {
+		t.Fatal("metainfo of v2 magnet not accepted")
+	}
+	if !tr.Infohash().Equal(meta.Infohash()) {
+		t.Fatalf("torrent has infohash %s instead of v1 infohash", tr.Infohash().Hex())
+	}
+	if h.GetTorrent(meta.Infohash()) != tr || h.GetTorrent(ih) != tr {
+		t.Fatal("torrent not found by both infohashes")
+	}
+}
@@ -0,0 +1,302 @@
+package swarm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/metainfo"
+	"github.com/majestrate/XD/lib/sync"
+	"github.com/majestrate/XD/lib/util"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// how long we wait before retrying a web seed after it failed
+const webSeedRetryInterval = time.Second * 30
+
+// longest we wait before retrying a web seed that keeps failing
+const webSeedMaxRetryInterval = time.Minute * 30
+
+var ErrBadWebSeedResponse = errors.New("bad web seed response")
+
+var ErrBadWebSeedData = errors.New("web seed sent data that failed the hash check")
+
+// a web seed (BEP 19) we download missing pieces from over http
+type webSeed struct {
+	url      string
+	t        *Torrent
+	client   *http.Client
+	rx       *util.Rate
+	mtx      sync.Mutex
+	busy     bool
+	failures int
+	retryAt  time.Time
+}
+
+func newWebSeed(t *Torrent, u string) *webSeed {
+	return &webSeed{
+		url: u,
+		t:   t,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return t.Network().Dial(network, addr)
+				},
+			},
+			Timeout: time.Minute * 2,
+		},
+		rx: util.NewRate(10),
+	}
+}
+
+// AddWebSeed adds a web seed url to download pieces from
+func (t *Torrent) AddWebSeed(u string) {
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		log.Warnf("ignoring web seed %s", u)
+		return
+	}
+	t.webSeedMtx.Lock()
+	defer t.webSeedMtx.Unlock()
+	for _, ws := range t.webSeeds {
+		if ws.url == u {
+			return
+		}
+	}
+	log.Debugf("add web seed %s to %s", u, t.Name())
+	t.webSeeds = append(t.webSeeds, newWebSeed(t, u))
+}
+
+// WebSeeds gets the urls of all web seeds
+func (t *Torrent) WebSeeds() (urls []string) {
+	t.webSeedMtx.Lock()
+	for _, ws := range t.webSeeds {
+		urls = append(urls, ws.url)
+	}
+	t.webSeedMtx.Unlock()
+	return
+}
+
+func (t *Torrent) visitWebSeeds(v func(*webSeed)) {
+	t.webSeedMtx.Lock()
+	seeds := make([]*webSeed, len(t.webSeeds))
+	copy(seeds, t.webSeeds)
+	t.webSeedMtx.Unlock()
+	for _, ws := range seeds {
+		v(ws)
+	}
+}
+
+// start downloads from idle web seeds
+func (t *Torrent) tickWebSeeds() {
+	now := time.Now()
+	t.visitWebSeeds(func(ws *webSeed) {
+		ws.rx.Tick()
+		if t.closing || t.Done() {
+			return
+		}
+		if ws.start(now) {
+			go ws.download()
+		}
+	})
+}
+
+// mark web seed as busy if it is idle and not backing off
+func (ws *webSeed) start(now time.Time) bool {
+	ws.mtx.Lock()
+	defer ws.mtx.Unlock()
+	if ws.busy || now.Before(ws.retryAt) {
+		return false
+	}
+	ws.busy = true
+	return true
+}
+
+// mark web seed as idle, backing off if the download failed
+func (ws *webSeed) finish(err error) {
+	ws.mtx.Lock()
+	defer ws.mtx.Unlock()
+	ws.busy = false
+	if err == nil {
+		ws.failures = 0
+		return
+	}
+	ws.failures++
+	backoff := webSeedRetryInterval * time.Duration(ws.failures)
+	if backoff > webSeedMaxRetryInterval {
+		backoff = webSeedMaxRetryInterval
+	}
+	ws.retryAt = time.Now().Add(backoff)
+	log.Warnf("web seed %s failed: %s, retry in %s", ws.url, err.Error(), backoff)
+}
+
+// web seed stats as a pseudo peer
+func (ws *webSeed) Stats() (st *PeerConnStats) {
+	st = &PeerConnStats{
+		RX:           ws.rx.Mean(),
+		ID:           "webseed",
+		Client:       "Web Seed",
+		Addr:         ws.url,
+		UsInterested: true,
+		WebSeed:      true,
+	}
+	ws.mtx.Lock()
+	st.Downloading = ws.busy
+	ws.mtx.Unlock()
+	if meta := ws.t.MetaInfo(); meta != nil {
+		bf := bittorrent.NewBitfield(meta.Info.NumPieces(), nil)
+		bf.Fill()
+		st.Bitfield.CopyFrom(bf)
+	}
+	return
+}
+
+// get the url a file is served at
+func (ws *webSeed) fileURL(meta *metainfo.TorrentFile, f metainfo.FileInfo) string {
+	u := ws.url
+	if meta.IsSingleFile() {
+		if strings.HasSuffix(u, "/") {
+			u += url.PathEscape(meta.Info.Path)
+		}
+		return u
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	parts := []string{url.PathEscape(meta.Info.Path)}
+	for _, p := range f.Path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return u + strings.Join(parts, "/")
+}
+
+// grab contiguous block requests of one piece from the piece tracker
+func (ws *webSeed) nextRequests() (reqs []*common.PieceRequest) {
+	meta := ws.t.MetaInfo()
+	if meta == nil {
+		return
+	}
+	remote := bittorrent.NewBitfield(meta.Info.NumPieces(), nil)
+	remote.Fill()
+	var last *common.PieceRequest
+	for {
+		r := ws.t.pt.NextRequest(remote, last)
+		if r == nil {
+			return
+		}
+		if last != nil && (r.Index != last.Index || r.Begin != last.Begin+last.Length) {
+			// not part of this range, give it back
+			ws.t.pt.canceledRequest(r)
+			return
+		}
+		reqs = append(reqs, r)
+		last = r
+	}
+}
+
+// download one range of a piece and hand it to the piece tracker
+func (ws *webSeed) download() {
+	var err error
+	defer func() {
+		ws.finish(err)
+	}()
+	reqs := ws.nextRequests()
+	if len(reqs) == 0 {
+		return
+	}
+	meta := ws.t.MetaInfo()
+	first, last := reqs[0], reqs[len(reqs)-1]
+	buf := make([]byte, last.Begin+last.Length-first.Begin)
+	off := uint64(first.Index)*uint64(meta.Info.PieceLength) + uint64(first.Begin)
+	err = ws.readRange(meta, off, buf)
+	if err != nil {
+		for _, r := range reqs {
+			ws.t.pt.canceledRequest(r)
+		}
+		return
+	}
+	for _, r := range reqs {
+		bad := ws.t.pt.handlePieceData(&common.PieceData{
+			Index: r.Index,
+			Begin: r.Begin,
+			Data:  buf[r.Begin-first.Begin:][:r.Length],
+		}, nil)
+		if bad != nil {
+			// back off so we do not download the same bad piece again right away
+			err = ErrBadWebSeedData
+		}
+	}
+	ws.t.gotData(time.Now())
+}
+
+// read torrent data starting at off into buf, fetching each file it spans with a range request
+func (ws *webSeed) readRange(meta *metainfo.TorrentFile, off uint64, buf []byte) (err error) {
+	for _, f := range meta.Info.GetFiles() {
+		if len(buf) == 0 {
+			return
+		}
+		if off >= f.Length {
+			off -= f.Length
+			continue
+		}
+		n := f.Length - off
+		if n > uint64(len(buf)) {
+			n = uint64(len(buf))
+		}
+		if f.IsPadding() {
+			for idx := range buf[:n] {
+				buf[idx] = 0
+			}
+		} else {
+			err = ws.fetch(ws.fileURL(meta, f), off, buf[:n])
+			if err != nil {
+				return
+			}
+		}
+		buf = buf[n:]
+		off = 0
+	}
+	if len(buf) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// fetch len(buf) bytes at offset off of a remote file
+func (ws *webSeed) fetch(u string, off uint64, buf []byte) (err error) {
+	var req *http.Request
+	req, err = http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+uint64(len(buf))-1))
+	var resp *http.Response
+	resp, err = ws.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// server ignored the range
+		_, err = io.CopyN(util.Discard, body, int64(off))
+	default:
+		err = fmt.Errorf("%s: %s", ErrBadWebSeedResponse, resp.Status)
+	}
+	if err == nil {
+		body = util.NewRateLimitedReader(body, ws.t.downloadLimiters()...)
+		_, err = io.ReadFull(body, buf)
+	}
+	if err == nil {
+		ws.rx.AddSample(uint64(len(buf)))
+		ws.t.statsTracker.AddSample(RateDownload, uint64(len(buf)))
+	}
+	return
+}
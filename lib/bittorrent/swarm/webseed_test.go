@@ -0,0 +1,97 @@
+package swarm
+
+import (
+	"bytes"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/metainfo"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSeedReadRange(t *testing.T) {
+	files := map[string][]byte{
+		"/seed/test dir/a":   []byte("01234"),
+		"/seed/test dir/d/b": []byte("abcdefghijklmnopqrst"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	meta, err := metainfo.TorrentFileFromInfo(metainfo.Info{
+		PieceLength: 16,
+		Pieces:      make([]byte, 40),
+		Path:        "test dir",
+		Files: []metainfo.FileInfo{
+			{Length: 5, Path: metainfo.FilePath{"a"}},
+			{Length: 20, Path: metainfo.FilePath{"d", "b"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTorrent(&testTorrentStorage{meta: meta, bf: bittorrent.NewBitfield(2, nil)}, nil)
+	ws := newWebSeed(tr, srv.URL+"/seed")
+	ws.client = srv.Client()
+	if u := ws.fileURL(meta, meta.Info.Files[1]); u != srv.URL+"/seed/test%20dir/d/b" {
+		t.Fatalf("bad file url %s", u)
+	}
+	buf := make([]byte, 10)
+	err = ws.readRange(meta, 3, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "34abcdefgh" {
+		t.Fatalf("read %q", buf)
+	}
+	ws.url = srv.URL + "/missing/"
+	if ws.readRange(meta, 0, buf) == nil {
+		t.Fatal("read from missing web seed")
+	}
+}
+
+func TestWebSeedSingleFileURL(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize, 1)
+	ws := newWebSeed(newTorrent(st, nil), "http://example.i2p/files/")
+	if u := ws.fileURL(st.meta, st.meta.Info.GetFiles()[0]); u != "http://example.i2p/files/test" {
+		t.Fatalf("bad url %s", u)
+	}
+	ws.url = "http://example.i2p/test.iso"
+	if u := ws.fileURL(st.meta, st.meta.Info.GetFiles()[0]); !strings.HasSuffix(u, "/test.iso") {
+		t.Fatalf("bad url %s", u)
+	}
+}
+
+func TestWebSeedBadPieceBacksOff(t *testing.T) {
+	st := newTestTorrentStorage(BlockSize*2, 1)
+	st.corrupt = true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(make([]byte, BlockSize*2)))
+	}))
+	defer srv.Close()
+	tr := newTorrent(st, nil)
+	ws := newWebSeed(tr, srv.URL+"/test")
+	ws.client = srv.Client()
+	now := time.Now()
+	if !ws.start(now) {
+		t.Fatal("idle web seed did not start")
+	}
+	ws.download()
+	if st.verifies != 1 {
+		t.Fatalf("piece verified %d times", st.verifies)
+	}
+	if ws.failures != 1 {
+		t.Fatalf("web seed has %d failures after sending a bad piece", ws.failures)
+	}
+	if ws.start(now) {
+		t.Fatal("web seed that sent a bad piece is not backing off")
+	}
+}
@@ -0,0 +1,300 @@
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/network/i2p"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// length of a base32 i2p destination hash without the .b32.i2p suffix
+const b32Len = 52
+
+// range of blocked ips, both ends included
+type ipRange struct {
+	first  net.IP
+	last   net.IP
+	source string
+}
+
+func (r *ipRange) contains(ip net.IP) bool {
+	return bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0
+}
+
+// SourceStats is the number of entries and hits for one blocklist source
+type SourceStats struct {
+	Entries int
+	Hits    uint64
+}
+
+// Stats is a summary of a blocklist
+type Stats struct {
+	Enabled bool
+	Entries int
+	Hits    uint64
+	Sources map[string]SourceStats
+}
+
+// Blocklist holds blocked destinations, names and ip ranges loaded from one or more sources
+// the zero value is not usable, use New
+type Blocklist struct {
+	access  sync.Mutex
+	enabled bool
+	hosts   map[string]string
+	ranges  []ipRange
+	entries map[string]int
+	hits    map[string]uint64
+}
+
+// New creates an empty enabled blocklist
+func New() *Blocklist {
+	return &Blocklist{
+		enabled: true,
+		hosts:   make(map[string]string),
+		entries: make(map[string]int),
+		hits:    make(map[string]uint64),
+	}
+}
+
+// normalize a host name for lookup
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if len(host) == b32Len && !strings.Contains(host, ".") {
+		host += ".b32.i2p"
+	}
+	return host
+}
+
+// parse a single ip, cidr or ip range
+func parseRange(str string) (first, last net.IP, ok bool) {
+	if strings.Contains(str, "/") {
+		_, n, err := net.ParseCIDR(str)
+		if err != nil {
+			return
+		}
+		first = n.IP.To16()
+		last = make(net.IP, len(first))
+		mask := n.Mask
+		if len(mask) == net.IPv4len {
+			// align v4 mask with 16 byte ip
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		ok = true
+		return
+	}
+	parts := strings.SplitN(str, "-", 2)
+	first = net.ParseIP(strings.TrimSpace(parts[0])).To16()
+	if len(parts) == 2 {
+		last = net.ParseIP(strings.TrimSpace(parts[1])).To16()
+	} else {
+		last = first
+	}
+	ok = first != nil && last != nil && bytes.Compare(first, last) <= 0
+	return
+}
+
+// parse one line of a blocklist into a host or an ip range
+func parseLine(line string) (host string, first, last net.IP, ok bool) {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		line = line[:idx]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	// p2p format has a description before the range
+	entry := line
+	if idx := strings.LastIndex(line, ":"); idx >= 0 && strings.Contains(line[idx:], "-") {
+		entry = line[idx+1:]
+	}
+	first, last, ok = parseRange(entry)
+	if ok {
+		return
+	}
+	host = normalizeHost(line)
+	ok = strings.HasSuffix(host, ".i2p") || strings.HasSuffix(host, ".loki")
+	return
+}
+
+// Load reads entries from a blocklist source, one per line
+// lines are base32 i2p destinations, .loki names, ips, cidr ranges or first-last ip ranges
+// returns how many entries were added
+func (b *Blocklist) Load(source string, r io.Reader) (n int, err error) {
+	var hosts []string
+	var ranges []ipRange
+	invalid := 0
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		host, first, last, ok := parseLine(sc.Text())
+		if !ok {
+			if strings.TrimSpace(sc.Text()) != "" {
+				invalid++
+			}
+			continue
+		}
+		if host == "" {
+			ranges = append(ranges, ipRange{first: first, last: last, source: source})
+		} else {
+			hosts = append(hosts, host)
+		}
+	}
+	err = sc.Err()
+	if err != nil {
+		return
+	}
+	if invalid > 0 {
+		log.Warnf("skipped %d invalid blocklist entries from %s", invalid, source)
+	}
+	n = len(hosts) + len(ranges)
+	b.access.Lock()
+	for _, host := range hosts {
+		b.hosts[host] = source
+	}
+	b.ranges = mergeRanges(append(b.ranges, ranges...))
+	b.entries[source] += n
+	b.access.Unlock()
+	return
+}
+
+// sort ranges and merge the ones that overlap so lookups can binary search
+func mergeRanges(ranges []ipRange) (merged []ipRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first, ranges[j].first) < 0
+	})
+	for _, r := range ranges {
+		l := len(merged)
+		if l > 0 && bytes.Compare(r.first, merged[l-1].last) <= 0 {
+			if bytes.Compare(r.last, merged[l-1].last) > 0 {
+				merged[l-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return
+}
+
+// Clear removes all entries, hit counters are kept
+func (b *Blocklist) Clear() {
+	b.access.Lock()
+	b.hosts = make(map[string]string)
+	b.ranges = nil
+	b.entries = make(map[string]int)
+	b.access.Unlock()
+}
+
+// Replace swaps in the entries of another blocklist, hit counters are kept
+func (b *Blocklist) Replace(other *Blocklist) {
+	other.access.Lock()
+	hosts, ranges, entries := other.hosts, other.ranges, other.entries
+	other.access.Unlock()
+	b.access.Lock()
+	b.hosts, b.ranges, b.entries = hosts, ranges, entries
+	b.access.Unlock()
+}
+
+// SetEnabled turns enforcement of the blocklist on or off
+func (b *Blocklist) SetEnabled(enabled bool) {
+	b.access.Lock()
+	b.enabled = enabled
+	b.access.Unlock()
+}
+
+// Enabled returns true if the blocklist is enforced
+func (b *Blocklist) Enabled() (enabled bool) {
+	b.access.Lock()
+	enabled = b.enabled
+	b.access.Unlock()
+	return
+}
+
+// Len gets the number of entries
+func (b *Blocklist) Len() (n int) {
+	b.access.Lock()
+	n = len(b.hosts) + len(b.ranges)
+	b.access.Unlock()
+	return
+}
+
+// find the source of the range holding ip, must hold lock
+func (b *Blocklist) findRange(ip net.IP) (source string, found bool) {
+	ip = ip.To16()
+	idx := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].first, ip) > 0
+	})
+	if idx > 0 && b.ranges[idx-1].contains(ip) {
+		return b.ranges[idx-1].source, true
+	}
+	return
+}
+
+// BlockedHost returns true if a host name or ip is blocked and counts the hit
+func (b *Blocklist) BlockedHost(host string) (blocked bool) {
+	if b == nil {
+		return
+	}
+	b.access.Lock()
+	defer b.access.Unlock()
+	if !b.enabled {
+		return
+	}
+	var source string
+	if ip := net.ParseIP(host); ip != nil {
+		source, blocked = b.findRange(ip)
+	} else {
+		source, blocked = b.hosts[normalizeHost(host)]
+	}
+	if blocked {
+		b.hits[source]++
+	}
+	return
+}
+
+// BlockedAddr returns true if a network address is blocked and counts the hit
+// i2p addresses are checked by both destination and base32 address
+func (b *Blocklist) BlockedAddr(a net.Addr) bool {
+	if b == nil || a == nil {
+		return false
+	}
+	host := a.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if b.BlockedHost(host) {
+		return true
+	}
+	if i2paddr, ok := a.(i2p.Addr); ok && !strings.HasSuffix(host, ".i2p") {
+		return b.BlockedHost(i2paddr.Base32Addr().String())
+	}
+	return false
+}
+
+// Stats gets entry and hit counts
+func (b *Blocklist) Stats() (st Stats) {
+	b.access.Lock()
+	st.Enabled = b.enabled
+	st.Entries = len(b.hosts) + len(b.ranges)
+	st.Sources = make(map[string]SourceStats)
+	for source, n := range b.entries {
+		s := st.Sources[source]
+		s.Entries = n
+		st.Sources[source] = s
+	}
+	for source, n := range b.hits {
+		s := st.Sources[source]
+		s.Hits = n
+		st.Sources[source] = s
+		st.Hits += n
+	}
+	b.access.Unlock()
+	return
+}
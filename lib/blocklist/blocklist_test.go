@@ -0,0 +1,67 @@
+package blocklist
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/majestrate/XD/lib/network/i2p"
+	"github.com/majestrate/XD/lib/network/inet"
+)
+
+const testList = `
+# comment
+ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p
+UKEU3K5OYCGAAUNEQGTNVSELMT4YEMVOILKLN7JPVAMVFX7DNKDA
+badnode.loki
+10.0.0.0/8
+some evil range:192.168.1.10-192.168.1.20
+172.16.0.1
+not a valid entry
+`
+
+func TestBlocklist(t *testing.T) {
+	b := New()
+	n, err := b.Load("test", strings.NewReader(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Fatalf("loaded %d entries, expected 6", n)
+	}
+	for _, host := range []string{
+		"ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p",
+		"ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkda.b32.i2p",
+		"BadNode.loki.",
+		"10.20.30.40",
+		"192.168.1.15",
+		"172.16.0.1",
+	} {
+		if !b.BlockedHost(host) {
+			t.Fatalf("%s is not blocked", host)
+		}
+	}
+	for _, host := range []string{
+		"goodnode.loki",
+		"11.0.0.1",
+		"192.168.1.21",
+		"172.16.0.2",
+	} {
+		if b.BlockedHost(host) {
+			t.Fatalf("%s is blocked", host)
+		}
+	}
+	if !b.BlockedAddr(inet.NewAddr("badnode.loki", "6881")) {
+		t.Fatal("loki address is not blocked")
+	}
+	if !b.BlockedAddr(i2p.I2PAddr("ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p")) {
+		t.Fatal("i2p address is not blocked")
+	}
+	st := b.Stats()
+	if st.Hits != 8 || st.Sources["test"].Hits != 8 {
+		t.Fatalf("expected 8 hits, got %d", st.Hits)
+	}
+	b.SetEnabled(false)
+	if b.BlockedHost("badnode.loki") {
+		t.Fatal("disabled blocklist blocked a host")
+	}
+}
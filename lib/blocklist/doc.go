@@ -0,0 +1,2 @@
+// blocklist of i2p destinations, lokinet addresses and ip ranges we refuse to talk to
+package blocklist
@@ -39,3 +39,34 @@ func DecodeInfohash(hexstr string) (ih Infohash, err error) {
 func (ih Infohash) Bytes() []byte {
 	return ih[:]
 }
+
+// InfohashV2 is a bittorrent v2 (BEP 52) sha256 infohash buffer
+type InfohashV2 [32]byte
+
+// Hex gets hex representation of v2 infohash
+func (ih InfohashV2) Hex() string {
+	return hex.EncodeToString(ih.Bytes())
+}
+
+// Bytes gets underlying byteslice of v2 infohash buffer
+func (ih InfohashV2) Bytes() []byte {
+	return ih[:]
+}
+
+// Truncated gets the v2 infohash truncated to 20 bytes as used on the wire and in trackers
+func (ih InfohashV2) Truncated() (t Infohash) {
+	copy(t[:], ih[:20])
+	return
+}
+
+// DecodeInfohashV2 decodes v2 infohash buffer from hex string
+func DecodeInfohashV2(hexstr string) (ih InfohashV2, err error) {
+	var dec []byte
+	dec, err = hex.DecodeString(hexstr)
+	if len(dec) == 32 {
+		copy(ih[:], dec[:])
+	} else {
+		err = ErrBadInfoHashLen
+	}
+	return
+}
@@ -33,6 +33,10 @@ func (pc PieceRequest) Cancel() WireMessage {
 	return NewCancel(pc.Index, pc.Begin, pc.Length)
 }
 
+func (pc PieceRequest) Reject() WireMessage {
+	return NewReject(pc.Index, pc.Begin, pc.Length)
+}
+
 // ErrInvalidPiece is an error for when a piece has invalid sha1sum
 var ErrInvalidPiece = errors.New("invalid piece")
 
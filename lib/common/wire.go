@@ -39,9 +39,33 @@ const Piece = WireMessageType(7)
 // Cancel is messageid for a Cancel message, used to cancel a pending request
 const Cancel = WireMessageType(8)
 
+// Suggest is messageid for a Suggest Piece message (BEP 6)
+const Suggest = WireMessageType(13)
+
+// HaveAll is messageid for a Have All message (BEP 6)
+const HaveAll = WireMessageType(14)
+
+// HaveNone is messageid for a Have None message (BEP 6)
+const HaveNone = WireMessageType(15)
+
+// Reject is messageid for a Reject Request message (BEP 6)
+const Reject = WireMessageType(16)
+
+// AllowedFast is messageid for an Allowed Fast message (BEP 6)
+const AllowedFast = WireMessageType(17)
+
 // Extended is messageid for ExtendedOptions message
 const Extended = WireMessageType(20)
 
+// HashRequest is messageid for a merkle hash request message (BEP 52)
+const HashRequest = WireMessageType(21)
+
+// Hashes is messageid for a response to a HashRequest message (BEP 52)
+const Hashes = WireMessageType(22)
+
+// HashReject is messageid for a rejected HashRequest message (BEP 52)
+const HashReject = WireMessageType(23)
+
 // special for invalid
 const Invalid = WireMessageType(255)
 
@@ -70,8 +94,24 @@ func (t WireMessageType) String() string {
 		return "Piece"
 	case Cancel:
 		return "Cancel"
+	case Suggest:
+		return "Suggest"
+	case HaveAll:
+		return "HaveAll"
+	case HaveNone:
+		return "HaveNone"
+	case Reject:
+		return "Reject"
+	case AllowedFast:
+		return "AllowedFast"
 	case Extended:
 		return "Extended"
+	case HashRequest:
+		return "HashRequest"
+	case Hashes:
+		return "Hashes"
+	case HashReject:
+		return "HashReject"
 	case Invalid:
 		return "INVALID"
 	default:
@@ -202,7 +242,8 @@ func (msg WireMessage) VisitPieceData(v func(*PieceData)) {
 
 // GetPieceRequest gets piece request from wire message
 func (msg WireMessage) GetPieceRequest() (req *PieceRequest) {
-	if msg.MessageID() == Request {
+	id := msg.MessageID()
+	if id == Request || id == Reject || id == Cancel {
 		data := msg.Payload()
 		if len(data) == 12 {
 			req = new(PieceRequest)
@@ -225,6 +266,19 @@ func (msg WireMessage) GetHave() (h uint32) {
 	return
 }
 
+// GetPieceIndex gets the piece index of a suggest or allowed fast message
+func (msg WireMessage) GetPieceIndex() (idx uint32, ok bool) {
+	id := msg.MessageID()
+	if id == Have || id == Suggest || id == AllowedFast {
+		data := msg.Payload()
+		if len(data) == 4 {
+			idx = binary.BigEndian.Uint32(data[:])
+			ok = true
+		}
+	}
+	return
+}
+
 // NewHave creates a new have message
 func NewHave(idx uint32) WireMessage {
 	var body [4]byte
@@ -249,3 +303,111 @@ func NewCancel(idx, offset, length uint32) WireMessage {
 	binary.BigEndian.PutUint32(body[8:], length)
 	return NewWireMessage(Cancel, body[:])
 }
+
+// NewHaveAll creates a new HaveAll message
+func NewHaveAll() WireMessage {
+	return NewWireMessage(HaveAll, nil)
+}
+
+// NewHaveNone creates a new HaveNone message
+func NewHaveNone() WireMessage {
+	return NewWireMessage(HaveNone, nil)
+}
+
+// NewSuggest creates a new Suggest Piece message
+func NewSuggest(idx uint32) WireMessage {
+	var body [4]byte
+	binary.BigEndian.PutUint32(body[:], idx)
+	return NewWireMessage(Suggest, body[:])
+}
+
+// NewAllowedFast creates a new Allowed Fast message
+func NewAllowedFast(idx uint32) WireMessage {
+	var body [4]byte
+	binary.BigEndian.PutUint32(body[:], idx)
+	return NewWireMessage(AllowedFast, body[:])
+}
+
+// NewReject creates a new Reject Request message
+func NewReject(idx, offset, length uint32) WireMessage {
+	var body [12]byte
+	binary.BigEndian.PutUint32(body[:], idx)
+	binary.BigEndian.PutUint32(body[4:], offset)
+	binary.BigEndian.PutUint32(body[8:], length)
+	return NewWireMessage(Reject, body[:])
+}
+
+// HashesRequest is a request for a range of merkle tree hashes of a file (BEP 52)
+type HashesRequest struct {
+	// root hash of the file's merkle tree
+	PiecesRoot [32]byte
+	// layer of the tree the hashes are from, 0 is the leaf layer
+	BaseLayer uint32
+	// index of the first hash in the base layer
+	Index uint32
+	// number of hashes from the base layer
+	Length uint32
+	// number of uncle hash layers to include as proof
+	ProofLayers uint32
+}
+
+func (req HashesRequest) header() []byte {
+	var body [48]byte
+	copy(body[:], req.PiecesRoot[:])
+	binary.BigEndian.PutUint32(body[32:], req.BaseLayer)
+	binary.BigEndian.PutUint32(body[36:], req.Index)
+	binary.BigEndian.PutUint32(body[40:], req.Length)
+	binary.BigEndian.PutUint32(body[44:], req.ProofLayers)
+	return body[:]
+}
+
+// ToWireMessage serialize to BitTorrent hash request message
+func (req HashesRequest) ToWireMessage() WireMessage {
+	return NewWireMessage(HashRequest, req.header())
+}
+
+// NewHashReject creates a new hash reject message for a hash request
+func NewHashReject(req HashesRequest) WireMessage {
+	return NewWireMessage(HashReject, req.header())
+}
+
+// NewHashes creates a new hashes message answering a hash request
+func NewHashes(req HashesRequest, hashes [][32]byte) WireMessage {
+	body := make([]byte, 0, 32*len(hashes))
+	for _, h := range hashes {
+		body = append(body, h[:]...)
+	}
+	return NewWireMessage(Hashes, req.header(), body)
+}
+
+// GetHashesRequest gets the hash request of a hash request, hashes or hash reject message
+func (msg WireMessage) GetHashesRequest() (req *HashesRequest) {
+	id := msg.MessageID()
+	if id == HashRequest || id == Hashes || id == HashReject {
+		data := msg.Payload()
+		if len(data) >= 48 {
+			req = new(HashesRequest)
+			copy(req.PiecesRoot[:], data[:32])
+			req.BaseLayer = binary.BigEndian.Uint32(data[32:])
+			req.Index = binary.BigEndian.Uint32(data[36:])
+			req.Length = binary.BigEndian.Uint32(data[40:])
+			req.ProofLayers = binary.BigEndian.Uint32(data[44:])
+		}
+	}
+	return
+}
+
+// GetHashes gets the hashes carried by a hashes message
+func (msg WireMessage) GetHashes() (hashes [][32]byte) {
+	if msg.MessageID() == Hashes {
+		data := msg.Payload()
+		if len(data) > 48 && (len(data)-48)%32 == 0 {
+			data = data[48:]
+			hashes = make([][32]byte, len(data)/32)
+			for idx := range hashes {
+				copy(hashes[idx][:], data[idx*32:])
+			}
+		}
+	}
+	return
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/majestrate/XD/lib/util"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const DefaultTorrentQueueSize = 0
@@ -71,6 +73,63 @@ type BittorrentConfig struct {
 	PieceWindowSize  int
 	Swarms           int
 	TorrentQueueSize int
+	UploadSlots      int
+	OptimisticSlots  int
+	// global rate limits in KiB/s, 0 means unlimited
+	MaxUploadRate   int
+	MaxDownloadRate int
+	// alternate rate limits in KiB/s
+	AltUploadRate   int
+	AltDownloadRate int
+	// turn on alternate rate limits by schedule
+	AltSpeedSchedule bool
+	// schedule start and end as HH:MM
+	AltSpeedBegin string
+	AltSpeedEnd   string
+	// days the schedule applies to, sunday is 1, monday 2, ... saturday 64
+	AltSpeedDays int
+	// files and urls to load the blocklist from
+	Blocklist []string
+	// swarm wide limit on peer connections, 0 means unlimited
+	MaxConnections int
+	// limit on outbound connections still being set up, 0 means unlimited
+	MaxHalfOpen int
+	// limits on active downloads and seeds, 0 means unlimited
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// minutes without data before a download stops counting as active, 0 turns this off
+	StalledMinutes int
+	// seeding goals, 0 means no goal
+	SeedRatio       float64
+	SeedMinutes     int
+	SeedIdleMinutes int
+	// remove torrents that reached a seeding goal instead of stopping them
+	SeedRemove bool
+}
+
+// split a comma separated list, dropping empty items
+func splitList(str string) (items []string) {
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// parse HH:MM into minutes after midnight
+func parseTimeOfDay(str string) (minutes int, err error) {
+	var h, m int
+	_, err = fmt.Sscanf(str, "%d:%d", &h, &m)
+	if err == nil {
+		if h < 0 || h > 23 || m < 0 || m > 59 {
+			err = fmt.Errorf("invalid time of day: %s", str)
+		} else {
+			minutes = h*60 + m
+		}
+	}
+	return
 }
 
 func (c *BittorrentConfig) Load(s *configparser.Section) error {
@@ -79,6 +138,14 @@ func (c *BittorrentConfig) Load(s *configparser.Section) error {
 	c.TorrentQueueSize = DefaultTorrentQueueSize
 	c.PEX = true
 	c.Swarms = 1
+	c.UploadSlots = swarm.DefaultUploadSlots
+	c.OptimisticSlots = swarm.DefaultOptimisticSlots
+	c.AltSpeedBegin = "09:00"
+	c.AltSpeedEnd = "17:00"
+	c.AltSpeedDays = swarm.AltSpeedEveryDay
+	c.MaxConnections = swarm.DefaultMaxConnections
+	c.MaxHalfOpen = swarm.DefaultMaxHalfOpen
+	c.StalledMinutes = int(swarm.DefaultStalledTime / time.Minute)
 	if s != nil {
 		c.DHT = s.Get("dht", "0") == "1"
 		c.PEX = s.Get("pex", "1") == "1"
@@ -96,6 +163,35 @@ func (c *BittorrentConfig) Load(s *configparser.Section) error {
 		if e != nil {
 			return e
 		}
+		c.UploadSlots = s.GetInt("upload-slots", swarm.DefaultUploadSlots)
+		c.OptimisticSlots = s.GetInt("optimistic-unchoke-slots", swarm.DefaultOptimisticSlots)
+		c.MaxUploadRate = s.GetInt("max-upload-rate", 0)
+		c.MaxDownloadRate = s.GetInt("max-download-rate", 0)
+		c.AltUploadRate = s.GetInt("alt-upload-rate", 0)
+		c.AltDownloadRate = s.GetInt("alt-download-rate", 0)
+		c.AltSpeedSchedule = s.Get("alt-speed-schedule", "0") == "1"
+		c.AltSpeedBegin = s.Get("alt-speed-begin", c.AltSpeedBegin)
+		c.AltSpeedEnd = s.Get("alt-speed-end", c.AltSpeedEnd)
+		c.AltSpeedDays = s.GetInt("alt-speed-days", swarm.AltSpeedEveryDay)
+		c.Blocklist = splitList(s.Get("blocklist", ""))
+		c.MaxConnections = s.GetInt("max-connections", swarm.DefaultMaxConnections)
+		c.MaxHalfOpen = s.GetInt("max-half-open", swarm.DefaultMaxHalfOpen)
+		c.MaxActiveDownloads = s.GetInt("max-active-downloads", 0)
+		c.MaxActiveSeeds = s.GetInt("max-active-seeds", 0)
+		c.StalledMinutes = s.GetInt("stalled-minutes", c.StalledMinutes)
+		c.SeedRatio, e = strconv.ParseFloat(s.Get("seed-ratio", "0"), 64)
+		if e != nil {
+			return e
+		}
+		c.SeedMinutes = s.GetInt("seed-minutes", 0)
+		c.SeedIdleMinutes = s.GetInt("seed-idle-minutes", 0)
+		c.SeedRemove = s.Get("seed-limit-action", "stop") == "remove"
+		if _, e = parseTimeOfDay(c.AltSpeedBegin); e != nil {
+			return e
+		}
+		if _, e = parseTimeOfDay(c.AltSpeedEnd); e != nil {
+			return e
+		}
 	}
 	return c.OpenTrackers.Load()
 }
@@ -119,6 +215,54 @@ func (c *BittorrentConfig) Save(s *configparser.Section) error {
 
 	s.Add("max-torrents", fmt.Sprintf("%d", c.TorrentQueueSize))
 
+	s.Add("upload-slots", fmt.Sprintf("%d", c.UploadSlots))
+
+	s.Add("optimistic-unchoke-slots", fmt.Sprintf("%d", c.OptimisticSlots))
+
+	s.Add("max-upload-rate", fmt.Sprintf("%d", c.MaxUploadRate))
+
+	s.Add("max-download-rate", fmt.Sprintf("%d", c.MaxDownloadRate))
+
+	s.Add("alt-upload-rate", fmt.Sprintf("%d", c.AltUploadRate))
+
+	s.Add("alt-download-rate", fmt.Sprintf("%d", c.AltDownloadRate))
+
+	if c.AltSpeedSchedule {
+		s.Add("alt-speed-schedule", "1")
+	} else {
+		s.Add("alt-speed-schedule", "0")
+	}
+
+	s.Add("alt-speed-begin", c.AltSpeedBegin)
+
+	s.Add("alt-speed-end", c.AltSpeedEnd)
+
+	s.Add("alt-speed-days", fmt.Sprintf("%d", c.AltSpeedDays))
+
+	s.Add("blocklist", strings.Join(c.Blocklist, ","))
+
+	s.Add("max-connections", fmt.Sprintf("%d", c.MaxConnections))
+
+	s.Add("max-half-open", fmt.Sprintf("%d", c.MaxHalfOpen))
+
+	s.Add("max-active-downloads", fmt.Sprintf("%d", c.MaxActiveDownloads))
+
+	s.Add("max-active-seeds", fmt.Sprintf("%d", c.MaxActiveSeeds))
+
+	s.Add("stalled-minutes", fmt.Sprintf("%d", c.StalledMinutes))
+
+	s.Add("seed-ratio", strconv.FormatFloat(c.SeedRatio, 'f', -1, 64))
+
+	s.Add("seed-minutes", fmt.Sprintf("%d", c.SeedMinutes))
+
+	s.Add("seed-idle-minutes", fmt.Sprintf("%d", c.SeedIdleMinutes))
+
+	if c.SeedRemove {
+		s.Add("seed-limit-action", "remove")
+	} else {
+		s.Add("seed-limit-action", "stop")
+	}
+
 	return c.OpenTrackers.Save()
 }
 
@@ -140,5 +284,32 @@ func (c *BittorrentConfig) CreateSwarm(st storage.Storage, gnutella *gnutella.Sw
 	}
 	sw.Torrents.MaxReq = c.PieceWindowSize
 	sw.Torrents.QueueSize = c.TorrentQueueSize
+	sw.Torrents.MaxActiveDownloads = c.MaxActiveDownloads
+	sw.Torrents.MaxActiveSeeds = c.MaxActiveSeeds
+	sw.Torrents.StalledTime = time.Duration(c.StalledMinutes) * time.Minute
+	sw.Torrents.UploadSlots = c.UploadSlots
+	sw.Torrents.OptimisticSlots = c.OptimisticSlots
+	sw.Torrents.SetRateLimits(uint64(c.MaxUploadRate)*1024, uint64(c.MaxDownloadRate)*1024)
+	sw.Torrents.SetConnLimits(c.MaxConnections, c.MaxHalfOpen)
+	sw.Torrents.SetSeedLimits(swarm.SeedLimits{
+		Ratio:  c.SeedRatio,
+		Time:   time.Duration(c.SeedMinutes) * time.Minute,
+		Idle:   time.Duration(c.SeedIdleMinutes) * time.Minute,
+		Remove: c.SeedRemove,
+	})
+	begin, _ := parseTimeOfDay(c.AltSpeedBegin)
+	end, _ := parseTimeOfDay(c.AltSpeedEnd)
+	sw.Torrents.SetAltSpeed(swarm.AltSpeed{
+		Upload:    uint64(c.AltUploadRate) * 1024,
+		Download:  uint64(c.AltDownloadRate) * 1024,
+		Scheduled: c.AltSpeedSchedule,
+		Begin:     begin,
+		End:       end,
+		Days:      c.AltSpeedDays,
+	})
+	if len(c.Blocklist) > 0 {
+		sw.SetBlocklistSources(c.Blocklist)
+		go sw.UpdateBlocklist()
+	}
 	return sw
 }
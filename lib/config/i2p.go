@@ -15,6 +15,8 @@ type I2PConfig struct {
 	nameWasProvided bool
 	I2CPOptions     map[string]string
 	Disabled        bool
+	// i2cp port to take datagrams on, 0 for none
+	DatagramPort int
 }
 
 func (cfg *I2PConfig) Load(section *configparser.Section) error {
@@ -71,7 +73,11 @@ func (cfg *I2PConfig) Save(s *configparser.Section) error {
 // create an i2p session from this config
 func (cfg *I2PConfig) CreateSession() i2p.Session {
 	log.Infof("create new i2p session with %s", cfg.Addr)
-	return i2p.NewSession(util.RandStr(5), cfg.Addr, cfg.Keyfile, cfg.I2CPOptions)
+	s := i2p.NewSession(util.RandStr(5), cfg.Addr, cfg.Keyfile, cfg.I2CPOptions)
+	if cfg.DatagramPort > 0 {
+		s.EnableDatagrams(cfg.DatagramPort)
+	}
+	return s
 }
 
 // EnvI2PAddress is the name of the environmental variable to set the i2p address for XD
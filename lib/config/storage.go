@@ -42,7 +42,17 @@ func (cfg *SFTPConfig) ToFS() fs.Driver {
 	return fs.SFTP(cfg.Username, cfg.Hostname, cfg.Keyfile, cfg.RemotePubkey, cfg.Port)
 }
 
+// StorageMemory is the storage backend that keeps everything in memory
+const StorageMemory = "memory"
+
+// StorageFS is the storage backend that keeps data in files
+const StorageFS = "fs"
+
 type StorageConfig struct {
+	// storage backend, fs or memory
+	Backend string
+	// megabytes of piece data the memory backend holds, 0 means no limit
+	MemoryMB int
 	// downloads directory
 	Downloads string
 	// completed directory
@@ -55,6 +65,12 @@ type StorageConfig struct {
 	Workers int
 	// number of buffered iops when using pooled io
 	IOPBufferSize int
+	// how disk space for data files is reserved
+	Allocation fs.Allocation
+	// number of data file handles kept open
+	OpenFiles int
+	// megabytes of piece data kept in memory
+	PieceCacheMB int
 	// sftp config
 	SFTP SFTPConfig
 }
@@ -68,9 +84,24 @@ func (cfg *StorageConfig) Load(s *configparser.Section) error {
 		}
 	}
 
+	cfg.Backend = StorageFS
+	cfg.OpenFiles = storage.DefaultOpenFiles
+	cfg.PieceCacheMB = storage.DefaultPieceCacheSize / (1024 * 1024)
 	if s != nil {
+		cfg.Backend = s.Get("backend", cfg.Backend)
+		if cfg.Backend != StorageFS && cfg.Backend != StorageMemory {
+			return fmt.Errorf("invalid storage backend: %s", cfg.Backend)
+		}
+		cfg.MemoryMB = s.GetInt("memory_mb", 0)
 		cfg.Workers = s.GetInt("workers", 0)
 		cfg.IOPBufferSize = s.GetInt("iop_buffer_size", 256)
+		cfg.OpenFiles = s.GetInt("open_files", cfg.OpenFiles)
+		cfg.PieceCacheMB = s.GetInt("piece_cache_mb", cfg.PieceCacheMB)
+		var err error
+		cfg.Allocation, err = fs.ParseAllocation(s.Get("allocation", cfg.Allocation.String()))
+		if err != nil {
+			return err
+		}
 	}
 
 	cfg.setSubpaths(s)
@@ -99,12 +130,17 @@ func (cfg *StorageConfig) setSubpaths(s *configparser.Section) {
 
 func (cfg *StorageConfig) Save(s *configparser.Section) error {
 
+	s.Add("backend", cfg.Backend)
+	s.Add("memory_mb", fmt.Sprintf("%d", cfg.MemoryMB))
 	s.Add("rootdir", cfg.Root)
 	s.Add("metadata", cfg.Meta)
 	s.Add("downloads", cfg.Downloads)
 	s.Add("completed", cfg.Completed)
 	s.Add("workers", fmt.Sprintf("%d", cfg.Workers))
 	s.Add("iop_buffer_size", fmt.Sprintf("%d", cfg.IOPBufferSize))
+	s.Add("open_files", fmt.Sprintf("%d", cfg.OpenFiles))
+	s.Add("piece_cache_mb", fmt.Sprintf("%d", cfg.PieceCacheMB))
+	s.Add("allocation", cfg.Allocation.String())
 	return nil
 }
 
@@ -117,14 +153,23 @@ func (cfg *StorageConfig) LoadEnv() {
 }
 
 func (cfg *StorageConfig) CreateStorage() storage.Storage {
+	if cfg.Backend == StorageMemory {
+		return &storage.MemStorage{
+			MaxSize: int64(cfg.MemoryMB) * 1024 * 1024,
+			DataDir: cfg.Downloads,
+		}
+	}
 
 	st := &storage.FsStorage{
-		SeedingDir:    cfg.Completed,
-		DataDir:       cfg.Downloads,
-		MetaDir:       cfg.Meta,
-		FS:            fs.STD,
-		IOPBufferSize: cfg.IOPBufferSize,
-		Workers:       cfg.Workers,
+		SeedingDir:     cfg.Completed,
+		DataDir:        cfg.Downloads,
+		MetaDir:        cfg.Meta,
+		FS:             fs.STD,
+		IOPBufferSize:  cfg.IOPBufferSize,
+		Workers:        cfg.Workers,
+		Allocation:     cfg.Allocation,
+		OpenFiles:      cfg.OpenFiles,
+		PieceCacheSize: int64(cfg.PieceCacheMB) * 1024 * 1024,
 	}
 	if cfg.SFTP.Enabled {
 		st.FS = cfg.SFTP.ToFS()
@@ -1,4 +1,65 @@
 package dht
 
-type FindNode struct {
+import (
+	"github.com/majestrate/XD/lib/common"
+)
+
+// encode nodes for the nodes value of a reply
+func encodeNodes(nodes []NodeInfo) (l []interface{}) {
+	l = []interface{}{}
+	for _, n := range nodes {
+		l = append(l, map[string]interface{}{
+			vID:   string(n.ID[:]),
+			vAddr: n.Addr,
+		})
+	}
+	return
+}
+
+// decode the nodes value of a reply, skipping bad entries
+func decodeNodes(v interface{}) (nodes []NodeInfo) {
+	l, _ := v.([]interface{})
+	for _, e := range l {
+		d, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := getString(d, vID)
+		addr, _ := getString(d, vAddr)
+		var n NodeInfo
+		if len(id) != len(n.ID) || addr == "" {
+			continue
+		}
+		copy(n.ID[:], id)
+		n.Addr = addr
+		nodes = append(nodes, n)
+	}
+	return
+}
+
+// answer a find_node query with the closest nodes we know
+func (dht *XDHT) handleFindNode(msg *Message, src Node) *Message {
+	target, ok := getString(msg.Args, vTarget)
+	if !ok || len(target) != 20 {
+		return NewError(msg.TID, ErrCodeProtocol, "bad target")
+	}
+	var t common.PeerID
+	copy(t[:], target)
+	return NewResponse(msg.TID, dht.selfID(), map[string]interface{}{
+		vNodes: encodeNodes(dht.table.Closest(t, K)),
+	})
+}
+
+// FindNode asks connected nodes for the nodes closest to target, adding what they know to our routing table
+func (dht *XDHT) FindNode(target common.PeerID) {
+	if !dht.Enabled() {
+		return
+	}
+	for _, n := range dht.closestConnected(target, alpha) {
+		dht.query(n, func(txid string) *Message {
+			return NewFindNodeRequest(txid, dht.selfID(), string(target[:]))
+		}, func(r *Message) {
+			dht.learnNodes(r.Response[vNodes])
+		})
+	}
 }
@@ -0,0 +1,155 @@
+package dht
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// get the infohash argument of a query
+func getInfohash(msg *Message) (ih common.Infohash, ok bool) {
+	var s string
+	s, ok = getString(msg.Args, vInfohash)
+	ok = ok && len(s) == len(ih)
+	if ok {
+		copy(ih[:], s)
+	}
+	return
+}
+
+// answer a get_peers query with the peers we know and a token to announce with
+func (dht *XDHT) handleGetPeers(msg *Message, src Node) *Message {
+	ih, ok := getInfohash(msg)
+	if !ok {
+		return NewError(msg.TID, ErrCodeProtocol, "bad info_hash")
+	}
+	values := []interface{}{}
+	dht.mtx.Lock()
+	for addr := range dht.peers[ih] {
+		if len(values) >= maxValues {
+			break
+		}
+		values = append(values, addr)
+	}
+	token := dht.tokens.Token(src.ID(), src.Addr())
+	dht.mtx.Unlock()
+	r := map[string]interface{}{
+		vToken: token,
+		vNodes: encodeNodes(dht.table.Closest(ih, K)),
+	}
+	if len(values) > 0 {
+		r[vValues] = values
+	}
+	return NewResponse(msg.TID, dht.selfID(), r)
+}
+
+// store the address of a peer that announced itself
+func (dht *XDHT) handleAnnouncePeer(msg *Message, src Node) *Message {
+	ih, ok := getInfohash(msg)
+	if !ok {
+		return NewError(msg.TID, ErrCodeProtocol, "bad info_hash")
+	}
+	token, _ := getString(msg.Args, vToken)
+	dht.mtx.Lock()
+	valid := dht.tokens.Valid(token, src.ID(), src.Addr())
+	dht.mtx.Unlock()
+	if !valid {
+		return NewError(msg.TID, ErrCodeProtocol, "bad token")
+	}
+	addr := src.Addr()
+	port, _ := getInt(msg.Args, vPort)
+	if port > 0 && port < 65536 {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+	}
+	dht.mtx.Lock()
+	if dht.peers[ih] == nil {
+		dht.peers[ih] = make(map[string]time.Time)
+	}
+	dht.peers[ih][addr] = time.Now()
+	dht.mtx.Unlock()
+	return NewResponse(msg.TID, dht.selfID(), nil)
+}
+
+// state of one get_peers lookup across connected nodes
+type peerLookup struct {
+	dht   *XDHT
+	ih    common.Infohash
+	port  int
+	found func([]string)
+	mtx   sync.Mutex
+	asked map[string]bool
+}
+
+// ask a node for peers unless we already did
+func (l *peerLookup) ask(n Node) {
+	l.mtx.Lock()
+	if l.asked[n.ID()] {
+		l.mtx.Unlock()
+		return
+	}
+	l.asked[n.ID()] = true
+	l.mtx.Unlock()
+	l.dht.query(n, func(txid string) *Message {
+		return NewGetPeersRequest(txid, l.dht.selfID(), string(l.ih[:]))
+	}, func(r *Message) {
+		l.gotReply(n, r)
+	})
+}
+
+func (l *peerLookup) gotReply(n Node, r *Message) {
+	if l.found != nil {
+		vals, _ := r.Response[vValues].([]interface{})
+		var addrs []string
+		for _, v := range vals {
+			if s, ok := v.(string); ok && s != "" {
+				addrs = append(addrs, s)
+			}
+		}
+		if len(addrs) > 0 {
+			l.found(addrs)
+		}
+	}
+	if token, ok := getString(r.Response, vToken); ok && l.port >= 0 {
+		l.dht.query(n, func(txid string) *Message {
+			return NewAnnouncePeerRequest(txid, l.dht.selfID(), string(l.ih[:]), token, l.port)
+		}, func(*Message) {})
+	}
+	// keep going with connected nodes they told us about
+	for _, info := range l.dht.learnNodes(r.Response[vNodes]) {
+		if next := l.dht.connectedNode(string(info.ID[:])); next != nil {
+			l.ask(next)
+		}
+	}
+}
+
+func (dht *XDHT) lookup(ih common.Infohash, port int, found func([]string)) {
+	if !dht.Enabled() {
+		return
+	}
+	l := &peerLookup{
+		dht:   dht,
+		ih:    ih,
+		port:  port,
+		found: found,
+		asked: make(map[string]bool),
+	}
+	for _, n := range dht.closestConnected(ih, K) {
+		l.ask(n)
+	}
+}
+
+// GetPeers looks up peers for an infohash, found is called with the addresses of peers as nodes reply
+func (dht *XDHT) GetPeers(ih common.Infohash, found func([]string)) {
+	dht.lookup(ih, -1, found)
+}
+
+// Announce looks up peers for an infohash and announces that we are reachable on port to every node that replies
+func (dht *XDHT) Announce(ih common.Infohash, port int, found func([]string)) {
+	dht.lookup(ih, port, found)
+}
@@ -0,0 +1,571 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/network/i2p"
+	"github.com/majestrate/XD/lib/sync"
+	"github.com/zeebo/bencode"
+)
+
+// I2PDHTPort is the i2cp port we take dht queries on, replies come in on the port after it
+const I2PDHTPort = 6881
+
+// size of a compact node info: node id, destination hash, query port
+const i2pNodeInfoLen = 20 + 32 + 2
+
+// port we put in announce_peer, i2psnark wants one but nothing uses it
+const i2pAnnouncePort = 6881
+
+// how often we look for nodes close to us
+const i2pRefreshInterval = time.Minute * 15
+
+// the i2p dht query ping
+const mPing = "ping"
+
+// PacketConn sends and receives datagrams, network.Network implements it
+type PacketConn interface {
+	ReadFrom([]byte) (int, net.Addr, error)
+	WriteTo([]byte, net.Addr) (int, error)
+}
+
+// RawWriter is implemented by networks that can send datagrams that cannot be replied to
+type RawWriter interface {
+	WriteRawTo([]byte, net.Addr) (int, error)
+}
+
+// a query we sent to an i2p dht node
+type i2pQuery struct {
+	node NodeInfo
+	// true if we know the id of the node, pings to new nodes do not
+	known   bool
+	sent    time.Time
+	handle  func(NodeInfo, *Message)
+	timeout func()
+}
+
+// I2PDHT is the kademlia dht i2psnark and BiglyBT speak over i2p datagrams (i2p_dht)
+// queries are repliable datagrams sent to a node's query port, replies are raw datagrams sent to the port after it
+type I2PDHT struct {
+	mtx         sync.Mutex
+	self        common.PeerID
+	table       *RoutingTable
+	tokens      *tokenSecrets
+	peers       map[common.Infohash]map[i2p.Base32Addr]time.Time
+	pending     map[string]*i2pQuery
+	nextTID     uint16
+	conn        PacketConn
+	ourHash     i2p.Base32Addr
+	fs          fs.Driver
+	path        string
+	lastSave    time.Time
+	lastRefresh time.Time
+}
+
+// Enable turns the i2p dht on with a random node id
+// if path is not empty the routing table is loaded from and saved to it on driver
+func (dht *I2PDHT) Enable(driver fs.Driver, path string) {
+	// node ids are random and do not look like peer ids
+	var self common.PeerID
+	io.ReadFull(rand.Reader, self[:])
+	dht.mtx.Lock()
+	dht.self = self
+	dht.table = NewRoutingTable(self)
+	dht.tokens = newTokenSecrets()
+	dht.peers = make(map[common.Infohash]map[i2p.Base32Addr]time.Time)
+	dht.pending = make(map[string]*i2pQuery)
+	dht.fs = driver
+	dht.path = path
+	dht.lastSave = time.Now()
+	dht.mtx.Unlock()
+	if path != "" {
+		err := dht.Load(path)
+		if err == nil {
+			log.Infof("loaded %d i2p dht nodes from %s", dht.table.Len(), path)
+		} else if !os.IsNotExist(err) {
+			log.Warnf("failed to load i2p dht nodes: %s", err.Error())
+		}
+	}
+}
+
+// Enabled returns true if the i2p dht is on
+func (dht *I2PDHT) Enabled() (on bool) {
+	dht.mtx.Lock()
+	on = dht.table != nil
+	dht.mtx.Unlock()
+	return
+}
+
+// Running returns true if we have a network to send datagrams on
+func (dht *I2PDHT) Running() (on bool) {
+	dht.mtx.Lock()
+	on = dht.conn != nil
+	dht.mtx.Unlock()
+	return
+}
+
+// Nodes returns how many nodes are in our routing table
+func (dht *I2PDHT) Nodes() int {
+	if !dht.Enabled() {
+		return 0
+	}
+	return dht.table.Len()
+}
+
+// Start reads datagrams from conn until it fails, our address is used to avoid talking to ourself
+func (dht *I2PDHT) Start(conn PacketConn, us net.Addr) {
+	if !dht.Enabled() {
+		return
+	}
+	host, _, err := net.SplitHostPort(us.String())
+	if err != nil {
+		host = us.String()
+	}
+	dht.mtx.Lock()
+	dht.conn = conn
+	dht.ourHash, _ = destHash(host)
+	dht.table.Remove(dht.self)
+	dht.lastRefresh = time.Now()
+	dht.mtx.Unlock()
+	go dht.readLoop(conn)
+	dht.FindNode(dht.self)
+}
+
+func (dht *I2PDHT) readLoop(conn PacketConn) {
+	var buf [65536]byte
+	for {
+		n, from, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			log.Warnf("i2p dht stopped: %s", err.Error())
+			break
+		}
+		err = dht.HandlePacket(buf[:n], from)
+		if err != nil {
+			log.Debugf("bad i2p dht packet: %s", err.Error())
+		}
+	}
+	dht.mtx.Lock()
+	if dht.conn == conn {
+		dht.conn = nil
+	}
+	dht.mtx.Unlock()
+}
+
+// get the destination hash of a full destination or a b32 address
+func destHash(host string) (h i2p.Base32Addr, err error) {
+	if strings.HasSuffix(strings.ToLower(host), ".b32.i2p") {
+		h, err = i2p.DecodeBase32Addr(host)
+	} else if host == "" {
+		err = i2p.ErrBadBase32Addr
+	} else {
+		h = i2p.I2PAddr(host).Base32Addr()
+	}
+	return
+}
+
+// make the routing table address of a node
+func i2pNodeAddr(h i2p.Base32Addr, port int) string {
+	return net.JoinHostPort(h.String(), strconv.Itoa(port))
+}
+
+// split a routing table address into destination hash and port
+func splitI2PNodeAddr(addr string) (h i2p.Base32Addr, port int, err error) {
+	var host, p string
+	host, p, err = net.SplitHostPort(addr)
+	if err == nil {
+		port, err = strconv.Atoi(p)
+	}
+	if err == nil {
+		h, err = destHash(host)
+	}
+	return
+}
+
+// encode nodes as concatenated compact node infos
+func encodeI2PNodes(nodes []NodeInfo) string {
+	var buf []byte
+	for _, n := range nodes {
+		h, port, err := splitI2PNodeAddr(n.Addr)
+		if err != nil {
+			continue
+		}
+		var info [i2pNodeInfoLen]byte
+		copy(info[:], n.ID[:])
+		copy(info[20:], h[:])
+		binary.BigEndian.PutUint16(info[52:], uint16(port))
+		buf = append(buf, info[:]...)
+	}
+	return string(buf)
+}
+
+// decode concatenated compact node infos
+func decodeI2PNodes(v interface{}) (nodes []NodeInfo) {
+	s, _ := v.(string)
+	for len(s) >= i2pNodeInfoLen {
+		var n NodeInfo
+		var h i2p.Base32Addr
+		copy(n.ID[:], s[:20])
+		copy(h[:], s[20:52])
+		n.Addr = i2pNodeAddr(h, int(binary.BigEndian.Uint16([]byte(s[52:54]))))
+		nodes = append(nodes, n)
+		s = s[i2pNodeInfoLen:]
+	}
+	return
+}
+
+// put nodes from a reply into the routing table, skipping ourself
+func (dht *I2PDHT) learnNodes(v interface{}) (nodes []NodeInfo) {
+	dht.mtx.Lock()
+	us := dht.ourHash
+	self := dht.self
+	dht.mtx.Unlock()
+	for _, n := range decodeI2PNodes(v) {
+		h, _, err := splitI2PNodeAddr(n.Addr)
+		if err != nil || h == us || n.ID == self {
+			continue
+		}
+		dht.table.Add(n)
+		nodes = append(nodes, n)
+	}
+	return
+}
+
+func (dht *I2PDHT) selfID() string {
+	dht.mtx.Lock()
+	defer dht.mtx.Unlock()
+	return string(dht.self[:])
+}
+
+// send a query to a node, handle is called with its reply and timeout if it never comes
+func (dht *I2PDHT) query(node NodeInfo, known bool, mk func(txid string) *Message, handle func(NodeInfo, *Message), timeout func()) {
+	var tid [2]byte
+	dht.mtx.Lock()
+	conn := dht.conn
+	if conn == nil {
+		dht.mtx.Unlock()
+		if timeout != nil {
+			timeout()
+		}
+		return
+	}
+	for {
+		dht.nextTID++
+		binary.BigEndian.PutUint16(tid[:], dht.nextTID)
+		if _, used := dht.pending[string(tid[:])]; !used {
+			break
+		}
+	}
+	txid := string(tid[:])
+	dht.pending[txid] = &i2pQuery{
+		node:    node,
+		known:   known,
+		sent:    time.Now(),
+		handle:  handle,
+		timeout: timeout,
+	}
+	dht.mtx.Unlock()
+	data, err := bencode.EncodeBytes(mk(txid))
+	if err == nil {
+		_, err = conn.WriteTo(data, i2p.I2PAddr(node.Addr))
+	}
+	if err != nil {
+		log.Debugf("failed to send i2p dht query: %s", err.Error())
+		dht.mtx.Lock()
+		delete(dht.pending, txid)
+		dht.mtx.Unlock()
+		if timeout != nil {
+			timeout()
+		}
+	}
+}
+
+// send a reply as a raw datagram to the reply port of a node
+func (dht *I2PDHT) reply(host string, port int, msg *Message) (err error) {
+	dht.mtx.Lock()
+	conn := dht.conn
+	dht.mtx.Unlock()
+	if conn == nil {
+		return ErrNotEnabled
+	}
+	var data []byte
+	data, err = bencode.EncodeBytes(msg)
+	if err == nil {
+		to := i2p.I2PAddr(net.JoinHostPort(host, strconv.Itoa(port+1)))
+		if raw, ok := conn.(RawWriter); ok {
+			_, err = raw.WriteRawTo(data, to)
+		} else {
+			_, err = conn.WriteTo(data, to)
+		}
+	}
+	return
+}
+
+// HandlePacket handles a datagram sent to us
+func (dht *I2PDHT) HandlePacket(data []byte, from net.Addr) (err error) {
+	if !dht.Enabled() {
+		return ErrNotEnabled
+	}
+	var msg *Message
+	msg, err = DecodeMessage(data)
+	if err != nil {
+		return
+	}
+	if msg.IsQuery() {
+		err = dht.handleQuery(msg, from)
+	} else if msg.IsResponse() || msg.IsError() {
+		err = dht.handleReply(msg)
+	} else {
+		err = ErrBadMessage
+	}
+	return
+}
+
+// handle a query, which must come in a repliable datagram
+func (dht *I2PDHT) handleQuery(msg *Message, from net.Addr) (err error) {
+	var host, p string
+	var port int
+	host, p, err = net.SplitHostPort(from.String())
+	if err == nil {
+		port, err = strconv.Atoi(p)
+	}
+	if err != nil {
+		return
+	}
+	var h i2p.Base32Addr
+	h, err = destHash(host)
+	if err != nil {
+		return
+	}
+	id, _ := getString(msg.Args, vID)
+	var reply *Message
+	if len(id) != 20 {
+		reply = NewError(msg.TID, ErrCodeProtocol, "bad node id")
+	} else {
+		n := NodeInfo{
+			Addr:     i2pNodeAddr(h, port),
+			LastSeen: time.Now().Unix(),
+		}
+		copy(n.ID[:], id)
+		dht.mtx.Lock()
+		us := dht.ourHash
+		dht.mtx.Unlock()
+		if h != us {
+			dht.table.Add(n)
+		}
+		switch msg.Query {
+		case mPing:
+			reply = NewResponse(msg.TID, dht.selfID(), nil)
+		case mFindNode:
+			reply = dht.handleFindNode(msg)
+		case mGetPeers:
+			reply = dht.handleGetPeers(msg, id, h)
+		case mAnnouncePeer:
+			reply = dht.handleAnnouncePeer(msg, id, h)
+		default:
+			reply = NewError(msg.TID, ErrCodeMethod, "method unknown")
+		}
+	}
+	return dht.reply(host, port, reply)
+}
+
+// handle a reply to one of our queries
+func (dht *I2PDHT) handleReply(msg *Message) error {
+	id, _ := getString(msg.Response, vID)
+	dht.mtx.Lock()
+	pq := dht.pending[msg.TID]
+	if pq != nil && (msg.IsError() || len(id) == 20 && (!pq.known || id == string(pq.node.ID[:]))) {
+		delete(dht.pending, msg.TID)
+	} else {
+		pq = nil
+	}
+	dht.mtx.Unlock()
+	if pq == nil {
+		return ErrUnexpectedReply
+	}
+	if msg.IsError() {
+		if msg.Err != nil {
+			log.Debugf("i2p dht error %d: %s", msg.Err.Code, msg.Err.Message)
+		}
+		if pq.timeout != nil {
+			pq.timeout()
+		}
+		return nil
+	}
+	n := pq.node
+	copy(n.ID[:], id)
+	if h, port, err := splitI2PNodeAddr(n.Addr); err == nil {
+		n.Addr = i2pNodeAddr(h, port)
+	}
+	n.LastSeen = time.Now().Unix()
+	dht.table.Add(n)
+	if pq.handle != nil {
+		pq.handle(n, msg)
+	}
+	return nil
+}
+
+func (dht *I2PDHT) handleFindNode(msg *Message) *Message {
+	target, ok := getString(msg.Args, vTarget)
+	if !ok || len(target) != 20 {
+		return NewError(msg.TID, ErrCodeProtocol, "bad target")
+	}
+	var t common.PeerID
+	copy(t[:], target)
+	return NewResponse(msg.TID, dht.selfID(), map[string]interface{}{
+		vNodes: encodeI2PNodes(dht.table.Closest(t, K)),
+	})
+}
+
+func (dht *I2PDHT) handleGetPeers(msg *Message, id string, h i2p.Base32Addr) *Message {
+	ih, ok := getInfohash(msg)
+	if !ok {
+		return NewError(msg.TID, ErrCodeProtocol, "bad info_hash")
+	}
+	values := []interface{}{}
+	dht.mtx.Lock()
+	for peer := range dht.peers[ih] {
+		if len(values) >= maxValues {
+			break
+		}
+		if peer != h {
+			values = append(values, string(peer[:]))
+		}
+	}
+	token := dht.tokens.Token(id, string(h[:]))
+	dht.mtx.Unlock()
+	r := map[string]interface{}{
+		vToken: token,
+		vNodes: encodeI2PNodes(dht.table.Closest(ih, K)),
+	}
+	if len(values) > 0 {
+		r[vValues] = values
+	}
+	return NewResponse(msg.TID, dht.selfID(), r)
+}
+
+func (dht *I2PDHT) handleAnnouncePeer(msg *Message, id string, h i2p.Base32Addr) *Message {
+	ih, ok := getInfohash(msg)
+	if !ok {
+		return NewError(msg.TID, ErrCodeProtocol, "bad info_hash")
+	}
+	token, _ := getString(msg.Args, vToken)
+	dht.mtx.Lock()
+	defer dht.mtx.Unlock()
+	if !dht.tokens.Valid(token, id, string(h[:])) {
+		return NewError(msg.TID, ErrCodeProtocol, "bad token")
+	}
+	if dht.peers[ih] == nil {
+		dht.peers[ih] = make(map[i2p.Base32Addr]time.Time)
+	}
+	dht.peers[ih][h] = time.Now()
+	return NewResponse(msg.TID, string(dht.self[:]), nil)
+}
+
+// Ping asks a node we have not talked to before for its node id, addr is its destination and query port
+func (dht *I2PDHT) Ping(addr string) {
+	if !dht.Enabled() {
+		return
+	}
+	dht.query(NodeInfo{Addr: addr}, false, func(txid string) *Message {
+		return &Message{
+			TID:   txid,
+			Reply: kQuery,
+			Query: mPing,
+			Args: map[string]interface{}{
+				vID: dht.selfID(),
+			},
+		}
+	}, nil, nil)
+}
+
+// Tick expires timed out queries and old peers, rotates tokens, refreshes and saves the routing table
+func (dht *I2PDHT) Tick() {
+	if !dht.Enabled() {
+		return
+	}
+	now := time.Now()
+	var timedOut []*i2pQuery
+	dht.mtx.Lock()
+	for txid, pq := range dht.pending {
+		if now.Sub(pq.sent) > queryTimeout {
+			delete(dht.pending, txid)
+			timedOut = append(timedOut, pq)
+		}
+	}
+	for ih, peers := range dht.peers {
+		for h, seen := range peers {
+			if now.Sub(seen) > peerTTL {
+				delete(peers, h)
+			}
+		}
+		if len(peers) == 0 {
+			delete(dht.peers, ih)
+		}
+	}
+	dht.tokens.tick(now)
+	save := dht.path != "" && now.Sub(dht.lastSave) > saveInterval
+	if save {
+		dht.lastSave = now
+	}
+	refresh := dht.conn != nil && now.Sub(dht.lastRefresh) > i2pRefreshInterval
+	if refresh {
+		dht.lastRefresh = now
+	}
+	path := dht.path
+	self := dht.self
+	dht.mtx.Unlock()
+	for _, pq := range timedOut {
+		if pq.timeout != nil {
+			pq.timeout()
+		}
+	}
+	if refresh {
+		dht.FindNode(self)
+	}
+	if save {
+		err := dht.Save(path)
+		if err != nil {
+			log.Warnf("failed to save i2p dht nodes: %s", err.Error())
+		}
+	}
+}
+
+// Close saves the routing table
+func (dht *I2PDHT) Close() error {
+	if !dht.Enabled() {
+		return nil
+	}
+	dht.mtx.Lock()
+	path := dht.path
+	dht.mtx.Unlock()
+	if path == "" {
+		return nil
+	}
+	return dht.Save(path)
+}
+
+// Save writes the routing table to a file
+func (dht *I2PDHT) Save(path string) error {
+	if !dht.Enabled() {
+		return ErrNotEnabled
+	}
+	return saveTable(dht.fs, dht.table, path)
+}
+
+// Load reads a routing table saved with Save
+func (dht *I2PDHT) Load(path string) error {
+	if !dht.Enabled() {
+		return ErrNotEnabled
+	}
+	return loadTable(dht.fs, dht.table, path)
+}
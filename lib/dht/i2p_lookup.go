@@ -0,0 +1,127 @@
+package dht
+
+import (
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/network/i2p"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// an iterative kademlia lookup over the i2p dht
+type i2pLookup struct {
+	dht    *I2PDHT
+	target [20]byte
+	// makes the query we send each node
+	mk func(txid string) *Message
+	// called with every reply
+	got      func(NodeInfo, *Message)
+	mtx      sync.Mutex
+	nodes    []NodeInfo
+	asked    map[common.PeerID]bool
+	inflight int
+}
+
+func (dht *I2PDHT) lookup(target [20]byte, mk func(txid string) *Message, got func(NodeInfo, *Message)) {
+	if !dht.Enabled() || !dht.Running() {
+		return
+	}
+	l := &i2pLookup{
+		dht:    dht,
+		target: target,
+		mk:     mk,
+		got:    got,
+		nodes:  dht.table.Closest(target, K),
+		asked:  make(map[common.PeerID]bool),
+	}
+	l.next()
+}
+
+// ask the closest nodes we have not asked yet, keeping alpha queries in flight
+func (l *i2pLookup) next() {
+	var ask []NodeInfo
+	l.mtx.Lock()
+	sortByDistance(l.nodes, l.target)
+	if len(l.nodes) > K {
+		l.nodes = l.nodes[:K]
+	}
+	for _, n := range l.nodes {
+		if l.inflight >= alpha {
+			break
+		}
+		if l.asked[n.ID] {
+			continue
+		}
+		l.asked[n.ID] = true
+		l.inflight++
+		ask = append(ask, n)
+	}
+	l.mtx.Unlock()
+	for _, n := range ask {
+		l.dht.query(n, true, l.mk, l.gotReply, l.done)
+	}
+}
+
+// a query finished without a useful reply
+func (l *i2pLookup) done() {
+	l.mtx.Lock()
+	l.inflight--
+	l.mtx.Unlock()
+	l.next()
+}
+
+func (l *i2pLookup) gotReply(n NodeInfo, r *Message) {
+	nodes := l.dht.learnNodes(r.Response[vNodes])
+	l.mtx.Lock()
+	for _, node := range nodes {
+		if !l.asked[node.ID] {
+			l.nodes = append(l.nodes, node)
+		}
+	}
+	l.mtx.Unlock()
+	if l.got != nil {
+		l.got(n, r)
+	}
+	l.done()
+}
+
+// FindNode looks for the nodes closest to target, filling our routing table
+func (dht *I2PDHT) FindNode(target common.PeerID) {
+	dht.lookup(target, func(txid string) *Message {
+		return NewFindNodeRequest(txid, dht.selfID(), string(target[:]))
+	}, nil)
+}
+
+// GetPeers looks up peers for an infohash, found is called with destination hashes of peers as nodes reply
+func (dht *I2PDHT) GetPeers(ih common.Infohash, found func([]i2p.Base32Addr)) {
+	dht.getPeers(ih, false, found)
+}
+
+// Announce looks up peers for an infohash and announces us to every node that gives us a token
+func (dht *I2PDHT) Announce(ih common.Infohash, found func([]i2p.Base32Addr)) {
+	dht.getPeers(ih, true, found)
+}
+
+func (dht *I2PDHT) getPeers(ih common.Infohash, announce bool, found func([]i2p.Base32Addr)) {
+	dht.lookup(ih, func(txid string) *Message {
+		return NewGetPeersRequest(txid, dht.selfID(), string(ih[:]))
+	}, func(n NodeInfo, r *Message) {
+		if found != nil {
+			vals, _ := r.Response[vValues].([]interface{})
+			var peers []i2p.Base32Addr
+			for _, v := range vals {
+				if s, ok := v.(string); ok && len(s) == 32 {
+					var h i2p.Base32Addr
+					copy(h[:], s)
+					peers = append(peers, h)
+				}
+			}
+			if len(peers) > 0 {
+				found(peers)
+			}
+		}
+		if token, ok := getString(r.Response, vToken); ok && announce {
+			dht.query(n, true, func(txid string) *Message {
+				return NewAnnouncePeerRequest(txid, dht.selfID(), string(ih[:]), token, i2pAnnouncePort)
+			}, nil, nil)
+		}
+	})
+}
@@ -0,0 +1,272 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/network"
+	"github.com/majestrate/XD/lib/network/i2p"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+var testI2PB64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+var errFakeClosed = errors.New("fake network closed")
+
+var _ network.Network = new(fakeSession)
+
+// a datagram on the fake network
+type fakeDatagram struct {
+	data []byte
+	from net.Addr
+}
+
+// in memory i2p datagram network
+type fakeI2P struct {
+	mtx   sync.Mutex
+	nodes map[i2p.Base32Addr]*fakeSession
+}
+
+// a destination on the fake network that takes repliable datagrams on port and raw datagrams on port+1
+type fakeSession struct {
+	net    *fakeI2P
+	dest   string
+	port   int
+	inbox  chan fakeDatagram
+	closed chan struct{}
+}
+
+func (f *fakeI2P) newSession(port int) *fakeSession {
+	var key [387]byte
+	rand.Read(key[:])
+	s := &fakeSession{
+		net:    f,
+		dest:   testI2PB64.EncodeToString(key[:]),
+		port:   port,
+		inbox:  make(chan fakeDatagram, 64),
+		closed: make(chan struct{}),
+	}
+	f.mtx.Lock()
+	f.nodes[i2p.I2PAddr(s.dest).Base32Addr()] = s
+	f.mtx.Unlock()
+	return s
+}
+
+func (s *fakeSession) send(d []byte, to net.Addr, from net.Addr, raw bool) (int, error) {
+	host, p, err := net.SplitHostPort(to.String())
+	if err != nil {
+		return 0, err
+	}
+	port, _ := strconv.Atoi(p)
+	h, err := destHash(host)
+	if err != nil {
+		return 0, err
+	}
+	s.net.mtx.Lock()
+	remote := s.net.nodes[h]
+	s.net.mtx.Unlock()
+	// wrong port or nobody there, datagrams are lost silently
+	if remote != nil && ((raw && port == remote.port+1) || (!raw && port == remote.port)) {
+		data := make([]byte, len(d))
+		copy(data, d)
+		select {
+		case remote.inbox <- fakeDatagram{data: data, from: from}:
+		case <-remote.closed:
+		}
+	}
+	return len(d), nil
+}
+
+func (s *fakeSession) WriteTo(d []byte, to net.Addr) (int, error) {
+	return s.send(d, to, i2p.I2PAddr(net.JoinHostPort(s.dest, strconv.Itoa(s.port))), false)
+}
+
+func (s *fakeSession) WriteRawTo(d []byte, to net.Addr) (int, error) {
+	// raw datagrams only carry the port they came from
+	return s.send(d, to, i2p.I2PAddr(net.JoinHostPort("", strconv.Itoa(s.port+1))), true)
+}
+
+func (s *fakeSession) ReadFrom(d []byte) (int, net.Addr, error) {
+	select {
+	case dg := <-s.inbox:
+		return copy(d, dg.data), dg.from, nil
+	case <-s.closed:
+		return 0, nil, errFakeClosed
+	}
+}
+
+func (s *fakeSession) Dial(n, a string) (net.Conn, error) {
+	return nil, errFakeClosed
+}
+
+func (s *fakeSession) Accept() (net.Conn, error) {
+	return nil, errFakeClosed
+}
+
+func (s *fakeSession) Open() error {
+	return nil
+}
+
+func (s *fakeSession) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func (s *fakeSession) Addr() net.Addr {
+	return i2p.I2PAddr(s.dest)
+}
+
+func (s *fakeSession) Lookup(name, port string) (net.Addr, error) {
+	return i2p.I2PAddr(net.JoinHostPort(name, port)), nil
+}
+
+// the address other nodes send queries to
+func (s *fakeSession) queryAddr() string {
+	return net.JoinHostPort(s.dest, strconv.Itoa(s.port))
+}
+
+func newTestI2PDHT(t *testing.T, f *fakeI2P) (*I2PDHT, *fakeSession) {
+	s := f.newSession(I2PDHTPort)
+	d := new(I2PDHT)
+	d.Enable(nil, "")
+	d.Start(s, s.Addr())
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return d, s
+}
+
+// wait until cond is true
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestI2PCompactNodes(t *testing.T) {
+	var h i2p.Base32Addr
+	h[0] = 1
+	h[31] = 2
+	n := NodeInfo{ID: testID(7), Addr: i2pNodeAddr(h, 6881)}
+	s := encodeI2PNodes([]NodeInfo{n, n})
+	if len(s) != 2*i2pNodeInfoLen {
+		t.Fatalf("compact nodes are %d bytes", len(s))
+	}
+	nodes := decodeI2PNodes(s + "trailing junk")
+	if len(nodes) != 2 || nodes[0].ID != n.ID || nodes[0].Addr != n.Addr {
+		t.Fatalf("bad decoded nodes %v", nodes)
+	}
+}
+
+func TestI2PPing(t *testing.T) {
+	f := &fakeI2P{nodes: make(map[i2p.Base32Addr]*fakeSession)}
+	a, _ := newTestI2PDHT(t, f)
+	b, bs := newTestI2PDHT(t, f)
+	a.Ping(bs.queryAddr())
+	waitFor(t, "ping reply", func() bool {
+		return a.Nodes() == 1 && b.Nodes() == 1
+	})
+	n, has := a.table.Get(b.self)
+	if !has {
+		t.Fatal("node we pinged is not in routing table")
+	}
+	h, port, err := splitI2PNodeAddr(n.Addr)
+	if err != nil || h != i2p.I2PAddr(bs.dest).Base32Addr() || port != I2PDHTPort {
+		t.Fatalf("bad node address %s", n.Addr)
+	}
+}
+
+func TestI2PAnnounceAndGetPeers(t *testing.T) {
+	f := &fakeI2P{nodes: make(map[i2p.Base32Addr]*fakeSession)}
+	var nodes []*I2PDHT
+	var sessions []*fakeSession
+	for idx := 0; idx < 6; idx++ {
+		d, s := newTestI2PDHT(t, f)
+		nodes = append(nodes, d)
+		sessions = append(sessions, s)
+	}
+	// everyone bootstraps from the first node
+	for _, d := range nodes[1:] {
+		d.Ping(sessions[0].queryAddr())
+	}
+	waitFor(t, "bootstrap", func() bool {
+		return nodes[0].Nodes() == len(nodes)-1
+	})
+	for _, d := range nodes[1:] {
+		d.FindNode(d.self)
+	}
+
+	var ih common.Infohash
+	ih[0] = 0x55
+	announcer := nodes[1]
+	announcer.Announce(ih, nil)
+	announced := func() (n int) {
+		for _, d := range nodes {
+			d.mtx.Lock()
+			n += len(d.peers[ih])
+			d.mtx.Unlock()
+		}
+		return
+	}
+	waitFor(t, "announce", func() bool {
+		return announced() > 0
+	})
+
+	var mtx sync.Mutex
+	var found []i2p.Base32Addr
+	nodes[len(nodes)-1].GetPeers(ih, func(peers []i2p.Base32Addr) {
+		mtx.Lock()
+		found = append(found, peers...)
+		mtx.Unlock()
+	})
+	waitFor(t, "peers", func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(found) > 0
+	})
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, h := range found {
+		if h != i2p.I2PAddr(sessions[1].dest).Base32Addr() {
+			t.Fatalf("found wrong peer %s", h)
+		}
+	}
+}
+
+func TestI2PRejectBadToken(t *testing.T) {
+	f := &fakeI2P{nodes: make(map[i2p.Base32Addr]*fakeSession)}
+	a, _ := newTestI2PDHT(t, f)
+	b, bs := newTestI2PDHT(t, f)
+	a.Ping(bs.queryAddr())
+	waitFor(t, "ping reply", func() bool {
+		return a.Nodes() == 1
+	})
+	n, _ := a.table.Get(b.self)
+	var ih common.Infohash
+	errored := make(chan bool, 1)
+	a.query(n, true, func(txid string) *Message {
+		return NewAnnouncePeerRequest(txid, a.selfID(), string(ih[:]), "bogus", i2pAnnouncePort)
+	}, func(NodeInfo, *Message) {
+		errored <- false
+	}, func() {
+		errored <- true
+	})
+	select {
+	case e := <-errored:
+		if !e {
+			t.Fatal("announce with bad token was accepted")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no reply to announce")
+	}
+}
@@ -1,5 +1,7 @@
 package dht
 
+import "github.com/zeebo/bencode"
+
 const mFindNode = "find_node"
 const mGetPeers = "get_peers"
 const mAnnouncePeer = "announce_peer"
@@ -11,19 +13,62 @@ const kError = "e"
 const vID = "id"
 const vTarget = "target"
 const vNodes = "nodes"
+const vInfohash = "info_hash"
+const vToken = "token"
+const vPort = "port"
+const vValues = "values"
+const vAddr = "addr"
 
 type Message struct {
-	Query string                 `bencode:"q",omitempty`
-	TID   string                 `bencode:"t"`
-	Reply string                 `bencode:"y"`
-	Err   *Error                 `bencode:"e",omitempty`
-	Args  map[string]interface{} `bencode:"a",omitempty`
+	Query    string                 `bencode:"q,omitempty"`
+	TID      string                 `bencode:"t"`
+	Reply    string                 `bencode:"y"`
+	Err      *Error                 `bencode:"e,omitempty"`
+	Args     map[string]interface{} `bencode:"a,omitempty"`
+	Response map[string]interface{} `bencode:"r,omitempty"`
+}
+
+// DecodeMessage decodes a bencoded dht message
+func DecodeMessage(data []byte) (msg *Message, err error) {
+	// the decoder only uses Error's unmarshaler if it is already allocated
+	msg = &Message{
+		Err: new(Error),
+	}
+	err = bencode.DecodeBytes(data, msg)
+	if !msg.IsError() {
+		msg.Err = nil
+	}
+	return
 }
 
 func (m *Message) IsError() bool {
 	return m.Reply == kError
 }
 
+func (m *Message) IsQuery() bool {
+	return m.Reply == kQuery
+}
+
+func (m *Message) IsResponse() bool {
+	return m.Reply == kResponse
+}
+
+// get a string value from a dict
+func getString(d map[string]interface{}, k string) (s string, ok bool) {
+	if d != nil {
+		s, ok = d[k].(string)
+	}
+	return
+}
+
+// get an int value from a dict
+func getInt(d map[string]interface{}, k string) (i int64, ok bool) {
+	if d != nil {
+		i, ok = d[k].(int64)
+	}
+	return
+}
+
 // NewError generates a new error reply message
 func NewError(txid string, code int, errMsg string) *Message {
 	return &Message{
@@ -36,6 +81,21 @@ func NewError(txid string, code int, errMsg string) *Message {
 	}
 }
 
+// NewResponse generates a new reply message
+func NewResponse(txid, id string, values map[string]interface{}) *Message {
+	r := map[string]interface{}{
+		vID: id,
+	}
+	for k, v := range values {
+		r[k] = v
+	}
+	return &Message{
+		TID:      txid,
+		Reply:    kResponse,
+		Response: r,
+	}
+}
+
 func NewFindNodeRequest(txid, id, target string) *Message {
 	return &Message{
 		TID:   txid,
@@ -47,3 +107,29 @@ func NewFindNodeRequest(txid, id, target string) *Message {
 		},
 	}
 }
+
+func NewGetPeersRequest(txid, id, infohash string) *Message {
+	return &Message{
+		TID:   txid,
+		Reply: kQuery,
+		Query: mGetPeers,
+		Args: map[string]interface{}{
+			vID:       id,
+			vInfohash: infohash,
+		},
+	}
+}
+
+func NewAnnouncePeerRequest(txid, id, infohash, token string, port int) *Message {
+	return &Message{
+		TID:   txid,
+		Reply: kQuery,
+		Query: mAnnouncePeer,
+		Args: map[string]interface{}{
+			vID:       id,
+			vInfohash: infohash,
+			vToken:    token,
+			vPort:     int64(port),
+		},
+	}
+}
@@ -1,6 +1,11 @@
 package dht
 
+// Node is a connected peer we speak the dht with
 type Node interface {
+	// SendLowLevel sends a bencoded dht message
 	SendLowLevel([]byte) error
+	// ID returns the node id as raw bytes
 	ID() string
+	// Addr returns the network address of the node
+	Addr() string
 }
@@ -0,0 +1,210 @@
+package dht
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/sync"
+	"github.com/zeebo/bencode"
+)
+
+// K is the size of a kademlia bucket
+const K = 8
+
+// how long a node can go unseen before a new node may replace it in a full bucket
+const nodeStaleTime = time.Minute * 15
+
+// NodeInfo is a dht node we know about
+type NodeInfo struct {
+	ID       common.PeerID `bencode:"-"`
+	Addr     string        `bencode:"addr"`
+	LastSeen int64         `bencode:"seen"`
+	RawID    string        `bencode:"id"`
+}
+
+// distance between 2 ids in kademlia xor metric
+func distance(a, b [20]byte) (d [20]byte) {
+	for idx := range d {
+		d[idx] = a[idx] ^ b[idx]
+	}
+	return
+}
+
+// index of the bucket an id falls in relative to us, -1 if it is our id
+func bucketIndex(self, id [20]byte) int {
+	d := distance(self, id)
+	for idx, b := range d {
+		for bit := 0; bit < 8; bit++ {
+			if b&(0x80>>uint(bit)) != 0 {
+				return 159 - (idx*8 + bit)
+			}
+		}
+	}
+	return -1
+}
+
+// RoutingTable is a kademlia routing table of dht nodes
+type RoutingTable struct {
+	mtx     sync.Mutex
+	self    common.PeerID
+	buckets [160][]NodeInfo
+}
+
+// NewRoutingTable creates a routing table for our node id
+func NewRoutingTable(self common.PeerID) *RoutingTable {
+	return &RoutingTable{
+		self: self,
+	}
+}
+
+// SetSelf changes our node id, putting every node into the bucket it falls in for the new id
+func (rt *RoutingTable) SetSelf(self common.PeerID) {
+	nodes := rt.Nodes()
+	rt.mtx.Lock()
+	rt.self = self
+	rt.buckets = [160][]NodeInfo{}
+	rt.mtx.Unlock()
+	for _, n := range nodes {
+		rt.Add(n)
+	}
+}
+
+// Add adds or refreshes a node, returns false if the node did not fit
+func (rt *RoutingTable) Add(n NodeInfo) bool {
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+	idx := bucketIndex(rt.self, n.ID)
+	if idx < 0 {
+		// that's us
+		return false
+	}
+	bucket := rt.buckets[idx]
+	for i := range bucket {
+		if bucket[i].ID == n.ID {
+			bucket[i].Addr = n.Addr
+			if n.LastSeen > bucket[i].LastSeen {
+				bucket[i].LastSeen = n.LastSeen
+			}
+			return true
+		}
+	}
+	if len(bucket) < K {
+		rt.buckets[idx] = append(bucket, n)
+		return true
+	}
+	// replace the node we saw least recently if it is stale
+	oldest := 0
+	for i := range bucket {
+		if bucket[i].LastSeen < bucket[oldest].LastSeen {
+			oldest = i
+		}
+	}
+	if time.Since(time.Unix(bucket[oldest].LastSeen, 0)) > nodeStaleTime {
+		bucket[oldest] = n
+		return true
+	}
+	return false
+}
+
+// Remove removes a node by id
+func (rt *RoutingTable) Remove(id common.PeerID) {
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+	idx := bucketIndex(rt.self, id)
+	if idx < 0 {
+		return
+	}
+	bucket := rt.buckets[idx]
+	for i := range bucket {
+		if bucket[i].ID == id {
+			rt.buckets[idx] = append(bucket[:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get gets a node by id
+func (rt *RoutingTable) Get(id common.PeerID) (n NodeInfo, has bool) {
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+	idx := bucketIndex(rt.self, id)
+	if idx < 0 {
+		return
+	}
+	for _, node := range rt.buckets[idx] {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return
+}
+
+// Len returns the number of nodes we know
+func (rt *RoutingTable) Len() (n int) {
+	rt.mtx.Lock()
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	rt.mtx.Unlock()
+	return
+}
+
+// Nodes gets every node we know
+func (rt *RoutingTable) Nodes() (nodes []NodeInfo) {
+	rt.mtx.Lock()
+	for _, bucket := range rt.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	rt.mtx.Unlock()
+	return
+}
+
+// Closest gets up to n nodes closest to target
+func (rt *RoutingTable) Closest(target [20]byte, n int) []NodeInfo {
+	nodes := rt.Nodes()
+	sortByDistance(nodes, target)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// sort nodes closest to target first
+func sortByDistance(nodes []NodeInfo, target [20]byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		di := distance(nodes[i].ID, target)
+		dj := distance(nodes[j].ID, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// Save writes every node we know as a bencoded list
+func (rt *RoutingTable) Save(w io.Writer) error {
+	nodes := rt.Nodes()
+	for idx := range nodes {
+		nodes[idx].RawID = string(nodes[idx].ID[:])
+	}
+	if nodes == nil {
+		nodes = []NodeInfo{}
+	}
+	return bencode.NewEncoder(w).Encode(nodes)
+}
+
+// Load reads nodes written by Save
+func (rt *RoutingTable) Load(r io.Reader) (err error) {
+	var nodes []NodeInfo
+	err = bencode.NewDecoder(r).Decode(&nodes)
+	if err == nil {
+		for _, n := range nodes {
+			if len(n.RawID) != len(n.ID) || n.Addr == "" {
+				continue
+			}
+			copy(n.ID[:], n.RawID)
+			rt.Add(n)
+		}
+	}
+	return
+}
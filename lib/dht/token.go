@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"io"
+	"time"
+)
+
+// how often we change the secret announce tokens are made from
+const tokenRotateInterval = time.Minute * 5
+
+// tokens handed out in get_peers replies that a node must give back in announce_peer
+// a token is valid until the secret it was made with is rotated out twice
+type tokenSecrets struct {
+	current  [20]byte
+	previous [20]byte
+	rotated  time.Time
+}
+
+func newTokenSecrets() *tokenSecrets {
+	s := new(tokenSecrets)
+	io.ReadFull(rand.Reader, s.current[:])
+	s.previous = s.current
+	s.rotated = time.Now()
+	return s
+}
+
+// rotate secrets if it is time to
+func (s *tokenSecrets) tick(now time.Time) {
+	if now.Sub(s.rotated) >= tokenRotateInterval {
+		s.previous = s.current
+		io.ReadFull(rand.Reader, s.current[:])
+		s.rotated = now
+	}
+}
+
+func makeToken(secret [20]byte, id, addr string) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write([]byte(id))
+	h.Write([]byte(addr))
+	return string(h.Sum(nil)[:8])
+}
+
+// Token makes a token for a node
+func (s *tokenSecrets) Token(id, addr string) string {
+	return makeToken(s.current, id, addr)
+}
+
+// Valid returns true if a node gave us a token we made for it
+func (s *tokenSecrets) Valid(token, id, addr string) bool {
+	for _, secret := range [][20]byte{s.current, s.previous} {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(makeToken(secret, id, addr))) == 1 {
+			return true
+		}
+	}
+	return false
+}
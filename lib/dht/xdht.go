@@ -1,27 +1,395 @@
 package dht
 
 import (
-	"bytes"
-	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+	"time"
+
 	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
 	"github.com/zeebo/bencode"
 )
 
+// how many nodes we ask at once
+const alpha = 3
+
+// how long we wait for a reply to a query
+const queryTimeout = time.Second * 30
+
+// how long we keep peers announced to us
+const peerTTL = time.Minute * 30
+
+// most peers we put in a get_peers reply
+const maxValues = 50
+
+// how often we save the routing table
+const saveInterval = time.Minute * 5
+
+var ErrNotEnabled = errors.New("dht not enabled")
+var ErrUnexpectedReply = errors.New("unexpected dht reply")
+var ErrBadMessage = errors.New("bad dht message")
+
+// a query we sent and are waiting on a reply for
+type pendingQuery struct {
+	node   string
+	sent   time.Time
+	handle func(*Message)
+}
+
+// XDHT is a kademlia dht spoken over the bittorrent wire protocol with connected peers
 type XDHT struct {
+	mtx       sync.Mutex
+	self      common.PeerID
+	table     *RoutingTable
+	connected map[string]Node
+	tokens    *tokenSecrets
+	peers     map[common.Infohash]map[string]time.Time
+	pending   map[string]*pendingQuery
+	nextTID   uint16
+	fs        fs.Driver
+	path      string
+	lastSave  time.Time
+}
+
+// Enable turns the dht on using our peer id as node id
+// if path is not empty the routing table is loaded from and saved to it on driver
+func (dht *XDHT) Enable(self common.PeerID, driver fs.Driver, path string) {
+	dht.mtx.Lock()
+	dht.self = self
+	dht.table = NewRoutingTable(self)
+	dht.connected = make(map[string]Node)
+	dht.tokens = newTokenSecrets()
+	dht.peers = make(map[common.Infohash]map[string]time.Time)
+	dht.pending = make(map[string]*pendingQuery)
+	dht.fs = driver
+	dht.path = path
+	dht.lastSave = time.Now()
+	dht.mtx.Unlock()
+	if path != "" {
+		err := dht.Load(path)
+		if err == nil {
+			log.Infof("loaded %d dht nodes from %s", dht.table.Len(), path)
+		} else if !os.IsNotExist(err) {
+			log.Warnf("failed to load dht nodes: %s", err.Error())
+		}
+	}
+}
+
+// Enabled returns true if the dht is on
+func (dht *XDHT) Enabled() (on bool) {
+	dht.mtx.Lock()
+	on = dht.table != nil
+	dht.mtx.Unlock()
+	return
+}
+
+// SetID changes our node id
+func (dht *XDHT) SetID(self common.PeerID) {
+	if !dht.Enabled() {
+		return
+	}
+	dht.mtx.Lock()
+	dht.self = self
+	dht.mtx.Unlock()
+	dht.table.SetSelf(self)
+}
+
+func (dht *XDHT) selfID() string {
+	dht.mtx.Lock()
+	defer dht.mtx.Unlock()
+	return string(dht.self[:])
+}
+
+// Nodes returns how many nodes are in our routing table
+func (dht *XDHT) Nodes() int {
+	if !dht.Enabled() {
+		return 0
+	}
+	return dht.table.Len()
+}
+
+// AddNode adds a connected peer that speaks the dht
+func (dht *XDHT) AddNode(n Node) {
+	if !dht.Enabled() {
+		return
+	}
+	dht.mtx.Lock()
+	dht.connected[n.ID()] = n
+	dht.mtx.Unlock()
+	dht.sawNode(n)
+}
+
+// RemoveNode removes a peer that disconnected, it stays in the routing table
+func (dht *XDHT) RemoveNode(n Node) {
+	if !dht.Enabled() {
+		return
+	}
+	dht.mtx.Lock()
+	if dht.connected[n.ID()] == n {
+		delete(dht.connected, n.ID())
+	}
+	dht.mtx.Unlock()
+}
+
+// put a node we heard from into the routing table
+func (dht *XDHT) sawNode(n Node) {
+	var info NodeInfo
+	id := n.ID()
+	if len(id) != len(info.ID) {
+		return
+	}
+	copy(info.ID[:], id)
+	info.Addr = n.Addr()
+	info.LastSeen = time.Now().Unix()
+	dht.table.Add(info)
+}
+
+// put nodes from a reply into the routing table
+func (dht *XDHT) learnNodes(v interface{}) (nodes []NodeInfo) {
+	nodes = decodeNodes(v)
+	for _, n := range nodes {
+		dht.table.Add(n)
+	}
+	return
 }
 
+// get up to n connected nodes closest to target
+func (dht *XDHT) closestConnected(target [20]byte, n int) (nodes []Node) {
+	dht.mtx.Lock()
+	for _, node := range dht.connected {
+		nodes = append(nodes, node)
+	}
+	dht.mtx.Unlock()
+	sort.Slice(nodes, func(i, j int) bool {
+		var a, b common.PeerID
+		copy(a[:], nodes[i].ID())
+		copy(b[:], nodes[j].ID())
+		da := distance(a, target)
+		db := distance(b, target)
+		return string(da[:]) < string(db[:])
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return
+}
+
+// get a connected node by id
+func (dht *XDHT) connectedNode(id string) (n Node) {
+	dht.mtx.Lock()
+	n = dht.connected[id]
+	dht.mtx.Unlock()
+	return
+}
+
+func (dht *XDHT) send(n Node, msg *Message) (err error) {
+	var b []byte
+	b, err = bencode.EncodeBytes(msg)
+	if err == nil {
+		err = n.SendLowLevel(b)
+	}
+	return
+}
+
+// send a query to a node, handle is called with its reply
+func (dht *XDHT) query(n Node, mk func(txid string) *Message, handle func(*Message)) {
+	var tid [2]byte
+	dht.mtx.Lock()
+	for {
+		dht.nextTID++
+		binary.BigEndian.PutUint16(tid[:], dht.nextTID)
+		if _, used := dht.pending[string(tid[:])]; !used {
+			break
+		}
+	}
+	txid := string(tid[:])
+	dht.pending[txid] = &pendingQuery{
+		node:   n.ID(),
+		sent:   time.Now(),
+		handle: handle,
+	}
+	dht.mtx.Unlock()
+	err := dht.send(n, mk(txid))
+	if err != nil {
+		log.Debugf("failed to send dht query: %s", err.Error())
+		dht.mtx.Lock()
+		delete(dht.pending, txid)
+		dht.mtx.Unlock()
+	}
+}
+
+// HandleError handles an error reply
 func (dht *XDHT) HandleError(err *Error) {
+	if err != nil {
+		log.Debugf("dht error %d: %s", err.Code, err.Message)
+	}
+}
 
+// HandleMessage handles a dht message from a connected peer
+func (dht *XDHT) HandleMessage(payload []byte, src Node) (err error) {
+	if !dht.Enabled() {
+		return ErrNotEnabled
+	}
+	var msg *Message
+	msg, err = DecodeMessage(payload)
+	if err != nil {
+		return
+	}
+	if msg.IsQuery() {
+		id, _ := getString(msg.Args, vID)
+		var reply *Message
+		if id != src.ID() {
+			reply = NewError(msg.TID, ErrCodeProtocol, "bad node id")
+		} else {
+			dht.sawNode(src)
+			reply = dht.handleQuery(msg, src)
+		}
+		err = dht.send(src, reply)
+	} else if msg.IsResponse() || msg.IsError() {
+		dht.mtx.Lock()
+		pq := dht.pending[msg.TID]
+		if pq != nil && pq.node == src.ID() {
+			delete(dht.pending, msg.TID)
+		} else {
+			pq = nil
+		}
+		dht.mtx.Unlock()
+		if pq == nil {
+			return ErrUnexpectedReply
+		}
+		if msg.IsError() {
+			dht.HandleError(msg.Err)
+			return
+		}
+		dht.sawNode(src)
+		pq.handle(msg)
+	} else {
+		err = ErrBadMessage
+	}
+	return
+}
+
+// dispatch a query to its handler
+func (dht *XDHT) handleQuery(msg *Message, src Node) *Message {
+	switch msg.Query {
+	case mFindNode:
+		return dht.handleFindNode(msg, src)
+	case mGetPeers:
+		return dht.handleGetPeers(msg, src)
+	case mAnnouncePeer:
+		return dht.handleAnnouncePeer(msg, src)
+	default:
+		return NewError(msg.TID, ErrCodeMethod, "method unknown")
+	}
 }
 
-func (dht *XDHT) HandleMessage(msg extensions.Message, src common.PeerID) (err error) {
-	r := bytes.NewReader(msg.PayloadRaw)
-	var dhtmsg Message
-	err = bencode.NewDecoder(r).Decode(&dhtmsg)
+// Tick expires timed out queries and old peers, rotates tokens and saves the routing table
+func (dht *XDHT) Tick() {
+	if !dht.Enabled() {
+		return
+	}
+	now := time.Now()
+	dht.mtx.Lock()
+	for txid, pq := range dht.pending {
+		if now.Sub(pq.sent) > queryTimeout {
+			delete(dht.pending, txid)
+		}
+	}
+	for ih, peers := range dht.peers {
+		for addr, seen := range peers {
+			if now.Sub(seen) > peerTTL {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(dht.peers, ih)
+		}
+	}
+	dht.tokens.tick(now)
+	save := dht.path != "" && now.Sub(dht.lastSave) > saveInterval
+	if save {
+		dht.lastSave = now
+	}
+	path := dht.path
+	dht.mtx.Unlock()
+	if save {
+		err := dht.Save(path)
+		if err != nil {
+			log.Warnf("failed to save dht nodes: %s", err.Error())
+		}
+	}
+}
+
+// Close saves the routing table
+func (dht *XDHT) Close() error {
+	if !dht.Enabled() {
+		return nil
+	}
+	dht.mtx.Lock()
+	path := dht.path
+	dht.mtx.Unlock()
+	if path == "" {
+		return nil
+	}
+	return dht.Save(path)
+}
+
+// Save writes the routing table to a file
+func (dht *XDHT) Save(path string) error {
+	if !dht.Enabled() {
+		return ErrNotEnabled
+	}
+	return saveTable(dht.fs, dht.table, path)
+}
+
+// Load reads a routing table saved with Save
+func (dht *XDHT) Load(path string) error {
+	if !dht.Enabled() {
+		return ErrNotEnabled
+	}
+	return loadTable(dht.fs, dht.table, path)
+}
+
+// write a routing table to a file
+func saveTable(driver fs.Driver, rt *RoutingTable, path string) (err error) {
+	dir, _ := driver.Split(path)
+	err = driver.EnsureDir(dir)
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if driver.FileExists(tmp) {
+		// left over from a failed save, opening for write does not truncate it
+		driver.Remove(tmp)
+	}
+	var f fs.WriteFile
+	f, err = driver.OpenFileWriteOnly(tmp)
 	if err == nil {
-		if dhtmsg.IsError() {
-			dht.HandleError(dhtmsg.Err)
+		err = rt.Save(f)
+		f.Close()
+		if err == nil {
+			err = driver.Move(tmp, path)
+		} else {
+			driver.Remove(tmp)
 		}
 	}
 	return
 }
+
+// read a routing table from a file
+func loadTable(driver fs.Driver, rt *RoutingTable, path string) (err error) {
+	if !driver.FileExists(path) {
+		return os.ErrNotExist
+	}
+	var f fs.ReadFile
+	f, err = driver.OpenFileReadOnly(path)
+	if err == nil {
+		err = rt.Load(f)
+		f.Close()
+	}
+	return
+}
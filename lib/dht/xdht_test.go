@@ -0,0 +1,225 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/zeebo/bencode"
+)
+
+// a node that hands what we send it straight to another dht
+type testNode struct {
+	id   common.PeerID
+	addr string
+	// the dht on the other end
+	remote *XDHT
+	// us as the other end sees us
+	back *testNode
+}
+
+func (n *testNode) SendLowLevel(data []byte) error {
+	return n.remote.HandleMessage(data, n.back)
+}
+
+func (n *testNode) ID() string {
+	return string(n.id[:])
+}
+
+func (n *testNode) Addr() string {
+	return n.addr
+}
+
+func testID(b byte) (id common.PeerID) {
+	id[0] = b
+	id[19] = b
+	return
+}
+
+// raw node id for a test id
+func testKey(b byte) string {
+	id := testID(b)
+	return string(id[:])
+}
+
+// connect 2 dhts to each other
+func connect(a, b *XDHT, aID, bID common.PeerID, aAddr, bAddr string) {
+	toB := &testNode{id: bID, addr: bAddr, remote: b}
+	toA := &testNode{id: aID, addr: aAddr, remote: a}
+	toB.back = toA
+	toA.back = toB
+	a.AddNode(toB)
+	b.AddNode(toA)
+}
+
+func TestRoutingTable(t *testing.T) {
+	rt := NewRoutingTable(testID(0))
+	for idx := 1; idx < 40; idx++ {
+		rt.Add(NodeInfo{ID: testID(byte(idx)), Addr: fmt.Sprintf("node%d:1", idx), LastSeen: time.Now().Unix()})
+	}
+	if rt.Add(NodeInfo{ID: testID(0)}) {
+		t.Fatal("added our own id")
+	}
+	// ids with the top bit set all share a bucket that is full
+	for _, n := range rt.Nodes() {
+		if n.ID[0]&0x80 != 0 {
+			t.Fatalf("bucket grew past %d", K)
+		}
+	}
+	closest := rt.Closest(testID(3), 3)
+	if len(closest) != 3 || closest[0].ID != testID(3) {
+		t.Fatalf("bad closest nodes %v", closest)
+	}
+	for idx := 1; idx < len(closest); idx++ {
+		a := distance(closest[idx-1].ID, testID(3))
+		b := distance(closest[idx].ID, testID(3))
+		if bytes.Compare(a[:], b[:]) > 0 {
+			t.Fatal("closest nodes not sorted by distance")
+		}
+	}
+
+	var buf bytes.Buffer
+	err := rt.Save(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewRoutingTable(testID(0))
+	err = loaded.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != rt.Len() {
+		t.Fatalf("loaded %d nodes, expected %d", loaded.Len(), rt.Len())
+	}
+	n, has := loaded.Get(testID(5))
+	if !has || n.Addr != "node5:1" {
+		t.Fatalf("bad loaded node %v", n)
+	}
+}
+
+func TestToken(t *testing.T) {
+	s := newTokenSecrets()
+	token := s.Token("node", "addr")
+	if !s.Valid(token, "node", "addr") {
+		t.Fatal("our token is not valid")
+	}
+	if s.Valid(token, "other", "addr") || s.Valid(token, "node", "other") {
+		t.Fatal("token valid for another node")
+	}
+	now := s.rotated
+	s.tick(now.Add(tokenRotateInterval))
+	if !s.Valid(token, "node", "addr") {
+		t.Fatal("token expired after one rotation")
+	}
+	s.tick(now.Add(tokenRotateInterval * 2))
+	if s.Valid(token, "node", "addr") {
+		t.Fatal("token still valid after two rotations")
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	b, err := bencode.EncodeBytes(NewResponse("aa", "id", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("1:e")) {
+		t.Fatalf("empty error encoded: %q", b)
+	}
+	b, err = bencode.EncodeBytes(NewError("aa", ErrCodeMethod, "method unknown"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecodeMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.IsError() || msg.Err.Code != ErrCodeMethod || msg.Err.Message != "method unknown" {
+		t.Fatalf("bad decoded error %v", msg)
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	var a, b, c XDHT
+	a.Enable(testID(1), nil, "")
+	b.Enable(testID(2), nil, "")
+	c.Enable(testID(3), nil, "")
+	// a and c only know b
+	connect(&a, &b, testID(1), testID(2), "a.loki:1000", "b.loki:1000")
+	connect(&c, &b, testID(3), testID(2), "c.loki:1000", "b.loki:1000")
+
+	var ih common.Infohash
+	ih[0] = 0xaa
+	a.Announce(ih, 6881, nil)
+
+	var found []string
+	c.GetPeers(ih, func(addrs []string) {
+		found = append(found, addrs...)
+	})
+	if len(found) != 1 || found[0] != "a.loki:6881" {
+		t.Fatalf("found %v", found)
+	}
+	// b told c about a
+	if _, has := c.table.Get(testID(1)); !has {
+		t.Fatal("did not learn about node a")
+	}
+	a.mtx.Lock()
+	pending := len(a.pending)
+	a.mtx.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d queries still pending", pending)
+	}
+}
+
+func TestAnnounceBadToken(t *testing.T) {
+	var a, b XDHT
+	a.Enable(testID(1), nil, "")
+	b.Enable(testID(2), nil, "")
+	connect(&a, &b, testID(1), testID(2), "a.loki:1000", "b.loki:1000")
+	var ih common.Infohash
+	var reply *Message
+	toB := a.connectedNode(testKey(2))
+	a.query(toB, func(txid string) *Message {
+		return NewAnnouncePeerRequest(txid, a.selfID(), string(ih[:]), "bogus", 6881)
+	}, func(r *Message) {
+		reply = r
+	})
+	if reply != nil {
+		t.Fatal("announce with bad token was accepted")
+	}
+	b.mtx.Lock()
+	stored := len(b.peers)
+	b.mtx.Unlock()
+	if stored != 0 {
+		t.Fatal("stored peer with bad token")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	var a, b XDHT
+	a.Enable(testID(1), fs.STD, path)
+	b.Enable(testID(2), nil, "")
+	connect(&a, &b, testID(1), testID(2), "a.loki:1000", "b.loki:1000")
+	// a failed save left junk behind
+	err := os.WriteFile(path+".tmp", bytes.Repeat([]byte{'x'}, 4096), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded XDHT
+	loaded.Enable(testID(1), fs.STD, path)
+	if loaded.Nodes() != 1 {
+		t.Fatalf("loaded %d nodes", loaded.Nodes())
+	}
+	if loaded.connectedNode(testKey(2)) != nil {
+		t.Fatal("loaded node is connected")
+	}
+}
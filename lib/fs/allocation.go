@@ -0,0 +1,51 @@
+package fs
+
+import (
+	"errors"
+	"github.com/majestrate/XD/lib/util"
+	"strings"
+)
+
+// Allocation is how we reserve disk space for new data files
+type Allocation int
+
+const (
+	// AllocateFull reserves all space of a file when it is created
+	AllocateFull = Allocation(iota)
+	// AllocateSparse creates files of full size without reserving space for them
+	AllocateSparse
+	// AllocateNone creates empty files that grow as data is written
+	AllocateNone
+)
+
+// ErrBadAllocation is returned when parsing an unknown allocation mode
+var ErrBadAllocation = errors.New("bad allocation mode, use full, sparse or none")
+
+// ErrNoFreeSpaceInfo is returned by drivers that cannot tell how much space is free
+var ErrNoFreeSpaceInfo = util.ErrNoFreeSpaceInfo
+
+var allocationNames = []string{"full", "sparse", "none"}
+
+func (a Allocation) String() string {
+	if a < 0 || int(a) >= len(allocationNames) {
+		return "unknown"
+	}
+	return allocationNames[a]
+}
+
+// ParseAllocation parses an allocation mode by name
+func ParseAllocation(str string) (a Allocation, err error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	for idx, name := range allocationNames {
+		if name == str {
+			a = Allocation(idx)
+			return
+		}
+	}
+	if str == "fallocate" {
+		a = AllocateFull
+		return
+	}
+	err = ErrBadAllocation
+	return
+}
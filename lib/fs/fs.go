@@ -30,6 +30,11 @@ type Driver interface {
 	EnsureDir(fpath string) error
 	// ensire a file exists and is of size sz
 	EnsureFile(fpath string, sz uint64) error
+	// ensure a file exists, if we create it space for sz bytes is allocated as mode says
+	AllocateFile(fpath string, sz uint64, mode Allocation) error
+	// get how many bytes we can write to the filesystem fpath is on
+	// returns ErrNoFreeSpaceInfo if we cannot tell
+	FreeSpace(fpath string) (int64, error)
 	// filepath.Glob lookalike
 	Glob(str string) ([]string, error)
 	// remove single file
@@ -255,6 +255,48 @@ func (fs *sftpFS) EnsureFile(fname string, sz uint64) error {
 	})
 }
 
+func (fs *sftpFS) AllocateFile(fname string, sz uint64, mode Allocation) error {
+	if mode == AllocateFull {
+		// writes zeros
+		return fs.EnsureFile(fname, sz)
+	}
+	if fs.FileExists(fname) {
+		return nil
+	}
+	return fs.ensureConn(func(c *sftp.Client) error {
+		d, _ := sftp.Split(fname)
+		var err error
+		if d != "" {
+			err = fs.EnsureDir(d)
+		}
+		if err == nil {
+			var f *sftp.File
+			f, err = c.Create(fname)
+			if err == nil {
+				if mode == AllocateSparse {
+					err = f.Truncate(int64(sz))
+				}
+				f.Close()
+			}
+		}
+		return err
+	})
+}
+
+func (fs *sftpFS) FreeSpace(fpath string) (free int64, err error) {
+	err = fs.ensureConn(func(c *sftp.Client) error {
+		st, e := c.StatVFS(fpath)
+		if e != nil {
+			// the server does not have the statvfs extension
+			log.Debugf("sftp statvfs failed: %s", e.Error())
+			return ErrNoFreeSpaceInfo
+		}
+		free = int64(st.Bavail * st.Frsize)
+		return nil
+	})
+	return
+}
+
 func (fs *sftpFS) removeAllDir(root string, c *sftp.Client) error {
 	dirs, err := c.ReadDir(root)
 	if err != nil {
@@ -26,6 +26,39 @@ func (f stdFs) EnsureFile(fname string, sz uint64) error {
 	return util.EnsureFile(fname, sz)
 }
 
+func (f stdFs) AllocateFile(fname string, sz uint64, mode Allocation) (err error) {
+	if util.CheckFile(fname) {
+		return
+	}
+	d, _ := filepath.Split(fname)
+	if d != "" {
+		err = util.EnsureDir(d)
+	}
+	if err != nil {
+		return
+	}
+	var fl *os.File
+	fl, err = os.OpenFile(fname, os.O_CREATE|os.O_WRONLY, 0666)
+	if err == nil {
+		switch mode {
+		case AllocateFull:
+			err = util.Preallocate(fl, int64(sz))
+		case AllocateSparse:
+			err = fl.Truncate(int64(sz))
+		}
+		fl.Close()
+		if err != nil {
+			// try again next time
+			os.Remove(fname)
+		}
+	}
+	return
+}
+
+func (f stdFs) FreeSpace(fpath string) (int64, error) {
+	return util.FreeSpace(fpath)
+}
+
 func (f stdFs) FileExists(fname string) bool {
 	return util.CheckFile(fname)
 }
@@ -3,12 +3,14 @@ package metainfo
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/log"
 	"github.com/zeebo/bencode"
 	"io"
 	"path/filepath"
+	"strings"
 )
 
 type FilePath []string
@@ -30,6 +32,15 @@ type FileInfo struct {
 	Path FilePath `bencode:"path"`
 	// md5sum
 	Sum []byte `bencode:"md5sum,omitempty"`
+	// file attributes, "p" for padding files
+	Attr string `bencode:"attr,omitempty"`
+	// root of the file's v2 merkle tree
+	PiecesRoot []byte `bencode:"-"`
+}
+
+// IsPadding returns true if this file only exists to align the next file to a piece boundary
+func (f FileInfo) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
 }
 
 // info section of torrent file
@@ -48,23 +59,56 @@ type Info struct {
 	Length uint64 `bencode:"length,omitempty"`
 	// md5sum
 	Sum []byte `bencode:"md5sum,omitempty"`
+	// bittorrent v2 meta version
+	MetaVersion uint64 `bencode:"meta version,omitempty"`
+	// bittorrent v2 file tree
+	FileTree map[string]interface{} `bencode:"file tree,omitempty"`
+
+	// files parsed from the v2 file tree, padded to piece boundaries
+	v2files []FileInfo
+	// pieces roots of v2 files by path
+	v2roots map[string][]byte
 }
 
 // get fileinfos from this info section
 func (i Info) GetFiles() (infos []FileInfo) {
 	if i.Length > 0 {
 		infos = append(infos, FileInfo{
-			Length: i.Length,
-			Path:   FilePath([]string{i.Path}),
-			Sum:    i.Sum,
+			Length:     i.Length,
+			Path:       FilePath([]string{i.Path}),
+			Sum:        i.Sum,
+			PiecesRoot: i.v2roots[i.Path],
 		})
+	} else if len(i.Files) > 0 {
+		for _, f := range i.Files {
+			f.PiecesRoot = i.v2roots[strings.Join(f.Path, "/")]
+			infos = append(infos, f)
+		}
 	} else {
-		infos = append(infos, i.Files...)
+		infos = append(infos, i.v2files...)
+	}
+	return
+}
+
+// get the range of pieces [begin, end) that hold data of the file at index idx
+func (i Info) FilePieces(idx int) (begin, end uint32) {
+	files := i.GetFiles()
+	if idx < 0 || idx >= len(files) || i.PieceLength == 0 {
+		return
+	}
+	var off uint64
+	for n := 0; n < idx; n++ {
+		off += files[n].Length
+	}
+	begin = uint32(off / uint64(i.PieceLength))
+	end = begin
+	if files[idx].Length > 0 {
+		end = uint32((off+files[idx].Length-1)/uint64(i.PieceLength)) + 1
 	}
 	return
 }
 
-// check if a piece is valid against the pieces in this info section
+// check if a piece is valid against the v1 pieces in this info section
 func (i Info) CheckPiece(p *common.PieceData) bool {
 	idx := p.Index * 20
 	if i.NumPieces() > p.Index {
@@ -81,6 +125,14 @@ func (i Info) CheckPiece(p *common.PieceData) bool {
 }
 
 func (i Info) NumPieces() uint32 {
+	if len(i.Pieces) == 0 && i.PieceLength > 0 {
+		// v2 only, count pieces from the file layout
+		var total uint64
+		for _, f := range i.v2files {
+			total += f.Length
+		}
+		return uint32((total + uint64(i.PieceLength) - 1) / uint64(i.PieceLength))
+	}
 	return uint32(len(i.Pieces) / 20)
 }
 
@@ -94,6 +146,10 @@ type TorrentFile struct {
 	Comment      []byte             `bencode:"comment"`
 	CreatedBy    []byte             `bencode:"created by"`
 	Encoding     []byte             `bencode:"encoding"`
+	// web seeds
+	URLList URLList `bencode:"url-list,omitempty"`
+	// v2 piece layers by pieces root
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
 }
 
 func (tf *TorrentFile) LengthOfPiece(idx uint32) (l uint32) {
@@ -111,11 +167,11 @@ func (tf *TorrentFile) LengthOfPiece(idx uint32) (l uint32) {
 
 // get total size of files from torrent info section
 func (tf *TorrentFile) TotalSize() uint64 {
-	if tf.IsSingleFile() {
+	if tf.IsSingleFile() && tf.Info.Length > 0 {
 		return tf.Info.Length
 	}
 	total := uint64(0)
-	for _, f := range tf.Info.Files {
+	for _, f := range tf.Info.GetFiles() {
 		total += f.Length
 	}
 	return total
@@ -139,16 +195,33 @@ func (tf *TorrentFile) TorrentName() string {
 	return tf.Info.Path
 }
 
-// calculate infohash
+// calculate infohash, v2 only torrents use their truncated v2 infohash
 func (tf *TorrentFile) Infohash() (ih common.Infohash) {
+	if tf.IsV2() && !tf.IsV1() {
+		return tf.InfohashV2().Truncated()
+	}
 	d := sha1.Sum(tf.RawInfo)
 	copy(ih[:], d[:])
 	return
 }
 
+// calculate v2 infohash
+func (tf *TorrentFile) InfohashV2() (ih common.InfohashV2) {
+	ih = sha256.Sum256(tf.RawInfo)
+	return
+}
+
 // return true if this torrent is for a single file
 func (tf *TorrentFile) IsSingleFile() bool {
-	return tf.Info.Length > 0
+	if tf.Info.Length > 0 {
+		return true
+	}
+	if tf.IsV1() || !tf.IsV2() {
+		return false
+	}
+	// v2 single file torrents have one file named after the torrent in the file tree
+	files := tf.Info.v2files
+	return len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == tf.Info.Path
 }
 
 // bencode this file via an io.Writer
@@ -166,6 +239,9 @@ func (tf *TorrentFile) BDecode(r io.Reader) (err error) {
 		return
 	}
 	err = bencode.DecodeBytes(tf.RawInfo, &tf.Info)
+	if err == nil {
+		err = tf.Info.loadFileTree()
+	}
 	return
 }
 
@@ -179,6 +255,9 @@ func TorrentFileFromInfoBytes(bytes []byte) (tf *TorrentFile, err error) {
 		RawInfo: bytes,
 	}
 	err = bencode.DecodeBytes(tf.RawInfo, &tf.Info)
+	if err == nil {
+		err = tf.Info.loadFileTree()
+	}
 	if err != nil {
 		tf = nil
 	}
@@ -190,6 +269,9 @@ func TorrentFileFromInfo(info Info) (tf *TorrentFile, err error) {
 		Info: info,
 	}
 	tf.RawInfo, err = bencode.EncodeBytes(tf.Info)
+	if err == nil {
+		err = tf.Info.loadFileTree()
+	}
 	if err != nil {
 		tf = nil
 	}
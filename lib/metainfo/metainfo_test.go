@@ -1,8 +1,10 @@
 package metainfo
 
 import (
+	"github.com/majestrate/XD/lib/common"
 	"github.com/zeebo/bencode"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -25,3 +27,173 @@ func TestLoadTorrent(t *testing.T) {
 	}
 	// TODO: check members
 }
+
+func TestFilePieces(t *testing.T) {
+	info := Info{
+		PieceLength: 16,
+		Files: []FileInfo{
+			{Length: 8},
+			{Length: 40},
+			{Length: 0},
+			{Length: 16},
+		},
+	}
+	expected := [][2]uint32{{0, 1}, {0, 3}, {3, 3}, {3, 4}}
+	for idx := range expected {
+		begin, end := info.FilePieces(idx)
+		if begin != expected[idx][0] || end != expected[idx][1] {
+			t.Errorf("file %d has pieces [%d, %d), expected [%d, %d)", idx, begin, end, expected[idx][0], expected[idx][1])
+		}
+	}
+}
+
+func testV2Torrent(t *testing.T) (tf *TorrentFile, a, b []byte) {
+	a = make([]byte, 80*1024)
+	b = make([]byte, 10*1024)
+	for idx := range a {
+		a[idx] = byte(idx % 251)
+	}
+	for idx := range b {
+		b[idx] = byte(idx % 13)
+	}
+	const pl = 32 * 1024
+	pad := merkleRoot(nil, pl/MerkleBlockSize, [32]byte{})
+	var layer [][32]byte
+	for off := 0; off < len(a); off += pl {
+		end := off + pl
+		if end > len(a) {
+			end = len(a)
+		}
+		layer = append(layer, merkleRoot(blockHashes(a[off:end]), pl/MerkleBlockSize, [32]byte{}))
+	}
+	rootA := merkleRoot(layer, 4, pad)
+	rootB := merkleRoot(blockHashes(b), 1, [32]byte{})
+	info := map[string]interface{}{
+		"name":         "test",
+		"piece length": pl,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"a": map[string]interface{}{"": map[string]interface{}{"length": len(a), "pieces root": string(rootA[:])}},
+			"d": map[string]interface{}{
+				"b": map[string]interface{}{"": map[string]interface{}{"length": len(b), "pieces root": string(rootB[:])}},
+			},
+		},
+	}
+	raw, err := bencode.EncodeBytes(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err = TorrentFileFromInfoBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l []byte
+	for _, h := range layer {
+		l = append(l, h[:]...)
+	}
+	tf.PieceLayers = map[string]string{string(rootA[:]): string(l)}
+	return
+}
+
+func TestV2Files(t *testing.T) {
+	tf, a, b := testV2Torrent(t)
+	if !tf.IsV2() || tf.IsV1() || tf.IsHybrid() {
+		t.Fatal("torrent is not v2 only")
+	}
+	files := tf.Info.GetFiles()
+	if len(files) != 3 || !files[1].IsPadding() || files[2].Path.FilePath("") != filepath.Join("d", "b") {
+		t.Fatalf("bad file layout: %v", files)
+	}
+	if tf.TotalSize() != 96*1024+uint64(len(b)) {
+		t.Fatalf("bad total size %d", tf.TotalSize())
+	}
+	if tf.Info.NumPieces() != 4 {
+		t.Fatalf("expected 4 pieces, got %d", tf.Info.NumPieces())
+	}
+	if tf.Infohash() != tf.InfohashV2().Truncated() {
+		t.Fatal("v2 only torrent does not use truncated v2 infohash")
+	}
+	data := append(append(a, make([]byte, 16*1024)...), b...)
+	for idx := uint32(0); idx < 4; idx++ {
+		l := tf.LengthOfPiece(idx)
+		p := &common.PieceData{Index: idx, Data: data[idx*tf.Info.PieceLength:][:l]}
+		if !tf.CheckPiece(p) {
+			t.Errorf("piece %d failed check", idx)
+		}
+		bad := append([]byte{}, p.Data...)
+		bad[0]++
+		if tf.CheckPiece(&common.PieceData{Index: idx, Data: bad}) {
+			t.Errorf("corrupt piece %d passed check", idx)
+		}
+	}
+}
+
+func TestV2PieceLayers(t *testing.T) {
+	tf, _, _ := testV2Torrent(t)
+	missing := tf.MissingPieceLayers()
+	if len(missing) != 0 {
+		t.Fatalf("%d missing piece layers", len(missing))
+	}
+	f := tf.Info.GetFiles()[0]
+	layer := tf.PieceLayers[string(f.PiecesRoot)]
+	req := common.HashesRequest{BaseLayer: 1, Index: 2, Length: 2, ProofLayers: 1}
+	copy(req.PiecesRoot[:], f.PiecesRoot)
+	hashes, err := tf.Hashes(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 3 {
+		t.Fatalf("expected 3 hashes, got %d", len(hashes))
+	}
+
+	tf.PieceLayers = nil
+	if tf.PieceVerifiable(0) || !tf.PieceVerifiable(3) {
+		t.Fatal("wrong verifiable pieces without piece layers")
+	}
+	if len(tf.MissingPieceLayers()) != 1 {
+		t.Fatal("piece layer not missing")
+	}
+	got, err := tf.VerifyHashes(req, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != splitHashes([]byte(layer))[2] {
+		t.Fatal("wrong hash returned")
+	}
+	hashes[2][0]++
+	if _, err = tf.VerifyHashes(req, hashes); err == nil {
+		t.Fatal("bad proof verified")
+	}
+	if tf.SetPieceLayer(f.PiecesRoot, []byte(layer[:64])) == nil {
+		t.Fatal("short piece layer accepted")
+	}
+	if err = tf.SetPieceLayer(f.PiecesRoot, []byte(layer)); err != nil {
+		t.Fatal(err)
+	}
+	if !tf.PieceVerifiable(0) {
+		t.Fatal("piece not verifiable with piece layer")
+	}
+	reqs := tf.PieceLayerRequests(f)
+	if len(reqs) != 1 || reqs[0].Length != 4 || reqs[0].ProofLayers != 0 {
+		t.Fatalf("bad piece layer requests %v", reqs)
+	}
+}
+
+func TestURLList(t *testing.T) {
+	var tf TorrentFile
+	err := tf.BDecode(strings.NewReader("d4:infod6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae8:url-list21:http://example.i2p/a/e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tf.URLList) != 1 || tf.URLList[0] != "http://example.i2p/a/" {
+		t.Fatalf("bad url list %v", tf.URLList)
+	}
+	tf = TorrentFile{}
+	err = tf.BDecode(strings.NewReader("d4:infod6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae8:url-listl17:http://a.i2p/a/b/0:15:http://b.loki/aee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tf.URLList) != 2 || tf.URLList[1] != "http://b.loki/a" {
+		t.Fatalf("bad url list %v", tf.URLList)
+	}
+}
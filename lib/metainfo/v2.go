@@ -0,0 +1,437 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"sort"
+	"strings"
+)
+
+// MerkleBlockSize is the size of the blocks hashed into the leaves of v2 merkle trees
+const MerkleBlockSize = 16 * 1024
+
+// MaxHashesPerRequest is the most hashes a single hash request may ask for
+const MaxHashesPerRequest = 512
+
+var ErrBadFileTree = errors.New("bad v2 file tree")
+var ErrBadPieceLength = errors.New("bad v2 piece length")
+var ErrBadPieceLayer = errors.New("piece layer does not match pieces root")
+var ErrNoPieceLayer = errors.New("no such piece layer")
+var ErrBadHashRequest = errors.New("bad hash request")
+
+// parse v2 file tree into files
+func (i *Info) loadFileTree() (err error) {
+	i.v2files = nil
+	i.v2roots = nil
+	if i.FileTree == nil {
+		return
+	}
+	if i.PieceLength < MerkleBlockSize || i.PieceLength&(i.PieceLength-1) != 0 {
+		err = ErrBadPieceLength
+		return
+	}
+	i.v2roots = make(map[string][]byte)
+	var files []FileInfo
+	err = walkFileTree(i.FileTree, nil, func(f FileInfo) {
+		files = append(files, f)
+		if len(f.PiecesRoot) > 0 {
+			i.v2roots[strings.Join(f.Path, "/")] = f.PiecesRoot
+		}
+	})
+	if err != nil {
+		return
+	}
+	// align every file but the last to a piece boundary like a v1 torrent with padding files would
+	pl := uint64(i.PieceLength)
+	for idx, f := range files {
+		i.v2files = append(i.v2files, f)
+		if idx+1 < len(files) && f.Length%pl != 0 {
+			pad := pl - f.Length%pl
+			i.v2files = append(i.v2files, FileInfo{
+				Length: pad,
+				Path:   FilePath([]string{".pad", fmt.Sprintf("%d", pad)}),
+				Attr:   "p",
+			})
+		}
+	}
+	return
+}
+
+// visit every file in a file tree in order
+func walkFileTree(node map[string]interface{}, path []string, visit func(FileInfo)) error {
+	var names []string
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child, ok := node[name].(map[string]interface{})
+		if !ok || name == "" {
+			return ErrBadFileTree
+		}
+		p := make([]string, len(path), len(path)+1)
+		copy(p, path)
+		p = append(p, name)
+		if leaf, isFile := child[""]; isFile {
+			attrs, ok := leaf.(map[string]interface{})
+			if !ok {
+				return ErrBadFileTree
+			}
+			l, ok := attrs["length"].(int64)
+			if !ok || l < 0 {
+				return ErrBadFileTree
+			}
+			f := FileInfo{
+				Length: uint64(l),
+				Path:   FilePath(p),
+			}
+			if root, ok := attrs["pieces root"].(string); ok {
+				if len(root) != 32 {
+					return ErrBadFileTree
+				}
+				f.PiecesRoot = []byte(root)
+			} else if l > 0 {
+				return ErrBadFileTree
+			}
+			visit(f)
+		} else if err := walkFileTree(child, p, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return true if this torrent has v1 piece hashes
+func (tf *TorrentFile) IsV1() bool {
+	return len(tf.Info.Pieces) > 0
+}
+
+// return true if this torrent has a v2 file tree
+func (tf *TorrentFile) IsV2() bool {
+	return tf.Info.MetaVersion == 2 && tf.Info.FileTree != nil
+}
+
+// return true if this torrent is both v1 and v2
+func (tf *TorrentFile) IsHybrid() bool {
+	return tf.IsV1() && tf.IsV2()
+}
+
+// get the file holding piece idx and the index of the piece inside that file's merkle tree
+func (i Info) v2PieceFile(idx uint32) (f FileInfo, piece uint32, ok bool) {
+	pos := uint64(idx) * uint64(i.PieceLength)
+	var off uint64
+	for _, fi := range i.GetFiles() {
+		if !fi.IsPadding() && fi.Length > 0 && pos >= off && pos < off+fi.Length {
+			if off%uint64(i.PieceLength) != 0 || len(fi.PiecesRoot) != 32 {
+				return
+			}
+			f = fi
+			piece = uint32((pos - off) / uint64(i.PieceLength))
+			ok = true
+			return
+		}
+		off += fi.Length
+	}
+	return
+}
+
+// number of pieces in a file
+func (i Info) filePieceCount(f FileInfo) int {
+	return int((f.Length + uint64(i.PieceLength) - 1) / uint64(i.PieceLength))
+}
+
+// CheckPiece checks a piece against the v1 piece hashes and the v2 merkle tree, whichever are present
+func (tf *TorrentFile) CheckPiece(p *common.PieceData) bool {
+	if tf.IsV1() && !tf.Info.CheckPiece(p) {
+		return false
+	}
+	if !tf.IsV2() {
+		return tf.IsV1()
+	}
+	f, piece, ok := tf.Info.v2PieceFile(p.Index)
+	if !ok {
+		log.Error("piece index out of bounds")
+		return false
+	}
+	data := p.Data
+	if left := f.Length - uint64(piece)*uint64(tf.Info.PieceLength); uint64(len(data)) > left {
+		// drop padding
+		data = data[:left]
+	}
+	leaves := blockHashes(data)
+	var expected []byte
+	var h [32]byte
+	if f.Length <= uint64(tf.Info.PieceLength) {
+		// the whole file fits in one piece so the piece hashes to the pieces root
+		h = merkleRoot(leaves, nextPow2(len(leaves)), [32]byte{})
+		expected = f.PiecesRoot
+	} else {
+		layer, has := tf.PieceLayers[string(f.PiecesRoot)]
+		if !has {
+			if tf.IsV1() {
+				// hybrid torrent that we don't have piece layers for yet
+				return true
+			}
+			log.Warnf("no piece layer for piece %d", p.Index)
+			return false
+		}
+		if len(layer) < int(piece+1)*32 {
+			return false
+		}
+		h = merkleRoot(leaves, int(tf.Info.PieceLength/MerkleBlockSize), [32]byte{})
+		expected = []byte(layer[piece*32 : (piece+1)*32])
+	}
+	if bytes.Equal(h[:], expected) {
+		return true
+	}
+	log.Warnf("v2 piece missmatch: %s != %s", hex.EncodeToString(h[:]), hex.EncodeToString(expected))
+	return false
+}
+
+// PieceVerifiable returns true if we have the hashes needed to check piece idx
+func (tf *TorrentFile) PieceVerifiable(idx uint32) bool {
+	if tf.IsV1() || !tf.IsV2() {
+		return true
+	}
+	f, _, ok := tf.Info.v2PieceFile(idx)
+	if !ok {
+		return false
+	}
+	if f.Length <= uint64(tf.Info.PieceLength) {
+		return true
+	}
+	_, ok = tf.PieceLayers[string(f.PiecesRoot)]
+	return ok
+}
+
+// MissingPieceLayers returns the files that need a piece layer we don't have yet
+func (tf *TorrentFile) MissingPieceLayers() (files []FileInfo) {
+	for _, f := range tf.Info.GetFiles() {
+		if len(f.PiecesRoot) != 32 || f.Length <= uint64(tf.Info.PieceLength) {
+			continue
+		}
+		if _, ok := tf.PieceLayers[string(f.PiecesRoot)]; !ok {
+			files = append(files, f)
+		}
+	}
+	return
+}
+
+// find a v2 file by pieces root
+func (tf *TorrentFile) fileByRoot(root []byte) (f FileInfo, ok bool) {
+	for _, fi := range tf.Info.GetFiles() {
+		if len(fi.PiecesRoot) == 32 && bytes.Equal(fi.PiecesRoot, root) {
+			return fi, true
+		}
+	}
+	return
+}
+
+// hash of a piece sized subtree with no data in it
+func (i Info) padPieceHash() [32]byte {
+	return merkleRoot(nil, int(i.PieceLength/MerkleBlockSize), [32]byte{})
+}
+
+// SetPieceLayer sets the piece layer of a file after checking it against the file's pieces root
+func (tf *TorrentFile) SetPieceLayer(root, layer []byte) (err error) {
+	f, ok := tf.fileByRoot(root)
+	if !ok {
+		err = ErrNoPieceLayer
+		return
+	}
+	n := tf.Info.filePieceCount(f)
+	if len(layer) != n*32 {
+		err = ErrBadPieceLayer
+		return
+	}
+	hashes := splitHashes(layer)
+	h := merkleRoot(hashes, nextPow2(n), tf.Info.padPieceHash())
+	if !bytes.Equal(h[:], root) {
+		err = ErrBadPieceLayer
+		return
+	}
+	// copy on write so readers never see a map being written to
+	layers := make(map[string]string)
+	for k, v := range tf.PieceLayers {
+		layers[k] = v
+	}
+	layers[string(root)] = string(layer)
+	tf.PieceLayers = layers
+	return
+}
+
+// height of the piece layer above the leaves
+func (i Info) pieceLayerHeight() (h uint32) {
+	for n := i.PieceLength / MerkleBlockSize; n > 1; n >>= 1 {
+		h++
+	}
+	return
+}
+
+// PieceLayerRequests makes the hash requests needed to fetch the piece layer of a file
+func (tf *TorrentFile) PieceLayerRequests(f FileInfo) (reqs []common.HashesRequest) {
+	n := tf.Info.filePieceCount(f)
+	width := nextPow2(n)
+	chunk := width
+	if chunk > MaxHashesPerRequest {
+		chunk = MaxHashesPerRequest
+	}
+	var proofs uint32
+	for w := width / chunk; w > 1; w >>= 1 {
+		proofs++
+	}
+	for idx := 0; idx < n; idx += chunk {
+		req := common.HashesRequest{
+			BaseLayer:   tf.Info.pieceLayerHeight(),
+			Index:       uint32(idx),
+			Length:      uint32(chunk),
+			ProofLayers: proofs,
+		}
+		copy(req.PiecesRoot[:], f.PiecesRoot)
+		reqs = append(reqs, req)
+	}
+	return
+}
+
+// checks a hash request against our metadata and returns the file and piece layer width it is for
+func (tf *TorrentFile) checkHashRequest(req common.HashesRequest) (f FileInfo, width int, err error) {
+	var ok bool
+	f, ok = tf.fileByRoot(req.PiecesRoot[:])
+	l := int(req.Length)
+	if !ok || req.BaseLayer != tf.Info.pieceLayerHeight() || l < 1 || l > MaxHashesPerRequest || l&(l-1) != 0 || int(req.Index)%l != 0 {
+		err = ErrBadHashRequest
+		return
+	}
+	width = nextPow2(tf.Info.filePieceCount(f))
+	if int(req.Index)+l > width {
+		err = ErrBadHashRequest
+	}
+	return
+}
+
+// Hashes answers a hash request for piece layer hashes with the hashes followed by their uncle hashes
+func (tf *TorrentFile) Hashes(req common.HashesRequest) (hashes [][32]byte, err error) {
+	var width int
+	_, width, err = tf.checkHashRequest(req)
+	if err != nil {
+		return
+	}
+	layer, ok := tf.PieceLayers[string(req.PiecesRoot[:])]
+	if !ok {
+		err = ErrNoPieceLayer
+		return
+	}
+	nodes := make([][32]byte, width)
+	copy(nodes, splitHashes([]byte(layer)))
+	pad := tf.Info.padPieceHash()
+	for idx := len(layer) / 32; idx < width; idx++ {
+		nodes[idx] = pad
+	}
+	hashes = append(hashes, nodes[req.Index:req.Index+req.Length]...)
+	// climb to the root of the requested range
+	pos := int(req.Index)
+	for l := int(req.Length); l > 1; l >>= 1 {
+		nodes = merkleLayerUp(nodes)
+		pos >>= 1
+	}
+	for proofs := req.ProofLayers; proofs > 0 && len(nodes) > 1; proofs-- {
+		hashes = append(hashes, nodes[pos^1])
+		nodes = merkleLayerUp(nodes)
+		pos >>= 1
+	}
+	return
+}
+
+// VerifyHashes checks the hashes answering one of our hash requests against the pieces root and returns the requested hashes
+func (tf *TorrentFile) VerifyHashes(req common.HashesRequest, hashes [][32]byte) (layer [][32]byte, err error) {
+	_, _, err = tf.checkHashRequest(req)
+	if err != nil {
+		return
+	}
+	if len(hashes) != int(req.Length+req.ProofLayers) {
+		err = ErrBadHashRequest
+		return
+	}
+	layer = hashes[:req.Length]
+	h := merkleRoot(layer, len(layer), [32]byte{})
+	pos := req.Index / req.Length
+	for _, uncle := range hashes[req.Length:] {
+		if pos&1 == 0 {
+			h = merkleParent(h, uncle)
+		} else {
+			h = merkleParent(uncle, h)
+		}
+		pos >>= 1
+	}
+	if pos != 0 || !bytes.Equal(h[:], req.PiecesRoot[:]) {
+		layer = nil
+		err = ErrBadPieceLayer
+	}
+	return
+}
+
+// hash two merkle tree nodes together
+func merkleParent(left, right [32]byte) [32]byte {
+	h := sha256.New()
+	h.Write(left[:])
+	h.Write(right[:])
+	var parent [32]byte
+	copy(parent[:], h.Sum(nil))
+	return parent
+}
+
+// compute the next layer up of a merkle tree
+func merkleLayerUp(nodes [][32]byte) (up [][32]byte) {
+	up = make([][32]byte, len(nodes)/2)
+	for idx := range up {
+		up[idx] = merkleParent(nodes[idx*2], nodes[idx*2+1])
+	}
+	return
+}
+
+// compute the root of a merkle tree of width n with layer padded by pad
+func merkleRoot(layer [][32]byte, n int, pad [32]byte) [32]byte {
+	nodes := make([][32]byte, n)
+	copy(nodes, layer)
+	for idx := len(layer); idx < n; idx++ {
+		nodes[idx] = pad
+	}
+	for len(nodes) > 1 {
+		nodes = merkleLayerUp(nodes)
+	}
+	return nodes[0]
+}
+
+// hash data into merkle tree leaves
+func blockHashes(data []byte) (leaves [][32]byte) {
+	for len(data) > 0 {
+		n := MerkleBlockSize
+		if n > len(data) {
+			n = len(data)
+		}
+		leaves = append(leaves, sha256.Sum256(data[:n]))
+		data = data[n:]
+	}
+	return
+}
+
+func splitHashes(data []byte) (hashes [][32]byte) {
+	hashes = make([][32]byte, len(data)/32)
+	for idx := range hashes {
+		copy(hashes[idx][:], data[idx*32:])
+	}
+	return
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
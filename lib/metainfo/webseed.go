@@ -0,0 +1,31 @@
+package metainfo
+
+import (
+	"github.com/zeebo/bencode"
+)
+
+// URLList is a list of web seed urls (BEP 19)
+type URLList []string
+
+// UnmarshalBencode decodes a url-list that is either a single string or a list of strings
+func (l *URLList) UnmarshalBencode(data []byte) (err error) {
+	var single string
+	if bencode.DecodeBytes(data, &single) == nil {
+		*l = nil
+		if len(single) > 0 {
+			*l = URLList{single}
+		}
+		return
+	}
+	var list []string
+	err = bencode.DecodeBytes(data, &list)
+	if err == nil {
+		*l = nil
+		for _, u := range list {
+			if len(u) > 0 {
+				*l = append(*l, u)
+			}
+		}
+	}
+	return
+}
@@ -2,6 +2,7 @@ package i2p
 
 import (
 	"crypto/sha256"
+	"errors"
 	"net"
 	"strings"
 )
@@ -55,3 +56,25 @@ func (b32 Base32Addr) String() string {
 	i2pB32enc.Encode(b32addr, b32[:])
 	return string(b32addr[:52]) + ".b32.i2p"
 }
+
+// ErrBadBase32Addr is returned when parsing a malformed .b32.i2p address
+var ErrBadBase32Addr = errors.New("bad b32 address")
+
+// DecodeBase32Addr parses a .b32.i2p address
+func DecodeBase32Addr(s string) (b32 Base32Addr, err error) {
+	s = strings.ToLower(s)
+	if !strings.HasSuffix(s, ".b32.i2p") || len(s) != 52+len(".b32.i2p") {
+		err = ErrBadBase32Addr
+		return
+	}
+	var buf [35]byte
+	var n int
+	n, err = i2pB32enc.Decode(buf[:], []byte(s[:52]+"===="))
+	if err == nil && n != len(b32) {
+		err = ErrBadBase32Addr
+	}
+	if err == nil {
+		copy(b32[:], buf[:n])
+	}
+	return
+}
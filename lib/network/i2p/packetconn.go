@@ -2,12 +2,15 @@ package i2p
 
 import (
 	"bytes"
+	"fmt"
 	"net"
+	"strings"
 	"time"
 )
 
-// tcp/i2p connection
-// implements net.Conn
+// datagram connection forwarded to us by SAM
+// repliable datagrams and raw datagrams both arrive on the same socket
+// implements net.PacketConn
 type I2PPacketConn struct {
 	// underlying connection
 	c net.PacketConn
@@ -17,15 +20,49 @@ type I2PPacketConn struct {
 	samaddr net.Addr
 	// sam version
 	version string
+	// id of repliable datagram subsession
+	id string
+	// port we send repliable datagrams from
+	port int
+	// id of raw datagram subsession
+	rawID string
+	// port we send raw datagrams from
+	rawPort int
+}
+
+// parse a forwarded datagram header line
+// repliable datagrams look like "$destination FROM_PORT=n TO_PORT=n"
+// raw datagrams look like "FROM_PORT=n TO_PORT=n PROTOCOL=n"
+func parseDatagramHeader(line string) (from Addr, ok bool) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return
+	}
+	if !strings.Contains(parts[0], "=") {
+		from.addr = parts[0]
+		parts = parts[1:]
+	}
+	for _, part := range parts {
+		if strings.HasPrefix(part, "FROM_PORT=") {
+			from.port = part[10:]
+		}
+	}
+	ok = true
+	return
 }
 
 // implements net.PacketConn
+// raw datagrams have no source destination, only the port they were sent from
 func (c *I2PPacketConn) ReadFrom(d []byte) (n int, from net.Addr, err error) {
+	if c.c == nil {
+		return 0, nil, ErrNoDatagrams
+	}
 	var buff [65336]byte
 	for err == nil {
-		n, from, err = c.c.ReadFrom(buff[:])
+		var src net.Addr
+		n, src, err = c.c.ReadFrom(buff[:])
 		if err == nil {
-			if from.String() != c.samaddr.String() {
+			if !sameHost(src, c.samaddr) {
 				// drop silent because source missmatch
 				continue
 			}
@@ -34,43 +71,67 @@ func (c *I2PPacketConn) ReadFrom(d []byte) (n int, from net.Addr, err error) {
 				// drop silent because invalid format
 				continue
 			}
-			parts := bytes.SplitN(buff[:idx-1], []byte{' '}, 2)
-			if len(parts) < 2 {
+			addr, ok := parseDatagramHeader(string(buff[:idx]))
+			if !ok {
 				// drop silent because invalid format
 				continue
 			}
-			parts = bytes.Split(parts[1], []byte{' '})
-
-			from = I2PAddr(string(parts[len(parts)-1]))
 			data := buff[idx+1 : n]
-			n -= 1 + idx
+			n = len(data)
 			if len(d) < n {
 				// drop silent because too big for caller
 				continue
 			}
-
 			copy(d, data)
+			from = addr
 			break
 		}
 	}
 	return
 }
 
-// implements net.PacketConn
-func (c *I2PPacketConn) WriteTo(d []byte, to net.Addr) (n int, err error) {
-	tostr := c.version + " " + to.String()
-	tolen := len(tostr)
-	buff := make([]byte, len(d)+tolen+1)
-	copy(buff, tostr)
-	buff[tolen] = '\n'
-	copy(buff[:tolen+1], d)
-	n, err = c.c.WriteTo(buff, c.samaddr)
+// return true if 2 udp addresses have the same ip
+func sameHost(a, b net.Addr) bool {
+	ha, _, _ := net.SplitHostPort(a.String())
+	hb, _, _ := net.SplitHostPort(b.String())
+	return ha == hb
+}
+
+// send a datagram through one of our subsessions
+func (c *I2PPacketConn) writeTo(id string, fromPort int, d []byte, to net.Addr) (n int, err error) {
+	dest := I2PAddr(to.String())
+	hdr := fmt.Sprintf("%s %s %s FROM_PORT=%d", c.version, id, dest.addr, fromPort)
+	if dest.port != "" {
+		hdr += " TO_PORT=" + dest.port
+	}
+	buff := make([]byte, len(hdr)+1+len(d))
+	copy(buff, hdr)
+	buff[len(hdr)] = '\n'
+	copy(buff[len(hdr)+1:], d)
+	_, err = c.c.WriteTo(buff, c.samaddr)
 	if err == nil {
 		n = len(d)
 	}
 	return
 }
 
+// implements net.PacketConn
+// sends a repliable datagram
+func (c *I2PPacketConn) WriteTo(d []byte, to net.Addr) (n int, err error) {
+	if c.c == nil {
+		return 0, ErrNoDatagrams
+	}
+	return c.writeTo(c.id, c.port, d, to)
+}
+
+// WriteRawTo sends a raw datagram, the receiver cannot reply to it
+func (c *I2PPacketConn) WriteRawTo(d []byte, to net.Addr) (n int, err error) {
+	if c.c == nil {
+		return 0, ErrNoDatagrams
+	}
+	return c.writeTo(c.rawID, c.rawPort, d, to)
+}
+
 // implements net.PacketConn
 func (c *I2PPacketConn) Close() error {
 	if c.c == nil {
@@ -30,6 +30,24 @@ type samSession struct {
 	readbuf    [1]byte
 	lookup     chan *lookupReq
 	pktconn    I2PPacketConn
+	// i2cp port we take repliable datagrams on, raw datagrams use the port after it
+	// 0 if we do not use datagrams
+	dgramPort int
+}
+
+// ErrNoDatagrams is returned when sending or receiving datagrams on a session without them
+var ErrNoDatagrams = errors.New("datagrams not enabled on i2p session")
+
+// EnableDatagrams makes the session take repliable datagrams on port and raw datagrams on port+1
+// this needs a SAM 3.3 primary session, call it before Open
+func (s *samSession) EnableDatagrams(port int) {
+	s.dgramPort = port
+	s.maxversion = "3.3"
+}
+
+func (s *samSession) WriteRawTo(d []byte, to net.Addr) (n int, err error) {
+	n, err = s.pktconn.WriteRawTo(d, to)
+	return
 }
 
 func (s *samSession) ReadFrom(d []byte) (n int, from net.Addr, err error) {
@@ -53,6 +71,7 @@ func (s *samSession) Close() error {
 	s.lookup <- nil
 	err := s.c.Close()
 	s.pktconn.Close()
+	s.pktconn.c = nil
 	s.c = nil
 	return err
 }
@@ -278,39 +297,20 @@ func (s *samSession) udpAddr() (string, string, error) {
 	return "", "", errors.New("unroutable address: " + host)
 }
 
-func (s *samSession) createSession(style string) (err error) {
-	// try opening if this session isn't already open
+// i2cp options for SESSION CREATE
+func (s *samSession) i2cpOpts() string {
 	optsstr := " inbound.name=XD"
 	if s.opts != nil {
 		for k, v := range s.opts {
 			optsstr += fmt.Sprintf(" %s=%s", k, v)
 		}
 	}
-	if style == "DATAGRAM" {
-		var daddr, saddr string
-		daddr, saddr, err = s.udpAddr()
-		if err != nil {
-			return
-		}
-		s.pktconn.c, err = net.ListenPacket("udp", saddr)
-		if err != nil {
-			return
-		}
-		s.pktconn.samaddr, err = net.ResolveUDPAddr("udp", daddr)
-		if err != nil {
-			return
-		}
-		addr := s.pktconn.c.LocalAddr().String()
-		var host, port string
-		host, port, err = net.SplitHostPort(addr)
-		if err != nil {
-			s.pktconn.c.Close()
-			return err
-		}
-		optsstr += fmt.Sprintf(" HOST=%s PORT=%s", host, port)
-	}
+	return optsstr
+}
 
-	_, err = fmt.Fprintf(s.c, "SESSION CREATE STYLE=%s ID=%s SIGNATURE_TYPE=%d DESTINATION=%s%s\n", style, s.Name(), SigType, s.keys.privkey, optsstr)
+// send a SESSION command on the control socket and wait for the status reply
+func (s *samSession) sessionCommand(cmd string) (err error) {
+	_, err = fmt.Fprintf(s.c, "%s\n", cmd)
 	if err == nil {
 		// read response line
 		var line string
@@ -339,13 +339,67 @@ func (s *samSession) createSession(style string) (err error) {
 	return
 }
 
+func (s *samSession) createSession(style string) (err error) {
+	return s.sessionCommand(fmt.Sprintf("SESSION CREATE STYLE=%s ID=%s SIGNATURE_TYPE=%d DESTINATION=%s%s", style, s.Name(), SigType, s.keys.privkey, s.i2cpOpts()))
+}
+
+// create a primary session with a stream subsession named like a plain stream session and 2 datagram subsessions
+func (s *samSession) createPrimary() (err error) {
+	err = s.sessionCommand(fmt.Sprintf("SESSION CREATE STYLE=PRIMARY ID=%s-primary SIGNATURE_TYPE=%d DESTINATION=%s%s", s.Name(), SigType, s.keys.privkey, s.i2cpOpts()))
+	if err == nil {
+		err = s.sessionCommand(fmt.Sprintf("SESSION ADD STYLE=STREAM ID=%s", s.Name()))
+	}
+	if err == nil {
+		err = s.openDatagrams()
+	}
+	return
+}
+
+// bind the udp socket sam forwards datagrams to and add the datagram subsessions
+func (s *samSession) openDatagrams() (err error) {
+	var daddr, saddr string
+	daddr, saddr, err = s.udpAddr()
+	if err != nil {
+		return
+	}
+	s.pktconn.c, err = net.ListenPacket("udp", saddr)
+	if err != nil {
+		return
+	}
+	s.pktconn.samaddr, err = net.ResolveUDPAddr("udp", daddr)
+	if err == nil {
+		var host, port string
+		host, port, err = net.SplitHostPort(s.pktconn.c.LocalAddr().String())
+		if err == nil {
+			s.pktconn.version = s.maxversion
+			s.pktconn.id = s.Name() + "-dgram"
+			s.pktconn.port = s.dgramPort
+			s.pktconn.rawID = s.Name() + "-raw"
+			s.pktconn.rawPort = s.dgramPort + 1
+			err = s.sessionCommand(fmt.Sprintf("SESSION ADD STYLE=DATAGRAM ID=%s HOST=%s PORT=%s FROM_PORT=%d LISTEN_PORT=%d", s.pktconn.id, host, port, s.pktconn.port, s.pktconn.port))
+			if err == nil {
+				err = s.sessionCommand(fmt.Sprintf("SESSION ADD STYLE=RAW ID=%s HOST=%s PORT=%s FROM_PORT=%d LISTEN_PORT=%d HEADER=true", s.pktconn.rawID, host, port, s.pktconn.rawPort, s.pktconn.rawPort))
+			}
+		}
+	}
+	if err != nil {
+		s.pktconn.c.Close()
+		s.pktconn.c = nil
+	}
+	return
+}
+
 func (s *samSession) Open() (err error) {
 	s.c, err = s.OpenControlSocket()
 	if err == nil {
 		err = s.keys.ensure(s.c)
 	}
 	if err == nil {
-		err = s.createSession("STREAM")
+		if s.dgramPort > 0 {
+			err = s.createPrimary()
+		} else {
+			err = s.createSession("STREAM")
+		}
 		if err == nil {
 			go s.runLookups()
 			var a Addr
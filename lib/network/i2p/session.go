@@ -28,6 +28,13 @@ type Session interface {
 	// implements network.Network
 	WriteTo([]byte, net.Addr) (int, error)
 
+	// send a raw datagram that cannot be replied to
+	WriteRawTo([]byte, net.Addr) (int, error)
+
+	// take repliable datagrams on an i2cp port and raw datagrams on the port after it
+	// must be called before Open
+	EnableDatagrams(port int)
+
 	// implements network.Network
 	Accept() (net.Conn, error)
 
@@ -0,0 +1,43 @@
+package inet
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// LokiKeyLen is the size of the public key in a .loki address
+const LokiKeyLen = 32
+
+// LokiKey is the public key a .loki address is made from
+type LokiKey [LokiKeyLen]byte
+
+// lokinet uses z-base32 for addresses
+var lokiEnc = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+// ErrBadLokiAddr is returned when parsing a malformed .loki address
+var ErrBadLokiAddr = errors.New("bad loki address")
+
+// String gets the .loki address of this key
+func (k LokiKey) String() string {
+	return lokiEnc.EncodeToString(k[:]) + ".loki"
+}
+
+// DecodeLokiAddr parses a .loki address made from a public key
+func DecodeLokiAddr(s string) (k LokiKey, err error) {
+	s = strings.TrimSuffix(strings.ToLower(s), ".")
+	if !strings.HasSuffix(s, ".loki") || len(s) != 52+len(".loki") {
+		err = ErrBadLokiAddr
+		return
+	}
+	var buf [LokiKeyLen + 1]byte
+	var n int
+	n, err = lokiEnc.Decode(buf[:], []byte(s[:52]))
+	if err == nil && n != LokiKeyLen {
+		err = ErrBadLokiAddr
+	}
+	if err == nil {
+		copy(k[:], buf[:n])
+	}
+	return
+}
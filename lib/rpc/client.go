@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/majestrate/XD/lib/bittorrent/swarm"
+	"github.com/majestrate/XD/lib/blocklist"
+	"github.com/majestrate/XD/lib/storage"
 	t "github.com/majestrate/XD/lib/translate"
 	"io"
 	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type Client struct {
@@ -53,20 +56,31 @@ func (cl *Client) doRPC(r interface{}, h func(r io.Reader) error) (err error) {
 	return
 }
 
-func (cl *Client) torrentAction(ih, action string) (err error) {
-	err = cl.doRPC(&ChangeTorrentRequest{BaseRequest{cl.swarmno}, ih, action}, func(r io.Reader) error {
-		var response map[string]interface{}
-		e := json.NewDecoder(r).Decode(&response)
-		if e == nil {
-			emsg, has := response["error"]
-			if has {
-				if emsg != nil {
-					return fmt.Errorf("%s", t.T(fmt.Sprintf("%s", emsg)))
-				}
+// decode a response that only carries an error
+func decodeErrorResponse(r io.Reader) error {
+	var response map[string]interface{}
+	e := json.NewDecoder(r).Decode(&response)
+	if e == nil {
+		emsg, has := response["error"]
+		if has {
+			if emsg != nil {
+				return fmt.Errorf("%s", t.T(fmt.Sprintf("%s", emsg)))
 			}
 		}
-		return e
+	}
+	return e
+}
+
+func (cl *Client) torrentAction(ih, action string) (err error) {
+	return cl.changeTorrent(&ChangeTorrentRequest{
+		BaseRequest: BaseRequest{cl.swarmno},
+		Infohash:    ih,
+		Action:      action,
 	})
+}
+
+func (cl *Client) changeTorrent(req *ChangeTorrentRequest) (err error) {
+	err = cl.doRPC(req, decodeErrorResponse)
 	return
 }
 
@@ -86,6 +100,62 @@ func (cl *Client) DeleteTorrent(ih string) error {
 	return cl.torrentAction(ih, TorrentChangeDelete)
 }
 
+// SetSeedLimits sets the seeding goals of a torrent, 0 uses the global goal and a negative value means no goal
+func (cl *Client) SetSeedLimits(ih string, ratio float64, seedTime, idleTime time.Duration) error {
+	return cl.changeTorrent(&ChangeTorrentRequest{
+		BaseRequest: BaseRequest{cl.swarmno},
+		Infohash:    ih,
+		Action:      TorrentChangeSeedLimits,
+		Ratio:       ratio,
+		SeedTime:    int64(seedTime / time.Minute),
+		IdleTime:    int64(idleTime / time.Minute),
+	})
+}
+
+// MoveInQueue moves a torrent in the queue, move is one of top, up, down or bottom
+func (cl *Client) MoveInQueue(ih, move string) error {
+	return cl.torrentAction(ih, "queue-"+move)
+}
+
+// VerifyTorrent checks all local data of a torrent again
+func (cl *Client) VerifyTorrent(ih string) error {
+	return cl.torrentAction(ih, TorrentChangeVerify)
+}
+
+func (cl *Client) SetFilePriority(ih string, file int, prio string) error {
+	return cl.changeTorrent(&ChangeTorrentRequest{
+		BaseRequest: BaseRequest{cl.swarmno},
+		Infohash:    ih,
+		Action:      TorrentChangeFilePriority,
+		File:        file,
+		Priority:    prio,
+	})
+}
+
+func (cl *Client) SetSequential(ih string, seq bool) error {
+	if seq {
+		return cl.torrentAction(ih, TorrentChangeSequential)
+	}
+	return cl.torrentAction(ih, TorrentChangeRarestFirst)
+}
+
+func (cl *Client) SetSuperSeeding(ih string, on bool) error {
+	if on {
+		return cl.torrentAction(ih, TorrentChangeSuperSeed)
+	}
+	return cl.torrentAction(ih, TorrentChangeNormalSeed)
+}
+
+func (cl *Client) SetPieceDeadline(ih string, piece uint32, deadline time.Duration) error {
+	return cl.changeTorrent(&ChangeTorrentRequest{
+		BaseRequest: BaseRequest{cl.swarmno},
+		Infohash:    ih,
+		Action:      TorrentChangePieceDeadline,
+		Piece:       piece,
+		Deadline:    int64(deadline / time.Millisecond),
+	})
+}
+
 func (cl *Client) ListTorrents() (torrents swarm.TorrentsList, err error) {
 	err = cl.doRPC(&ListTorrentsRequest{BaseRequest{cl.swarmno}}, func(r io.Reader) error {
 		return json.NewDecoder(r).Decode(&torrents)
@@ -108,6 +178,72 @@ func (cl *Client) SetPieceWindow(n int) (err error) {
 	return
 }
 
+// SetRateLimit sets upload and download limits in bytes per second, globally if ih is empty
+func (cl *Client) SetRateLimit(ih string, up, down uint64) (err error) {
+	err = cl.doRPC(&SetRateLimitRequest{BaseRequest{cl.swarmno}, ih, up, down}, decodeErrorResponse)
+	return
+}
+
+// GetBlocklist gets blocklist stats, reloading the blocklist first if update is true
+func (cl *Client) GetBlocklist(update bool) (st blocklist.Stats, err error) {
+	err = cl.doRPC(&BlocklistRequest{BaseRequest{cl.swarmno}, update}, func(r io.Reader) error {
+		var raw json.RawMessage
+		e := json.NewDecoder(r).Decode(&raw)
+		if e == nil {
+			var response struct {
+				Error *string `json:"error"`
+			}
+			json.Unmarshal(raw, &response)
+			if response.Error != nil {
+				return fmt.Errorf("%s", t.T(*response.Error))
+			}
+			e = json.Unmarshal(raw, &st)
+		}
+		return e
+	})
+	return
+}
+
+// GetConnStats gets the state of the swarm wide connection limits
+func (cl *Client) GetConnStats() (st swarm.ConnStats, err error) {
+	err = cl.doRPC(&ConnStatsRequest{BaseRequest{cl.swarmno}}, func(r io.Reader) error {
+		var raw json.RawMessage
+		e := json.NewDecoder(r).Decode(&raw)
+		if e == nil {
+			var response struct {
+				Error *string `json:"error"`
+			}
+			json.Unmarshal(raw, &response)
+			if response.Error != nil {
+				return fmt.Errorf("%s", t.T(*response.Error))
+			}
+			e = json.Unmarshal(raw, &st)
+		}
+		return e
+	})
+	return
+}
+
+// GetCacheStats gets statistics of the piece cache
+func (cl *Client) GetCacheStats() (st storage.CacheStats, err error) {
+	err = cl.doRPC(&CacheStatsRequest{BaseRequest{cl.swarmno}}, func(r io.Reader) error {
+		var raw json.RawMessage
+		e := json.NewDecoder(r).Decode(&raw)
+		if e == nil {
+			var response struct {
+				Error *string `json:"error"`
+			}
+			json.Unmarshal(raw, &response)
+			if response.Error != nil {
+				return fmt.Errorf("%s", t.T(*response.Error))
+			}
+			e = json.Unmarshal(raw, &st)
+		}
+		return e
+	})
+	return
+}
+
 func (cl *Client) AddTorrent(url string) (err error) {
 	err = cl.doRPC(&AddTorrentRequest{BaseRequest{cl.swarmno}, url}, func(r io.Reader) error {
 		var response interface{}
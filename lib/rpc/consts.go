@@ -5,3 +5,13 @@ const ParamURL = "url"
 const ParamN = "n"
 const ParamAction = "action"
 const ParamSwarms = "swarms"
+const ParamFile = "file"
+const ParamPriority = "priority"
+const ParamPiece = "piece"
+const ParamDeadline = "deadline"
+const ParamRatio = "ratio"
+const ParamSeedTime = "seed-time"
+const ParamIdleTime = "idle-time"
+const ParamUpload = "upload"
+const ParamDownload = "download"
+const ParamUpdate = "update"
@@ -11,3 +11,7 @@ const RPCDelTorrent = RPCName + ".DelTorrent"
 const RPCSetPieceWindow = RPCName + ".SetPieceWindow"
 const RPCChangeTorrent = RPCName + ".ChangeTorrent"
 const RPCSwarmCount = RPCName + ".SwarmCount"
+const RPCSetRateLimit = RPCName + ".SetRateLimit"
+const RPCBlocklist = RPCName + ".Blocklist"
+const RPCConnStats = RPCName + ".ConnStats"
+const RPCCacheStats = RPCName + ".CacheStats"
@@ -0,0 +1,32 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+)
+
+// BlocklistRequest gets blocklist entry and hit counts, reloading the blocklist first if Update is set
+type BlocklistRequest struct {
+	BaseRequest
+	Update bool `json:"update"`
+}
+
+func (r *BlocklistRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter) {
+	if r.Update {
+		err := sw.UpdateBlocklist()
+		if err != nil {
+			w.SendError(err.Error())
+			return
+		}
+	}
+	w.Return(sw.Blocklist().Stats())
+}
+
+func (r *BlocklistRequest) MarshalJSON() (data []byte, err error) {
+	data, err = json.Marshal(map[string]interface{}{
+		ParamMethod: RPCBlocklist,
+		ParamSwarm:  r.Swarm,
+		ParamUpdate: r.Update,
+	})
+	return
+}
@@ -0,0 +1,23 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+)
+
+// CacheStatsRequest gets statistics of the piece cache
+type CacheStatsRequest struct {
+	BaseRequest
+}
+
+func (r *CacheStatsRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter) {
+	w.Return(sw.Torrents.CacheStats())
+}
+
+func (r *CacheStatsRequest) MarshalJSON() (data []byte, err error) {
+	data, err = json.Marshal(map[string]interface{}{
+		ParamMethod: RPCCacheStats,
+		ParamSwarm:  r.Swarm,
+	})
+	return
+}
@@ -5,12 +5,34 @@ import (
 	"errors"
 	"github.com/majestrate/XD/lib/bittorrent/swarm"
 	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/storage"
+	"time"
 )
 
 const TorrentChangeStart = "start"
 const TorrentChangeStop = "stop"
 const TorrentChangeRemove = "remove"
 const TorrentChangeDelete = "delete"
+const TorrentChangeVerify = "verify"
+const TorrentChangeFilePriority = "file-priority"
+const TorrentChangeSequential = "sequential"
+const TorrentChangeRarestFirst = "rarest-first"
+const TorrentChangePieceDeadline = "piece-deadline"
+const TorrentChangeSuperSeed = "super-seed"
+const TorrentChangeNormalSeed = "normal-seed"
+const TorrentChangeSeedLimits = "seed-limits"
+const TorrentChangeQueueTop = "queue-top"
+const TorrentChangeQueueUp = "queue-up"
+const TorrentChangeQueueDown = "queue-down"
+const TorrentChangeQueueBottom = "queue-bottom"
+
+// queue moves by torrent action
+var queueMoves = map[string]swarm.QueueMove{
+	TorrentChangeQueueTop:    swarm.QueueTop,
+	TorrentChangeQueueUp:     swarm.QueueUp,
+	TorrentChangeQueueDown:   swarm.QueueDown,
+	TorrentChangeQueueBottom: swarm.QueueBottom,
+}
 
 var ErrInvalidAction = errors.New("invalid torrent action")
 
@@ -18,6 +40,25 @@ type ChangeTorrentRequest struct {
 	BaseRequest
 	Infohash string `json:"infohash"`
 	Action   string `json:"action"`
+	File     int    `json:"file"`
+	Priority string `json:"priority"`
+	Piece    uint32 `json:"piece"`
+	// deadline in milliseconds from now, 0 clears it
+	Deadline int64 `json:"deadline"`
+	// seeding goals, times in minutes, 0 uses the global goal and a negative value means no goal
+	Ratio    float64 `json:"ratio"`
+	SeedTime int64   `json:"seed-time"`
+	IdleTime int64   `json:"idle-time"`
+}
+
+// seeding goals of 0 use the global goal and negative goals mean no goal
+func seedLimitMode(limit float64) storage.SeedLimitMode {
+	if limit > 0 {
+		return storage.SeedLimitSingle
+	} else if limit < 0 {
+		return storage.SeedLimitUnlimited
+	}
+	return storage.SeedLimitGlobal
 }
 
 func (r *ChangeTorrentRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter) {
@@ -38,6 +79,43 @@ func (r *ChangeTorrentRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter
 					err = t.Remove()
 				case TorrentChangeDelete:
 					err = t.Delete()
+				case TorrentChangeVerify:
+					err = t.Recheck()
+				case TorrentChangeFilePriority:
+					var p storage.FilePriority
+					p, err = storage.ParseFilePriority(r.Priority)
+					if err == nil {
+						// skip stops downloading the file, any other priority downloads it again
+						err = t.SetFileWanted(r.File, p.Wanted())
+					}
+					if err == nil && p.Wanted() {
+						err = t.SetFilePriority(r.File, p)
+					}
+				case TorrentChangeSequential:
+					t.SetSequential(true)
+				case TorrentChangeRarestFirst:
+					t.SetSequential(false)
+				case TorrentChangeSuperSeed:
+					t.SetSuperSeeding(true)
+				case TorrentChangeNormalSeed:
+					t.SetSuperSeeding(false)
+				case TorrentChangeSeedLimits:
+					err = t.SetSeedLimits(storage.SeedLimits{
+						Ratio:     r.Ratio,
+						RatioMode: seedLimitMode(r.Ratio),
+						Time:      time.Duration(r.SeedTime) * time.Minute,
+						TimeMode:  seedLimitMode(float64(r.SeedTime)),
+						Idle:      time.Duration(r.IdleTime) * time.Minute,
+						IdleMode:  seedLimitMode(float64(r.IdleTime)),
+					})
+				case TorrentChangeQueueTop, TorrentChangeQueueUp, TorrentChangeQueueDown, TorrentChangeQueueBottom:
+					err = sw.Torrents.MoveInQueue(t, queueMoves[r.Action])
+				case TorrentChangePieceDeadline:
+					var deadline time.Time
+					if r.Deadline > 0 {
+						deadline = time.Now().Add(time.Duration(r.Deadline) * time.Millisecond)
+					}
+					err = t.SetPieceDeadline(r.Piece, deadline)
 				default:
 					err = ErrInvalidAction
 				}
@@ -56,6 +134,13 @@ func (r *ChangeTorrentRequest) MarshalJSON() (data []byte, err error) {
 		ParamSwarm:    r.Swarm,
 		ParamInfohash: r.Infohash,
 		ParamAction:   r.Action,
+		ParamFile:     r.File,
+		ParamPriority: r.Priority,
+		ParamPiece:    r.Piece,
+		ParamDeadline: r.Deadline,
+		ParamRatio:    r.Ratio,
+		ParamSeedTime: r.SeedTime,
+		ParamIdleTime: r.IdleTime,
 		ParamMethod:   RPCChangeTorrent,
 	})
 	return
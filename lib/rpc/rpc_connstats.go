@@ -0,0 +1,23 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+)
+
+// ConnStatsRequest gets the state of the swarm wide connection limits
+type ConnStatsRequest struct {
+	BaseRequest
+}
+
+func (r *ConnStatsRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter) {
+	w.Return(sw.Torrents.ConnStats())
+}
+
+func (r *ConnStatsRequest) MarshalJSON() (data []byte, err error) {
+	data, err = json.Marshal(map[string]interface{}{
+		ParamMethod: RPCConnStats,
+		ParamSwarm:  r.Swarm,
+	})
+	return
+}
@@ -0,0 +1,51 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+	"github.com/majestrate/XD/lib/common"
+)
+
+// SetRateLimitRequest sets upload and download limits in bytes per second
+// limits are global unless an infohash is given, 0 means unlimited
+type SetRateLimitRequest struct {
+	BaseRequest
+	Infohash string `json:"infohash"`
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+func (r *SetRateLimitRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter) {
+	var err error
+	if r.Infohash == "" {
+		sw.Torrents.SetRateLimits(r.Upload, r.Download)
+	} else {
+		var ih common.Infohash
+		ih, err = common.DecodeInfohash(r.Infohash)
+		if err == nil {
+			sw.Torrents.VisitTorrent(ih, func(t *swarm.Torrent) {
+				if t == nil {
+					err = ErrNoTorrent
+				} else {
+					t.SetRateLimits(r.Upload, r.Download)
+				}
+			})
+		}
+	}
+	if err == nil {
+		w.Return(map[string]interface{}{"error": nil})
+	} else {
+		w.Return(map[string]interface{}{"error": err.Error()})
+	}
+}
+
+func (r *SetRateLimitRequest) MarshalJSON() (data []byte, err error) {
+	data, err = json.Marshal(map[string]interface{}{
+		ParamMethod:   RPCSetRateLimit,
+		ParamSwarm:    r.Swarm,
+		ParamInfohash: r.Infohash,
+		ParamUpload:   r.Upload,
+		ParamDownload: r.Download,
+	})
+	return
+}
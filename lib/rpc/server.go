@@ -89,10 +89,23 @@ func (r *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 							N: len(r.sw),
 						}
 					case RPCChangeTorrent:
-						rr = &ChangeTorrentRequest{
+						req := &ChangeTorrentRequest{
 							Infohash: fmt.Sprintf("%s", body[ParamInfohash]),
 							Action:   fmt.Sprintf("%s", body[ParamAction]),
 						}
+						if file, ok := body[ParamFile].(float64); ok {
+							req.File = int(file)
+						}
+						if prio, ok := body[ParamPriority].(string); ok {
+							req.Priority = prio
+						}
+						if piece, ok := body[ParamPiece].(float64); ok {
+							req.Piece = uint32(piece)
+						}
+						if deadline, ok := body[ParamDeadline].(float64); ok {
+							req.Deadline = int64(deadline)
+						}
+						rr = req
 					case RPCListTorrents:
 						rr = &ListTorrentsRequest{}
 					case RPCTorrentStatus:
@@ -114,6 +127,30 @@ func (r *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 								message: fmt.Sprintf("invalid value: %s", body[ParamN]),
 							}
 						}
+					case RPCSetRateLimit:
+						up, upOK := body[ParamUpload].(float64)
+						down, downOK := body[ParamDownload].(float64)
+						if upOK && downOK && up >= 0 && down >= 0 {
+							ih, _ := body[ParamInfohash].(string)
+							rr = &SetRateLimitRequest{
+								Infohash: ih,
+								Upload:   uint64(up),
+								Download: uint64(down),
+							}
+						} else {
+							rr = &rpcError{
+								message: fmt.Sprintf("invalid rate limits: %v %v", body[ParamUpload], body[ParamDownload]),
+							}
+						}
+					case RPCBlocklist:
+						update, _ := body[ParamUpdate].(bool)
+						rr = &BlocklistRequest{
+							Update: update,
+						}
+					case RPCConnStats:
+						rr = &ConnStatsRequest{}
+					case RPCCacheStats:
+						rr = &CacheStatsRequest{}
 					case RPCListTorrentStatus:
 						rr = &ListTorrentStatusRequest{}
 					default:
@@ -24,6 +24,13 @@ const tr_Status_Download = 4
 const tr_Status_SeedWait = 5
 const tr_Status_Seed = 6
 
+const tr_Stat_OK = 0
+const tr_Stat_Local_Error = 3
+
+const tr_Limit_Global = 0
+const tr_Limit_Single = 1
+const tr_Limit_Unlimited = 2
+
 const tr_Pri_Low = -1
 const tr_Pri_Norm = 0
 const tr_Pri_High = 1
@@ -0,0 +1,17 @@
+package transmission
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+)
+
+func BlocklistUpdate(sw *swarm.Swarm, args Args) (resp Response) {
+	resp.Args = make(Args)
+	err := sw.UpdateBlocklist()
+	if err == nil {
+		resp.Args["blocklist-size"] = sw.Blocklist().Len()
+		resp.Result = Success
+	} else {
+		resp.Result = err.Error()
+	}
+	return
+}
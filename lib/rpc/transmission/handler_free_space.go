@@ -0,0 +1,19 @@
+package transmission
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+)
+
+func FreeSpace(sw *swarm.Swarm, args Args) (resp Response) {
+	resp.Args = make(Args)
+	path, _ := args["path"].(string)
+	free, err := sw.Torrents.FreeSpace(path)
+	if err != nil {
+		resp.Result = err.Error()
+		return
+	}
+	resp.Args["path"] = path
+	resp.Args["size-bytes"] = free
+	resp.Result = Success
+	return
+}
@@ -0,0 +1,39 @@
+package transmission
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+	"sort"
+)
+
+// QueueMove makes a handler that moves torrents in the queue
+func QueueMove(move swarm.QueueMove) Handler {
+	return func(sw *swarm.Swarm, args Args) (resp Response) {
+		resp.Args = make(Args)
+		var torrents []*swarm.Torrent
+		ids := getTorrentIDs(sw.Torrents.TorrentIDs, args)
+		for _, id := range ids {
+			t := sw.Torrents.GetTorrentByID(int64(id))
+			if t != nil && t.QueuePosition() >= 0 {
+				torrents = append(torrents, t)
+			}
+		}
+		// move in an order that keeps the moved torrents in the order they were in
+		sort.Slice(torrents, func(i, j int) bool {
+			return torrents[i].QueuePosition() < torrents[j].QueuePosition()
+		})
+		if move == swarm.QueueTop || move == swarm.QueueDown {
+			for i, j := 0, len(torrents)-1; i < j; i, j = i+1, j-1 {
+				torrents[i], torrents[j] = torrents[j], torrents[i]
+			}
+		}
+		for _, t := range torrents {
+			err := sw.Torrents.MoveInQueue(t, move)
+			if err != nil {
+				resp.Result = err.Error()
+				return
+			}
+		}
+		resp.Result = Success
+		return
+	}
+}
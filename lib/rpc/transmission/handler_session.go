@@ -0,0 +1,162 @@
+package transmission
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+	"strings"
+	"time"
+)
+
+// transmission speeds are in kB/s
+const trSpeedUnit = 1000
+
+func SessionGet(sw *swarm.Swarm, args Args) (resp Response) {
+	resp.Args = make(Args)
+	up, down := sw.Torrents.SpeedLimits()
+	alt := sw.Torrents.GetAltSpeed()
+	resp.Args["speed-limit-up"] = up.Rate / trSpeedUnit
+	resp.Args["speed-limit-up-enabled"] = up.Enabled
+	resp.Args["speed-limit-down"] = down.Rate / trSpeedUnit
+	resp.Args["speed-limit-down-enabled"] = down.Enabled
+	resp.Args["alt-speed-up"] = alt.Upload / trSpeedUnit
+	resp.Args["alt-speed-down"] = alt.Download / trSpeedUnit
+	resp.Args["alt-speed-enabled"] = alt.Enabled
+	resp.Args["alt-speed-time-enabled"] = alt.Scheduled
+	resp.Args["alt-speed-time-begin"] = alt.Begin
+	resp.Args["alt-speed-time-end"] = alt.End
+	resp.Args["alt-speed-time-day"] = alt.Days
+	resp.Args["blocklist-enabled"] = sw.Blocklist().Enabled()
+	resp.Args["blocklist-size"] = sw.Blocklist().Len()
+	resp.Args["blocklist-url"] = ""
+	conns := sw.Torrents.ConnStats()
+	resp.Args["peer-limit-global"] = conns.MaxConnections
+	resp.Args["peer-limit-per-torrent"] = conns.FairShare
+	resp.Args["download-queue-size"] = sw.Torrents.MaxActiveDownloads
+	resp.Args["download-queue-enabled"] = sw.Torrents.MaxActiveDownloads > 0
+	resp.Args["seed-queue-size"] = sw.Torrents.MaxActiveSeeds
+	resp.Args["seed-queue-enabled"] = sw.Torrents.MaxActiveSeeds > 0
+	resp.Args["queue-stalled-minutes"] = int(sw.Torrents.StalledTime / time.Minute)
+	resp.Args["queue-stalled-enabled"] = sw.Torrents.StalledTime > 0
+	if free, err := sw.Torrents.FreeSpace(""); err == nil {
+		resp.Args["download-dir-free-space"] = free
+	}
+	seed := sw.Torrents.SeedLimits()
+	resp.Args["seedRatioLimit"] = seed.Ratio
+	resp.Args["seedRatioLimited"] = seed.Ratio > 0
+	resp.Args["idle-seeding-limit"] = int(seed.Idle / time.Minute)
+	resp.Args["idle-seeding-limit-enabled"] = seed.Idle > 0
+	for _, source := range sw.BlocklistSources() {
+		if isURL(source) {
+			resp.Args["blocklist-url"] = source
+			break
+		}
+	}
+	resp.Result = Success
+	return
+}
+
+// get a speed in bytes per second from a kB/s value
+func getSpeed(v interface{}) (speed uint64, ok bool) {
+	var n int64
+	n, ok = getInt(v)
+	if ok && n >= 0 {
+		speed = uint64(n) * trSpeedUnit
+	} else {
+		ok = false
+	}
+	return
+}
+
+// apply a speed and speed enabled pair of session args to a limit
+func setSpeedLimit(args Args, speedKey, enabledKey string, limit *swarm.SpeedLimit) {
+	if v, ok := args[speedKey]; ok {
+		if speed, ok := getSpeed(v); ok {
+			limit.Rate = speed
+		}
+	}
+	if v, ok := args[enabledKey].(bool); ok {
+		limit.Enabled = v
+	}
+}
+
+// apply a limit and enabled pair of session args, disabled means no limit
+func setIntLimit(args Args, limitKey, enabledKey string, limit *int) {
+	if v, ok := getInt(args[limitKey]); ok && v >= 0 {
+		*limit = int(v)
+	}
+	if v, ok := args[enabledKey].(bool); ok && !v {
+		*limit = 0
+	}
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func SessionSet(sw *swarm.Swarm, args Args) (resp Response) {
+	resp.Args = make(Args)
+	up, down := sw.Torrents.SpeedLimits()
+	setSpeedLimit(args, "speed-limit-up", "speed-limit-up-enabled", &up)
+	setSpeedLimit(args, "speed-limit-down", "speed-limit-down-enabled", &down)
+	sw.Torrents.SetSpeedLimits(up, down)
+
+	alt := sw.Torrents.GetAltSpeed()
+	if v, ok := getSpeed(args["alt-speed-up"]); ok {
+		alt.Upload = v
+	}
+	if v, ok := getSpeed(args["alt-speed-down"]); ok {
+		alt.Download = v
+	}
+	if v, ok := args["alt-speed-enabled"].(bool); ok {
+		alt.Enabled = v
+	}
+	if v, ok := args["alt-speed-time-enabled"].(bool); ok {
+		alt.Scheduled = v
+	}
+	if v, ok := getInt(args["alt-speed-time-begin"]); ok {
+		alt.Begin = int(v)
+	}
+	if v, ok := getInt(args["alt-speed-time-end"]); ok {
+		alt.End = int(v)
+	}
+	if v, ok := getInt(args["alt-speed-time-day"]); ok {
+		alt.Days = int(v)
+	}
+	sw.Torrents.SetAltSpeed(alt)
+
+	setIntLimit(args, "download-queue-size", "download-queue-enabled", &sw.Torrents.MaxActiveDownloads)
+	setIntLimit(args, "seed-queue-size", "seed-queue-enabled", &sw.Torrents.MaxActiveSeeds)
+	stalled := int(sw.Torrents.StalledTime / time.Minute)
+	setIntLimit(args, "queue-stalled-minutes", "queue-stalled-enabled", &stalled)
+	sw.Torrents.StalledTime = time.Duration(stalled) * time.Minute
+
+	seed := sw.Torrents.SeedLimits()
+	if v, ok := getFloat(args["seedRatioLimit"]); ok && v >= 0 {
+		seed.Ratio = v
+	}
+	if v, ok := args["seedRatioLimited"].(bool); ok && !v {
+		seed.Ratio = 0
+	}
+	idle := int(seed.Idle / time.Minute)
+	setIntLimit(args, "idle-seeding-limit", "idle-seeding-limit-enabled", &idle)
+	seed.Idle = time.Duration(idle) * time.Minute
+	sw.Torrents.SetSeedLimits(seed)
+
+	if v, ok := args["blocklist-enabled"].(bool); ok {
+		sw.Blocklist().SetEnabled(v)
+	}
+	if v, ok := args["blocklist-url"].(string); ok {
+		// replace the url sources, files from the config are kept
+		var sources []string
+		for _, source := range sw.BlocklistSources() {
+			if !isURL(source) {
+				sources = append(sources, source)
+			}
+		}
+		if v != "" {
+			sources = append(sources, v)
+		}
+		sw.SetBlocklistSources(sources)
+	}
+	resp.Result = Success
+	return
+}
@@ -0,0 +1,29 @@
+package transmission
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+)
+
+func TorrentSet(sw *swarm.Swarm, args Args) (resp Response) {
+	resp.Args = make(Args)
+	var err error
+	ids := getTorrentIDs(sw.Torrents.TorrentIDs, args)
+	for _, id := range ids {
+		t := sw.Torrents.GetTorrentByID(int64(id))
+		if t == nil {
+			continue
+		}
+		for _, f := range tsFieldHandlers {
+			v, ok := args[f.name]
+			if ok {
+				err = f.h(t, v)
+				if err != nil {
+					resp.Result = err.Error()
+					return
+				}
+			}
+		}
+	}
+	resp.Result = Success
+	return
+}
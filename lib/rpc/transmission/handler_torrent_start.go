@@ -0,0 +1,33 @@
+package transmission
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+)
+
+// TorrentStart puts torrents in the queue to be started when there is a free slot
+func TorrentStart(sw *swarm.Swarm, args Args) (resp Response) {
+	return startTorrents(sw, args, (*swarm.Torrent).StartQueued)
+}
+
+// TorrentStartNow starts torrents right away without waiting in the queue
+func TorrentStartNow(sw *swarm.Swarm, args Args) (resp Response) {
+	return startTorrents(sw, args, (*swarm.Torrent).Start)
+}
+
+func startTorrents(sw *swarm.Swarm, args Args, start func(*swarm.Torrent) error) (resp Response) {
+	resp.Args = make(Args)
+	ids := getTorrentIDs(sw.Torrents.TorrentIDs, args)
+	for _, id := range ids {
+		t := sw.Torrents.GetTorrentByID(int64(id))
+		if t == nil {
+			continue
+		}
+		err := start(t)
+		if err != nil && err != swarm.ErrAlreadyStarted {
+			resp.Result = err.Error()
+			return
+		}
+	}
+	resp.Result = Success
+	return
+}
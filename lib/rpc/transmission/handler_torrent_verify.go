@@ -0,0 +1,23 @@
+package transmission
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+)
+
+func TorrentVerify(sw *swarm.Swarm, args Args) (resp Response) {
+	resp.Args = make(Args)
+	ids := getTorrentIDs(sw.Torrents.TorrentIDs, args)
+	for _, id := range ids {
+		t := sw.Torrents.GetTorrentByID(int64(id))
+		if t == nil {
+			continue
+		}
+		err := t.Recheck()
+		if err != nil && err != swarm.ErrChecking {
+			resp.Result = err.Error()
+			return
+		}
+	}
+	resp.Result = Success
+	return
+}
@@ -83,27 +83,28 @@ func NewHandler(sw *swarm.Swarm) http.Handler {
 		sw:        sw,
 		nextToken: newToken(),
 		handlers: map[string]Handler{
-			"torrent-start":        NotImplemented,
-			"torrent-start-now":    NotImplemented,
+			"torrent-start":        TorrentStart,
+			"torrent-start-now":    TorrentStartNow,
 			"torrent-stop":         NotImplemented,
-			"torrent-verify":       NotImplemented,
+			"torrent-verify":       TorrentVerify,
 			"torrent-reannounce":   NotImplemented,
 			"torrent-get":          TorrentGet,
-			"torrent-set":          NotImplemented,
+			"torrent-set":          TorrentSet,
 			"torrent-add":          NotImplemented,
 			"torrent-remove":       NotImplemented,
 			"torrent-set-location": NotImplemented,
 			"torrent-rename-path":  NotImplemented,
-			"session-set":          NotImplemented,
+			"session-get":          SessionGet,
+			"session-set":          SessionSet,
 			"session-stats":        NotImplemented,
-			"blocklist-update":     NotImplemented,
+			"blocklist-update":     BlocklistUpdate,
 			"port-test":            NotImplemented,
 			"session-close":        NotImplemented,
-			"queue-move-top":       NotImplemented,
-			"queue-move-up":        NotImplemented,
-			"queue-move-down":      NotImplemented,
-			"queue-move-bottom":    NotImplemented,
-			"free-space":           NotImplemented,
+			"queue-move-top":       QueueMove(swarm.QueueTop),
+			"queue-move-up":        QueueMove(swarm.QueueUp),
+			"queue-move-down":      QueueMove(swarm.QueueDown),
+			"queue-move-bottom":    QueueMove(swarm.QueueBottom),
+			"free-space":           FreeSpace,
 		},
 	}
 }
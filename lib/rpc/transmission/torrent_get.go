@@ -2,6 +2,8 @@ package transmission
 
 import (
 	"github.com/majestrate/XD/lib/bittorrent/swarm"
+	"github.com/majestrate/XD/lib/storage"
+	"math"
 	"time"
 )
 
@@ -48,11 +50,22 @@ func tgStatus(f string, t *swarm.Torrent, resp *tgResp) (err error) {
 		trStatus = tr_Status_Seed
 	case swarm.Checking:
 		trStatus = tr_Status_Check
+	case swarm.Queued:
+		if t.Done() {
+			trStatus = tr_Status_SeedWait
+		} else {
+			trStatus = tr_Status_DownloadWait
+		}
 	}
 	resp.Set(f, trStatus)
 	return
 }
 
+func tgQueuePosition(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	resp.Set(f, t.QueuePosition())
+	return
+}
+
 func tgZeroInt(f string, t *swarm.Torrent, resp *tgResp) (err error) {
 	resp.Set(f, 0)
 	return
@@ -68,6 +81,24 @@ func tgTrue(f string, t *swarm.Torrent, resp *tgResp) (err error) {
 	return
 }
 
+func tgError(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	code := tr_Stat_OK
+	if t.LocalError() != nil {
+		code = tr_Stat_Local_Error
+	}
+	resp.Set(f, code)
+	return
+}
+
+func tgErrorString(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	var str string
+	if e := t.LocalError(); e != nil {
+		str = e.Error()
+	}
+	resp.Set(f, str)
+	return
+}
+
 func tgZeroStr(f string, t *swarm.Torrent, resp *tgResp) (err error) {
 	resp.Set(f, "")
 	return
@@ -154,14 +185,92 @@ func tgFileStats(f string, t *swarm.Torrent, resp *tgResp) (err error) {
 	for idx := range stats.Files {
 		files[idx] = &tgFileStat{
 			Completed: stats.Files[idx].BytesCompleted(),
-			Wanted:    true,
-			Priority:  tr_Pri_Norm,
+			Wanted:    stats.Files[idx].Wanted,
+			Priority:  trPriority(stats.Files[idx].Priority),
 		}
 	}
 	resp.Set(f, files)
 	return
 }
 
+func tgDownloadLimit(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	_, down := t.RateLimits()
+	resp.Set(f, down/trSpeedUnit)
+	return
+}
+
+func tgDownloadLimited(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	_, down := t.RateLimits()
+	resp.Set(f, down > 0)
+	return
+}
+
+func tgUploadLimit(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	up, _ := t.RateLimits()
+	resp.Set(f, up/trSpeedUnit)
+	return
+}
+
+func tgUploadLimited(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	up, _ := t.RateLimits()
+	resp.Set(f, up > 0)
+	return
+}
+
+func tgSequential(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	resp.Set(f, t.Sequential())
+	return
+}
+
+// get the transmission mode of a seeding goal of a torrent
+func trSeedLimitMode(mode storage.SeedLimitMode) int {
+	switch mode {
+	case storage.SeedLimitSingle:
+		return tr_Limit_Single
+	case storage.SeedLimitUnlimited:
+		return tr_Limit_Unlimited
+	}
+	return tr_Limit_Global
+}
+
+func tgSeedRatioLimit(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	l := t.SeedLimits()
+	ratio := l.Ratio
+	if l.RatioMode == storage.SeedLimitGlobal {
+		ratio = t.ActiveSeedLimits().Ratio
+	}
+	resp.Set(f, math.Max(ratio, 0))
+	return
+}
+
+func tgSeedRatioMode(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	resp.Set(f, trSeedLimitMode(t.SeedLimits().RatioMode))
+	return
+}
+
+func tgSeedIdleLimit(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	l := t.SeedLimits()
+	idle := l.Idle
+	if l.IdleMode == storage.SeedLimitGlobal {
+		idle = t.ActiveSeedLimits().Idle
+	}
+	if idle < 0 {
+		idle = 0
+	}
+	resp.Set(f, int(idle/time.Minute))
+	return
+}
+
+func tgSeedIdleMode(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	resp.Set(f, trSeedLimitMode(t.SeedLimits().IdleMode))
+	return
+}
+
+func tgFinished(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	resp.Set(f, t.Finished())
+	return
+}
+
 type tgPeer struct {
 	Addr            string  `json:"address"`
 	ClientName      string  `json:"clientName"`
@@ -200,34 +309,69 @@ func tgPeers(f string, t *swarm.Torrent, resp *tgResp) (err error) {
 			RX:              int64(stats.Peers[idx].RX),
 			TX:              int64(stats.Peers[idx].TX),
 		}
+		if stats.Peers[idx].WebSeed {
+			peers[idx].Flag = "W"
+		}
+	}
+	resp.Set(f, peers)
+	return
+}
+
+func tgWebSeeds(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	seeds := t.WebSeeds()
+	if seeds == nil {
+		seeds = []string{}
+	}
+	resp.Set(f, seeds)
+	return
+}
+
+func tgWebSeedsSending(f string, t *swarm.Torrent, resp *tgResp) (err error) {
+	sending := 0
+	for _, p := range t.GetStatus().Peers {
+		if p.WebSeed && p.Downloading {
+			sending++
+		}
 	}
+	resp.Set(f, sending)
 	return
 }
 
 var tgFieldHandlers = map[string]tgFieldHandler{
-	"id":                tgID,
-	"name":              tgName,
-	"rateUpload":        tgUploadRate,
-	"rateDownload":      tgDownloadRate,
-	"downloadDir":       tgDownloadDir,
-	"status":            tgStatus,
-	"error":             tgZeroInt, // TODO
-	"errorString":       tgZeroStr, // TODO
-	"activityDate":      tgActivityDate,
-	"addedDate":         tgAddedDate,
-	"bandwidthPriority": tgBwPrior,
-	"comment":           tgComment,
-	"corruptEver":       tgZeroInt, // TODO
-	"creator":           tgZeroStr, // TODO
-	"dateCreated":       tgZeroInt, // TODO
-	"desiredAvailable":  tgBytesAvail,
-	"dowwloadLimit":     tgZeroInt, // TODO
-	"downloadLimited":   tgFalse,   // TODO
-	"doneDate":          tgZeroInt, // TODO
-	"downloadedEver":    tgZeroInt, // TODO
-	"eta":               tgZeroInt, // TODO
-	"etaIdle":           tgZeroInt, // TODO
-	"files":             tgFiles,
-	"fileStats":         tgFileStats,
-	"peers":             tgPeers,
+	"id":                  tgID,
+	"name":                tgName,
+	"rateUpload":          tgUploadRate,
+	"rateDownload":        tgDownloadRate,
+	"downloadDir":         tgDownloadDir,
+	"status":              tgStatus,
+	"error":               tgError,
+	"errorString":         tgErrorString,
+	"activityDate":        tgActivityDate,
+	"addedDate":           tgAddedDate,
+	"bandwidthPriority":   tgBwPrior,
+	"comment":             tgComment,
+	"corruptEver":         tgZeroInt, // TODO
+	"creator":             tgZeroStr, // TODO
+	"dateCreated":         tgZeroInt, // TODO
+	"desiredAvailable":    tgBytesAvail,
+	"downloadLimit":       tgDownloadLimit,
+	"downloadLimited":     tgDownloadLimited,
+	"uploadLimit":         tgUploadLimit,
+	"uploadLimited":       tgUploadLimited,
+	"doneDate":            tgZeroInt, // TODO
+	"downloadedEver":      tgZeroInt, // TODO
+	"eta":                 tgZeroInt, // TODO
+	"etaIdle":             tgZeroInt, // TODO
+	"files":               tgFiles,
+	"fileStats":           tgFileStats,
+	"peers":               tgPeers,
+	"queuePosition":       tgQueuePosition,
+	"sequentialDownload":  tgSequential,
+	"seedRatioLimit":      tgSeedRatioLimit,
+	"seedRatioMode":       tgSeedRatioMode,
+	"seedIdleLimit":       tgSeedIdleLimit,
+	"seedIdleMode":        tgSeedIdleMode,
+	"isFinished":          tgFinished,
+	"webseeds":            tgWebSeeds,
+	"webseedsSendingToUs": tgWebSeedsSending,
 }
@@ -0,0 +1,232 @@
+package transmission
+
+import (
+	"errors"
+	"github.com/majestrate/XD/lib/bittorrent/swarm"
+	"github.com/majestrate/XD/lib/storage"
+	"time"
+)
+
+var errBadFileList = errors.New("file list is not an array of file indexes")
+var errNotBool = errors.New("value is not a boolean")
+var errBadSpeed = errors.New("speed is not a positive number")
+var errBadSeedLimit = errors.New("seed limit is not a positive number")
+var errBadSeedLimitMode = errors.New("invalid seed limit mode")
+
+type tsFieldHandler func(*swarm.Torrent, interface{}) error
+
+// convert file priority to transmission priority
+func trPriority(p storage.FilePriority) int {
+	switch p {
+	case storage.PriorityLow:
+		return tr_Pri_Low
+	case storage.PriorityHigh:
+		return tr_Pri_High
+	default:
+		return tr_Pri_Norm
+	}
+}
+
+// get list of file indexes from a decoded json value, an empty list means all files
+func getFileIndexes(t *swarm.Torrent, v interface{}) (files []int, err error) {
+	l, ok := v.([]interface{})
+	if !ok {
+		err = errBadFileList
+		return
+	}
+	if len(l) == 0 {
+		for idx := range t.FilePriorities() {
+			files = append(files, idx)
+		}
+		return
+	}
+	for _, i := range l {
+		idx, ok := getInt(i)
+		if !ok {
+			err = errBadFileList
+			return
+		}
+		files = append(files, int(idx))
+	}
+	return
+}
+
+// set priority of files, skipped files stay skipped and keep the priority for when they are wanted
+func tsPriority(p storage.FilePriority) tsFieldHandler {
+	return func(t *swarm.Torrent, v interface{}) (err error) {
+		var files []int
+		files, err = getFileIndexes(t, v)
+		for _, idx := range files {
+			if err != nil {
+				break
+			}
+			err = t.SetFilePriority(idx, p)
+		}
+		return
+	}
+}
+
+// set if files are downloaded
+func tsFilesWanted(wanted bool) tsFieldHandler {
+	return func(t *swarm.Torrent, v interface{}) (err error) {
+		var files []int
+		files, err = getFileIndexes(t, v)
+		for _, idx := range files {
+			if err != nil {
+				break
+			}
+			err = t.SetFileWanted(idx, wanted)
+		}
+		return
+	}
+}
+
+func tsSequential(t *swarm.Torrent, v interface{}) (err error) {
+	seq, ok := v.(bool)
+	if ok {
+		t.SetSequential(seq)
+	} else {
+		err = errNotBool
+	}
+	return
+}
+
+func tsDownloadLimit(t *swarm.Torrent, v interface{}) (err error) {
+	speed, ok := getSpeed(v)
+	if ok {
+		up, _ := t.RateLimits()
+		t.SetRateLimits(up, speed)
+	} else {
+		err = errBadSpeed
+	}
+	return
+}
+
+func tsDownloadLimited(t *swarm.Torrent, v interface{}) (err error) {
+	limited, ok := v.(bool)
+	if !ok {
+		err = errNotBool
+	} else if !limited {
+		up, _ := t.RateLimits()
+		t.SetRateLimits(up, 0)
+	}
+	return
+}
+
+func tsUploadLimit(t *swarm.Torrent, v interface{}) (err error) {
+	speed, ok := getSpeed(v)
+	if ok {
+		_, down := t.RateLimits()
+		t.SetRateLimits(speed, down)
+	} else {
+		err = errBadSpeed
+	}
+	return
+}
+
+func tsUploadLimited(t *swarm.Torrent, v interface{}) (err error) {
+	limited, ok := v.(bool)
+	if !ok {
+		err = errNotBool
+	} else if !limited {
+		_, down := t.RateLimits()
+		t.SetRateLimits(0, down)
+	}
+	return
+}
+
+// get a float from a decoded json value
+func getFloat(v interface{}) (f float64, ok bool) {
+	switch n := v.(type) {
+	case float64:
+		f, ok = n, true
+	default:
+		var i int64
+		i, ok = getInt(v)
+		f = float64(i)
+	}
+	return
+}
+
+// get the seeding goal mode of a transmission seed limit mode
+func getSeedLimitMode(v interface{}) (mode storage.SeedLimitMode, err error) {
+	n, ok := getInt(v)
+	if !ok {
+		err = errBadSeedLimitMode
+		return
+	}
+	switch n {
+	case tr_Limit_Global:
+		mode = storage.SeedLimitGlobal
+	case tr_Limit_Single:
+		mode = storage.SeedLimitSingle
+	case tr_Limit_Unlimited:
+		mode = storage.SeedLimitUnlimited
+	default:
+		err = errBadSeedLimitMode
+	}
+	return
+}
+
+func tsSeedRatioLimit(t *swarm.Torrent, v interface{}) (err error) {
+	ratio, ok := getFloat(v)
+	if ok && ratio > 0 {
+		l := t.SeedLimits()
+		l.Ratio = ratio
+		err = t.SetSeedLimits(l)
+	} else {
+		err = errBadSeedLimit
+	}
+	return
+}
+
+func tsSeedRatioMode(t *swarm.Torrent, v interface{}) (err error) {
+	l := t.SeedLimits()
+	l.RatioMode, err = getSeedLimitMode(v)
+	if err == nil {
+		err = t.SetSeedLimits(l)
+	}
+	return
+}
+
+func tsSeedIdleLimit(t *swarm.Torrent, v interface{}) (err error) {
+	minutes, ok := getInt(v)
+	if ok && minutes > 0 {
+		l := t.SeedLimits()
+		l.Idle = time.Duration(minutes) * time.Minute
+		err = t.SetSeedLimits(l)
+	} else {
+		err = errBadSeedLimit
+	}
+	return
+}
+
+func tsSeedIdleMode(t *swarm.Torrent, v interface{}) (err error) {
+	l := t.SeedLimits()
+	l.IdleMode, err = getSeedLimitMode(v)
+	if err == nil {
+		err = t.SetSeedLimits(l)
+	}
+	return
+}
+
+// fields are applied in this order so that wanted and unwanted win over priorities
+var tsFieldHandlers = []struct {
+	name string
+	h    tsFieldHandler
+}{
+	{"priority-high", tsPriority(storage.PriorityHigh)},
+	{"priority-normal", tsPriority(storage.PriorityNormal)},
+	{"priority-low", tsPriority(storage.PriorityLow)},
+	{"files-wanted", tsFilesWanted(true)},
+	{"files-unwanted", tsFilesWanted(false)},
+	{"sequentialDownload", tsSequential},
+	{"downloadLimit", tsDownloadLimit},
+	{"downloadLimited", tsDownloadLimited},
+	{"uploadLimit", tsUploadLimit},
+	{"uploadLimited", tsUploadLimited},
+	{"seedRatioLimit", tsSeedRatioLimit},
+	{"seedRatioMode", tsSeedRatioMode},
+	{"seedIdleLimit", tsSeedIdleLimit},
+	{"seedIdleMode", tsSeedIdleMode},
+}
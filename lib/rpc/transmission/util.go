@@ -6,7 +6,7 @@ func getTorrentIDs(getActiveIDs func() map[int64]string, args Args) (ids Torrent
 		ids_slice, ok := ids_i.([]interface{})
 		if ok {
 			for _, id := range ids_slice {
-				tid, ok := id.(int64)
+				tid, ok := getInt(id)
 				if ok {
 					ids = append(ids, TorrentID(tid))
 				}
@@ -21,7 +21,7 @@ func getTorrentIDs(getActiveIDs func() map[int64]string, args Args) (ids Torrent
 					}
 				}
 			} else {
-				ids_int, ok := ids_i.(int64)
+				ids_int, ok := getInt(ids_i)
 				if ok {
 					ids = append(ids, TorrentID(ids_int))
 				}
@@ -30,3 +30,16 @@ func getTorrentIDs(getActiveIDs func() map[int64]string, args Args) (ids Torrent
 	}
 	return
 }
+
+// get an integer from a decoded json value, json numbers decode as float64
+func getInt(v interface{}) (i int64, ok bool) {
+	switch n := v.(type) {
+	case int64:
+		i, ok = n, true
+	case int:
+		i, ok = int64(n), true
+	case float64:
+		i, ok = int64(n), true
+	}
+	return
+}
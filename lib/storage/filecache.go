@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"container/list"
+
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// DefaultOpenFiles is how many data file handles we keep open by default
+const DefaultOpenFiles = 64
+
+// fileKey identifies an open data file by path and mode
+type fileKey struct {
+	path  string
+	write bool
+}
+
+// cachedFile is an open data file handle
+type cachedFile struct {
+	key fileKey
+	r   fs.ReadFile
+	w   fs.WriteFile
+	// set when we wrote to the file since it was last synced
+	dirty bool
+	// how many reads or writes are using the handle now
+	users int
+	// set when the handle was taken out of the cache while in use
+	orphaned bool
+	elem     *list.Element
+}
+
+func (f *cachedFile) close() (err error) {
+	if f.w != nil {
+		if f.dirty {
+			err = f.w.Sync()
+		}
+		f.w.Close()
+	} else {
+		err = f.r.Close()
+	}
+	return
+}
+
+// fileCache keeps the least recently used data file handles open
+// so we do not open and close a file for every block
+type fileCache struct {
+	mtx   sync.Mutex
+	fs    fs.Driver
+	size  int
+	lru   *list.List
+	files map[fileKey]*cachedFile
+}
+
+func newFileCache(driver fs.Driver, size int) *fileCache {
+	return &fileCache{
+		fs:    driver,
+		size:  size,
+		lru:   list.New(),
+		files: make(map[fileKey]*cachedFile),
+	}
+}
+
+// get an open handle for a file, release it when done
+func (c *fileCache) acquire(path string, write bool) (f *cachedFile, err error) {
+	key := fileKey{path: path, write: write}
+	c.mtx.Lock()
+	f = c.files[key]
+	if f != nil {
+		f.users++
+		c.lru.MoveToFront(f.elem)
+		c.mtx.Unlock()
+		return
+	}
+	c.mtx.Unlock()
+	// open without holding the lock, the sftp driver does a round trip here
+	f = &cachedFile{key: key, users: 1}
+	if write {
+		// skipped files are not allocated but pieces on their boundary are still written to them
+		dir, _ := c.fs.Split(path)
+		if dir != "" {
+			err = c.fs.EnsureDir(dir)
+		}
+		if err == nil {
+			f.w, err = c.fs.OpenFileWriteOnly(path)
+		}
+	} else {
+		f.r, err = c.fs.OpenFileReadOnly(path)
+	}
+	if err != nil {
+		f = nil
+		return
+	}
+	c.mtx.Lock()
+	if other := c.files[key]; other != nil {
+		// someone else opened it first
+		other.users++
+		c.lru.MoveToFront(other.elem)
+		c.mtx.Unlock()
+		f.close()
+		f = other
+		return
+	}
+	f.elem = c.lru.PushFront(f)
+	c.files[key] = f
+	c.mtx.Unlock()
+	return
+}
+
+// done using a handle, closes the least recently used handles over the limit
+func (c *fileCache) release(f *cachedFile, wrote bool) {
+	var evicted []*cachedFile
+	c.mtx.Lock()
+	f.users--
+	if wrote {
+		f.dirty = true
+	}
+	if f.orphaned && f.users == 0 {
+		evicted = append(evicted, f)
+	}
+	elem := c.lru.Back()
+	for len(c.files) > c.size && elem != nil {
+		prev := elem.Prev()
+		if old := elem.Value.(*cachedFile); old.users == 0 {
+			c.remove(old)
+			evicted = append(evicted, old)
+		}
+		elem = prev
+	}
+	c.mtx.Unlock()
+	for _, old := range evicted {
+		err := old.close()
+		if err != nil {
+			log.Warnf("failed to close %s: %s", old.key.path, err.Error())
+		}
+	}
+}
+
+// take a handle out of the cache, call with mtx held
+func (c *fileCache) remove(f *cachedFile) {
+	c.lru.Remove(f.elem)
+	delete(c.files, f.key)
+}
+
+// sync dirty handles of these files
+func (c *fileCache) sync(paths []string) (err error) {
+	var dirty []*cachedFile
+	c.mtx.Lock()
+	for _, path := range paths {
+		f := c.files[fileKey{path: path, write: true}]
+		if f != nil && f.dirty {
+			f.dirty = false
+			f.users++
+			dirty = append(dirty, f)
+		}
+	}
+	c.mtx.Unlock()
+	for _, f := range dirty {
+		e := f.w.Sync()
+		if e != nil {
+			err = e
+		}
+		c.release(f, false)
+	}
+	return
+}
+
+// close all handles of these files, used before files are moved or removed
+// handles in use are closed once they are released
+func (c *fileCache) close(paths []string) {
+	var closing []*cachedFile
+	c.mtx.Lock()
+	for _, path := range paths {
+		for _, write := range []bool{false, true} {
+			f := c.files[fileKey{path: path, write: write}]
+			if f != nil {
+				c.remove(f)
+				if f.users > 0 {
+					f.orphaned = true
+				} else {
+					closing = append(closing, f)
+				}
+			}
+		}
+	}
+	c.mtx.Unlock()
+	for _, f := range closing {
+		f.close()
+	}
+}
+
+// close every handle
+func (c *fileCache) closeAll() {
+	c.mtx.Lock()
+	var paths []string
+	for key := range c.files {
+		paths = append(paths, key.path)
+	}
+	c.mtx.Unlock()
+	c.close(paths)
+}
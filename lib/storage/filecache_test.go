@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"github.com/majestrate/XD/lib/fs"
+	"testing"
+)
+
+func TestFileCache(t *testing.T) {
+	dir := t.TempDir()
+	a := fs.STD.Join(dir, "a")
+	// directories of files that were never allocated are created on write
+	b := fs.STD.Join(dir, "skipped", "b")
+	c := newFileCache(fs.STD, 1)
+
+	w, err := c.acquire(a, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.w.WriteAt([]byte("data"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.release(w, true)
+	again, _ := c.acquire(a, true)
+	if again != w {
+		t.Fatal("open handle not reused")
+	}
+	c.release(again, false)
+	if err = c.sync([]string{a}); err != nil || w.dirty {
+		t.Fatalf("dirty handle not synced: %v", err)
+	}
+
+	// opening another file closes the least recently used handle over the limit
+	w2, err := c.acquire(b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.release(w2, true)
+	if len(c.files) != 1 || c.files[fileKey{path: b, write: true}] != w2 {
+		t.Fatal("least recently used handle not closed")
+	}
+
+	// handles in use are closed when they are released
+	r, err := c.acquire(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.close([]string{a})
+	buf := make([]byte, 4)
+	if _, err = r.r.ReadAt(buf, 0); err != nil || string(buf) != "data" {
+		t.Fatalf("handle in use was closed: %v", err)
+	}
+	c.release(r, false)
+	if _, err = r.r.ReadAt(buf, 0); err == nil {
+		t.Fatal("released handle of closed file still open")
+	}
+	c.closeAll()
+	if len(c.files) != 0 || c.lru.Len() != 0 {
+		t.Fatal("handles left open")
+	}
+}
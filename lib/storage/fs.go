@@ -10,6 +10,7 @@ import (
 	"github.com/majestrate/XD/lib/stats"
 	"github.com/majestrate/XD/lib/sync"
 	"io"
+	"strconv"
 )
 
 /* Mutex used in fsTorrent.VerifyAll to ensure that the integrity of each
@@ -22,8 +23,9 @@ var seqck *sync.Mutex = &sync.Mutex{}
 type fsTorrent struct {
 	// parent storage
 	st *FsStorage
-	// infohash
-	ih common.Infohash
+	// infohash, changes to the v1 infohash when a hybrid torrent added by v2 infohash gets its metainfo
+	ih    common.Infohash
+	ihMtx sync.Mutex
 	// metainfo
 	meta *metainfo.TorrentFile
 	// cached bitfield
@@ -40,6 +42,27 @@ type fsTorrent struct {
 	seeding bool
 	// seeding mutex
 	seedAccess sync.Mutex
+	// download priority of each file
+	priorities []FilePriority
+	// which files we download
+	wanted []bool
+	// cached queue position
+	queuePos    int
+	queueLoaded bool
+	queueMtx    sync.Mutex
+	// cached seeding goals
+	seedLimits       SeedLimits
+	seedLimitsLoaded bool
+	seedLimitsMtx    sync.Mutex
+	// blocks on disk of pieces we did not check yet
+	partial        map[uint32]*bittorrent.Bitfield
+	partialChanged bool
+	partialMtx     sync.Mutex
+	// size and modification time of data files at the last flush
+	resume *resumeData
+	// indexes of files we wrote to since the last flush
+	resumeStale map[int]bool
+	resumeMtx   sync.Mutex
 }
 
 func (t *fsTorrent) DownloadDir() string {
@@ -47,9 +70,21 @@ func (t *fsTorrent) DownloadDir() string {
 }
 
 func (t *fsTorrent) Delete() (err error) {
-	err = t.st.FS.RemoveAll(t.st.metainfoFilename(t.ih))
+	ih := t.Infohash()
+	t.st.cache.evictTorrent(ih, true)
+	t.st.files.close(t.dataFilenames())
+	err = t.st.FS.RemoveAll(t.st.metainfoFilename(ih))
 	if err == nil {
-		err = t.st.FS.RemoveAll(t.st.bitfieldFilename(t.ih))
+		err = t.st.FS.RemoveAll(t.st.bitfieldFilename(ih))
+		if err == nil {
+			err = t.st.FS.RemoveAll(t.st.peersFilename(ih))
+		}
+		if err == nil {
+			err = t.st.FS.RemoveAll(t.st.resumeFilename(ih))
+		}
+		if err == nil {
+			err = t.st.FS.RemoveAll(t.st.partialFilename(ih))
+		}
 		if err == nil {
 			err = t.st.FS.RemoveAll(t.FilePath())
 		}
@@ -58,12 +93,20 @@ func (t *fsTorrent) Delete() (err error) {
 }
 
 func (t *fsTorrent) MoveTo(other string) (err error) {
+	err = t.st.cache.evictTorrent(t.Infohash(), false)
+	if err != nil {
+		return
+	}
 	t.access.Lock()
+	t.st.files.close(t.dataFilenames())
 	err = t.st.FS.EnsureDir(other)
 	if err == nil {
 		multifile := !t.MetaInfo().IsSingleFile()
 		files := t.MetaInfo().Info.GetFiles()
 		for _, file := range files {
+			if file.IsPadding() {
+				continue
+			}
 			root := ""
 			if multifile {
 				root = t.MetaInfo().Info.Path
@@ -80,69 +123,259 @@ func (t *fsTorrent) MoveTo(other string) (err error) {
 	// Remove empty parent directories from old location
 	t.st.FS.RemoveAll(t.FilePath())
 
-	s := t.st.getSettings(t.ih)
+	s := t.st.getSettings(t.Infohash())
 	s.Put("dir", other)
-	t.st.putSettings(t.ih, s)
+	t.st.putSettings(t.Infohash(), s)
 	t.dir = other
 	t.access.Unlock()
+	t.forgetResumeData()
 	return
 }
 
 func (t *fsTorrent) AllocateFile(f metainfo.FileInfo) (err error) {
 	fname := t.st.FS.Join(t.FilePath(), f.Path.FilePath(""))
-	err = t.st.FS.EnsureFile(fname, f.Length)
+	err = t.st.FS.AllocateFile(fname, f.Length, t.st.Allocation)
 	return
 }
 
 func (t *fsTorrent) Allocate() (err error) {
+	if t.st.Allocation == fs.AllocateFull {
+		// do not fill the disk with files we cannot download
+		err = t.CheckFreeSpace()
+		if err != nil {
+			return
+		}
+	}
 	if t.meta.IsSingleFile() {
-		log.Debugf("file is %d bytes", t.meta.Info.Length)
-		err = t.st.FS.EnsureFile(t.FilePath(), t.meta.Info.Length)
+		if !t.fileWanted(0) {
+			log.Debugf("not allocating skipped file for %s", t.Name())
+			return
+		}
+		log.Debugf("file is %d bytes", t.meta.TotalSize())
+		err = t.st.FS.AllocateFile(t.FilePath(), t.meta.TotalSize(), t.st.Allocation)
 	} else {
-		for _, f := range t.meta.Info.Files {
+		for idx, f := range t.meta.Info.GetFiles() {
+			if f.IsPadding() {
+				continue
+			}
+			if !t.fileWanted(idx) {
+				log.Debugf("not allocating skipped file %s", f.Path.FilePath(""))
+				continue
+			}
 			err = t.AllocateFile(f)
 			if err != nil {
 				break
 			}
 		}
 	}
+	t.forgetResumeData()
 	return
 }
 
-func (t *fsTorrent) openfileRead(i metainfo.FileInfo) (f fs.ReadFile, err error) {
-	var fname string
-	if t.meta.IsSingleFile() {
-		fname = t.FilePath()
-	} else {
-		fname = t.st.FS.Join(t.FilePath(), i.Path.FilePath(""))
+// load file priorities and wanted files from settings
+func (t *fsTorrent) loadPriorities() {
+	s := t.st.getSettings(t.Infohash())
+	t.priorities, t.wanted = parseFileSettings(s.Get("priorities", ""), s.Get("unwanted", ""), len(t.meta.Info.GetFiles()))
+}
+
+// save file priorities and wanted files to settings, call with access held
+func (t *fsTorrent) savePriorities() {
+	s := t.st.getSettings(t.Infohash())
+	s.Put("priorities", formatFilePriorities(t.priorities))
+	s.Put("unwanted", formatFilesWanted(t.wanted))
+	t.st.putSettings(t.Infohash(), s)
+}
+
+func (t *fsTorrent) filePriority(idx int) FilePriority {
+	if idx < len(t.priorities) {
+		return t.priorities[idx]
+	}
+	return PriorityNormal
+}
+
+func (t *fsTorrent) fileWanted(idx int) bool {
+	if idx < len(t.wanted) {
+		return t.wanted[idx]
+	}
+	return true
+}
+
+func (t *fsTorrent) QueuePosition() int {
+	t.queueMtx.Lock()
+	defer t.queueMtx.Unlock()
+	if !t.queueLoaded {
+		s := t.st.getSettings(t.Infohash())
+		pos, err := strconv.Atoi(s.Get("queue", "-1"))
+		if err != nil {
+			pos = -1
+		}
+		t.queuePos = pos
+		t.queueLoaded = true
+	}
+	return t.queuePos
+}
+
+func (t *fsTorrent) SetQueuePosition(pos int) (err error) {
+	t.queueMtx.Lock()
+	defer t.queueMtx.Unlock()
+	s := t.st.getSettings(t.Infohash())
+	s.Put("queue", strconv.Itoa(pos))
+	t.st.putSettings(t.Infohash(), s)
+	t.queuePos = pos
+	t.queueLoaded = true
+	return
+}
+
+func (t *fsTorrent) SeedLimits() SeedLimits {
+	t.seedLimitsMtx.Lock()
+	defer t.seedLimitsMtx.Unlock()
+	if !t.seedLimitsLoaded {
+		s := t.st.getSettings(t.Infohash())
+		t.seedLimits = loadSeedLimits(&s)
+		t.seedLimitsLoaded = true
+	}
+	return t.seedLimits
+}
+
+func (t *fsTorrent) SetSeedLimits(l SeedLimits) (err error) {
+	t.seedLimitsMtx.Lock()
+	defer t.seedLimitsMtx.Unlock()
+	s := t.st.getSettings(t.Infohash())
+	l.save(&s)
+	t.st.putSettings(t.Infohash(), s)
+	t.seedLimits = l
+	t.seedLimitsLoaded = true
+	return
+}
+
+func (t *fsTorrent) FilePriorities() (prios []FilePriority) {
+	if t.meta == nil {
+		return
+	}
+	t.access.Lock()
+	prios = make([]FilePriority, len(t.meta.Info.GetFiles()))
+	for idx := range prios {
+		prios[idx] = t.filePriority(idx)
+	}
+	t.access.Unlock()
+	return
+}
+
+func (t *fsTorrent) SetFilePriority(idx int, p FilePriority) (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	if p <= PrioritySkip || p > PriorityHigh {
+		err = ErrBadFilePriority
+		return
+	}
+	files := t.meta.Info.GetFiles()
+	if idx < 0 || idx >= len(files) {
+		err = ErrNoSuchFile
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	if len(t.priorities) != len(files) {
+		t.priorities, t.wanted = parseFileSettings("", "", len(files))
+	}
+	t.priorities[idx] = p
+	t.savePriorities()
+	return
+}
+
+func (t *fsTorrent) FilesWanted() (wanted []bool) {
+	if t.meta == nil {
+		return
+	}
+	t.access.Lock()
+	wanted = make([]bool, len(t.meta.Info.GetFiles()))
+	for idx := range wanted {
+		wanted[idx] = t.fileWanted(idx)
+	}
+	t.access.Unlock()
+	return
+}
+
+func (t *fsTorrent) SetFileWanted(idx int, wanted bool) (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	files := t.meta.Info.GetFiles()
+	if idx < 0 || idx >= len(files) {
+		err = ErrNoSuchFile
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	if len(t.wanted) != len(files) {
+		t.priorities, t.wanted = parseFileSettings("", "", len(files))
+	}
+	wasWanted := t.wanted[idx]
+	t.wanted[idx] = wanted
+	t.savePriorities()
+	if wanted && !wasWanted {
+		if t.meta.IsSingleFile() {
+			err = t.st.FS.AllocateFile(t.FilePath(), t.meta.TotalSize(), t.st.Allocation)
+		} else if !files[idx].IsPadding() {
+			err = t.AllocateFile(files[idx])
+		}
+		t.forgetResumeData()
 	}
-	f, err = t.st.FS.OpenFileReadOnly(fname)
 	return
 }
 
-func (t *fsTorrent) openfileWrite(i metainfo.FileInfo) (f fs.WriteFile, err error) {
-	var fname string
+// get the path of a data file
+func (t *fsTorrent) dataFilename(i metainfo.FileInfo) string {
 	if t.meta.IsSingleFile() {
-		fname = t.FilePath()
-	} else {
-		fname = t.st.FS.Join(t.FilePath(), i.Path.FilePath(""))
+		return t.FilePath()
+	}
+	return t.st.FS.Join(t.FilePath(), i.Path.FilePath(""))
+}
+
+// get the paths of all stored data files
+func (t *fsTorrent) dataFilenames() (paths []string) {
+	if t.meta == nil {
+		return
+	}
+	for _, f := range t.meta.Info.GetFiles() {
+		if !f.IsPadding() {
+			paths = append(paths, t.dataFilename(f))
+		}
 	}
-	f, err = t.st.FS.OpenFileWriteOnly(fname)
 	return
 }
 
 func (t *fsTorrent) readFileAt(fi metainfo.FileInfo, b []byte, off int64) (n int, err error) {
 
+	if fi.IsPadding() {
+		// padding files are all zeros and never stored
+		if int64(len(b)) > int64(fi.Length)-off {
+			b = b[:int64(fi.Length)-off]
+		}
+		for idx := range b {
+			b[idx] = 0
+		}
+		n = len(b)
+		return
+	}
 	// from github.com/anacrolix/torrent
-	var f fs.ReadFile
-	f, err = t.openfileRead(fi)
+	var f *cachedFile
+	f, err = t.st.files.acquire(t.dataFilename(fi), false)
+	if err != nil {
+		// skipped files are not allocated
+		return
+	}
+	defer t.st.files.release(f, false)
 	fil := int64(fi.Length)
 	// Limit the read to within the expected bounds of this file.
 	if int64(len(b)) > fil-off {
 		b = b[:fil-off]
 	}
 	for off < fil && len(b) != 0 {
-		n1, err1 := f.ReadAt(b, off)
+		n1, err1 := f.r.ReadAt(b, off)
 		b = b[n1:]
 		n += n1
 		off += int64(n1)
@@ -151,9 +384,6 @@ func (t *fsTorrent) readFileAt(fi metainfo.FileInfo, b []byte, off int64) (n int
 			break
 		}
 	}
-	if f != nil {
-		f.Close()
-	}
 	return
 }
 
@@ -193,7 +423,7 @@ func (t *fsTorrent) ReadAt(b []byte, off int64) (n int, err error) {
 func (t *fsTorrent) WriteAt(p []byte, off int64) (n int, err error) {
 
 	// from github.com/anacrolix/torrent
-	for _, fi := range t.meta.Info.GetFiles() {
+	for idx, fi := range t.meta.Info.GetFiles() {
 		fil := int64(fi.Length)
 		if off >= fil {
 			off -= fil
@@ -203,14 +433,24 @@ func (t *fsTorrent) WriteAt(p []byte, off int64) (n int, err error) {
 		if int64(n1) > fil-off {
 			n1 = int(fil - off)
 		}
-		var f fs.WriteFile
-		f, err = t.openfileWrite(fi)
+		if fi.IsPadding() {
+			// don't store padding
+			n += n1
+			off = 0
+			p = p[n1:]
+			if len(p) == 0 {
+				break
+			}
+			continue
+		}
+		var f *cachedFile
+		f, err = t.st.files.acquire(t.dataFilename(fi), true)
 		if err != nil {
 			return
 		}
-		n1, err = f.WriteAt(p[:n1], off)
-		f.Sync()
-		f.Close()
+		n1, err = f.w.WriteAt(p[:n1], off)
+		t.st.files.release(f, true)
+		t.fileWritten(idx)
 		if err == io.ErrUnexpectedEOF {
 			err = nil
 		}
@@ -239,11 +479,11 @@ func (t *fsTorrent) ensureBitfield() {
 		return
 	}
 	if t.bf == nil {
-		if !t.st.HasBitfield(t.ih) {
+		if !t.st.HasBitfield(t.Infohash()) {
 			// we have no pieces
-			t.st.CreateNewBitfield(t.ih, t.meta.Info.NumPieces())
+			t.st.CreateNewBitfield(t.Infohash(), t.meta.Info.NumPieces())
 		}
-		t.bf = t.st.FindBitfield(t.ih)
+		t.bf = t.st.FindBitfield(t.Infohash())
 	}
 }
 
@@ -282,7 +522,9 @@ func (t *fsTorrent) Name() string {
 }
 
 func (t *fsTorrent) Infohash() (ih common.Infohash) {
+	t.ihMtx.Lock()
 	copy(ih[:], t.ih[:])
+	t.ihMtx.Unlock()
 	return
 }
 
@@ -301,30 +543,83 @@ func (t *fsTorrent) PutInfoBytes(info []byte) (err error) {
 		if err != nil {
 			return
 		}
-		ih := meta.Infohash()
-		if !t.ih.Equal(ih) {
+		old := t.Infohash()
+		if !metaInfoMatches(meta, old) {
 			err = ErrMetaInfoMissmatch
 			return
 		}
+		if ih := meta.Infohash(); !ih.Equal(old) {
+			// added by truncated v2 infohash, keep settings we saved so far under the v1 infohash
+			t.st.putSettings(ih, t.st.getSettings(old))
+			t.ihMtx.Lock()
+			t.ih = ih
+			t.ihMtx.Unlock()
+		}
 		t.access.Lock()
 		t.meta = meta
-		metapath := t.st.metainfoFilename(ih)
-		var f fs.WriteFile
-		f, err = t.st.FS.OpenFileWriteOnly(metapath)
+		t.loadPriorities()
+		err = t.saveMetaInfo()
 		if err == nil {
-			err = t.meta.BEncode(f)
-			f.Close()
-			if err == nil {
-				log.Debugf("allocate room for %s", t.Name())
-				err = t.Allocate()
-			}
+			log.Debugf("allocate room for %s", t.Name())
+			err = t.Allocate()
 		}
 		t.access.Unlock()
 	}
 	return
 }
 
+// write torrent file to the metadata directory
+func (t *fsTorrent) saveMetaInfo() (err error) {
+	var f fs.WriteFile
+	f, err = t.st.FS.OpenFileWriteOnly(t.st.metainfoFilename(t.meta.Infohash()))
+	if err == nil {
+		err = t.meta.BEncode(f)
+		f.Close()
+	}
+	return
+}
+
+func (t *fsTorrent) PutPieceLayer(root, layer []byte) (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	t.access.Lock()
+	err = t.meta.SetPieceLayer(root, layer)
+	if err == nil {
+		err = t.saveMetaInfo()
+	}
+	t.access.Unlock()
+	return
+}
+
 func (t *fsTorrent) GetPiece(r common.PieceRequest, pc *common.PieceData) (err error) {
+	pc.Data = make([]byte, r.Length)
+	if t.st.cache.get(t.Infohash(), r.Index, r.Begin, pc.Data) {
+		pc.Index = r.Index
+		pc.Begin = r.Begin
+		return
+	}
+	length := t.meta.LengthOfPiece(r.Index)
+	bf := t.bf
+	if r.Length < length && r.Begin+r.Length <= length && t.st.cache.fits(length) && bf != nil && bf.Has(r.Index) {
+		// read the whole piece ahead, peers usually ask for the rest of it next
+		var whole common.PieceData
+		err = t.readPiece(common.PieceRequest{Index: r.Index, Length: length}, &whole)
+		if err == nil {
+			t.st.cache.readAhead(t, r.Index, whole.Data)
+			copy(pc.Data, whole.Data[r.Begin:])
+			pc.Index = r.Index
+			pc.Begin = r.Begin
+		}
+		return
+	}
+	err = t.readPiece(r, pc)
+	return
+}
+
+// read part of a piece from disk
+func (t *fsTorrent) readPiece(r common.PieceRequest, pc *common.PieceData) (err error) {
 	t.access.Lock()
 	sz := t.meta.Info.PieceLength
 	offset := int64(r.Begin) + (int64(sz) * int64(r.Index))
@@ -352,6 +647,33 @@ func (t *fsTorrent) GetPiece(r common.PieceRequest, pc *common.PieceData) (err e
 }
 
 func (t *fsTorrent) VerifyPiece(idx uint32) (err error) {
+	if data := t.st.cache.downloaded(t.Infohash(), idx); data != nil {
+		// hash from memory and write the whole piece at once
+		pc := common.PieceData{Index: idx, Data: data}
+		if !t.meta.CheckPiece(&pc) {
+			t.st.cache.drop(t.Infohash(), idx)
+			t.forgetPartial(idx)
+			t.bf.Unset(idx)
+			err = common.ErrInvalidPiece
+			return
+		}
+		err = t.writeChunk(idx, 0, data)
+		if err == nil {
+			t.st.cache.written(t.Infohash(), idx)
+			t.forgetPartial(idx)
+			t.bf.Set(idx)
+		}
+		return
+	}
+	err = t.st.cache.writeBack(t.Infohash(), idx)
+	if err == nil {
+		err = t.verifyPiece(idx)
+	}
+	return
+}
+
+// check a piece against the data on disk
+func (t *fsTorrent) verifyPiece(idx uint32) (err error) {
 	l := t.meta.LengthOfPiece(idx)
 	r := common.PieceRequest{
 		Index:  idx,
@@ -360,9 +682,15 @@ func (t *fsTorrent) VerifyPiece(idx uint32) (err error) {
 	var pc common.PieceData
 	pc.Data = make([]byte, l)
 	pc.Index = idx
-	err = t.GetPiece(r, &pc)
-	if err == nil {
-		if t.meta.Info.CheckPiece(&pc) {
+	err = t.readPiece(r, &pc)
+	// checked pieces are either complete or bad
+	t.forgetPartial(idx)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// files that are not allocated yet end early, we do not have the piece
+		t.bf.Unset(idx)
+		err = common.ErrInvalidPiece
+	} else if err == nil {
+		if t.meta.CheckPiece(&pc) {
 			t.bf.Set(idx)
 		} else {
 			t.bf.Unset(idx)
@@ -379,6 +707,11 @@ func (t *fsTorrent) VerifyAll() (err error) {
 		err = ErrNoMetaInfo
 		return
 	}
+	// check what is on disk
+	err = t.st.cache.evictTorrent(t.Infohash(), false)
+	if err != nil {
+		return
+	}
 	t.bfmtx.Lock()
 	t.checking = true
 	log.Infof("checking local data for %s", t.Name())
@@ -387,7 +720,7 @@ func (t *fsTorrent) VerifyAll() (err error) {
 	sz := info.NumPieces()
 	idx := uint32(0)
 	for idx < sz {
-		err = t.VerifyPiece(uint32(idx))
+		err = t.verifyPiece(uint32(idx))
 		if err == common.ErrInvalidPiece {
 			err = nil
 		} else if err != nil {
@@ -398,6 +731,75 @@ func (t *fsTorrent) VerifyAll() (err error) {
 	t.seeding = t.bf.Completed()
 	t.bfmtx.Unlock()
 	log.Infof("local data check done for %s", t.Name())
+	t.forgetResumeData()
+	err = t.Flush()
+	t.checking = false
+	return
+}
+
+// get the size and modification time of every data file
+func (t *fsTorrent) statFiles() (r *resumeData) {
+	r = new(resumeData)
+	for _, f := range t.meta.Info.GetFiles() {
+		r.Files = append(r.Files, t.statFile(f))
+	}
+	return
+}
+
+// get the size and modification time of one data file
+func (t *fsTorrent) statFile(f metainfo.FileInfo) (rf resumeFile) {
+	if f.IsPadding() {
+		return
+	}
+	rf.Size = -1
+	fi, err := t.st.FS.Stat(t.dataFilename(f))
+	if err == nil {
+		rf.Size = fi.Size()
+		rf.ModTime = fi.ModTime().UnixNano()
+	}
+	return
+}
+
+func (t *fsTorrent) VerifyChanged() (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	saved := t.st.loadResumeData(t.Infohash())
+	if saved == nil {
+		return t.VerifyAll()
+	}
+	changed, ok := saved.changed(t.statFiles())
+	if !ok {
+		return t.VerifyAll()
+	}
+	seqck.Lock()
+	defer seqck.Unlock()
+	t.bfmtx.Lock()
+	t.checking = true
+	t.ensureBitfield()
+	info := t.meta.Info
+	for _, file := range changed {
+		log.Infof("checking changed file %s of %s", info.GetFiles()[file].Path.FilePath(""), t.Name())
+		begin, end := info.FilePieces(file)
+		for idx := begin; idx < end; idx++ {
+			if !t.bf.Has(idx) {
+				// blocks we saved of this piece may be gone
+				t.forgetPartial(idx)
+				continue
+			}
+			err = t.verifyPiece(idx)
+			if err != nil {
+				// pieces we cannot read are missing
+				t.bf.Unset(idx)
+				err = nil
+			}
+		}
+	}
+	// data that did not move to the seeding directory still needs a full check before seeding
+	t.seeding = t.bf.Completed() && t.dir == t.st.SeedingDir
+	t.bfmtx.Unlock()
+	t.forgetResumeData()
 	err = t.Flush()
 	t.checking = false
 	return
@@ -413,6 +815,18 @@ func (t *fsTorrent) putChunk(idx, offset uint32, data []byte) (err error) {
 		err = ErrNoMetaInfo
 		return
 	}
+	var cached bool
+	cached, err = t.st.cache.put(t, idx, offset, data)
+	if cached || err != nil {
+		// written once the piece is complete
+		return
+	}
+	err = t.writeChunk(idx, offset, data)
+	return
+}
+
+// write part of a piece to disk
+func (t *fsTorrent) writeChunk(idx, offset uint32, data []byte) (err error) {
 	t.access.Lock()
 	sz := int64(t.meta.Info.PieceLength)
 	off := (sz * int64(idx)) + int64(offset)
@@ -431,6 +845,9 @@ func (t *fsTorrent) putChunk(idx, offset uint32, data []byte) (err error) {
 		_, err = t.WriteAt(data, off)
 	}
 	t.access.Unlock()
+	if err == nil {
+		t.wroteBlocks(idx, offset, len(data))
+	}
 	return
 }
 
@@ -438,17 +855,44 @@ func (t *fsTorrent) Flush() error {
 	if t.meta == nil {
 		return ErrNoMetaInfo
 	}
-	log.Debugf("flush bitfield for %s", t.ih.Hex())
+	log.Debugf("flush bitfield for %s", t.Infohash().Hex())
+	err := t.st.files.sync(t.dataFilenames())
+	if err != nil {
+		log.Warnf("failed to sync files of %s: %s", t.Name(), err.Error())
+	}
 	bf := t.Bitfield()
-	return t.st.flushBitfield(t.ih, bf)
+	err = t.st.flushBitfield(t.Infohash(), bf)
+	if err == nil {
+		err = t.st.saveResumeData(t.Infohash(), t.currentResumeData())
+	}
+	if err == nil {
+		err = t.savePartial()
+	}
+	return err
 }
 
 func (t *fsTorrent) Close() error {
-	return t.Flush()
+	err := t.st.cache.evictTorrent(t.Infohash(), false)
+	// files may have changed without us, stat all of them one last time
+	t.forgetResumeData()
+	if ferr := t.Flush(); err == nil {
+		err = ferr
+	}
+	return err
 }
 
 func (t *fsTorrent) SaveStats(s *stats.Tracker) (err error) {
-	err = t.st.saveStatsForTorrent(t.ih, s)
+	err = t.st.saveStatsForTorrent(t.Infohash(), s)
+	return
+}
+
+func (t *fsTorrent) SavePeers(peers []KnownPeer) (err error) {
+	err = t.st.savePeersForTorrent(t.Infohash(), peers)
+	return
+}
+
+func (t *fsTorrent) LoadPeers() (peers []KnownPeer, err error) {
+	peers, err = t.st.loadPeersForTorrent(t.Infohash())
 	return
 }
 
@@ -541,6 +985,16 @@ type FsStorage struct {
 	Workers int
 	// IOP channel buffer size
 	IOPBufferSize int
+	// how we reserve disk space for data files
+	Allocation fs.Allocation
+	// how many data file handles we keep open
+	OpenFiles int
+	// open data file handles
+	files *fileCache
+	// how many bytes of piece data we keep in memory
+	PieceCacheSize int64
+	// pieces in memory
+	cache *pieceCache
 	// buffered io channel
 	ioChan chan IOP
 }
@@ -583,7 +1037,11 @@ func (st *FsStorage) Close() (err error) {
 			workers--
 		}
 	}
-	err = st.FS.Close()
+	err = st.cache.flushAll()
+	st.files.closeAll()
+	if ferr := st.FS.Close(); err == nil {
+		err = ferr
+	}
 	return
 }
 
@@ -604,6 +1062,8 @@ func (st *FsStorage) Init() (err error) {
 	if err != nil {
 		return
 	}
+	st.files = newFileCache(st.FS, st.OpenFiles)
+	st.cache = newPieceCache(st.PieceCacheSize)
 	if st.DataDir == "" || st.MetaDir == "" {
 		err = errors.New("bad FsStorage parameters")
 		return
@@ -618,6 +1078,17 @@ func (st *FsStorage) Init() (err error) {
 	return
 }
 
+func (st *FsStorage) FreeSpace(path string) (int64, error) {
+	if path == "" {
+		path = st.DataDir
+	}
+	return st.FS.FreeSpace(path)
+}
+
+func (st *FsStorage) CacheStats() CacheStats {
+	return st.cache.stats()
+}
+
 func (st *FsStorage) FindBitfield(ih common.Infohash) (bf *bittorrent.Bitfield) {
 	fpath := st.bitfieldFilename(ih)
 	f, err := st.FS.OpenFileReadOnly(fpath)
@@ -658,10 +1129,51 @@ func (st *FsStorage) statsFilename(ih common.Infohash) string {
 	return st.FS.Join(st.MetaDir, ih.Hex()+".stats")
 }
 
+func (st *FsStorage) peersFilename(ih common.Infohash) string {
+	return st.FS.Join(st.MetaDir, ih.Hex()+".peers")
+}
+
 func (st *FsStorage) settingsFilename(ih common.Infohash) string {
 	return st.FS.Join(st.MetaDir, ih.Hex()+".settings")
 }
 
+func (st *FsStorage) resumeFilename(ih common.Infohash) string {
+	return st.FS.Join(st.MetaDir, ih.Hex()+".resume")
+}
+
+func (st *FsStorage) partialFilename(ih common.Infohash) string {
+	return st.FS.Join(st.MetaDir, ih.Hex()+".partial")
+}
+
+func (st *FsStorage) saveResumeData(ih common.Infohash, r *resumeData) (err error) {
+	var f fs.WriteFile
+	f, err = st.FS.OpenFileWriteOnly(st.resumeFilename(ih))
+	if err == nil {
+		err = r.BEncode(f)
+		f.Close()
+	}
+	return
+}
+
+// load the resume data of a torrent, nil if we have none
+func (st *FsStorage) loadResumeData(ih common.Infohash) (r *resumeData) {
+	fname := st.resumeFilename(ih)
+	if !st.FS.FileExists(fname) {
+		return
+	}
+	f, err := st.FS.OpenFileReadOnly(fname)
+	if err == nil {
+		r = new(resumeData)
+		err = r.BDecode(f)
+		f.Close()
+		if err != nil {
+			log.Warnf("bad resume data in %s: %s", fname, err.Error())
+			r = nil
+		}
+	}
+	return
+}
+
 func (st *FsStorage) saveStatsForTorrent(ih common.Infohash, s *stats.Tracker) (err error) {
 	var f fs.WriteFile
 	f, err = st.FS.OpenFileWriteOnly(st.statsFilename(ih))
@@ -672,6 +1184,36 @@ func (st *FsStorage) saveStatsForTorrent(ih common.Infohash, s *stats.Tracker) (
 	return
 }
 
+func (st *FsStorage) savePeersForTorrent(ih common.Infohash, peers []KnownPeer) (err error) {
+	kp := knownPeers{Peers: peers}
+	if kp.Peers == nil {
+		kp.Peers = []KnownPeer{}
+	}
+	var f fs.WriteFile
+	f, err = st.FS.OpenFileWriteOnly(st.peersFilename(ih))
+	if err == nil {
+		err = kp.BEncode(f)
+		f.Close()
+	}
+	return
+}
+
+func (st *FsStorage) loadPeersForTorrent(ih common.Infohash) (peers []KnownPeer, err error) {
+	fname := st.peersFilename(ih)
+	if !st.FS.FileExists(fname) {
+		return
+	}
+	var f fs.ReadFile
+	f, err = st.FS.OpenFileReadOnly(fname)
+	if err == nil {
+		var kp knownPeers
+		err = kp.BDecode(f)
+		f.Close()
+		peers = kp.Peers
+	}
+	return
+}
+
 func (st *FsStorage) EmptyTorrent(ih common.Infohash) (t Torrent) {
 	t = &fsTorrent{
 		dir: st.DataDir,
@@ -712,6 +1254,8 @@ func (st *FsStorage) openTorrent(info *metainfo.TorrentFile, rootpath string) (t
 			meta: info,
 			ih:   ih,
 		}
+		ft.loadPriorities()
+		ft.loadPartial()
 		log.Debugf("allocate space for %s", ft.Name())
 		err = ft.Allocate()
 		if err != nil {
@@ -773,6 +1317,13 @@ func (st *FsStorage) OpenAllTorrents() (torrents []Torrent, err error) {
 			path := s.Get("dir", st.DataDir)
 			t, err = st.openTorrent(tf, path)
 		}
+		if err == nil && st.FS.FileExists(st.resumeFilename(tf.Infohash())) {
+			// without resume data we trust the saved bitfield
+			e := t.VerifyChanged()
+			if e != nil {
+				log.Errorf("failed to check %s: %s", t.Name(), e.Error())
+			}
+		}
 		if t != nil {
 			torrents = append(torrents, t)
 		}
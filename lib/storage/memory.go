@@ -0,0 +1,577 @@
+package storage
+
+import (
+	"errors"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/metainfo"
+	"github.com/majestrate/XD/lib/stats"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// ErrNoPieceData is returned when reading a piece we do not have
+var ErrNoPieceData = errors.New("piece not stored")
+
+// memPiece is the data of a piece held in memory
+type memPiece struct {
+	data []byte
+	// which blocks of data we got
+	blocks *bittorrent.Bitfield
+}
+
+// memTorrent is a storage session for a torrent kept in memory
+type memTorrent struct {
+	st    *MemStorage
+	ih    common.Infohash
+	ihMtx sync.Mutex
+	meta  *metainfo.TorrentFile
+	bf    *bittorrent.Bitfield
+	// access mutex for pieces, bf and settings
+	access     sync.Mutex
+	pieces     map[uint32]*memPiece
+	priorities []FilePriority
+	wanted     []bool
+	queuePos   int
+	seedLimits SeedLimits
+	peers      []KnownPeer
+	dir        string
+}
+
+func (t *memTorrent) Allocate() error {
+	return nil
+}
+
+func (t *memTorrent) CheckFreeSpace() (err error) {
+	if t.meta == nil || t.st.MaxSize <= 0 {
+		return
+	}
+	var need int64
+	t.access.Lock()
+	for idx := uint32(0); idx < t.meta.Info.NumPieces(); idx++ {
+		if _, has := t.pieces[idx]; !has && t.pieceWanted(idx) {
+			need += int64(t.meta.LengthOfPiece(idx))
+		}
+	}
+	t.access.Unlock()
+	free, _ := t.st.FreeSpace("")
+	if need > free {
+		err = ErrNoSpace
+	}
+	return
+}
+
+// returns true if a piece is part of a file we want, call with access held
+func (t *memTorrent) pieceWanted(idx uint32) bool {
+	for file := range t.meta.Info.GetFiles() {
+		begin, end := t.meta.Info.FilePieces(file)
+		if idx >= begin && idx < end && t.fileWanted(file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *memTorrent) VerifyAll() (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	for idx := uint32(0); idx < t.meta.Info.NumPieces(); idx++ {
+		err = t.VerifyPiece(idx)
+		if err == common.ErrInvalidPiece {
+			err = nil
+		}
+	}
+	return
+}
+
+func (t *memTorrent) VerifyChanged() error {
+	// nothing changes behind our back
+	return nil
+}
+
+func (t *memTorrent) Checking() bool {
+	return false
+}
+
+func (t *memTorrent) PutChunk(d *common.PieceData) (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	if d.Index >= t.meta.Info.NumPieces() {
+		err = common.ErrInvalidPiece
+		return
+	}
+	length := t.meta.LengthOfPiece(d.Index)
+	if int(d.Begin)+len(d.Data) > int(length) {
+		err = common.ErrInvalidPiece
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	p := t.pieces[d.Index]
+	if p == nil {
+		if !t.st.reserve(int64(length)) {
+			err = ErrNoSpace
+			return
+		}
+		p = &memPiece{
+			data:   make([]byte, length),
+			blocks: bittorrent.NewBitfield((length+BlockSize-1)/BlockSize, nil),
+		}
+		t.pieces[d.Index] = p
+	}
+	copy(p.data[d.Begin:], d.Data)
+	end := d.Begin + uint32(len(d.Data))
+	for b := d.Begin / BlockSize; b*BlockSize < end; b++ {
+		if (b+1)*BlockSize <= end || end == length {
+			p.blocks.Set(b)
+		}
+	}
+	return
+}
+
+func (t *memTorrent) GetPiece(r common.PieceRequest, pc *common.PieceData) (err error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	p := t.pieces[r.Index]
+	if p == nil || t.bf == nil || !t.bf.Has(r.Index) || int(r.Begin)+int(r.Length) > len(p.data) {
+		err = ErrNoPieceData
+		return
+	}
+	pc.Data = make([]byte, r.Length)
+	copy(pc.Data, p.data[r.Begin:])
+	pc.Index = r.Index
+	pc.Begin = r.Begin
+	return
+}
+
+func (t *memTorrent) VerifyPiece(idx uint32) (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.ensureBitfield()
+	p := t.pieces[idx]
+	if p != nil && p.blocks.Completed() && t.meta.CheckPiece(&common.PieceData{Index: idx, Data: p.data}) {
+		t.bf.Set(idx)
+		return
+	}
+	t.bf.Unset(idx)
+	if p != nil && p.blocks.Completed() {
+		// bad data, free it
+		delete(t.pieces, idx)
+		t.st.release(int64(len(p.data)))
+	}
+	err = common.ErrInvalidPiece
+	return
+}
+
+func (t *memTorrent) MetaInfo() *metainfo.TorrentFile {
+	return t.meta
+}
+
+func (t *memTorrent) Infohash() (ih common.Infohash) {
+	t.ihMtx.Lock()
+	copy(ih[:], t.ih[:])
+	t.ihMtx.Unlock()
+	return
+}
+
+// create the bitfield once we have metainfo, call with access held
+func (t *memTorrent) ensureBitfield() {
+	if t.bf == nil && t.meta != nil {
+		t.bf = bittorrent.NewBitfield(t.meta.Info.NumPieces(), nil)
+	}
+}
+
+func (t *memTorrent) Bitfield() *bittorrent.Bitfield {
+	t.access.Lock()
+	t.ensureBitfield()
+	t.access.Unlock()
+	return t.bf
+}
+
+func (t *memTorrent) DownloadedSize() (r uint64) {
+	if t.meta == nil {
+		return
+	}
+	bf := t.Bitfield()
+	r = uint64(bf.CountSet()) * uint64(t.meta.Info.PieceLength)
+	return
+}
+
+func (t *memTorrent) DownloadRemaining() (r uint64) {
+	if t.meta == nil {
+		return
+	}
+	have := t.DownloadedSize()
+	if have < t.meta.TotalSize() {
+		r = t.meta.TotalSize() - have
+	}
+	return
+}
+
+func (t *memTorrent) Flush() error {
+	if t.meta == nil {
+		return ErrNoMetaInfo
+	}
+	return nil
+}
+
+func (t *memTorrent) Name() string {
+	if t.meta == nil {
+		return t.Infohash().Hex()
+	}
+	return t.meta.TorrentName()
+}
+
+func (t *memTorrent) Delete() error {
+	t.access.Lock()
+	for idx, p := range t.pieces {
+		delete(t.pieces, idx)
+		t.st.release(int64(len(p.data)))
+	}
+	t.bf = nil
+	t.access.Unlock()
+	t.st.forget(t.Infohash())
+	return nil
+}
+
+func (t *memTorrent) SaveStats(s *stats.Tracker) error {
+	return nil
+}
+
+func (t *memTorrent) SavePeers(peers []KnownPeer) error {
+	t.access.Lock()
+	t.peers = peers
+	t.access.Unlock()
+	return nil
+}
+
+func (t *memTorrent) LoadPeers() (peers []KnownPeer, err error) {
+	t.access.Lock()
+	peers = t.peers
+	t.access.Unlock()
+	return
+}
+
+func (t *memTorrent) FileList() (flist []string) {
+	if t.meta != nil {
+		for _, f := range t.meta.Info.GetFiles() {
+			flist = append(flist, f.Path.FilePath(t.dir))
+		}
+	}
+	return
+}
+
+func (t *memTorrent) MoveTo(other string) error {
+	t.dir = other
+	return nil
+}
+
+func (t *memTorrent) Seed() (bool, error) {
+	return t.Bitfield().Completed(), nil
+}
+
+func (t *memTorrent) PutInfoBytes(info []byte) (err error) {
+	if t.meta != nil {
+		return
+	}
+	var meta *metainfo.TorrentFile
+	meta, err = metainfo.TorrentFileFromInfoBytes(info)
+	if err != nil {
+		return
+	}
+	old := t.Infohash()
+	if !metaInfoMatches(meta, old) {
+		err = ErrMetaInfoMissmatch
+		return
+	}
+	if ih := meta.Infohash(); !ih.Equal(old) {
+		// added by truncated v2 infohash
+		t.ihMtx.Lock()
+		t.ih = ih
+		t.ihMtx.Unlock()
+		t.st.rekey(old, t)
+	}
+	t.access.Lock()
+	t.meta = meta
+	t.access.Unlock()
+	return
+}
+
+func (t *memTorrent) DownloadDir() string {
+	return t.dir
+}
+
+func (t *memTorrent) filePriority(idx int) FilePriority {
+	if idx < len(t.priorities) {
+		return t.priorities[idx]
+	}
+	return PriorityNormal
+}
+
+func (t *memTorrent) fileWanted(idx int) bool {
+	if idx < len(t.wanted) {
+		return t.wanted[idx]
+	}
+	return true
+}
+
+func (t *memTorrent) FilePriorities() (prios []FilePriority) {
+	if t.meta == nil {
+		return
+	}
+	t.access.Lock()
+	prios = make([]FilePriority, len(t.meta.Info.GetFiles()))
+	for idx := range prios {
+		prios[idx] = t.filePriority(idx)
+	}
+	t.access.Unlock()
+	return
+}
+
+func (t *memTorrent) SetFilePriority(idx int, p FilePriority) (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	if p <= PrioritySkip || p > PriorityHigh {
+		err = ErrBadFilePriority
+		return
+	}
+	files := t.meta.Info.GetFiles()
+	if idx < 0 || idx >= len(files) {
+		err = ErrNoSuchFile
+		return
+	}
+	t.access.Lock()
+	if len(t.priorities) != len(files) {
+		t.priorities, t.wanted = parseFileSettings("", "", len(files))
+	}
+	t.priorities[idx] = p
+	t.access.Unlock()
+	return
+}
+
+func (t *memTorrent) FilesWanted() (wanted []bool) {
+	if t.meta == nil {
+		return
+	}
+	t.access.Lock()
+	wanted = make([]bool, len(t.meta.Info.GetFiles()))
+	for idx := range wanted {
+		wanted[idx] = t.fileWanted(idx)
+	}
+	t.access.Unlock()
+	return
+}
+
+func (t *memTorrent) SetFileWanted(idx int, wanted bool) (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	files := t.meta.Info.GetFiles()
+	if idx < 0 || idx >= len(files) {
+		err = ErrNoSuchFile
+		return
+	}
+	t.access.Lock()
+	if len(t.wanted) != len(files) {
+		t.priorities, t.wanted = parseFileSettings("", "", len(files))
+	}
+	t.wanted[idx] = wanted
+	t.access.Unlock()
+	return
+}
+
+func (t *memTorrent) QueuePosition() int {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return t.queuePos
+}
+
+func (t *memTorrent) SetQueuePosition(pos int) error {
+	t.access.Lock()
+	t.queuePos = pos
+	t.access.Unlock()
+	return nil
+}
+
+func (t *memTorrent) SeedLimits() SeedLimits {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return t.seedLimits
+}
+
+func (t *memTorrent) SetSeedLimits(l SeedLimits) error {
+	t.access.Lock()
+	t.seedLimits = l
+	t.access.Unlock()
+	return nil
+}
+
+func (t *memTorrent) PartialPieces() (pieces map[uint32]*bittorrent.Bitfield) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	pieces = make(map[uint32]*bittorrent.Bitfield)
+	for idx, p := range t.pieces {
+		if t.bf == nil || !t.bf.Has(idx) {
+			pieces[idx] = p.blocks.Copy()
+		}
+	}
+	return
+}
+
+func (t *memTorrent) PutPieceLayer(root, layer []byte) (err error) {
+	if t.meta == nil {
+		err = ErrNoMetaInfo
+		return
+	}
+	t.access.Lock()
+	err = t.meta.SetPieceLayer(root, layer)
+	t.access.Unlock()
+	return
+}
+
+// MemStorage keeps torrents and their piece data in memory, nothing survives a restart
+type MemStorage struct {
+	// most bytes of piece data we hold, 0 means no limit
+	MaxSize int64
+	// name of the directory torrents claim to be in
+	DataDir  string
+	mtx      sync.Mutex
+	used     int64
+	torrents map[common.Infohash]*memTorrent
+}
+
+// take size bytes of the limit, returns false if they do not fit
+func (st *MemStorage) reserve(size int64) bool {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if st.MaxSize > 0 && st.used+size > st.MaxSize {
+		return false
+	}
+	st.used += size
+	return true
+}
+
+// give back size bytes of the limit
+func (st *MemStorage) release(size int64) {
+	st.mtx.Lock()
+	st.used -= size
+	st.mtx.Unlock()
+}
+
+func (st *MemStorage) forget(ih common.Infohash) {
+	st.mtx.Lock()
+	delete(st.torrents, ih)
+	st.mtx.Unlock()
+}
+
+// move a torrent to its new infohash
+func (st *MemStorage) rekey(old common.Infohash, t *memTorrent) {
+	st.mtx.Lock()
+	if st.torrents[old] == t {
+		delete(st.torrents, old)
+	}
+	st.torrents[t.Infohash()] = t
+	st.mtx.Unlock()
+}
+
+func (st *MemStorage) newTorrent(ih common.Infohash, meta *metainfo.TorrentFile) *memTorrent {
+	st.mtx.Lock()
+	t := st.torrents[ih]
+	if t == nil {
+		t = &memTorrent{
+			st:       st,
+			ih:       ih,
+			pieces:   make(map[uint32]*memPiece),
+			queuePos: -1,
+			dir:      st.DataDir,
+		}
+		st.torrents[ih] = t
+	}
+	st.mtx.Unlock()
+	t.access.Lock()
+	if t.meta == nil {
+		t.meta = meta
+	}
+	t.access.Unlock()
+	return t
+}
+
+func (st *MemStorage) Close() error {
+	st.mtx.Lock()
+	log.Infof("dropping %d bytes of piece data in memory", st.used)
+	st.torrents = make(map[common.Infohash]*memTorrent)
+	st.used = 0
+	st.mtx.Unlock()
+	return nil
+}
+
+func (st *MemStorage) EmptyTorrent(ih common.Infohash) Torrent {
+	return st.newTorrent(ih, nil)
+}
+
+func (st *MemStorage) OpenTorrent(info *metainfo.TorrentFile) (Torrent, error) {
+	return st.newTorrent(info.Infohash(), info), nil
+}
+
+func (st *MemStorage) OpenAllTorrents() (torrents []Torrent, err error) {
+	st.mtx.Lock()
+	for _, t := range st.torrents {
+		torrents = append(torrents, t)
+	}
+	st.mtx.Unlock()
+	return
+}
+
+func (st *MemStorage) Init() error {
+	log.Info("Ensure memory storage")
+	if st.DataDir == "" {
+		st.DataDir = "memory"
+	}
+	st.torrents = make(map[common.Infohash]*memTorrent)
+	return nil
+}
+
+func (st *MemStorage) PollNewTorrents() []Torrent {
+	return nil
+}
+
+func (st *MemStorage) Run() {
+}
+
+func (st *MemStorage) CacheStats() (s CacheStats) {
+	torrents, _ := st.OpenAllTorrents()
+	for _, t := range torrents {
+		mt := t.(*memTorrent)
+		mt.access.Lock()
+		s.Pieces += len(mt.pieces)
+		mt.access.Unlock()
+	}
+	st.mtx.Lock()
+	s.Size = st.used
+	s.MaxSize = st.MaxSize
+	st.mtx.Unlock()
+	return
+}
+
+func (st *MemStorage) FreeSpace(path string) (free int64, err error) {
+	if st.MaxSize <= 0 {
+		err = fs.ErrNoFreeSpaceInfo
+		return
+	}
+	st.mtx.Lock()
+	free = st.MaxSize - st.used
+	st.mtx.Unlock()
+	return
+}
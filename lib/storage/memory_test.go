@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/fs"
+	"os"
+	"testing"
+)
+
+func TestMemStorage(t *testing.T) {
+	fname := fs.STD.Join(t.TempDir(), "test.bin")
+	meta, err := createRandomTorrent(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for two pieces
+	st := &MemStorage{MaxSize: testPieceLen * 2}
+	if err = st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	torrent, _ := st.OpenTorrent(meta)
+	if torrent.CheckFreeSpace() != ErrNoSpace {
+		t.Fatal("torrent bigger than the limit fits")
+	}
+	put := func(idx uint32, piece []byte) error {
+		for begin := 0; begin < len(piece); begin += BlockSize {
+			end := begin + BlockSize
+			if end > len(piece) {
+				end = len(piece)
+			}
+			err := torrent.PutChunk(&common.PieceData{Index: idx, Begin: uint32(begin), Data: piece[begin:end]})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	piece := func(idx uint32) []byte {
+		return data[idx*testPieceLen : idx*testPieceLen+testPieceLen]
+	}
+
+	if err = put(0, bytes.Repeat([]byte{1}, testPieceLen)); err != nil {
+		t.Fatal(err)
+	}
+	if torrent.VerifyPiece(0) != common.ErrInvalidPiece || st.CacheStats().Size != 0 {
+		t.Fatal("bad piece kept")
+	}
+	if err = put(0, piece(0)); err == nil {
+		err = torrent.VerifyPiece(0)
+	}
+	if err != nil || !torrent.Bitfield().Has(0) {
+		t.Fatalf("good piece not accepted: %v", err)
+	}
+	var pc common.PieceData
+	err = torrent.GetPiece(common.PieceRequest{Index: 0, Begin: BlockSize, Length: BlockSize}, &pc)
+	if err != nil || !bytes.Equal(pc.Data, piece(0)[BlockSize:BlockSize*2]) {
+		t.Fatalf("bad read of piece: %v", err)
+	}
+
+	// half of a piece is partial
+	if err = put(1, piece(1)[:testPieceLen/2]); err != nil {
+		t.Fatal(err)
+	}
+	if blocks := torrent.PartialPieces()[1]; blocks == nil || blocks.CountSet() != testPieceLen/2/BlockSize {
+		t.Fatalf("bad partial piece: %v", blocks)
+	}
+	// the limit is reached
+	if err = put(2, piece(2)); err != ErrNoSpace {
+		t.Fatalf("wrote past the limit: %v", err)
+	}
+	torrent.Delete()
+	if stats := st.CacheStats(); stats.Size != 0 || stats.Pieces != 0 {
+		t.Fatalf("deleted torrent still in memory: %+v", stats)
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/zeebo/bencode"
+	"io"
+)
+
+// BlockSize is the size of the blocks we track in partially downloaded pieces, the size peers request
+const BlockSize = 16 * 1024
+
+// partialPiece is a piece we have some but not all blocks of on disk
+type partialPiece struct {
+	Index  uint32              `bencode:"index"`
+	Blocks bittorrent.Bitfield `bencode:"blocks"`
+}
+
+// partialPieces are the block bitfields of all incomplete pieces of a torrent
+type partialPieces struct {
+	Pieces []partialPiece `bencode:"pieces"`
+}
+
+func (p *partialPieces) BDecode(r io.Reader) (err error) {
+	dec := bencode.NewDecoder(r)
+	err = dec.Decode(p)
+	return
+}
+
+func (p *partialPieces) BEncode(w io.Writer) (err error) {
+	enc := bencode.NewEncoder(w)
+	err = enc.Encode(p)
+	return
+}
+
+// get how many blocks a piece has
+func (t *fsTorrent) blocksInPiece(idx uint32) uint32 {
+	return (t.meta.LengthOfPiece(idx) + BlockSize - 1) / BlockSize
+}
+
+// load the block bitfields of incomplete pieces saved by savePartial
+func (t *fsTorrent) loadPartial() {
+	t.partialMtx.Lock()
+	defer t.partialMtx.Unlock()
+	t.partial = make(map[uint32]*bittorrent.Bitfield)
+	fname := t.st.partialFilename(t.Infohash())
+	if !t.st.FS.FileExists(fname) {
+		return
+	}
+	var p partialPieces
+	f, err := t.st.FS.OpenFileReadOnly(fname)
+	if err == nil {
+		err = p.BDecode(f)
+		f.Close()
+	}
+	if err != nil {
+		log.Warnf("bad partial pieces in %s: %s", fname, err.Error())
+		return
+	}
+	for idx := range p.Pieces {
+		piece := p.Pieces[idx]
+		if piece.Index >= t.meta.Info.NumPieces() || piece.Blocks.Length != t.blocksInPiece(piece.Index) {
+			continue
+		}
+		t.partial[piece.Index] = piece.Blocks.Copy()
+	}
+}
+
+// persist the block bitfields of incomplete pieces if they changed
+func (t *fsTorrent) savePartial() (err error) {
+	t.partialMtx.Lock()
+	defer t.partialMtx.Unlock()
+	if !t.partialChanged {
+		return
+	}
+	fname := t.st.partialFilename(t.Infohash())
+	if len(t.partial) == 0 {
+		if t.st.FS.FileExists(fname) {
+			err = t.st.FS.RemoveAll(fname)
+		}
+	} else {
+		var p partialPieces
+		for idx, blocks := range t.partial {
+			p.Pieces = append(p.Pieces, partialPiece{Index: idx, Blocks: *blocks})
+		}
+		var f fs.WriteFile
+		f, err = t.st.FS.OpenFileWriteOnly(fname)
+		if err == nil {
+			err = p.BEncode(f)
+			f.Close()
+		}
+	}
+	if err == nil {
+		t.partialChanged = false
+	}
+	return
+}
+
+// remember that a range of a piece is on disk
+func (t *fsTorrent) wroteBlocks(idx, begin uint32, length int) {
+	if t.meta == nil || length <= 0 {
+		return
+	}
+	end := begin + uint32(length)
+	pieceLen := t.meta.LengthOfPiece(idx)
+	t.partialMtx.Lock()
+	defer t.partialMtx.Unlock()
+	if t.partial == nil {
+		t.partial = make(map[uint32]*bittorrent.Bitfield)
+	}
+	blocks := t.partial[idx]
+	for b := (begin + BlockSize - 1) / BlockSize; b*BlockSize < end; b++ {
+		// only blocks we wrote all of
+		blockEnd := (b + 1) * BlockSize
+		if blockEnd > pieceLen {
+			blockEnd = pieceLen
+		}
+		if blockEnd > end {
+			break
+		}
+		if blocks == nil {
+			blocks = bittorrent.NewBitfield(t.blocksInPiece(idx), nil)
+			t.partial[idx] = blocks
+		}
+		if !blocks.Has(b) {
+			blocks.Set(b)
+			t.partialChanged = true
+		}
+	}
+}
+
+// forget the blocks of a piece once it is checked
+func (t *fsTorrent) forgetPartial(idx uint32) {
+	t.partialMtx.Lock()
+	if _, has := t.partial[idx]; has {
+		delete(t.partial, idx)
+		t.partialChanged = true
+	}
+	t.partialMtx.Unlock()
+}
+
+// PartialPieces gets the block bitfields of pieces we have some blocks of on disk but did not check yet
+func (t *fsTorrent) PartialPieces() (pieces map[uint32]*bittorrent.Bitfield) {
+	t.partialMtx.Lock()
+	defer t.partialMtx.Unlock()
+	pieces = make(map[uint32]*bittorrent.Bitfield)
+	for idx, blocks := range t.partial {
+		pieces[idx] = blocks.Copy()
+	}
+	return
+}
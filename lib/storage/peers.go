@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"github.com/zeebo/bencode"
+	"io"
+)
+
+// KnownPeer is a peer of a torrent we connected to before
+type KnownPeer struct {
+	// network address we reach the peer at
+	Addr string `bencode:"addr"`
+	// peer id the peer last had
+	ID string `bencode:"id"`
+	// unix time we last connected to the peer
+	LastSeen int64 `bencode:"seen"`
+	// how many times we connected to the peer
+	Successes int64 `bencode:"ok"`
+	// how many times connecting to the peer failed
+	Failures int64 `bencode:"fail"`
+}
+
+type knownPeers struct {
+	Peers []KnownPeer `bencode:"peers"`
+}
+
+func (p *knownPeers) BDecode(r io.Reader) (err error) {
+	dec := bencode.NewDecoder(r)
+	err = dec.Decode(p)
+	return
+}
+
+func (p *knownPeers) BEncode(w io.Writer) (err error) {
+	enc := bencode.NewEncoder(w)
+	err = enc.Encode(p)
+	return
+}
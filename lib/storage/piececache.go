@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"container/list"
+
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// DefaultPieceCacheSize is how many bytes of piece data we keep in memory by default
+const DefaultPieceCacheSize = 64 * 1024 * 1024
+
+// CacheStats are statistics of the piece cache
+type CacheStats struct {
+	// bytes of piece data in memory
+	Size int64
+	// most bytes of piece data we keep in memory
+	MaxSize int64
+	// bytes in memory that are not on disk yet
+	Pending int64
+	// pieces in memory
+	Pieces int
+	// blocks served from memory
+	Hits uint64
+	// blocks read from disk
+	Misses uint64
+	// downloaded pieces hashed in memory and written to disk in one go
+	Writes uint64
+}
+
+// HitRate gets the fraction of blocks served from memory
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type pieceKey struct {
+	ih  common.Infohash
+	idx uint32
+}
+
+// a piece in memory
+type cacheEntry struct {
+	key pieceKey
+	t   *fsTorrent
+	// offset of the piece in the torrent
+	offset int64
+	data   []byte
+	// which blocks of the piece we have in data
+	blocks []bool
+	have   int
+	// set when data has blocks that are not on disk
+	dirty bool
+	elem  *list.Element
+	// closed once a dirty entry taken out of the cache is on disk
+	written chan struct{}
+	// closed once an earlier entry of the same piece is on disk, we write after it
+	after chan struct{}
+}
+
+func (e *cacheEntry) complete() bool {
+	return e.have == len(e.blocks)
+}
+
+// returns true if every block of a range is in memory
+func (e *cacheEntry) has(begin, length uint32) bool {
+	if length == 0 || int(begin)+int(length) > len(e.data) {
+		return false
+	}
+	for b := begin / BlockSize; b <= (begin+length-1)/BlockSize; b++ {
+		if !e.blocks[b] {
+			return false
+		}
+	}
+	return true
+}
+
+// write the blocks we have to disk, call only with the entry out of the cache
+func (e *cacheEntry) writeBack() (err error) {
+	for b := 0; b < len(e.blocks) && err == nil; b++ {
+		if !e.blocks[b] {
+			continue
+		}
+		// write runs of blocks at once
+		end := b
+		for end < len(e.blocks) && e.blocks[end] {
+			end++
+		}
+		begin := b * BlockSize
+		last := end * BlockSize
+		if last > len(e.data) {
+			last = len(e.data)
+		}
+		_, err = e.t.WriteAt(e.data[begin:last], e.offset+int64(begin))
+		if err == nil {
+			e.t.wroteBlocks(e.key.idx, uint32(begin), last-begin)
+		}
+		b = end
+	}
+	return
+}
+
+// pieceCache keeps pieces in memory, it holds downloaded blocks until their piece is complete
+// and reads whole pieces ahead for peers we seed to
+type pieceCache struct {
+	mtx    sync.Mutex
+	max    int64
+	size   int64
+	lru    *list.List
+	pieces map[pieceKey]*cacheEntry
+	// pieces taken out of the cache that we are writing to disk, closed when done
+	writing map[pieceKey]chan struct{}
+	// pieces we failed to write to disk
+	failed map[pieceKey]error
+	hits   uint64
+	misses uint64
+	writes uint64
+}
+
+func newPieceCache(max int64) *pieceCache {
+	return &pieceCache{
+		max:     max,
+		lru:     list.New(),
+		pieces:  make(map[pieceKey]*cacheEntry),
+		writing: make(map[pieceKey]chan struct{}),
+		failed:  make(map[pieceKey]error),
+	}
+}
+
+// returns true if pieces of this length fit in the cache
+func (c *pieceCache) fits(length uint32) bool {
+	return int64(length) <= c.max
+}
+
+// add an entry and make room for it, returns entries with data we must write to disk, call with mtx held
+func (c *pieceCache) insert(e *cacheEntry) (evicted []*cacheEntry) {
+	c.size += int64(len(e.data))
+	e.elem = c.lru.PushFront(e)
+	c.pieces[e.key] = e
+	elem := c.lru.Back()
+	for c.size > c.max && elem != nil {
+		prev := elem.Prev()
+		if old := elem.Value.(*cacheEntry); old != e {
+			c.remove(old)
+			if old.dirty {
+				c.markWriting(old)
+				evicted = append(evicted, old)
+			}
+		}
+		elem = prev
+	}
+	return
+}
+
+// take an entry out, call with mtx held
+func (c *pieceCache) remove(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.pieces, e.key)
+	c.size -= int64(len(e.data))
+}
+
+// remember that we write a dirty entry taken out of the cache, call with mtx held
+func (c *pieceCache) markWriting(e *cacheEntry) {
+	e.after = c.writing[e.key]
+	e.written = make(chan struct{})
+	c.writing[e.key] = e.written
+}
+
+// write entries taken out of the cache to disk without holding mtx, returns the first error
+// errors are kept until the piece is checked so we do not blame peers for data we lost
+func (c *pieceCache) writeBackEvicted(evicted []*cacheEntry) (err error) {
+	for _, e := range evicted {
+		if e.after != nil {
+			<-e.after
+		}
+		werr := e.writeBack()
+		c.mtx.Lock()
+		if werr != nil {
+			log.Errorf("failed to write back piece %d of %s: %s", e.key.idx, e.t.Name(), werr.Error())
+			c.failed[e.key] = werr
+			if err == nil {
+				err = werr
+			}
+		}
+		if c.writing[e.key] == e.written {
+			delete(c.writing, e.key)
+		}
+		c.mtx.Unlock()
+		close(e.written)
+	}
+	return
+}
+
+// wait until a piece taken out of the cache is on disk, returns the error if we failed to write it
+func (c *pieceCache) waitWritten(key pieceKey) (err error) {
+	c.mtx.Lock()
+	for c.writing[key] != nil {
+		ch := c.writing[key]
+		c.mtx.Unlock()
+		<-ch
+		c.mtx.Lock()
+	}
+	err = c.failed[key]
+	delete(c.failed, key)
+	c.mtx.Unlock()
+	return
+}
+
+// hold a downloaded block in memory, cached is false if the block must be written to disk
+// err is set if we failed to write a piece we took out of the cache to make room
+func (c *pieceCache) put(t *fsTorrent, idx, begin uint32, data []byte) (cached bool, err error) {
+	length := t.meta.LengthOfPiece(idx)
+	if !c.fits(length) || begin%BlockSize != 0 || int(begin)+len(data) > int(length) {
+		return
+	}
+	if len(data) != BlockSize && int(begin)+len(data) != int(length) {
+		// only whole blocks
+		return
+	}
+	var evicted []*cacheEntry
+	key := pieceKey{ih: t.Infohash(), idx: idx}
+	c.mtx.Lock()
+	e := c.pieces[key]
+	if e == nil {
+		e = &cacheEntry{
+			key:    key,
+			t:      t,
+			offset: int64(idx) * int64(t.meta.Info.PieceLength),
+			data:   make([]byte, length),
+			blocks: make([]bool, (length+BlockSize-1)/BlockSize),
+		}
+		evicted = c.insert(e)
+	} else {
+		c.lru.MoveToFront(e.elem)
+	}
+	copy(e.data[begin:], data)
+	if b := begin / BlockSize; !e.blocks[b] {
+		e.blocks[b] = true
+		e.have++
+	}
+	e.dirty = true
+	c.mtx.Unlock()
+	cached = true
+	err = c.writeBackEvicted(evicted)
+	return
+}
+
+// copy a range of a piece into buf if we have all of it in memory
+func (c *pieceCache) get(ih common.Infohash, idx, begin uint32, buf []byte) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e := c.pieces[pieceKey{ih: ih, idx: idx}]
+	if e == nil || !e.has(begin, uint32(len(buf))) {
+		c.misses++
+		return false
+	}
+	c.lru.MoveToFront(e.elem)
+	copy(buf, e.data[begin:])
+	c.hits++
+	return true
+}
+
+// keep a whole piece we read from disk
+func (c *pieceCache) readAhead(t *fsTorrent, idx uint32, data []byte) {
+	key := pieceKey{ih: t.Infohash(), idx: idx}
+	c.mtx.Lock()
+	if c.pieces[key] != nil {
+		c.mtx.Unlock()
+		return
+	}
+	e := &cacheEntry{
+		key:    key,
+		t:      t,
+		offset: int64(idx) * int64(t.meta.Info.PieceLength),
+		data:   data,
+		blocks: make([]bool, (len(data)+BlockSize-1)/BlockSize),
+	}
+	for b := range e.blocks {
+		e.blocks[b] = true
+	}
+	e.have = len(e.blocks)
+	evicted := c.insert(e)
+	c.mtx.Unlock()
+	// the reader is not to blame if this fails, the error is returned when the evicted pieces are checked
+	c.writeBackEvicted(evicted)
+}
+
+// get a downloaded piece we have every block of in memory, nil if we do not
+func (c *pieceCache) downloaded(ih common.Infohash, idx uint32) (data []byte) {
+	c.mtx.Lock()
+	e := c.pieces[pieceKey{ih: ih, idx: idx}]
+	if e != nil && e.dirty && e.complete() {
+		data = e.data
+	}
+	c.mtx.Unlock()
+	return
+}
+
+// mark a piece as written to disk
+func (c *pieceCache) written(ih common.Infohash, idx uint32) {
+	c.mtx.Lock()
+	e := c.pieces[pieceKey{ih: ih, idx: idx}]
+	if e != nil {
+		e.dirty = false
+	}
+	c.writes++
+	c.mtx.Unlock()
+}
+
+// forget a piece
+func (c *pieceCache) drop(ih common.Infohash, idx uint32) {
+	c.mtx.Lock()
+	e := c.pieces[pieceKey{ih: ih, idx: idx}]
+	if e != nil {
+		c.remove(e)
+	}
+	c.mtx.Unlock()
+}
+
+// make sure all blocks of a piece we hold are on disk before we check it there
+// waits for writes of the piece that are in progress and returns the error if any of them failed
+func (c *pieceCache) writeBack(ih common.Infohash, idx uint32) (err error) {
+	key := pieceKey{ih: ih, idx: idx}
+	var evicted []*cacheEntry
+	c.mtx.Lock()
+	e := c.pieces[key]
+	if e != nil && e.dirty {
+		c.remove(e)
+		c.markWriting(e)
+		evicted = append(evicted, e)
+	}
+	c.mtx.Unlock()
+	c.writeBackEvicted(evicted)
+	err = c.waitWritten(key)
+	return
+}
+
+// take all pieces of a torrent out of memory, pieces not on disk are written first unless discard is set
+func (c *pieceCache) evictTorrent(ih common.Infohash, discard bool) (err error) {
+	var evicted []*cacheEntry
+	c.mtx.Lock()
+	for key, e := range c.pieces {
+		if key.ih == ih {
+			c.remove(e)
+			if e.dirty && !discard {
+				c.markWriting(e)
+				evicted = append(evicted, e)
+			}
+		}
+	}
+	if discard {
+		for key := range c.failed {
+			if key.ih == ih {
+				delete(c.failed, key)
+			}
+		}
+	}
+	c.mtx.Unlock()
+	err = c.writeBackEvicted(evicted)
+	return
+}
+
+// write every piece that is not on disk
+func (c *pieceCache) flushAll() (err error) {
+	var dirty []*cacheEntry
+	c.mtx.Lock()
+	for _, e := range c.pieces {
+		if e.dirty {
+			c.remove(e)
+			c.markWriting(e)
+			dirty = append(dirty, e)
+		}
+	}
+	c.mtx.Unlock()
+	err = c.writeBackEvicted(dirty)
+	// remember which blocks made it to disk
+	saved := make(map[*fsTorrent]bool)
+	for _, e := range dirty {
+		if !saved[e.t] {
+			saved[e.t] = true
+			e.t.savePartial()
+		}
+	}
+	return
+}
+
+func (c *pieceCache) stats() (s CacheStats) {
+	c.mtx.Lock()
+	s.Size = c.size
+	s.MaxSize = c.max
+	s.Pieces = len(c.pieces)
+	for _, e := range c.pieces {
+		if e.dirty {
+			pending := int64(e.have) * BlockSize
+			if pending > int64(len(e.data)) {
+				pending = int64(len(e.data))
+			}
+			s.Pending += pending
+		}
+	}
+	s.Hits = c.hits
+	s.Misses = c.misses
+	s.Writes = c.writes
+	c.mtx.Unlock()
+	return
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/fs"
+	"os"
+	"testing"
+)
+
+func TestPieceCache(t *testing.T) {
+	dir := t.TempDir()
+	st := &FsStorage{
+		MetaDir:        fs.STD.Join(dir, "meta"),
+		DataDir:        fs.STD.Join(dir, "data"),
+		SeedingDir:     fs.STD.Join(dir, "seeding"),
+		FS:             fs.STD,
+		PieceCacheSize: testPieceLen * 4,
+	}
+	if err := st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	meta, err := createRandomTorrent(st.FS.Join(st.DataDir, "test.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := st.OpenTorrent(meta)
+	if err == nil {
+		err = torrent.VerifyAll()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seeding reads whole pieces ahead
+	getBlock := func(begin uint32) []byte {
+		var pc common.PieceData
+		err := torrent.GetPiece(common.PieceRequest{Index: 2, Begin: begin, Length: BlockSize}, &pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc.Data
+	}
+	var piece []byte
+	for begin := uint32(0); begin < testPieceLen; begin += BlockSize {
+		piece = append(piece, getBlock(begin)...)
+	}
+	stats := st.CacheStats()
+	if stats.Misses != 1 || stats.Hits != testPieceLen/BlockSize-1 || stats.Size != testPieceLen {
+		t.Fatalf("piece not read ahead: %+v", stats)
+	}
+
+	// downloaded pieces are hashed in memory and only written when valid
+	put := func(data []byte) {
+		for begin := 0; begin < len(data); begin += BlockSize {
+			err := torrent.PutChunk(&common.PieceData{Index: 2, Begin: uint32(begin), Data: data[begin : begin+BlockSize]})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bad := bytes.Repeat([]byte{1}, testPieceLen)
+	put(bad)
+	if st.CacheStats().Pending != testPieceLen {
+		t.Fatal("downloaded piece not held in memory")
+	}
+	if torrent.VerifyPiece(2) != common.ErrInvalidPiece || torrent.Bitfield().Has(2) {
+		t.Fatal("bad piece accepted")
+	}
+	put(piece)
+	if err = torrent.VerifyPiece(2); err != nil || !torrent.Bitfield().Has(2) {
+		t.Fatalf("good piece not accepted: %v", err)
+	}
+	stats = st.CacheStats()
+	if stats.Writes != 1 || stats.Pending != 0 {
+		t.Fatalf("piece not written: %+v", stats)
+	}
+	torrent.(*fsTorrent).Close()
+	if st.CacheStats().Size != 0 {
+		t.Fatal("closed torrent left in cache")
+	}
+	if !bytes.Equal(getBlock(0), piece[:BlockSize]) {
+		t.Fatal("piece on disk does not match")
+	}
+}
+
+func TestPartialPieces(t *testing.T) {
+	dir := t.TempDir()
+	st := &FsStorage{
+		MetaDir:    fs.STD.Join(dir, "meta"),
+		DataDir:    fs.STD.Join(dir, "data"),
+		SeedingDir: fs.STD.Join(dir, "seeding"),
+		FS:         fs.STD,
+		// hold two pieces
+		PieceCacheSize: testPieceLen * 2,
+	}
+	if err := st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := createRandomTorrent(st.FS.Join(dir, "test.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := st.OpenTorrent(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := bytes.Repeat([]byte{1}, BlockSize)
+	put := func(idx, begin uint32) {
+		err := torrent.PutChunk(&common.PieceData{Index: idx, Begin: begin, Data: block})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(1, 0)
+	put(1, BlockSize*2)
+	put(3, BlockSize)
+	if len(torrent.PartialPieces()) != 0 {
+		t.Fatal("blocks in memory reported as on disk")
+	}
+	// closing writes blocks in memory to disk and saves which blocks we have
+	st.Close()
+
+	st.Init()
+	defer st.Close()
+	torrent, err = st.OpenTorrent(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := torrent.PartialPieces()
+	if len(partial) != 2 {
+		t.Fatalf("expected 2 partial pieces, got %d", len(partial))
+	}
+	one := partial[1]
+	if one == nil || !one.Has(0) || one.Has(1) || !one.Has(2) || one.Has(3) {
+		t.Fatalf("bad blocks of piece 1: %v", one)
+	}
+	if three := partial[3]; three == nil || three.CountSet() != 1 || !three.Has(1) {
+		t.Fatalf("bad blocks of piece 3: %v", three)
+	}
+	// checked pieces are forgotten
+	torrent.Bitfield()
+	torrent.VerifyPiece(1)
+	torrent.Flush()
+	if _, has := torrent.PartialPieces()[1]; has {
+		t.Fatal("checked piece still partial")
+	}
+}
+
+func TestPieceCacheEvictError(t *testing.T) {
+	dir := t.TempDir()
+	st := &FsStorage{
+		MetaDir:        fs.STD.Join(dir, "meta"),
+		DataDir:        fs.STD.Join(dir, "data"),
+		SeedingDir:     fs.STD.Join(dir, "seeding"),
+		FS:             fs.STD,
+		PieceCacheSize: testPieceLen,
+	}
+	if err := st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	fname := st.FS.Join(st.DataDir, "test.bin")
+	meta, err := createRandomTorrent(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := st.OpenTorrent(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{1}, BlockSize)
+	for begin := uint32(0); begin < testPieceLen; begin += BlockSize {
+		if err = torrent.PutChunk(&common.PieceData{Index: 1, Begin: begin, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the data file can no longer be written
+	st.files.closeAll()
+	if err = os.Remove(fname); err == nil {
+		err = os.Mkdir(fname, 0700)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// making room for another piece fails to write the first one
+	if err = torrent.PutChunk(&common.PieceData{Index: 3, Begin: 0, Data: data}); err == nil {
+		t.Fatal("failed write of evicted piece not returned")
+	}
+	if err = torrent.VerifyPiece(1); err == nil || err == common.ErrInvalidPiece {
+		t.Fatalf("lost piece checked as %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// FilePriority is the download priority of a file in a torrent
+type FilePriority int
+
+// PrioritySkip means the file is not downloaded at all
+// storage keeps whether a file is wanted apart from its priority, this is only used for files that are not wanted
+const PrioritySkip = FilePriority(0)
+
+// PriorityLow means the file is downloaded after all other wanted files
+const PriorityLow = FilePriority(1)
+
+// PriorityNormal is the default file priority
+const PriorityNormal = FilePriority(2)
+
+// PriorityHigh means the file is downloaded before all other files
+const PriorityHigh = FilePriority(3)
+
+var ErrBadFilePriority = errors.New("bad file priority")
+var ErrNoSuchFile = errors.New("no such file in torrent")
+
+// String gets the name of this priority
+func (p FilePriority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// Wanted returns true if a file with this priority should be downloaded
+func (p FilePriority) Wanted() bool {
+	return p != PrioritySkip
+}
+
+// ParseFilePriority parses a FilePriority from its name
+func ParseFilePriority(str string) (p FilePriority, err error) {
+	switch strings.ToLower(str) {
+	case "skip":
+		p = PrioritySkip
+	case "low":
+		p = PriorityLow
+	case "normal":
+		p = PriorityNormal
+	case "high":
+		p = PriorityHigh
+	default:
+		err = ErrBadFilePriority
+	}
+	return
+}
+
+func formatFilePriorities(prios []FilePriority) string {
+	strs := make([]string, len(prios))
+	for idx := range prios {
+		strs[idx] = prios[idx].String()
+	}
+	return strings.Join(strs, ",")
+}
+
+// parse file priorities for n files, missing or invalid entries are normal priority
+func parseFilePriorities(str string, n int) (prios []FilePriority) {
+	prios = make([]FilePriority, n)
+	parts := strings.Split(str, ",")
+	for idx := range prios {
+		prios[idx] = PriorityNormal
+		if idx < len(parts) {
+			p, err := ParseFilePriority(parts[idx])
+			if err == nil {
+				prios[idx] = p
+			}
+		}
+	}
+	return
+}
+
+// parse which of n files are wanted from a list of indexes of unwanted files
+func parseFilesWanted(str string, n int) (wanted []bool) {
+	wanted = make([]bool, n)
+	for idx := range wanted {
+		wanted[idx] = true
+	}
+	for _, part := range strings.Split(str, ",") {
+		idx, err := strconv.Atoi(part)
+		if err == nil && idx >= 0 && idx < n {
+			wanted[idx] = false
+		}
+	}
+	return
+}
+
+// format the indexes of unwanted files
+func formatFilesWanted(wanted []bool) string {
+	var strs []string
+	for idx := range wanted {
+		if !wanted[idx] {
+			strs = append(strs, strconv.Itoa(idx))
+		}
+	}
+	return strings.Join(strs, ",")
+}
+
+// parse saved priorities and wanted files for n files
+// older versions saved unwanted files as skip priority, they get normal priority
+func parseFileSettings(prios, unwanted string, n int) (priorities []FilePriority, wanted []bool) {
+	priorities = parseFilePriorities(prios, n)
+	wanted = parseFilesWanted(unwanted, n)
+	for idx := range priorities {
+		if priorities[idx] == PrioritySkip {
+			priorities[idx] = PriorityNormal
+			wanted[idx] = false
+		}
+	}
+	return
+}
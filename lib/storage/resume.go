@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"github.com/zeebo/bencode"
+	"io"
+)
+
+// resumeFile is the size and modification time a data file had when the bitfield was flushed
+type resumeFile struct {
+	// size in bytes, -1 if the file did not exist
+	Size int64 `bencode:"size"`
+	// modification time in unix nanoseconds
+	ModTime int64 `bencode:"mtime"`
+}
+
+// resumeData lets us trust a saved bitfield for files that did not change since it was flushed
+type resumeData struct {
+	Files []resumeFile `bencode:"files"`
+}
+
+func (r *resumeData) BDecode(rd io.Reader) (err error) {
+	dec := bencode.NewDecoder(rd)
+	err = dec.Decode(r)
+	return
+}
+
+func (r *resumeData) BEncode(w io.Writer) (err error) {
+	enc := bencode.NewEncoder(w)
+	err = enc.Encode(r)
+	return
+}
+
+// get the indexes of files that differ from the resume data we have now
+// ok is false if the resume data does not fit the files of the torrent
+func (r *resumeData) changed(now *resumeData) (files []int, ok bool) {
+	if len(r.Files) != len(now.Files) {
+		return
+	}
+	for idx := range r.Files {
+		if r.Files[idx] != now.Files[idx] {
+			files = append(files, idx)
+		}
+	}
+	ok = true
+	return
+}
+
+// get resume data for the files as they are now
+// only files we wrote to since the last call are stat'd again, stat is slow on remote filesystems
+func (t *fsTorrent) currentResumeData() (r *resumeData) {
+	t.resumeMtx.Lock()
+	defer t.resumeMtx.Unlock()
+	if t.resume == nil {
+		t.resume = t.statFiles()
+	} else {
+		files := t.meta.Info.GetFiles()
+		for idx := range t.resumeStale {
+			t.resume.Files[idx] = t.statFile(files[idx])
+		}
+	}
+	t.resumeStale = nil
+	r = &resumeData{Files: append([]resumeFile{}, t.resume.Files...)}
+	return
+}
+
+// remember that we changed a data file
+func (t *fsTorrent) fileWritten(idx int) {
+	t.resumeMtx.Lock()
+	if t.resume != nil {
+		if t.resumeStale == nil {
+			t.resumeStale = make(map[int]bool)
+		}
+		t.resumeStale[idx] = true
+	}
+	t.resumeMtx.Unlock()
+}
+
+// stat every data file again next time we need resume data
+func (t *fsTorrent) forgetResumeData() {
+	t.resumeMtx.Lock()
+	t.resume = nil
+	t.resumeStale = nil
+	t.resumeMtx.Unlock()
+}
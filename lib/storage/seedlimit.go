@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+)
+
+// SeedLimitMode says which seeding goal applies to a torrent
+type SeedLimitMode int
+
+const (
+	// SeedLimitGlobal uses the global seeding goal
+	SeedLimitGlobal = SeedLimitMode(iota)
+	// SeedLimitSingle uses the seeding goal of the torrent
+	SeedLimitSingle
+	// SeedLimitUnlimited has no seeding goal
+	SeedLimitUnlimited
+)
+
+// SeedLimits are the seeding goals of a torrent
+// a goal keeps its value when its mode changes so it applies again when the mode is set back to single
+type SeedLimits struct {
+	// stop once we uploaded this many times what we downloaded
+	Ratio     float64
+	RatioMode SeedLimitMode
+	// stop after seeding this long
+	Time     time.Duration
+	TimeMode SeedLimitMode
+	// stop after this long with nothing uploaded
+	Idle     time.Duration
+	IdleMode SeedLimitMode
+}
+
+// read seeding goals from torrent settings
+func loadSeedLimits(s *fsSettings) (l SeedLimits) {
+	l.Ratio, _ = strconv.ParseFloat(s.Get("seed-ratio", "0"), 64)
+	l.RatioMode = parseSeedLimitMode(s.Get("seed-ratio-mode", ""))
+	l.Time = parseSeedLimitDuration(s.Get("seed-time", ""))
+	l.TimeMode = parseSeedLimitMode(s.Get("seed-time-mode", ""))
+	l.Idle = parseSeedLimitDuration(s.Get("seed-idle", ""))
+	l.IdleMode = parseSeedLimitMode(s.Get("seed-idle-mode", ""))
+	return
+}
+
+// write seeding goals to torrent settings
+func (l SeedLimits) save(s *fsSettings) {
+	s.Put("seed-ratio", strconv.FormatFloat(l.Ratio, 'f', -1, 64))
+	s.Put("seed-ratio-mode", strconv.Itoa(int(l.RatioMode)))
+	s.Put("seed-time", strconv.FormatInt(int64(l.Time), 10))
+	s.Put("seed-time-mode", strconv.Itoa(int(l.TimeMode)))
+	s.Put("seed-idle", strconv.FormatInt(int64(l.Idle), 10))
+	s.Put("seed-idle-mode", strconv.Itoa(int(l.IdleMode)))
+}
+
+// unknown modes use the global goal
+func parseSeedLimitMode(str string) SeedLimitMode {
+	mode, _ := strconv.Atoi(str)
+	switch SeedLimitMode(mode) {
+	case SeedLimitSingle, SeedLimitUnlimited:
+		return SeedLimitMode(mode)
+	}
+	return SeedLimitGlobal
+}
+
+// durations are saved in nanoseconds
+func parseSeedLimitDuration(str string) time.Duration {
+	d, _ := strconv.ParseInt(str, 10, 64)
+	return time.Duration(d)
+}
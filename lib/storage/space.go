@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"github.com/majestrate/XD/lib/fs"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/util"
+)
+
+// get how many more bytes of disk space the files we want need
+func (t *fsTorrent) spaceNeeded() (need int64) {
+	info := t.meta.Info
+	files := info.GetFiles()
+	if t.st.Allocation == fs.AllocateFull {
+		// files we allocated already have their space
+		for idx, f := range files {
+			if f.IsPadding() || !t.fileWanted(idx) {
+				continue
+			}
+			need += int64(f.Length)
+			if fi, err := t.st.FS.Stat(t.dataFilename(f)); err == nil {
+				need -= fi.Size()
+			}
+		}
+		if need < 0 {
+			need = 0
+		}
+		return
+	}
+	bf := t.Bitfield()
+	for idx, f := range files {
+		if f.IsPadding() || !t.fileWanted(idx) {
+			continue
+		}
+		begin, end := info.FilePieces(idx)
+		var missing int64
+		for piece := begin; piece < end; piece++ {
+			if !bf.Has(piece) {
+				missing += int64(info.PieceLength)
+			}
+		}
+		if missing > int64(f.Length) {
+			missing = int64(f.Length)
+		}
+		need += missing
+	}
+	return
+}
+
+func (t *fsTorrent) CheckFreeSpace() (err error) {
+	if t.meta == nil {
+		return
+	}
+	var free int64
+	free, err = t.st.FS.FreeSpace(t.dir)
+	if err == fs.ErrNoFreeSpaceInfo {
+		// we cannot check so we hope for the best
+		err = nil
+		return
+	}
+	if err == nil {
+		need := t.spaceNeeded()
+		if need > free {
+			log.Warnf("%s needs %s but only %s is free in %s", t.Name(), util.FormatBytes(need), util.FormatBytes(free), t.dir)
+			err = ErrNoSpace
+		}
+	}
+	return
+}
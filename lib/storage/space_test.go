@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"github.com/majestrate/XD/lib/fs"
+	"testing"
+)
+
+func TestAllocation(t *testing.T) {
+	for _, mode := range []fs.Allocation{fs.AllocateFull, fs.AllocateSparse, fs.AllocateNone} {
+		dir := t.TempDir()
+		st := &FsStorage{
+			MetaDir:    fs.STD.Join(dir, "meta"),
+			DataDir:    fs.STD.Join(dir, "data"),
+			SeedingDir: fs.STD.Join(dir, "seeding"),
+			FS:         fs.STD,
+			Allocation: mode,
+		}
+		if err := st.Init(); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := createRandomTorrent(fs.STD.Join(dir, "test.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrent, err := st.OpenTorrent(meta)
+		if err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		fi, err := st.FS.Stat(fs.STD.Join(st.DataDir, "test.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := int64(meta.TotalSize())
+		if mode == fs.AllocateNone {
+			size = 0
+		}
+		if fi.Size() != size {
+			t.Fatalf("%s: allocated %d bytes instead of %d", mode, fi.Size(), size)
+		}
+		// nothing is downloaded and files that end early are missing pieces
+		if err = torrent.VerifyAll(); err != nil || torrent.Bitfield().CountSet() != 0 {
+			t.Fatalf("%s: bad check of empty data: %v", mode, err)
+		}
+		need := torrent.(*fsTorrent).spaceNeeded()
+		if mode == fs.AllocateFull && need != 0 || mode != fs.AllocateFull && need != int64(meta.TotalSize()) {
+			t.Fatalf("%s: need %d bytes", mode, need)
+		}
+		if err = torrent.CheckFreeSpace(); err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		st.Close()
+	}
+}
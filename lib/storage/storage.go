@@ -10,6 +10,13 @@ import (
 
 var ErrNoMetaInfo = errors.New("no torrent file")
 var ErrMetaInfoMissmatch = errors.New("torrent infohash does not match")
+var ErrNoSpace = errors.New("not enough free disk space")
+
+// returns true if metainfo is for the torrent with infohash ih
+// torrents added by v2 magnet use the truncated v2 infohash, hybrid torrents have a different v1 infohash
+func metaInfoMatches(meta *metainfo.TorrentFile, ih common.Infohash) bool {
+	return meta.Infohash().Equal(ih) || (meta.IsV2() && meta.InfohashV2().Truncated().Equal(ih))
+}
 
 // storage session for 1 torrent
 type Torrent interface {
@@ -17,9 +24,16 @@ type Torrent interface {
 	// allocate all files for download
 	Allocate() error
 
+	// returns ErrNoSpace if the data we still need to download does not fit on disk
+	CheckFreeSpace() error
+
 	// verify all piece data
 	VerifyAll() error
 
+	// check only the pieces of files that changed since the bitfield was last flushed
+	// checks every piece if there is no resume data
+	VerifyChanged() error
+
 	// return true if we are currently doing a deep check
 	Checking() bool
 
@@ -59,6 +73,12 @@ type Torrent interface {
 	// save torrent stats
 	SaveStats(s *stats.Tracker) error
 
+	// save peers we know for this torrent
+	SavePeers(peers []KnownPeer) error
+
+	// load peers saved with SavePeers
+	LoadPeers() ([]KnownPeer, error)
+
 	// get a list of files for this torrent
 	// returns absolute path of all downloaded files
 	FileList() []string
@@ -74,6 +94,37 @@ type Torrent interface {
 
 	// get directory for data files
 	DownloadDir() string
+
+	// get download priority of each file, files that are not wanted keep their priority
+	FilePriorities() []FilePriority
+
+	// set download priority of a file by index, does not change if the file is wanted
+	SetFilePriority(idx int, p FilePriority) error
+
+	// get which files we download
+	FilesWanted() []bool
+
+	// set if we download a file by index, allocates the file if it was not wanted before
+	SetFileWanted(idx int, wanted bool) error
+
+	// get the saved queue position or -1 if there is none
+	QueuePosition() int
+
+	// save the queue position
+	SetQueuePosition(pos int) error
+
+	// get the saved seeding goals
+	SeedLimits() SeedLimits
+
+	// save the seeding goals
+	SetSeedLimits(l SeedLimits) error
+
+	// get the block bitfields of pieces we have some blocks of on disk but did not check yet
+	// one bit per BlockSize bytes of the piece
+	PartialPieces() map[uint32]*bittorrent.Bitfield
+
+	// set and persist the v2 piece layer of the file with pieces root root
+	PutPieceLayer(root, layer []byte) error
 }
 
 // torrent storage driver
@@ -102,4 +153,10 @@ type Storage interface {
 
 	// run mainloop
 	Run()
+
+	// get statistics of the piece cache
+	CacheStats() CacheStats
+
+	// get how many bytes are free on the filesystem of path, empty path means the download directory
+	FreeSpace(path string) (int64, error)
 }
@@ -8,7 +8,9 @@ import (
 	"github.com/majestrate/XD/lib/metainfo"
 	"github.com/majestrate/XD/lib/mktorrent"
 	"io"
+	"os"
 	"testing"
+	"time"
 )
 
 const testPieceLen = 65536
@@ -92,4 +94,140 @@ func TestStorage(t *testing.T) {
 		return
 	}
 
+	peers := []KnownPeer{{Addr: "127.0.0.1:6881", LastSeen: 1, Successes: 2, Failures: 1}}
+	err = torrent.SavePeers(peers)
+	if err != nil {
+		t.Log(err.Error())
+		t.Fail()
+		return
+	}
+	loaded, err := torrent.LoadPeers()
+	if err != nil || len(loaded) != 1 || loaded[0] != peers[0] {
+		t.Logf("loaded peers %v: %v", loaded, err)
+		t.Fail()
+		return
+	}
+
+	limits := SeedLimits{Ratio: 2, RatioMode: SeedLimitUnlimited, Idle: time.Hour, IdleMode: SeedLimitSingle}
+	err = torrent.SetSeedLimits(limits)
+	if err == nil {
+		var reopened Torrent
+		reopened, err = st.OpenTorrent(meta)
+		if err == nil && reopened.SeedLimits() != limits {
+			t.Logf("seed limits not saved: %+v", reopened.SeedLimits())
+			t.Fail()
+			return
+		}
+	}
+	if err != nil {
+		t.Log(err.Error())
+		t.Fail()
+		return
+	}
+
+	// unchanged files keep their pieces, changed files are checked again
+	err = torrent.Flush()
+	if err == nil {
+		err = torrent.VerifyChanged()
+	}
+	if err != nil || !torrent.Bitfield().Completed() {
+		t.Logf("unchanged file not trusted: %v", err)
+		t.Fail()
+		return
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY, 0)
+	if err == nil {
+		_, err = f.WriteAt([]byte("corrupt"), testPieceLen*2)
+		f.Close()
+	}
+	if err == nil {
+		later := time.Now().Add(time.Minute)
+		err = os.Chtimes(fname, later, later)
+	}
+	if err == nil {
+		err = torrent.VerifyChanged()
+	}
+	bf := torrent.Bitfield()
+	if err != nil || bf.Has(2) || !bf.Has(1) || !bf.Has(3) {
+		t.Logf("changed file not checked: %v", err)
+		t.Fail()
+		return
+	}
+}
+
+func TestParseFilePriorities(t *testing.T) {
+	prios := parseFilePriorities("skip,high,bogus", 4)
+	expect := []FilePriority{PrioritySkip, PriorityHigh, PriorityNormal, PriorityNormal}
+	for idx := range expect {
+		if prios[idx] != expect[idx] {
+			t.Fatalf("file %d has priority %s, expected %s", idx, prios[idx], expect[idx])
+		}
+	}
+	str := formatFilePriorities(prios)
+	if str != "skip,high,normal,normal" {
+		t.Fatalf("bad formatted priorities: %s", str)
+	}
+}
+
+func TestParseFileSettings(t *testing.T) {
+	// skip saved by older versions becomes an unwanted file with normal priority
+	prios, wanted := parseFileSettings("skip,high,low", "2,7,bogus", 3)
+	expect := []FilePriority{PriorityNormal, PriorityHigh, PriorityLow}
+	expectWanted := []bool{false, true, false}
+	for idx := range expect {
+		if prios[idx] != expect[idx] || wanted[idx] != expectWanted[idx] {
+			t.Fatalf("file %d has priority %s wanted %v", idx, prios[idx], wanted[idx])
+		}
+	}
+	str := formatFilesWanted(wanted)
+	if str != "0,2" {
+		t.Fatalf("bad formatted unwanted files: %s", str)
+	}
+}
+
+func TestResumeDataStatsWrittenFiles(t *testing.T) {
+	dir := t.TempDir()
+	meta, err := metainfo.TorrentFileFromInfo(metainfo.Info{
+		PieceLength: 16,
+		Pieces:      make([]byte, 40),
+		Path:        "test",
+		Files: []metainfo.FileInfo{
+			{Length: 16, Path: metainfo.FilePath{"a"}},
+			{Length: 16, Path: metainfo.FilePath{"b"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &FsStorage{FS: fs.STD, files: newFileCache(fs.STD, 4)}
+	torrent := &fsTorrent{st: st, meta: meta, dir: dir}
+	err = torrent.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := torrent.currentResumeData()
+	_, err = torrent.WriteAt(make([]byte, 16), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	for _, f := range meta.Info.GetFiles() {
+		err = os.Chtimes(torrent.dataFilename(f), later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only the file we wrote is stat'd again
+	now := torrent.currentResumeData()
+	if now.Files[0].ModTime != later.UnixNano() {
+		t.Fatal("written file not stat'd")
+	}
+	if now.Files[1] != before.Files[1] {
+		t.Fatal("untouched file stat'd")
+	}
+	torrent.forgetResumeData()
+	now = torrent.currentResumeData()
+	if now.Files[1].ModTime != later.UnixNano() {
+		t.Fatal("forgotten resume data not stat'd again")
+	}
 }
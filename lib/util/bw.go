@@ -7,6 +7,18 @@ import (
 
 var rateUnits = []string{"B", "KB", "MB", "GB", "TB", "PB"}
 
+// FormatBytes formats a number of bytes as string with closest unit
+func FormatBytes(n int64) (str string) {
+	size := float64(n)
+	var idx int
+	for size > 1024.0 {
+		size /= 1024.0
+		idx++
+	}
+	str = fmt.Sprintf("%.2f%s", size, rateUnits[idx])
+	return
+}
+
 // FormatRate formats a floating point b/s as string with closest unit
 func FormatRate(rate float64) (str string) {
 	if math.IsInf(rate, 0) {
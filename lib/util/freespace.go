@@ -0,0 +1,16 @@
+package util
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNoFreeSpaceInfo is returned on platforms where we cannot tell how much disk space is free
+var ErrNoFreeSpaceInfo = errors.New("free space unknown")
+
+func writeZeros(w io.Writer, size int64) (err error) {
+	if size > 0 {
+		_, err = io.CopyN(w, Zero, size)
+	}
+	return
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package util
+
+import (
+	"strings"
+)
+
+// FreeSpace is not supported on this platform
+func FreeSpace(fpath string) (int64, error) {
+	return 0, ErrNoFreeSpaceInfo
+}
+
+// IsDiskFull returns true if err is from a write to a full disk
+func IsDiskFull(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no space")
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package util
+
+import (
+	"errors"
+	"syscall"
+)
+
+// FreeSpace gets how many bytes we can write to the filesystem fpath is on
+func FreeSpace(fpath string) (free int64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(fpath, &st)
+	if err == nil {
+		free = int64(st.Bavail) * int64(st.Bsize)
+	}
+	return
+}
+
+// IsDiskFull returns true if err is from a write to a full disk
+func IsDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
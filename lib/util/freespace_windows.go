@@ -0,0 +1,38 @@
+//go:build windows
+
+package util
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+const (
+	errorHandleDiskFull = syscall.Errno(39)
+	errorDiskFull       = syscall.Errno(112)
+)
+
+// FreeSpace gets how many bytes we can write to the filesystem fpath is on
+func FreeSpace(fpath string) (free int64, err error) {
+	var p *uint16
+	p, err = syscall.UTF16PtrFromString(fpath)
+	if err != nil {
+		return
+	}
+	var avail uint64
+	r, _, e := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if r == 0 {
+		err = e
+		return
+	}
+	free = int64(avail)
+	return
+}
+
+// IsDiskFull returns true if err is from a write to a full disk
+func IsDiskFull(err error) bool {
+	return errors.Is(err, errorDiskFull) || errors.Is(err, errorHandleDiskFull)
+}
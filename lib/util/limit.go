@@ -0,0 +1,140 @@
+package util
+
+import (
+	"io"
+	"time"
+
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// size of chunks that limited writers write at a time
+const rateLimitChunkSize = 16 * 1024
+
+// RateLimiter is a token bucket that limits throughput to a number of bytes per second
+// a rate of zero means unlimited
+type RateLimiter struct {
+	access sync.Mutex
+	rate   uint64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a token bucket allowing rate bytes per second
+func NewRateLimiter(rate uint64) *RateLimiter {
+	return &RateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Rate gets the current limit in bytes per second
+func (l *RateLimiter) Rate() (rate uint64) {
+	l.access.Lock()
+	rate = l.rate
+	l.access.Unlock()
+	return
+}
+
+// SetRate sets the limit in bytes per second, zero means unlimited
+func (l *RateLimiter) SetRate(rate uint64) {
+	l.access.Lock()
+	if rate != l.rate {
+		l.rate = rate
+		l.tokens = float64(rate)
+		l.last = time.Now()
+	}
+	l.access.Unlock()
+}
+
+// take n tokens from the bucket and return how long to wait before they may be used
+func (l *RateLimiter) reserve(n int) (d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.access.Lock()
+	if l.rate > 0 {
+		now := time.Now()
+		rate := float64(l.rate)
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		// allow bursts of at most one second
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+		l.last = now
+		l.tokens -= float64(n)
+		if l.tokens < 0 {
+			d = time.Duration(-l.tokens / rate * float64(time.Second))
+		}
+	}
+	l.access.Unlock()
+	return
+}
+
+// Wait blocks until n bytes may pass through the limiter
+func (l *RateLimiter) Wait(n int) {
+	WaitRateLimiters(n, l)
+}
+
+// WaitRateLimiters blocks until n bytes may pass through all of the limiters
+func WaitRateLimiters(n int, limiters ...*RateLimiter) {
+	var wait time.Duration
+	for _, l := range limiters {
+		d := l.reserve(n)
+		if d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type rateLimitedReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+func (r *rateLimitedReader) Read(b []byte) (n int, err error) {
+	n, err = r.r.Read(b)
+	if n > 0 {
+		WaitRateLimiters(n, r.limiters...)
+	}
+	return
+}
+
+// NewRateLimitedReader wraps a reader so reads are limited by all of the given limiters
+func NewRateLimitedReader(r io.Reader, limiters ...*RateLimiter) io.Reader {
+	return &rateLimitedReader{
+		r:        r,
+		limiters: limiters,
+	}
+}
+
+type rateLimitedWriter struct {
+	w        io.Writer
+	limiters []*RateLimiter
+}
+
+func (w *rateLimitedWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 && err == nil {
+		chunk := b
+		if len(chunk) > rateLimitChunkSize {
+			chunk = chunk[:rateLimitChunkSize]
+		}
+		WaitRateLimiters(len(chunk), w.limiters...)
+		var written int
+		written, err = w.w.Write(chunk)
+		n += written
+		b = b[written:]
+	}
+	return
+}
+
+// NewRateLimitedWriter wraps a writer so writes are limited by all of the given limiters
+func NewRateLimitedWriter(w io.Writer, limiters ...*RateLimiter) io.Writer {
+	return &rateLimitedWriter{
+		w:        w,
+		limiters: limiters,
+	}
+}
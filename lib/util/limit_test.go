@@ -0,0 +1,36 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1024)
+	// first second worth of data is allowed as a burst, the rest must wait
+	if d := l.reserve(1024); d != 0 {
+		t.Fatalf("burst had to wait %s", d)
+	}
+	if d := l.reserve(512); d < time.Millisecond*400 || d > time.Millisecond*500 {
+		t.Fatalf("waiting %s for half a second of data", d)
+	}
+	l.SetRate(0)
+	if d := l.reserve(1024 * 1024); d != 0 {
+		t.Fatalf("unlimited reserve has to wait %s", d)
+	}
+	var none *RateLimiter
+	if d := none.reserve(1024); d != 0 {
+		t.Fatalf("nil limiter has to wait %s", d)
+	}
+
+	var buf bytes.Buffer
+	w := NewRateLimitedWriter(&buf, l, nil)
+	n, err := w.Write(make([]byte, 4*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != buf.Len() {
+		t.Fatalf("wrote %d bytes but buffer has %d", n, buf.Len())
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// Preallocate reserves size bytes of disk space for an empty file
+// uses fallocate and falls back to writing zeros if the filesystem does not support it
+func Preallocate(f *os.File, size int64) (err error) {
+	err = syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		err = writeZeros(f, size)
+	}
+	return
+}
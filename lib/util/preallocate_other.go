@@ -0,0 +1,12 @@
+//go:build !linux
+
+package util
+
+import (
+	"os"
+)
+
+// Preallocate reserves size bytes of disk space for an empty file by writing zeros
+func Preallocate(f *os.File, size int64) error {
+	return writeZeros(f, size)
+}